@@ -32,10 +32,24 @@ type AstConstructor struct {
 	Functions                  map[string]*FuncDefStmt
 	GlobalVariables            map[string]*VarDefStmt
 	Imports                    []Import
+	Macros                     map[string]*FuncDefStmt
+	// Expander runs the macros. Macros can not be declared if it is not set
+	Expander MacroExpander
+}
+
+// MacroExpander runs macros while the ast is created
+type MacroExpander interface {
+	// Define makes a macro available to be expanded
+	Define(macro FuncDefStmt) error
+	// Expand calls a macro with the code passed to it, and returns the code that the macro returned
+	Expand(macro string, args []Datum, callRange types.FileRange) (parser.Node, error)
+	// Copy returns an expander with the same macros, which macros can be defined in without affecting this one
+	Copy() MacroExpander
 }
 
 func (constructor *AstConstructor) New() {
 	constructor.Functions = make(map[string]*FuncDefStmt)
+	constructor.Macros = make(map[string]*FuncDefStmt)
 	constructor.GlobalVariables = make(map[string]*VarDefStmt)
 	constructor.Imports = make([]Import, 0)
 	constructor.AllowFunctionRedeclaration = false
@@ -52,14 +66,29 @@ type Import struct {
 type AstResult struct {
 	Asts    []Ast
 	Imports []Import
+	// Expanded is the code of every top level form other than macro declarations, after its macros were expanded
+	Expanded []parser.Node
 }
 
 func (constructor *AstConstructor) CreateAst(rootExpression parser.Node) (AstResult, error) {
-	asts, err := constructor.createAst(rootExpression, true)
-	if err != nil {
-		return AstResult{}, err
+	result := AstResult{Asts: make([]Ast, 0), Expanded: make([]parser.Node, 0)}
+	// Each form is expanded once the forms before it have been created, so a macro can be used after it is declared
+	for _, expression := range rootExpression.Children {
+		expanded, err := constructor.expandMacros(expression, 0)
+		if err != nil {
+			return AstResult{}, err
+		}
+		ast, err := constructor.createAstItem(expanded, true)
+		if err != nil {
+			return AstResult{}, err
+		}
+		result.Asts = append(result.Asts, ast)
+		if _, isMacro := ast.Statement.(MacroDefStmt); !isMacro {
+			result.Expanded = append(result.Expanded, expanded)
+		}
 	}
-	return AstResult{Asts: asts, Imports: constructor.Imports}, nil
+	result.Imports = constructor.Imports
+	return result, nil
 }
 
 func (constructor *AstConstructor) createAst(expr parser.Node, isRoot bool) ([]Ast, error) {
@@ -107,7 +136,8 @@ func safeTraverse(node parser.Node, childIndexes []int) (parser.Node, bool) {
 }
 
 func (constructor *AstConstructor) createAstItem(node parser.Node, isRoot bool) (Ast, error) {
-	if ok, val := nestedLiteralValue(node); ok && (val == "def" || val == "defun" || val == "while" || val == "import" || val == "defstruct" || val == "return") {
+	if ok, val := nestedLiteralValue(node); ok && (val == "def" || val == "defun" || val == "while" || val == "import" || val == "defstruct" || val == "return" || val == "deftest" ||
+		val == "set!" || val == "global" || val == "break" || val == "continue" || val == "defmacro") {
 		varDefStmt, err := constructor.createAstStatement(node, isRoot)
 		if err != nil {
 			return Ast{}, err
@@ -159,6 +189,9 @@ func (constructor *AstConstructor) createAstExpression(node parser.Node) (Expr,
 		return constructor.createStructAccessorOperation(node)
 	case parser.AccessorNode:
 		return constructor.createStructAccessorFromShortenedNotation(node)
+	case parser.KeywordNode:
+		return nil, types.Error{Range: node.Range,
+			Simple: fmt.Sprintf("Keyword :%s can only be used to pass an argument to a function", node.Data)}
 	case parser.ExpressionNode:
 		if len(node.Children) == 0 {
 			return nil, types.Error{Range: node.Range,
@@ -174,6 +207,24 @@ func (constructor *AstConstructor) createAstExpression(node parser.Node) (Expr,
 				return constructor.createList(node)
 			} else if litNode.Data == "lambda" {
 				return constructor.createClosure(node)
+			} else if litNode.Data == "let" || litNode.Data == "let*" {
+				return constructor.createLet(node, litNode.Data)
+			} else if litNode.Data == "try" {
+				return constructor.createTry(node)
+			} else if litNode.Data == "for" {
+				return constructor.createFor(node)
+			} else if litNode.Data == "foreach" {
+				return constructor.createForeach(node)
+			} else if litNode.Data == "cond" {
+				return constructor.createCond(node)
+			} else if litNode.Data == "match" {
+				return constructor.createMatch(node)
+			} else if litNode.Data == "quote" || litNode.Data == "quasiquote" {
+				return constructor.createQuote(node, litNode.Data)
+			} else if litNode.Data == "unquote" || litNode.Data == "unquote-splicing" {
+				return nil, types.Error{Range: node.Range, Simple: fmt.Sprintf("Syntax error - %s can only be used in a quasiquote", litNode.Data)}
+			} else if litNode.Data == "catch" || litNode.Data == "finally" {
+				return nil, types.Error{Range: node.Range, Simple: fmt.Sprintf("Syntax error - %s can only be used in try", litNode.Data)}
 			} else if litNode.Data == "struct" {
 				return constructor.createStruct(node)
 			} else if litNode.Data == "funcall" {
@@ -214,6 +265,20 @@ func (constructor *AstConstructor) createReturn(node parser.Node) (Stmt, error)
 	return nil, types.Error{Range: node.Range, Simple: "Syntax error - bad return: expected either (return) or (return <value to return>)"}
 }
 
+func (constructor *AstConstructor) createBreak(node parser.Node) (Stmt, error) {
+	if len(node.Children) == 1 {
+		return BreakStmt{Range: node.Range}, nil
+	}
+	if len(node.Children) == 2 {
+		value, err := constructor.createAstExpression(node.Children[1])
+		if err != nil {
+			return nil, err
+		}
+		return BreakStmt{Value: value, Range: node.Range}, nil
+	}
+	return nil, types.Error{Range: node.Range, Simple: "Syntax error - bad break: expected either (break) or (break <value>)"}
+}
+
 func (constructor *AstConstructor) createStruct(node parser.Node) (StructExpr, error) {
 	// Create a struct, with optional initialization
 	if len(node.Children) < 2 {
@@ -362,15 +427,11 @@ func (constructor AstConstructor) createAppExpr(exprParts []parser.Node, appRang
 	if err != nil {
 		return ClosureApplicationExpr{}, err
 	}
-	closureApp := ClosureApplicationExpr{Range: appRange, Closure: val, Args: make([]Expr, len(exprParts)-1)}
-	for i, exprNode := range exprParts[1:] {
-		arg, err := constructor.createAstExpression(exprNode)
-		if err != nil {
-			return ClosureApplicationExpr{}, err
-		}
-		closureApp.Args[i] = arg
+	args, keywordArgs, err := constructor.createCallArgs(exprParts[1:])
+	if err != nil {
+		return ClosureApplicationExpr{}, err
 	}
-	return closureApp, nil
+	return ClosureApplicationExpr{Range: appRange, Closure: val, Args: args, KeywordArgs: keywordArgs}, nil
 }
 
 func (constructor *AstConstructor) createFuncAppExpr(node parser.Node) (Expr, error) {
@@ -390,17 +451,12 @@ func (constructor *AstConstructor) createFuncAppExpr(node parser.Node) (Expr, er
 		return nil, types.Error{Simple: "Parse error", Detail: "bad function application", Range: node.Range}
 	}
 
-	appExpr := FunctionApplicationExpr{Identifier: identifier, Qualifier: qualifier, Args: make([]Expr, len(node.Children)-1), Range: node.Range}
-	for i, argNode := range node.Children[1:] {
-		argExpr, err := constructor.createAstExpression(argNode)
-		if err != nil {
-			return nil, types.Error{
-				Simple: "Function application expression must an expression",
-				Range:  argNode.Range}
-		}
-		appExpr.Args[i] = argExpr
+	args, keywordArgs, err := constructor.createCallArgs(node.Children[1:])
+	if err != nil {
+		return nil, err
 	}
-	return appExpr, nil
+	return FunctionApplicationExpr{Identifier: identifier, Qualifier: qualifier, Args: args, KeywordArgs: keywordArgs,
+		Range: node.Range}, nil
 }
 
 func (constructor *AstConstructor) createClosure(node parser.Node) (ClosureDefExpr, error) {
@@ -409,15 +465,11 @@ func (constructor *AstConstructor) createClosure(node parser.Node) (ClosureDefEx
 			Simple: "Syntax error whilst declaring closure",
 			Detail: fmt.Sprintf("Expected at least 3 child nodes for closure, got %d", len(node.Children))}
 	}
-	closure := ClosureDefExpr{Args: make([]string, len(node.Children[1].Children))}
-	for i, argExpr := range node.Children[1].Children {
-		if len(argExpr.Children) != 1 || argExpr.Children[0].Kind != parser.LiteralNode {
-			return ClosureDefExpr{}, types.Error{Range: node.Range,
-				Simple: "Syntax error - argument name must be a string",
-				Detail: fmt.Sprintf("Closure argument %d type is %s", i+1, argExpr.Kind)}
-		}
-		closure.Args[i] = argExpr.Children[0].Data
+	params, err := constructor.createParams(node.Children[1])
+	if err != nil {
+		return ClosureDefExpr{}, err
 	}
+	closure := ClosureDefExpr{Params: params}
 	body, err := constructor.createFunctionBody(node.Children[2:])
 	if err != nil {
 		return ClosureDefExpr{}, err
@@ -426,6 +478,319 @@ func (constructor *AstConstructor) createClosure(node parser.Node) (ClosureDefEx
 	return closure, nil
 }
 
+func (constructor *AstConstructor) createLet(node parser.Node, form string) (LetExpr, error) {
+	// (let ((<name> <value>)...) <body>)
+	syntaxError := types.Error{Range: node.Range,
+		Simple: fmt.Sprintf("Syntax error - %s should take form (%s ((<name> <value>)...) <body>)", form, form)}
+	if len(node.Children) < 3 || node.Children[1].Kind != parser.ExpressionNode {
+		return LetExpr{}, syntaxError
+	}
+	let := LetExpr{Sequential: form == "let*", Bindings: make([]LetBinding, 0), Range: node.Range}
+	for _, bindingNode := range node.Children[1].Children {
+		if len(bindingNode.Children) != 2 {
+			syntaxError.Range = bindingNode.Range
+			return LetExpr{}, syntaxError
+		}
+		nameNode, err := singleNestedExpr(bindingNode.Children[0])
+		if err != nil || nameNode.Kind != parser.LiteralNode {
+			return LetExpr{}, types.Error{Simple: "Parse error - variable name must be literal", Range: bindingNode.Children[0].Range}
+		}
+		for _, binding := range let.Bindings {
+			if binding.Identifier == nameNode.Data {
+				return LetExpr{}, types.Error{Range: bindingNode.Range,
+					Simple: fmt.Sprintf("Variable %s is bound more than once by %s", nameNode.Data, form)}
+			}
+		}
+		value, err := constructor.createAstExpression(bindingNode.Children[1])
+		if err != nil {
+			return LetExpr{}, err
+		}
+		let.Bindings = append(let.Bindings, LetBinding{Identifier: nameNode.Data, Value: value, Range: bindingNode.Range})
+	}
+	body, err := constructor.createFunctionBody(node.Children[2:])
+	if err != nil {
+		return LetExpr{}, err
+	}
+	let.Body = body
+	return let, nil
+}
+
+func (constructor *AstConstructor) createTry(node parser.Node) (TryExpr, error) {
+	// (try <body> (catch <kind> <name> <body>)... (finally <body>))
+	try := TryExpr{Catches: make([]CatchClause, 0), Range: node.Range}
+	bodyEnd := len(node.Children)
+	for i, child := range node.Children[1:] {
+		if _, form := nestedLiteralValue(child); form == "catch" || form == "finally" {
+			bodyEnd = i + 1
+			break
+		}
+	}
+	if bodyEnd == 1 {
+		return TryExpr{}, types.Error{Range: node.Range, Simple: "Syntax error - try must have a body"}
+	}
+	body, err := constructor.createFunctionBody(node.Children[1:bodyEnd])
+	if err != nil {
+		return TryExpr{}, err
+	}
+	try.Body = body
+
+	for _, clauseNode := range node.Children[bodyEnd:] {
+		_, form := nestedLiteralValue(clauseNode)
+		if try.Finally != nil {
+			return TryExpr{}, types.Error{Range: clauseNode.Range, Simple: "Syntax error - finally must be the last part of try"}
+		}
+		if form == "finally" {
+			finally, err := constructor.createFunctionBody(clauseNode.Children[1:])
+			if err != nil {
+				return TryExpr{}, err
+			}
+			try.Finally = finally
+			continue
+		}
+		if form != "catch" {
+			return TryExpr{}, types.Error{Range: clauseNode.Range, Simple: "Syntax error - expected catch or finally after the body of try"}
+		}
+		syntaxError := types.Error{Range: clauseNode.Range, Simple: "Syntax error - catch should take form (catch <kind> <name> <body>)"}
+		if len(clauseNode.Children) < 4 {
+			return TryExpr{}, syntaxError
+		}
+		kindNode, err := singleNestedExpr(clauseNode.Children[1])
+		if err != nil || kindNode.Kind != parser.LiteralNode {
+			return TryExpr{}, syntaxError
+		}
+		nameNode, err := singleNestedExpr(clauseNode.Children[2])
+		if err != nil || nameNode.Kind != parser.LiteralNode {
+			return TryExpr{}, syntaxError
+		}
+		catchBody, err := constructor.createFunctionBody(clauseNode.Children[3:])
+		if err != nil {
+			return TryExpr{}, err
+		}
+		try.Catches = append(try.Catches, CatchClause{Kind: kindNode.Data, Identifier: nameNode.Data, Body: catchBody,
+			Range: clauseNode.Range})
+	}
+	if len(try.Catches) == 0 && try.Finally == nil {
+		return TryExpr{}, types.Error{Range: node.Range, Simple: "Syntax error - try must have a catch or a finally"}
+	}
+	return try, nil
+}
+
+func (constructor *AstConstructor) createFor(node parser.Node) (ForExpr, error) {
+	// (for (<name> <from> <to> <step>) <body>)
+	syntaxError := types.Error{Range: node.Range, Simple: "Syntax error - for should take form (for (<name> <from> <to> <step>) <body>)"}
+	if len(node.Children) < 3 || node.Children[1].Kind != parser.ExpressionNode {
+		return ForExpr{}, syntaxError
+	}
+	header := node.Children[1].Children
+	if len(header) != 3 && len(header) != 4 {
+		syntaxError.Range = node.Children[1].Range
+		return ForExpr{}, syntaxError
+	}
+	nameNode, err := singleNestedExpr(header[0])
+	if err != nil || nameNode.Kind != parser.LiteralNode {
+		return ForExpr{}, types.Error{Simple: "Parse error - variable name must be literal", Range: header[0].Range}
+	}
+	loop := ForExpr{Identifier: nameNode.Data, Range: node.Range}
+	loop.From, err = constructor.createAstExpression(header[1])
+	if err != nil {
+		return ForExpr{}, err
+	}
+	loop.To, err = constructor.createAstExpression(header[2])
+	if err != nil {
+		return ForExpr{}, err
+	}
+	if len(header) == 4 {
+		loop.Step, err = constructor.createAstExpression(header[3])
+		if err != nil {
+			return ForExpr{}, err
+		}
+	}
+	loop.Body, err = constructor.createFunctionBody(node.Children[2:])
+	if err != nil {
+		return ForExpr{}, err
+	}
+	return loop, nil
+}
+
+func (constructor *AstConstructor) createForeach(node parser.Node) (ForeachExpr, error) {
+	// (foreach (<name> <items>) <body>)
+	syntaxError := types.Error{Range: node.Range, Simple: "Syntax error - foreach should take form (foreach (<name> <items>) <body>)"}
+	if len(node.Children) < 3 || node.Children[1].Kind != parser.ExpressionNode {
+		return ForeachExpr{}, syntaxError
+	}
+	header := node.Children[1].Children
+	if len(header) != 2 {
+		syntaxError.Range = node.Children[1].Range
+		return ForeachExpr{}, syntaxError
+	}
+	nameNode, err := singleNestedExpr(header[0])
+	if err != nil || nameNode.Kind != parser.LiteralNode {
+		return ForeachExpr{}, types.Error{Simple: "Parse error - variable name must be literal", Range: header[0].Range}
+	}
+	items, err := constructor.createAstExpression(header[1])
+	if err != nil {
+		return ForeachExpr{}, err
+	}
+	body, err := constructor.createFunctionBody(node.Children[2:])
+	if err != nil {
+		return ForeachExpr{}, err
+	}
+	return ForeachExpr{Identifier: nameNode.Data, Items: items, Body: body, Range: node.Range}, nil
+}
+
+func (constructor *AstConstructor) createCond(node parser.Node) (CondExpr, error) {
+	// (cond (<test> <body>)... (else <body>))
+	cond := CondExpr{Clauses: make([]CondClause, 0), Range: node.Range}
+	for _, clauseNode := range node.Children[1:] {
+		if cond.Else != nil {
+			return CondExpr{}, types.Error{Range: clauseNode.Range, Simple: "Syntax error - else must be the last clause of cond"}
+		}
+		if clauseNode.Kind != parser.ExpressionNode || len(clauseNode.Children) < 2 || clauseNode.Children[0].Kind != parser.ExpressionNode {
+			return CondExpr{}, types.Error{Range: clauseNode.Range, Simple: "Syntax error - cond clause should take form (<test> <body>)"}
+		}
+		body, err := constructor.createFunctionBody(clauseNode.Children[1:])
+		if err != nil {
+			return CondExpr{}, err
+		}
+		if _, form := nestedLiteralValue(clauseNode); form == "else" {
+			cond.Else = body
+			continue
+		}
+		condition, err := constructor.createAstExpression(clauseNode.Children[0])
+		if err != nil {
+			return CondExpr{}, err
+		}
+		cond.Clauses = append(cond.Clauses, CondClause{Condition: condition, Body: body, Range: clauseNode.Range})
+	}
+	if len(cond.Clauses) == 0 && cond.Else == nil {
+		return CondExpr{}, types.Error{Range: node.Range, Simple: "Syntax error - cond must have a clause"}
+	}
+	return cond, nil
+}
+
+func (constructor *AstConstructor) createMatch(node parser.Node) (MatchExpr, error) {
+	// (match <value> (<pattern> <body>)...)
+	if len(node.Children) < 3 {
+		return MatchExpr{}, types.Error{Range: node.Range, Simple: "Syntax error - match should take form (match <value> (<pattern> <body>)...)"}
+	}
+	value, err := constructor.createAstExpression(node.Children[1])
+	if err != nil {
+		return MatchExpr{}, err
+	}
+	match := MatchExpr{Value: value, Clauses: make([]MatchClause, 0), Range: node.Range}
+	for i, clauseNode := range node.Children[2:] {
+		if clauseNode.Kind != parser.ExpressionNode || len(clauseNode.Children) < 2 {
+			return MatchExpr{}, types.Error{Range: clauseNode.Range, Simple: "Syntax error - match clause should take form (<pattern> <body>)"}
+		}
+		var pattern Pattern
+		if _, form := nestedLiteralValue(clauseNode); form == "else" {
+			if i != len(node.Children)-3 {
+				return MatchExpr{}, types.Error{Range: clauseNode.Range, Simple: "Syntax error - else must be the last clause of match"}
+			}
+			pattern = WildcardPattern{Range: clauseNode.Children[0].Range}
+		} else {
+			pattern, err = constructor.createPattern(clauseNode.Children[0])
+			if err != nil {
+				return MatchExpr{}, err
+			}
+		}
+		if err := checkPatternBindings(pattern, map[string]bool{}); err != nil {
+			return MatchExpr{}, err
+		}
+		body, err := constructor.createFunctionBody(clauseNode.Children[1:])
+		if err != nil {
+			return MatchExpr{}, err
+		}
+		match.Clauses = append(match.Clauses, MatchClause{Pattern: pattern, Body: body, Range: clauseNode.Range})
+	}
+	return match, nil
+}
+
+func (constructor *AstConstructor) createPattern(node parser.Node) (Pattern, error) {
+	syntaxError := types.Error{Range: node.Range, Simple: "Syntax error - a pattern must be a number, string, bool, null, " +
+		"variable, _, (list <pattern>...) or (struct <name> (<field> <pattern>)...)"}
+	if valueNode, err := singleNestedExpr(node); err == nil && valueNode.Kind != parser.ExpressionNode {
+		switch valueNode.Kind {
+		case parser.LiteralNode:
+			if valueNode.Data == "_" {
+				return WildcardPattern{Range: node.Range}, nil
+			}
+			return BindPattern{Identifier: valueNode.Data, Range: node.Range}, nil
+		case parser.NumberNode, parser.StringNode, parser.BoolNode, parser.NullNode:
+			value, err := constructor.createAstExpression(valueNode)
+			if err != nil {
+				return nil, err
+			}
+			return LiteralPattern{Value: value, Range: node.Range}, nil
+		}
+		return nil, syntaxError
+	}
+
+	_, form := nestedLiteralValue(node)
+	if form == "list" {
+		list := ListPattern{Items: make([]Pattern, 0), Range: node.Range}
+		for _, itemNode := range node.Children[1:] {
+			item, err := constructor.createPattern(itemNode)
+			if err != nil {
+				return nil, err
+			}
+			list.Items = append(list.Items, item)
+		}
+		return list, nil
+	}
+	if form == "struct" {
+		if len(node.Children) < 2 {
+			return nil, syntaxError
+		}
+		nameNode, err := singleNestedExpr(node.Children[1])
+		if err != nil || nameNode.Kind != parser.LiteralNode {
+			return nil, syntaxError
+		}
+		stru := StructPattern{StructIdentifier: nameNode.Data, Fields: make([]FieldPattern, 0), Range: node.Range}
+		for _, fieldNode := range node.Children[2:] {
+			if len(fieldNode.Children) != 2 {
+				return nil, types.Error{Range: fieldNode.Range, Simple: "Syntax error - struct field pattern should take form (<field> <pattern>)"}
+			}
+			fieldNameNode, err := singleNestedExpr(fieldNode.Children[0])
+			if err != nil || fieldNameNode.Kind != parser.LiteralNode {
+				return nil, types.Error{Range: fieldNode.Range, Simple: "Syntax error - struct field pattern should take form (<field> <pattern>)"}
+			}
+			fieldPattern, err := constructor.createPattern(fieldNode.Children[1])
+			if err != nil {
+				return nil, err
+			}
+			stru.Fields = append(stru.Fields, FieldPattern{FieldIdentifier: fieldNameNode.Data, Pattern: fieldPattern,
+				Range: fieldNode.Range})
+		}
+		return stru, nil
+	}
+	return nil, syntaxError
+}
+
+// checkPatternBindings checks that a pattern binds each variable at most once
+func checkPatternBindings(pattern Pattern, bound map[string]bool) error {
+	switch p := pattern.(type) {
+	case BindPattern:
+		if bound[p.Identifier] {
+			return types.Error{Range: p.Range, Simple: fmt.Sprintf("Variable %s is bound more than once by pattern", p.Identifier)}
+		}
+		bound[p.Identifier] = true
+	case ListPattern:
+		for _, item := range p.Items {
+			if err := checkPatternBindings(item, bound); err != nil {
+				return err
+			}
+		}
+	case StructPattern:
+		for _, field := range p.Fields {
+			if err := checkPatternBindings(field.Pattern, bound); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (constructor *AstConstructor) createAstStatement(node parser.Node, isRoot bool) (Stmt, error) {
 	ok, literal := nestedLiteralValue(node)
 	if !ok {
@@ -443,6 +808,8 @@ func (constructor *AstConstructor) createAstStatement(node parser.Node, isRoot b
 		}
 	} else if literal == "defun" {
 		return constructor.createFunctionDeclaration(node, isRoot)
+	} else if literal == "defmacro" {
+		return constructor.createMacroDeclaration(node, isRoot)
 	} else if literal == "while" {
 		return constructor.createWhileLoop(node)
 	} else if literal == "import" {
@@ -451,6 +818,17 @@ func (constructor *AstConstructor) createAstStatement(node parser.Node, isRoot b
 		return constructor.createStructDeclaration(node)
 	} else if literal == "return" {
 		return constructor.createReturn(node)
+	} else if literal == "deftest" {
+		return constructor.createTestDeclaration(node, isRoot)
+	} else if literal == "set!" || literal == "global" {
+		return constructor.createAssignment(node, literal)
+	} else if literal == "break" {
+		return constructor.createBreak(node)
+	} else if literal == "continue" {
+		if len(node.Children) != 1 {
+			return nil, types.Error{Range: node.Range, Simple: "Syntax error - continue should take form (continue)"}
+		}
+		return ContinueStmt{Range: node.Range}, nil
 	}
 	return nil, types.Error{
 		Simple: "Parse error",
@@ -506,7 +884,7 @@ func (constructor *AstConstructor) createFunctionDeclaration(node parser.Node, i
 		}
 	}
 
-	funcDefStmt := FuncDefStmt{Identifier: node.Children[1].Children[0].Data, Args: make([]string, 0), Body: make([]Ast, 0), Range: node.Range}
+	funcDefStmt := FuncDefStmt{Identifier: node.Children[1].Children[0].Data, Body: make([]Ast, 0), Range: node.Range}
 	if _, ok := constructor.Functions[funcDefStmt.Identifier]; ok && !constructor.AllowFunctionRedeclaration {
 		return FuncDefStmt{}, types.Error{
 			Simple: fmt.Sprintf("Duplicate declaration of function %s", funcDefStmt.Identifier),
@@ -514,16 +892,11 @@ func (constructor *AstConstructor) createFunctionDeclaration(node parser.Node, i
 		}
 	}
 
-	argNode := node.Children[2]
-	for _, argExpr := range argNode.Children {
-		if len(argExpr.Children) != 1 || argExpr.Children[0].Kind != parser.LiteralNode {
-			return FuncDefStmt{}, types.Error{
-				Simple: "Bad function argument - expected identifier",
-				Range:  argExpr.Range,
-			}
-		}
-		funcDefStmt.Args = append(funcDefStmt.Args, argExpr.Children[0].Data)
+	params, err := constructor.createParams(node.Children[2])
+	if err != nil {
+		return FuncDefStmt{}, err
 	}
+	funcDefStmt.Params = params
 
 	body, err := constructor.createFunctionBody(node.Children[3:])
 	if err != nil {
@@ -536,6 +909,362 @@ func (constructor *AstConstructor) createFunctionDeclaration(node parser.Node, i
 
 }
 
+func (constructor *AstConstructor) createMacroDeclaration(node parser.Node, isRoot bool) (MacroDefStmt, error) {
+	// (defmacro identifier (args) definition)
+	if len(node.Children) < 4 {
+		return MacroDefStmt{}, types.Error{Range: node.Range,
+			Simple: "Syntax error - macro declaration should take form (defmacro <name> <args> <body>)"}
+	}
+	if len(node.Children[1].Children) != 1 || node.Children[1].Children[0].Kind != parser.LiteralNode {
+		return MacroDefStmt{}, types.Error{Range: node.Children[1].Range, Simple: "Invalid macro declaration - name must be a literal"}
+	}
+	identifier := node.Children[1].Children[0].Data
+	if !isRoot {
+		return MacroDefStmt{}, types.Error{Range: node.Range,
+			Simple: fmt.Sprintf("Invalid macro declaration %s - macros can only be declared at top level", identifier)}
+	}
+	if _, ok := constructor.Macros[identifier]; ok && !constructor.AllowFunctionRedeclaration {
+		return MacroDefStmt{}, types.Error{Range: node.Range, Simple: fmt.Sprintf("Duplicate declaration of macro %s", identifier)}
+	}
+	if constructor.Expander == nil {
+		return MacroDefStmt{}, types.Error{Range: node.Range, Simple: "Macros can not be declared here"}
+	}
+
+	params, err := constructor.createParams(node.Children[2])
+	if err != nil {
+		return MacroDefStmt{}, err
+	}
+	body, err := constructor.createFunctionBody(node.Children[3:])
+	if err != nil {
+		return MacroDefStmt{}, err
+	}
+	macro := FuncDefStmt{Identifier: identifier, Params: params, Body: body, Range: node.Range}
+	err = constructor.Expander.Define(macro)
+	if err != nil {
+		return MacroDefStmt{}, err
+	}
+	constructor.Macros[identifier] = &macro
+	return MacroDefStmt{Identifier: identifier, Range: node.Range}, nil
+}
+
+// maxExpansionDepth is how many macro calls can be expanded within each other, so that a macro that always expands
+// to a call to itself fails rather than never finishing
+const maxExpansionDepth = 1000
+
+// isAtom is true for an expression that is a single value (e.g. 1 or x) rather than a list
+func isAtom(node parser.Node) bool {
+	return len(node.Children) == 1 && node.Children[0].Kind != parser.ExpressionNode &&
+		node.Children[0].Kind != parser.AccessorOperationNode
+}
+
+// expandMacros replaces every call to a macro in node with the code that the macro expands to, apart from in code
+// that is quoted. Depth is the number of expansions that node is within
+func (constructor *AstConstructor) expandMacros(node parser.Node, depth int) (parser.Node, error) {
+	if node.Kind == parser.AccessorOperationNode {
+		return expandChildren(node, 1, func(child parser.Node) (parser.Node, error) {
+			return constructor.expandMacros(child, depth)
+		})
+	}
+	if node.Kind != parser.ExpressionNode || isAtom(node) {
+		return node, nil
+	}
+	_, head := nestedLiteralValue(node)
+	if _, ok := constructor.Macros[head]; ok {
+		if depth >= maxExpansionDepth {
+			return parser.Node{}, types.Error{Range: node.Range,
+				Simple: fmt.Sprintf("Expansion of macro %s is nested too deeply - does it always expand to itself?", head)}
+		}
+		// Arguments are passed to the macro as the code itself rather than its value
+		args := make([]Datum, 0)
+		for _, argNode := range node.Children[1:] {
+			arg, err := constructor.createDatum(argNode, 0)
+			if err != nil {
+				return parser.Node{}, err
+			}
+			args = append(args, arg)
+		}
+		expanded, err := constructor.Expander.Expand(head, args, node.Range)
+		if err != nil {
+			return parser.Node{}, err
+		}
+		return constructor.expandMacros(expanded, depth+1)
+	}
+
+	expand := func(child parser.Node) (parser.Node, error) {
+		return constructor.expandMacros(child, depth)
+	}
+	switch head {
+	case "quote":
+		return node, nil
+	case "quasiquote":
+		return expandChildren(node, 1, func(child parser.Node) (parser.Node, error) {
+			return constructor.expandQuasiquoted(child, 1, depth)
+		})
+	case "defun", "defmacro":
+		// The name and arguments are not code
+		return expandChildren(node, 3, expand)
+	case "lambda":
+		return expandChildren(node, 2, expand)
+	}
+	return expandChildren(node, 0, expand)
+}
+
+// expandQuasiquoted expands the macros in the code that is unquoted in a quasiquote, where level is the number of
+// quasiquotes that node is nested in
+func (constructor *AstConstructor) expandQuasiquoted(node parser.Node, level int, depth int) (parser.Node, error) {
+	if level == 0 {
+		return constructor.expandMacros(node, depth)
+	}
+	if node.Kind != parser.ExpressionNode || isAtom(node) {
+		return node, nil
+	}
+	childLevel := level
+	switch _, head := nestedLiteralValue(node); head {
+	case "quasiquote":
+		childLevel++
+	case "unquote", "unquote-splicing":
+		childLevel--
+	}
+	return expandChildren(node, 0, func(child parser.Node) (parser.Node, error) {
+		return constructor.expandQuasiquoted(child, childLevel, depth)
+	})
+}
+
+// expandChildren expands each child of node from index start onwards
+func expandChildren(node parser.Node, start int, expand func(parser.Node) (parser.Node, error)) (parser.Node, error) {
+	children := append([]parser.Node{}, node.Children...)
+	for i := start; i < len(children); i++ {
+		child, err := expand(children[i])
+		if err != nil {
+			return parser.Node{}, err
+		}
+		children[i] = child
+	}
+	node.Children = children
+	return node, nil
+}
+
+func (constructor *AstConstructor) createQuote(node parser.Node, form string) (QuoteExpr, error) {
+	// (quote <code>) or (quasiquote <code>)
+	if len(node.Children) != 2 {
+		return QuoteExpr{}, types.Error{Range: node.Range, Simple: fmt.Sprintf("Syntax error - %s should take form (%s <code>)", form, form)}
+	}
+	level := 0
+	if form == "quasiquote" {
+		level = 1
+	}
+	datum, err := constructor.createDatum(node.Children[1], level)
+	if err != nil {
+		return QuoteExpr{}, err
+	}
+	if datum.Kind == SpliceDatum {
+		return QuoteExpr{}, types.Error{Range: datum.Range, Simple: "Syntax error - unquote-splicing can only be used in a list"}
+	}
+	return QuoteExpr{Datum: datum, Range: node.Range}, nil
+}
+
+// createDatum creates code that is quoted. Level is the number of quasiquotes that node is nested in, and code that
+// is unquoted from the outermost quasiquote is evalulated rather than quoted
+func (constructor *AstConstructor) createDatum(node parser.Node, level int) (Datum, error) {
+	switch node.Kind {
+	case parser.NumberNode:
+		f, err := strconv.ParseFloat(node.Data, 64)
+		if err != nil {
+			return Datum{}, types.Error{Range: node.Range, Simple: fmt.Sprintf("Failed to parse `%s` as float", node.Data)}
+		}
+		return Datum{Kind: NumberDatum, Num: f, Range: node.Range}, nil
+	case parser.StringNode:
+		return Datum{Kind: StringDatum, Text: node.Data, Range: node.Range}, nil
+	case parser.BoolNode:
+		return Datum{Kind: BoolDatum, Bool: node.Data == "true", Range: node.Range}, nil
+	case parser.NullNode:
+		return Datum{Kind: NullDatum, Range: node.Range}, nil
+	case parser.LiteralNode:
+		return Datum{Kind: SymbolDatum, Text: node.Data, Range: node.Range}, nil
+	case parser.KeywordNode:
+		return Datum{Kind: SymbolDatum, Text: ":" + node.Data, Range: node.Range}, nil
+	case parser.QualifiedLiteralNode:
+		return Datum{Kind: SymbolDatum, Text: node.Children[0].Data + "." + node.Children[1].Data, Range: node.Range}, nil
+	case parser.AccessorNode:
+		return Datum{Kind: SymbolDatum, Text: node.Children[0].Data + ":" + node.Children[1].Data, Range: node.Range}, nil
+	case parser.AccessorOperationNode:
+		// (:name person) is a list of the field (as a keyword) and the struct
+		field := Datum{Kind: SymbolDatum, Text: ":" + node.Children[0].Data, Range: node.Children[0].Range}
+		structDatum, err := constructor.createDatum(node.Children[1], level)
+		if err != nil {
+			return Datum{}, err
+		}
+		accessorRange := types.FileRange{Start: field.Range.Start, End: structDatum.Range.End}
+		return Datum{Kind: ListDatum, Items: []Datum{field, structDatum}, Range: accessorRange}, nil
+	case parser.ExpressionNode:
+		if isAtom(node) {
+			return constructor.createDatum(node.Children[0], level)
+		}
+		if _, head := nestedLiteralValue(node); level > 0 {
+			switch head {
+			case "quasiquote":
+				level++
+			case "unquote", "unquote-splicing":
+				if len(node.Children) != 2 {
+					return Datum{}, types.Error{Range: node.Range, Simple: fmt.Sprintf("Syntax error - %s should take form (%s <code>)", head, head)}
+				}
+				if level == 1 {
+					expr, err := constructor.createAstExpression(node.Children[1])
+					if err != nil {
+						return Datum{}, err
+					}
+					kind := UnquoteDatum
+					if head == "unquote-splicing" {
+						kind = SpliceDatum
+					}
+					return Datum{Kind: kind, Expr: expr, Range: node.Range}, nil
+				}
+				level--
+			}
+		}
+		items := make([]Datum, 0)
+		for _, child := range node.Children {
+			item, err := constructor.createDatum(child, level)
+			if err != nil {
+				return Datum{}, err
+			}
+			items = append(items, item)
+		}
+		return Datum{Kind: ListDatum, Items: items, Range: node.Range}, nil
+	}
+	return Datum{}, types.Error{Simple: "Parse Error", Detail: fmt.Sprintf("unknown syntax node kind %s", node.Kind), Range: node.Range}
+}
+
+// createParams creates the arguments of a function or closure, which take the form
+// (<name>... &optional <name or (name default)>... &rest <name> &key <name or (name default)>...)
+func (constructor *AstConstructor) createParams(node parser.Node) (Params, error) {
+	params := Params{Args: []string{}}
+	// The last of &optional, &rest or &key seen, which the arguments that follow it are
+	section := ""
+	sectionOrder := map[string]int{"": 0, "&optional": 1, "&rest": 2, "&key": 3}
+	declared := make(map[string]bool)
+	for _, paramNode := range node.Children {
+		nameNode, err := singleNestedExpr(paramNode)
+		if err == nil && nameNode.Kind == parser.LiteralNode {
+			if order, ok := sectionOrder[nameNode.Data]; ok {
+				if order <= sectionOrder[section] {
+					return Params{}, types.Error{Range: nameNode.Range,
+						Simple: fmt.Sprintf("Syntax error - %s can not follow %s", nameNode.Data, section)}
+				}
+				if section == "&rest" && len(params.Rest) == 0 {
+					return Params{}, types.Error{Range: node.Range, Simple: "Syntax error - &rest must be followed by exactly one argument name"}
+				}
+				if nameNode.Data == "&key" && section == "&rest" {
+					return Params{}, types.Error{Range: nameNode.Range, Simple: "Syntax error - &rest and &key can not be used together"}
+				}
+				section = nameNode.Data
+				continue
+			}
+		}
+
+		// Arguments that can be left out can be given a default, as (name default)
+		var defaultExpr Expr
+		if (section == "&optional" || section == "&key") && len(paramNode.Children) == 2 {
+			nameNode, err = singleNestedExpr(paramNode.Children[0])
+			if err == nil {
+				defaultExpr, err = constructor.createAstExpression(paramNode.Children[1])
+				if err != nil {
+					return Params{}, err
+				}
+			}
+		}
+		if err != nil || nameNode.Kind != parser.LiteralNode {
+			return Params{}, types.Error{Simple: "Bad function argument - expected identifier", Range: paramNode.Range}
+		}
+		if declared[nameNode.Data] {
+			return Params{}, types.Error{Range: paramNode.Range, Simple: fmt.Sprintf("Argument %s is declared more than once", nameNode.Data)}
+		}
+		declared[nameNode.Data] = true
+
+		switch section {
+		case "":
+			params.Args = append(params.Args, nameNode.Data)
+		case "&optional":
+			params.Optional = append(params.Optional, OptionalArg{Identifier: nameNode.Data, Default: defaultExpr, Range: paramNode.Range})
+		case "&rest":
+			if len(params.Rest) > 0 {
+				return Params{}, types.Error{Range: node.Range, Simple: "Syntax error - &rest must be followed by exactly one argument name"}
+			}
+			params.Rest = nameNode.Data
+		case "&key":
+			params.Keys = append(params.Keys, OptionalArg{Identifier: nameNode.Data, Default: defaultExpr, Range: paramNode.Range})
+		}
+	}
+	if section == "&rest" && len(params.Rest) == 0 {
+		return Params{}, types.Error{Range: node.Range, Simple: "Syntax error - &rest must be followed by exactly one argument name"}
+	}
+	return params, nil
+}
+
+// createCallArgs creates the arguments of a call. Keyword arguments (:name value) come after any other arguments
+func (constructor *AstConstructor) createCallArgs(nodes []parser.Node) ([]Expr, []KeywordArg, error) {
+	args := make([]Expr, 0, len(nodes))
+	keywordArgs := []KeywordArg{}
+	for i := 0; i < len(nodes); i++ {
+		if keywordNode, err := singleNestedExpr(nodes[i]); err == nil && keywordNode.Kind == parser.KeywordNode {
+			if i+1 == len(nodes) {
+				return nil, nil, types.Error{Range: keywordNode.Range,
+					Simple: fmt.Sprintf("Keyword argument :%s must be followed by a value", keywordNode.Data)}
+			}
+			for _, keywordArg := range keywordArgs {
+				if keywordArg.Name == keywordNode.Data {
+					return nil, nil, types.Error{Range: keywordNode.Range,
+						Simple: fmt.Sprintf("Keyword argument :%s is passed more than once", keywordNode.Data)}
+				}
+			}
+			value, err := constructor.createAstExpression(nodes[i+1])
+			if err != nil {
+				return nil, nil, err
+			}
+			keywordArgs = append(keywordArgs, KeywordArg{Name: keywordNode.Data, Value: value, Range: keywordNode.Range})
+			i += 1
+			continue
+		}
+		if len(keywordArgs) > 0 {
+			return nil, nil, types.Error{Range: nodes[i].Range, Simple: "Syntax error - arguments must come before keyword arguments"}
+		}
+		arg, err := constructor.createAstExpression(nodes[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, keywordArgs, nil
+}
+
+func (constructor *AstConstructor) createTestDeclaration(node parser.Node, isRoot bool) (TestDefStmt, error) {
+	// (deftest name body) where name is a string or a literal
+	if len(node.Children) < 3 {
+		return TestDefStmt{}, types.Error{
+			Simple: "Syntax error - test declaration should take form (deftest <name> <body>)",
+			Range:  node.Range,
+		}
+	}
+	if len(node.Children[1].Children) != 1 ||
+		(node.Children[1].Children[0].Kind != parser.LiteralNode && node.Children[1].Children[0].Kind != parser.StringNode) {
+		return TestDefStmt{}, types.Error{
+			Simple: "Invalid test declaration - name must be a string or literal",
+			Range:  node.Children[1].Range,
+		}
+	}
+	name := node.Children[1].Children[0].Data
+	if !isRoot {
+		return TestDefStmt{}, types.Error{Range: node.Range,
+			Simple: fmt.Sprintf("Invalid test declaration %s - tests can only be declared at top level", name),
+		}
+	}
+	body, err := constructor.createFunctionBody(node.Children[2:])
+	if err != nil {
+		return TestDefStmt{}, err
+	}
+	return TestDefStmt{Name: name, Body: body, Range: node.Range}, nil
+}
+
 func (constructor *AstConstructor) createVariableDeclaration(node parser.Node, isRoot bool) (VarDefStmt, error) {
 	if len(node.Children) != 3 {
 		return VarDefStmt{}, types.Error{
@@ -560,6 +1289,27 @@ func (constructor *AstConstructor) createVariableDeclaration(node parser.Node, i
 	return varAst, err
 }
 
+func (constructor *AstConstructor) createAssignment(node parser.Node, form string) (AssignStmt, error) {
+	// (set! <name> <value>) or (global <name> <value>)
+	if len(node.Children) != 3 {
+		return AssignStmt{}, types.Error{
+			Simple: fmt.Sprintf("Syntax error - assignment should take form (%s <name> <value>)", form),
+			Range:  node.Range,
+		}
+	}
+	if len(node.Children[1].Children) != 1 || node.Children[1].Children[0].Kind != parser.LiteralNode {
+		return AssignStmt{}, types.Error{Simple: "Parse error - variable name must be literal", Range: node.Children[1].Range}
+	}
+	value, err := constructor.createAstExpression(node.Children[2])
+	if err != nil {
+		return AssignStmt{}, types.Error{Simple: "Invalid variable assignment - variable assigned to statement",
+			Detail: err.Error(),
+			Range:  node.Children[2].Range}
+	}
+	return AssignStmt{Identifier: node.Children[1].Children[0].Data, Value: value, Global: form == "global",
+		Range: node.Range}, nil
+}
+
 func (constructor *AstConstructor) createStructFieldDeclaration(node parser.Node) (StructFieldDeclarationStmt, error) {
 	if len(node.Children) != 3 {
 		return StructFieldDeclarationStmt{}, types.Error{
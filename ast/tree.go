@@ -1,6 +1,10 @@
 package ast
 
-import "github.com/benbanerjeerichards/lisp-calculator/types"
+import (
+	"strings"
+
+	"github.com/benbanerjeerichards/lisp-calculator/types"
+)
 
 type Ast struct {
 	Expression Expr
@@ -15,14 +19,31 @@ type VarDefStmt struct {
 	Range      types.FileRange
 }
 
-type FuncDefStmt struct {
+// AssignStmt is (set! <name> <value>), which assigns to the variable that name refers to (a local, a variable
+// captured by a closure or a global), or (global <name> <value>) which always assigns to the global
+type AssignStmt struct {
 	Identifier string
-	Args       []string
-	Body       []Ast
-	FilePath   string
+	Value      Expr
+	Global     bool
 	Range      types.FileRange
 }
 
+type FuncDefStmt struct {
+	Identifier string
+	Params
+	Body     []Ast
+	FilePath string
+	Range    types.FileRange
+}
+
+// TestDefStmt is a test declared with (deftest <name> <body>), which is only run by the test runner
+type TestDefStmt struct {
+	Name     string
+	Body     []Ast
+	FilePath string
+	Range    types.FileRange
+}
+
 // No information is stored in this node as it is immedialy added to global ast construct env
 type ImportStmt struct {
 	Range types.FileRange
@@ -40,17 +61,67 @@ type FunctionApplicationExpr struct {
 	FilePath  string
 	IsBuiltin bool
 	Args      []Expr
-	Range     types.FileRange
+	// KeywordArgs are the arguments passed by name, which follow Args
+	KeywordArgs []KeywordArg
+	Range       types.FileRange
 }
 
 type ClosureApplicationExpr struct {
-	Closure Expr
-	Args    []Expr
+	Closure     Expr
+	Args        []Expr
+	KeywordArgs []KeywordArg
+	Range       types.FileRange
+}
+
+// KeywordArg is an argument passed to a &key argument by name (:name value)
+type KeywordArg struct {
+	Name  string
+	Value Expr
+	Range types.FileRange
+}
+
+// Params are the arguments declared by a function or closure
+type Params struct {
+	Args []string
+	// Optional are the &optional arguments, which follow Args and do not have to be passed
+	Optional []OptionalArg
+	// Rest is the &rest argument that collects any further arguments into a list, or empty if there is none
+	Rest string
+	// Keys are the &key arguments, which are passed by name in any order and do not have to be passed
+	Keys []OptionalArg
+}
+
+// String is the arguments as they are written when declaring them, without their defaults
+func (p Params) String() string {
+	names := append([]string{}, p.Args...)
+	if len(p.Optional) > 0 {
+		names = append(names, "&optional")
+		for _, arg := range p.Optional {
+			names = append(names, arg.Identifier)
+		}
+	}
+	if len(p.Rest) > 0 {
+		names = append(names, "&rest", p.Rest)
+	}
+	if len(p.Keys) > 0 {
+		names = append(names, "&key")
+		for _, arg := range p.Keys {
+			names = append(names, arg.Identifier)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// OptionalArg is an &optional or &key argument
+type OptionalArg struct {
+	Identifier string
+	// Default is evalulated for the argument's value when it is not passed. If nil, the argument defaults to null
+	Default Expr
 	Range   types.FileRange
 }
 
 type ClosureDefExpr struct {
-	Args  []string
+	Params
 	Body  []Ast
 	Range types.FileRange
 }
@@ -91,6 +162,183 @@ type IfOnlyExpr struct {
 	Range     types.FileRange
 }
 
+// LetExpr is (let ((<name> <value>)...) <body>), whose variables can only be used in its body. The values of let are
+// all evaluated before any variable is bound, whereas each value of let* can use the variables bound before it
+type LetExpr struct {
+	Bindings   []LetBinding
+	Sequential bool
+	Body       []Ast
+	Range      types.FileRange
+}
+
+type LetBinding struct {
+	Identifier string
+	Value      Expr
+	Range      types.FileRange
+}
+
+// TryExpr is (try <body> (catch <kind> <name> <body>)... (finally <body>)). An error raised by the body is passed to
+// the first catch whose kind matches it, and the finally body is run however the try is left
+type TryExpr struct {
+	Body    []Ast
+	Catches []CatchClause
+	// Finally is nil if the try has no finally
+	Finally []Ast
+	Range   types.FileRange
+}
+
+// CatchClause handles the errors of kind Kind, bound to the variable Identifier in its body
+type CatchClause struct {
+	Kind       string
+	Identifier string
+	Body       []Ast
+	Range      types.FileRange
+}
+
+// CondExpr is (cond (<test> <body>)... (else <body>)), which runs the body of the first clause whose test is true
+type CondExpr struct {
+	Clauses []CondClause
+	// Else is nil if the cond has no else
+	Else  []Ast
+	Range types.FileRange
+}
+
+type CondClause struct {
+	Condition Expr
+	Body      []Ast
+	Range     types.FileRange
+}
+
+// MatchExpr is (match <value> (<pattern> <body>)...), which runs the body of the first clause whose pattern matches
+// the value. An else clause is the same as a clause with the pattern _
+type MatchExpr struct {
+	Value   Expr
+	Clauses []MatchClause
+	Range   types.FileRange
+}
+
+// MatchClause binds the variables of its pattern in its body
+type MatchClause struct {
+	Pattern Pattern
+	Body    []Ast
+	Range   types.FileRange
+}
+
+// Pattern is what a clause of match compares a value against
+type Pattern interface {
+	patternType()
+	GetRange() types.FileRange
+}
+
+// LiteralPattern matches a value equal to a number, string, bool or null
+type LiteralPattern struct {
+	Value Expr
+	Range types.FileRange
+}
+
+// BindPattern matches any value, which is bound to the variable Identifier
+type BindPattern struct {
+	Identifier string
+	Range      types.FileRange
+}
+
+// WildcardPattern is _, which matches any value
+type WildcardPattern struct {
+	Range types.FileRange
+}
+
+// ListPattern is (list <pattern>...), which matches a list with an item for each pattern that matches it
+type ListPattern struct {
+	Items []Pattern
+	Range types.FileRange
+}
+
+// StructPattern is (struct <name> (<field> <pattern>)...), which matches a struct of type StructIdentifier whose
+// fields match their patterns
+type StructPattern struct {
+	StructIdentifier string
+	Fields           []FieldPattern
+	Range            types.FileRange
+}
+
+type FieldPattern struct {
+	FieldIdentifier string
+	Pattern         Pattern
+	Range           types.FileRange
+}
+
+// ForExpr is (for (<name> <from> <to> <step>) <body>), which runs its body with the variable set to each number from
+// from up to (but not including) to, counting by step. Step is nil if it is not given, when it counts up by 1
+type ForExpr struct {
+	Identifier string
+	From       Expr
+	To         Expr
+	Step       Expr
+	Body       []Ast
+	Range      types.FileRange
+}
+
+// ForeachExpr is (foreach (<name> <items>) <body>), which runs its body with the variable set to each item of a list
+// or each character of a string
+type ForeachExpr struct {
+	Identifier string
+	Items      Expr
+	Body       []Ast
+	Range      types.FileRange
+}
+
+// BreakStmt is (break) or (break <value>), which ends the innermost loop. The value of the loop is Value, or null if
+// Value is nil
+type BreakStmt struct {
+	Value Expr
+	Range types.FileRange
+}
+
+// ContinueStmt is (continue), which starts the next iteration of the innermost loop
+type ContinueStmt struct {
+	Range types.FileRange
+}
+
+// QuoteExpr is (quote <code>) or (quasiquote <code>), which is the code as data rather than the value of the code
+type QuoteExpr struct {
+	Datum Datum
+	Range types.FileRange
+}
+
+const (
+	SymbolDatum = iota
+	NumberDatum
+	StringDatum
+	BoolDatum
+	NullDatum
+	ListDatum
+	// UnquoteDatum is (unquote <code>) in a quasiquote, which is the value of the code
+	UnquoteDatum
+	// SpliceDatum is (unquote-splicing <code>) in a list of a quasiquote, which is each item of the list that the
+	// code evalulates to
+	SpliceDatum
+)
+
+// Datum is a part of quoted code
+type Datum struct {
+	Kind int
+	// Text is the name of a symbol or the value of a string
+	Text  string
+	Num   float64
+	Bool  bool
+	Items []Datum
+	// Expr is the code that is unquoted
+	Expr  Expr
+	Range types.FileRange
+}
+
+// MacroDefStmt is (defmacro <name> <args> <body>). Macros are expanded when the ast is created, so there is nothing
+// left of them to run
+type MacroDefStmt struct {
+	Identifier string
+	Range      types.FileRange
+}
+
 type WhileStmt struct {
 	Condition Expr
 	Body      []Ast
@@ -135,10 +383,18 @@ func (v VarDefStmt) GetRange() types.FileRange {
 	return v.Range
 }
 
+func (v AssignStmt) GetRange() types.FileRange {
+	return v.Range
+}
+
 func (v FuncDefStmt) GetRange() types.FileRange {
 	return v.Range
 }
 
+func (v TestDefStmt) GetRange() types.FileRange {
+	return v.Range
+}
+
 func (v VarUseExpr) GetRange() types.FileRange {
 	return v.Range
 }
@@ -171,10 +427,70 @@ func (v IfElseExpr) GetRange() types.FileRange {
 	return v.Range
 }
 
+func (v LetExpr) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v TryExpr) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v CondExpr) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v MatchExpr) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v LiteralPattern) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v BindPattern) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v WildcardPattern) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v ListPattern) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v StructPattern) GetRange() types.FileRange {
+	return v.Range
+}
+
 func (v IfOnlyExpr) GetRange() types.FileRange {
 	return v.Range
 }
 
+func (v ForExpr) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v ForeachExpr) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v BreakStmt) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v ContinueStmt) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v QuoteExpr) GetRange() types.FileRange {
+	return v.Range
+}
+
+func (v MacroDefStmt) GetRange() types.FileRange {
+	return v.Range
+}
+
 func (v WhileStmt) GetRange() types.FileRange {
 	return v.Range
 }
@@ -221,6 +537,12 @@ func (VarUseExpr) exprType()              {}
 func (BoolExpr) exprType()                {}
 func (IfElseExpr) exprType()              {}
 func (IfOnlyExpr) exprType()              {}
+func (LetExpr) exprType()                 {}
+func (TryExpr) exprType()                 {}
+func (CondExpr) exprType()                {}
+func (MatchExpr) exprType()               {}
+func (ForExpr) exprType()                 {}
+func (ForeachExpr) exprType()             {}
 func (StringExpr) exprType()              {}
 func (ListExpr) exprType()                {}
 func (NullExpr) exprType()                {}
@@ -228,15 +550,27 @@ func (ClosureDefExpr) exprType()          {}
 func (ClosureApplicationExpr) exprType()  {}
 func (StructAccessorExpr) exprType()      {}
 func (StructExpr) exprType()              {}
+func (QuoteExpr) exprType()               {}
 
 func (VarDefStmt) stmtType()                 {}
+func (AssignStmt) stmtType()                 {}
 func (FuncDefStmt) stmtType()                {}
+func (TestDefStmt) stmtType()                {}
 func (WhileStmt) stmtType()                  {}
 func (ImportStmt) stmtType()                 {}
 func (StructDefStmt) stmtType()              {}
 func (StructFieldDeclarationStmt) stmtType() {}
 func (ReturnStmt) stmtType()                 {}
 func (ReturnValueStmt) stmtType()            {}
+func (BreakStmt) stmtType()                  {}
+func (ContinueStmt) stmtType()               {}
+func (MacroDefStmt) stmtType()               {}
+
+func (LiteralPattern) patternType()  {}
+func (BindPattern) patternType()     {}
+func (WildcardPattern) patternType() {}
+func (ListPattern) patternType()     {}
+func (StructPattern) patternType()   {}
 
 func (ast *Ast) newStatement(stmt Stmt) {
 	ast.Kind = StmtType
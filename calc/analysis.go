@@ -0,0 +1,122 @@
+package calc
+
+import (
+	"sort"
+
+	"github.com/benbanerjeerichards/lisp-calculator/ast"
+	"github.com/benbanerjeerichards/lisp-calculator/types"
+	"github.com/benbanerjeerichards/lisp-calculator/vm"
+)
+
+// FunctionDefinition is a function declared in a file
+type FunctionDefinition struct {
+	FilePath string
+	// Qualifier that the function has to be called with from the analysed file (empty if unqualified)
+	Qualifier string
+	Function  ast.FuncDefStmt
+}
+
+// Analysis is the result of building and compiling a file (and its imports) without running it.
+// Used by tooling such as the language server
+type Analysis struct {
+	Path    string
+	builder AstBuilder
+	// Err is the first error found whilst tokenising, parsing, building the AST or compiling
+	Err error
+}
+
+// Analyse builds and compiles the file at path with the given contents
+func Analyse(path string, code string) Analysis {
+	analysis := Analysis{Path: path}
+	analysis.builder.New()
+	analysis.Err = analysis.compile(code)
+	return analysis
+}
+
+func (a *Analysis) compile(code string) error {
+	err := a.builder.buildFile(a.Path, code)
+	if err != nil {
+		return err
+	}
+	err = a.builder.resolveFunctions()
+	if err != nil {
+		return err
+	}
+	allAsts := []ast.Ast{}
+	for _, fileAst := range a.builder.fileAsts {
+		allAsts = append(allAsts, fileAst.asts...)
+	}
+	compiler := vm.Compiler{}
+	compiler.New()
+	_, err = compiler.CompileProgram(a.Path, allAsts)
+	return err
+}
+
+// FindFunction finds the declaration of the function applied as qualifier.identifier in the analysed file,
+// using the same rules as when the program is compiled. Builtins are not included
+func (a Analysis) FindFunction(qualifier string, identifier string) (FunctionDefinition, bool) {
+	theFile, ok := a.builder.fileAsts[a.Path]
+	if !ok {
+		return FunctionDefinition{}, false
+	}
+	filePath, isBuiltin, err := a.builder.lookupFunction(theFile, qualifier, identifier, types.FileRange{})
+	if err != nil || isBuiltin || len(filePath) == 0 {
+		return FunctionDefinition{}, false
+	}
+	for _, function := range functionsInFile(a.builder.fileAsts[filePath]) {
+		if function.Identifier == identifier {
+			return FunctionDefinition{FilePath: filePath, Qualifier: qualifier, Function: function}, true
+		}
+	}
+	return FunctionDefinition{}, false
+}
+
+// Functions returns every function that can be called from the analysed file, sorted by name
+func (a Analysis) Functions() []FunctionDefinition {
+	definitions := []FunctionDefinition{}
+	theFile, ok := a.builder.fileAsts[a.Path]
+	if !ok {
+		return definitions
+	}
+	for _, function := range functionsInFile(theFile) {
+		definitions = append(definitions, FunctionDefinition{FilePath: theFile.filePath, Function: function})
+	}
+	for _, fileImport := range theFile.imports {
+		if importedFile, ok := a.builder.fileAsts[fileImport.Path]; ok {
+			for _, function := range functionsInFile(importedFile) {
+				definitions = append(definitions, FunctionDefinition{FilePath: importedFile.filePath,
+					Qualifier: fileImport.Qualifier, Function: function})
+			}
+		}
+	}
+	sort.Slice(definitions, func(i, j int) bool {
+		return definitions[i].Function.Identifier < definitions[j].Function.Identifier
+	})
+	return definitions
+}
+
+// Structs returns every struct declared in the analysed file or any file it imports, sorted by name
+func (a Analysis) Structs() []ast.StructDefStmt {
+	structs := []ast.StructDefStmt{}
+	for _, theFile := range a.builder.fileAsts {
+		for _, anAst := range theFile.asts {
+			if structDef, ok := anAst.Statement.(ast.StructDefStmt); ok && anAst.Kind == ast.StmtType {
+				structs = append(structs, structDef)
+			}
+		}
+	}
+	sort.Slice(structs, func(i, j int) bool {
+		return structs[i].Identifier < structs[j].Identifier
+	})
+	return structs
+}
+
+func functionsInFile(theFile file) []ast.FuncDefStmt {
+	functions := []ast.FuncDefStmt{}
+	for _, anAst := range theFile.asts {
+		if funDef, ok := anAst.Statement.(ast.FuncDefStmt); ok && anAst.Kind == ast.StmtType {
+			functions = append(functions, funDef)
+		}
+	}
+	return functions
+}
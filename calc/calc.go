@@ -21,6 +21,12 @@ type RunOptions struct {
 	PrintTokens    bool
 	PrintAst       bool
 	PrintFunctions bool
+	// Debugger, if set, is attached to the program whilst it runs
+	Debugger *vm.Debugger
+	// Profiler, if set, records a profile of the program whilst it runs
+	Profiler *vm.Profiler
+	// MaxCallDepth is how many calls can be running at once, or vm.DefaultMaxCallDepth if not set
+	MaxCallDepth int
 }
 
 //go:embed stdlib.lisp
@@ -68,6 +74,17 @@ func ParseAndEval(path string, code string, programArgs []string, options RunOpt
 	if err != nil {
 		return vm.Value{}, err
 	}
+	if options.Debugger != nil || options.Profiler != nil || options.MaxCallDepth > 0 {
+		evalulator := vm.Evalulator{}
+		evalulator.New(programArgs, os.Stdout)
+		evalulator.SetDebugger(options.Debugger)
+		evalulator.SetProfiler(options.Profiler)
+		evalulator.SetTrace(options.Debug)
+		if options.MaxCallDepth > 0 {
+			evalulator.SetMaxCallDepth(options.MaxCallDepth)
+		}
+		return evalulator.Eval(compileRes)
+	}
 	evalResult, err := vm.Eval(compileRes, programArgs, options.Debug, os.Stdout)
 	if err != nil {
 		return vm.Value{}, err
@@ -75,6 +92,26 @@ func ParseAndEval(path string, code string, programArgs []string, options RunOpt
 	return evalResult, nil
 }
 
+// Compile builds the program at path, along with everything it imports, into bytecode
+func Compile(path string, code string) (vm.CompileResult, error) {
+	asts, err := Ast(path, code)
+	if err != nil {
+		return vm.CompileResult{}, err
+	}
+	compiler := vm.Compiler{}
+	compiler.New()
+	return compiler.CompileProgram(path, asts)
+}
+
+// Disassemble compiles the program at path and returns the bytecode of every frame
+func Disassemble(path string, code string) (string, error) {
+	compileRes, err := Compile(path, code)
+	if err != nil {
+		return "", err
+	}
+	return vm.Disassemble(compileRes, map[string]string{path: code}), nil
+}
+
 type file struct {
 	filePath      string
 	functionNames map[string]struct{}
@@ -85,22 +122,32 @@ type file struct {
 }
 
 type AstBuilder struct {
-	fileAsts       map[string]file
+	fileAsts map[string]file
+	// Paths of the built files, with every file after the files it imports so globals are declared before use
+	order          []string
 	functionNames  map[string]string
 	printTokens    bool
 	printParseTree bool
 	printAst       bool
 	printFunctions bool
+	builtins       *vm.BuiltinRegistry
 }
 
 func (a *AstBuilder) New() {
 	a.fileAsts = make(map[string]file)
 	a.functionNames = make(map[string]string)
+	a.builtins = &vm.BuiltinRegistry{}
+	a.builtins.New()
 	a.printTokens = false
 	a.printParseTree = false
 	a.printAst = false
 }
 
+// SetBuiltins sets the builtins that unqualified function applications can resolve to
+func (a *AstBuilder) SetBuiltins(builtins *vm.BuiltinRegistry) {
+	a.builtins = builtins
+}
+
 // buildFile builds a file's ast and recursivly builds all its imports
 // Only provide code if no file exists (e.g. from unit tests, command line, etc)
 func (a *AstBuilder) buildFile(path string, code string) error {
@@ -146,9 +193,111 @@ func (a *AstBuilder) buildFile(path string, code string) error {
 			return types.Error{Range: fileImport.Range, Simple: fmt.Sprintf("Failed to find file to import - %s", fileImport.Path)}
 		}
 	}
+	a.addToOrder(path)
 	return nil
 }
 
+func (a *AstBuilder) addToOrder(path string) {
+	for i, orderedPath := range a.order {
+		if orderedPath == path {
+			a.order = append(a.order[:i], a.order[i+1:]...)
+			break
+		}
+	}
+	a.order = append(a.order, path)
+}
+
+// BuildInput builds the ast for code that is entered bit by bit (e.g. into the REPL), as if each input was appended
+// to the file at path. The constructor is kept between inputs so it can allow functions to be redeclared.
+// Returns the asts for the input, preceded by the asts of any files that are imported for the first time
+func (a *AstBuilder) BuildInput(path string, code string, constructor *ast.AstConstructor) ([]ast.Ast, error) {
+	// Imports are accumulated by the constructor, so only the ones after those we have already seen are new
+	numSeenImports := 0
+	inputFile, ok := a.fileAsts[path]
+	if ok {
+		numSeenImports = len(inputFile.imports)
+	} else {
+		inputFile = file{filePath: path, functionNames: make(map[string]struct{})}
+	}
+
+	astResult, err := createAstWithConstructor(path, code, constructor, a.printTokens, a.printParseTree)
+	if err != nil {
+		return []ast.Ast{}, err
+	}
+	if a.printAst {
+		spew.Dump(astResult)
+	}
+
+	for _, anAst := range astResult.Asts {
+		if anAst.Kind == ast.StmtType {
+			if funDef, ok := anAst.Statement.(ast.FuncDefStmt); ok {
+				inputFile.functionNames[funDef.Identifier] = struct{}{}
+			}
+		}
+	}
+
+	importedAsts := []ast.Ast{}
+	for _, fileImport := range astResult.Imports[numSeenImports:] {
+		fullPath, ok := resolveImportPath(path, fileImport.Path)
+		if !ok {
+			return []ast.Ast{}, types.Error{Range: fileImport.Range, Simple: fmt.Sprintf("Failed to find file to import - %s", fileImport.Path)}
+		}
+		fileImport.Path = fullPath
+		inputFile.imports = append(inputFile.imports, fileImport)
+		if _, ok := a.fileAsts[fullPath]; ok {
+			continue
+		}
+		newAsts, err := a.buildNewFiles(fullPath)
+		if err != nil {
+			return []ast.Ast{}, err
+		}
+		importedAsts = append(importedAsts, newAsts...)
+	}
+	a.fileAsts[path] = inputFile
+
+	for _, anAst := range astResult.Asts {
+		err := a.resolveFunctionAst(inputFile, anAst)
+		if err != nil {
+			return []ast.Ast{}, err
+		}
+	}
+	return append(importedAsts, astResult.Asts...), nil
+}
+
+// LoadFile (re)builds the file at path, even if it has been built before, along with any of its imports that have
+// not yet been built. Returns the asts of every file that was built
+func (a *AstBuilder) LoadFile(path string) ([]ast.Ast, error) {
+	delete(a.fileAsts, path)
+	return a.buildNewFiles(path)
+}
+
+// buildNewFiles builds the file at path and returns the resolved asts of it and every file it caused to be built
+func (a *AstBuilder) buildNewFiles(path string) ([]ast.Ast, error) {
+	seenFiles := make(map[string]struct{})
+	for filePath := range a.fileAsts {
+		seenFiles[filePath] = struct{}{}
+	}
+	err := a.buildFile(path, "")
+	if err != nil {
+		return []ast.Ast{}, err
+	}
+	newAsts := []ast.Ast{}
+	for _, filePath := range a.order {
+		if _, ok := seenFiles[filePath]; ok {
+			continue
+		}
+		newFile := a.fileAsts[filePath]
+		for _, anAst := range newFile.asts {
+			err := a.resolveFunctionAst(newFile, anAst)
+			if err != nil {
+				return []ast.Ast{}, err
+			}
+		}
+		newAsts = append(newAsts, newFile.asts...)
+	}
+	return newAsts, nil
+}
+
 func (a *AstBuilder) resolveFunctions() error {
 	// Find all functionApplications and set the FilePath on them to resolve them to the correct file
 	// So need to iterate over entire tree
@@ -172,52 +321,57 @@ func (a *AstBuilder) resolveFunctionAst(theFile file, node ast.Ast) error {
 }
 
 func (a *AstBuilder) resolveFunctionFilePath(theFile file, expr *ast.FunctionApplicationExpr) error {
-	if len(expr.Qualifier) != 0 {
+	filePath, isBuiltin, err := a.lookupFunction(theFile, expr.Qualifier, expr.Identifier, expr.Range)
+	if err != nil {
+		return err
+	}
+	expr.FilePath = filePath
+	expr.IsBuiltin = isBuiltin
+	return nil
+}
+
+// lookupFunction finds the path of the file containing the function applied as qualifier.identifier in theFile
+// The path is empty if the function could not be found
+func (a *AstBuilder) lookupFunction(theFile file, qualifier string, identifier string, appRange types.FileRange) (string, bool, error) {
+	if len(qualifier) != 0 {
 		// If the function is qualified, then need to look up correctly
 		for _, fileImport := range theFile.imports {
-			if fileImport.Qualifier == expr.Qualifier {
+			if fileImport.Qualifier == qualifier {
 				if importedFile, ok := a.fileAsts[fileImport.Path]; ok {
-					if _, functionIsInFile := a.fileAsts[fileImport.Path].functionNames[expr.Identifier]; functionIsInFile {
-						expr.FilePath = importedFile.filePath
-						return nil
+					if _, functionIsInFile := a.fileAsts[fileImport.Path].functionNames[identifier]; functionIsInFile {
+						return importedFile.filePath, false, nil
 					} else {
-						return types.Error{Range: expr.Range,
-							Simple: fmt.Sprintf("Failed to find function %s in file %s (qualified by %s)", expr.Identifier, importedFile.filePath, expr.Qualifier)}
+						return "", false, types.Error{Range: appRange,
+							Simple: fmt.Sprintf("Failed to find function %s in file %s (qualified by %s)", identifier, importedFile.filePath, qualifier)}
 					}
 				} else {
-					spew.Dump(a.fileAsts)
-					return types.Error{Range: expr.Range, Simple: fmt.Sprintf("Function application uses unknown qualifier %s", expr.Qualifier)}
+					return "", false, types.Error{Range: appRange, Simple: fmt.Sprintf("Function application uses unknown qualifier %s", qualifier)}
 				}
 			}
 		}
 	} else {
 		// Non qualified, could either 1) buildin 2) this file 3) unqualified import from other file
-		// TODO we should have a buildin map for quick checking
-		for _, builtin := range vm.Builtins {
-			if builtin.Identifier == expr.Identifier {
-				expr.IsBuiltin = true
-				return nil
-			}
+		if _, _, ok := a.builtins.Lookup(identifier); ok {
+			return "", true, nil
 		}
-		if _, inThisFile := theFile.functionNames[expr.Identifier]; inThisFile {
-			expr.FilePath = theFile.filePath
+		if _, inThisFile := theFile.functionNames[identifier]; inThisFile {
+			return theFile.filePath, false, nil
 		} else {
 			for _, fileImport := range theFile.imports {
 				if len(fileImport.Qualifier) == 0 {
 					if importedFile, ok := a.fileAsts[fileImport.Path]; ok {
-						if _, ok := importedFile.functionNames[expr.Identifier]; ok {
-							expr.FilePath = importedFile.filePath
-							return nil
+						if _, ok := importedFile.functionNames[identifier]; ok {
+							return importedFile.filePath, false, nil
 						}
 					}
 				}
 			}
 			// Not an issue if we can't resove a non-qualifid function application, as it could also be a local/global variable
 			// Should probably rename the FunctionApplicationNode to prevent confusion
-			return nil
+			return "", false, nil
 		}
 	}
-	return nil
+	return "", false, nil
 }
 
 func (a *AstBuilder) resolveFunctionExpression(theFile file, node ast.Expr) error {
@@ -239,8 +393,18 @@ func (a *AstBuilder) resolveFunctionExpression(theFile file, node ast.Expr) erro
 				return err
 			}
 		}
+		for _, keywordArg := range expr.KeywordArgs {
+			err := a.resolveFunctionExpression(theFile, keywordArg.Value)
+			if err != nil {
+				return err
+			}
+		}
 		return a.resolveFunctionExpression(theFile, expr.Closure)
 	case ast.ClosureDefExpr:
+		err := a.resolveParamDefaults(theFile, expr.Params)
+		if err != nil {
+			return err
+		}
 		for _, bodyAst := range expr.Body {
 			err := a.resolveFunctionAst(theFile, bodyAst)
 			if err != nil {
@@ -264,6 +428,90 @@ func (a *AstBuilder) resolveFunctionExpression(theFile file, node ast.Expr) erro
 				return err
 			}
 		}
+	case ast.LetExpr:
+		for _, binding := range expr.Bindings {
+			err := a.resolveFunctionExpression(theFile, binding.Value)
+			if err != nil {
+				return err
+			}
+		}
+		for _, bodyAst := range expr.Body {
+			err := a.resolveFunctionAst(theFile, bodyAst)
+			if err != nil {
+				return err
+			}
+		}
+	case ast.TryExpr:
+		body := append([]ast.Ast{}, expr.Body...)
+		for _, catch := range expr.Catches {
+			body = append(body, catch.Body...)
+		}
+		for _, bodyAst := range append(body, expr.Finally...) {
+			err := a.resolveFunctionAst(theFile, bodyAst)
+			if err != nil {
+				return err
+			}
+		}
+	case ast.ForExpr:
+		for _, valExpr := range []ast.Expr{expr.From, expr.To, expr.Step} {
+			if valExpr == nil {
+				continue
+			}
+			err := a.resolveFunctionExpression(theFile, valExpr)
+			if err != nil {
+				return err
+			}
+		}
+		for _, bodyAst := range expr.Body {
+			err := a.resolveFunctionAst(theFile, bodyAst)
+			if err != nil {
+				return err
+			}
+		}
+	case ast.ForeachExpr:
+		err := a.resolveFunctionExpression(theFile, expr.Items)
+		if err != nil {
+			return err
+		}
+		for _, bodyAst := range expr.Body {
+			err := a.resolveFunctionAst(theFile, bodyAst)
+			if err != nil {
+				return err
+			}
+		}
+	case ast.CondExpr:
+		for _, clause := range expr.Clauses {
+			err := a.resolveFunctionExpression(theFile, clause.Condition)
+			if err != nil {
+				return err
+			}
+			for _, bodyAst := range clause.Body {
+				err := a.resolveFunctionAst(theFile, bodyAst)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		for _, bodyAst := range expr.Else {
+			err := a.resolveFunctionAst(theFile, bodyAst)
+			if err != nil {
+				return err
+			}
+		}
+	case ast.MatchExpr:
+		err := a.resolveFunctionExpression(theFile, expr.Value)
+		if err != nil {
+			return err
+		}
+		// Patterns only hold literal values, so it is just the bodies that can call functions
+		for _, clause := range expr.Clauses {
+			for _, bodyAst := range clause.Body {
+				err := a.resolveFunctionAst(theFile, bodyAst)
+				if err != nil {
+					return err
+				}
+			}
+		}
 	case ast.IfOnlyExpr:
 		err := a.resolveFunctionExpression(theFile, expr.Condition)
 		if err != nil {
@@ -284,6 +532,8 @@ func (a *AstBuilder) resolveFunctionExpression(theFile file, node ast.Expr) erro
 		}
 	case ast.StructAccessorExpr:
 		return a.resolveFunctionExpression(theFile, expr.Struct)
+	case ast.QuoteExpr:
+		return a.resolveDatum(theFile, expr.Datum)
 	case ast.StructExpr:
 		for _, valExpr := range expr.Values {
 			err := a.resolveFunctionExpression(theFile, valExpr)
@@ -299,23 +549,66 @@ func (a *AstBuilder) resolveFunctionExpression(theFile file, node ast.Expr) erro
 	return nil
 }
 
+// resolveDatum resolves the code that is unquoted in quoted code
+func (a *AstBuilder) resolveDatum(theFile file, datum ast.Datum) error {
+	if datum.Kind == ast.UnquoteDatum || datum.Kind == ast.SpliceDatum {
+		return a.resolveFunctionExpression(theFile, datum.Expr)
+	}
+	for _, item := range datum.Items {
+		err := a.resolveDatum(theFile, item)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *AstBuilder) resolveParamDefaults(theFile file, params ast.Params) error {
+	for _, arg := range append(append([]ast.OptionalArg{}, params.Optional...), params.Keys...) {
+		if arg.Default != nil {
+			err := a.resolveFunctionExpression(theFile, arg.Default)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 func (a *AstBuilder) resolveFunctionStatement(theFile file, node ast.Stmt) error {
 	switch stmt := node.(type) {
 	case ast.FuncDefStmt:
+		err := a.resolveParamDefaults(theFile, stmt.Params)
+		if err != nil {
+			return err
+		}
 		for _, bodyAst := range stmt.Body {
 			err := a.resolveFunctionAst(theFile, bodyAst)
 			if err != nil {
 				return err
 			}
 		}
-	case ast.ImportStmt, ast.ReturnStmt, ast.StructDefStmt:
+	case ast.TestDefStmt:
+		for _, bodyAst := range stmt.Body {
+			err := a.resolveFunctionAst(theFile, bodyAst)
+			if err != nil {
+				return err
+			}
+		}
+	case ast.ImportStmt, ast.ReturnStmt, ast.StructDefStmt, ast.ContinueStmt, ast.MacroDefStmt:
 		// Leaf, do nothing
+	case ast.BreakStmt:
+		if stmt.Value != nil {
+			return a.resolveFunctionExpression(theFile, stmt.Value)
+		}
 	case ast.ReturnValueStmt:
 		return a.resolveFunctionExpression(theFile, stmt.Value)
 	case ast.StructFieldDeclarationStmt:
 		return a.resolveFunctionExpression(theFile, stmt.Value)
 	case ast.VarDefStmt:
 		return a.resolveFunctionExpression(theFile, stmt.Value)
+	case ast.AssignStmt:
+		return a.resolveFunctionExpression(theFile, stmt.Value)
 	case ast.WhileStmt:
 		for _, bodyAst := range stmt.Body {
 			err := a.resolveFunctionAst(theFile, bodyAst)
@@ -350,8 +643,8 @@ func AstWithDebugOptions(path string, code string, printTokens bool, printParseT
 	}
 
 	allAsts := []ast.Ast{}
-	for _, fileAst := range builder.fileAsts {
-		allAsts = append(allAsts, fileAst.asts...)
+	for _, filePath := range builder.order {
+		allAsts = append(allAsts, builder.fileAsts[filePath].asts...)
 	}
 
 	return allAsts, nil
@@ -382,30 +675,44 @@ func resolveImportPath(importFilePath, importPath string) (string, bool) {
 }
 
 func createAstForFile(path string, code string, printTokens bool, printParseTree bool) (ast.AstResult, error) {
-	tokens := parser.Tokenise(code)
+	astConstruct := ast.AstConstructor{}
+	astConstruct.New()
+	return createAstWithConstructor(path, code, &astConstruct, printTokens, printParseTree)
+}
+
+func createAstWithConstructor(path string, code string, astConstruct *ast.AstConstructor, printTokens bool, printParseTree bool) (ast.AstResult, error) {
+	if astConstruct.Expander == nil {
+		astConstruct.Expander = NewMacroExpander(path)
+	}
+	tokens, err := parser.Tokenise(code)
 	if printTokens {
 		spew.Dump(tokens)
 	}
+	if err != nil {
+		if ourErr, ok := err.(types.Error); ok {
+			ourErr.File = path
+			return ast.AstResult{}, ourErr
+		}
+		return ast.AstResult{}, err
+	}
 	calcParser := parser.Parser{}
 	calcParser.New(tokens)
 	syntaxTree, err := calcParser.ParseProgram()
 	if err != nil {
 		if ourErr, ok := err.(types.Error); ok {
 			ourErr.File = path
-			return ast.AstResult{}, err
+			return ast.AstResult{}, ourErr
 		}
 		return ast.AstResult{}, err
 	}
 	if printParseTree {
 		fmt.Println(util.ParseTreeToString(syntaxTree))
 	}
-	astConstruct := ast.AstConstructor{}
-	astConstruct.New()
 	astTree, err := astConstruct.CreateAst(syntaxTree)
 	if err != nil {
 		if ourErr, ok := err.(types.Error); ok {
 			ourErr.File = path
-			return ast.AstResult{}, err
+			return ast.AstResult{}, ourErr
 		}
 		return ast.AstResult{}, err
 	}
@@ -0,0 +1,151 @@
+package calc
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/benbanerjeerichards/lisp-calculator/ast"
+	"github.com/benbanerjeerichards/lisp-calculator/vm"
+)
+
+// InterpreterOptions configures an Interpreter. Any stream that is not set uses the process's own
+type InterpreterOptions struct {
+	Stdout io.Writer
+	Stdin  io.Reader
+	// Stderr is where the trace is written
+	Stderr io.Writer
+	// Args are the program arguments, given to main when it takes an argument
+	Args []string
+	// Trace prints every instruction executed along with the resulting stack
+	Trace bool
+	// MaxCallDepth is how many calls can be running at once, or vm.DefaultMaxCallDepth if not set
+	MaxCallDepth int
+}
+
+// Interpreter runs code from a Go program. Everything declared (functions, structs and globals) is kept between
+// calls, so a script can be loaded once and then called into many times.
+// An Interpreter must not be copied after New, or used from more than one goroutine at once
+type Interpreter struct {
+	// Path that code given to Eval is treated as being in, so imports are relative to the working directory
+	path        string
+	builder     AstBuilder
+	constructor ast.AstConstructor
+	compiler    vm.Compiler
+	evalulator  vm.Evalulator
+	builtins    vm.BuiltinRegistry
+}
+
+func (i *Interpreter) New(options InterpreterOptions) {
+	cwd, _ := os.Getwd()
+	i.path = filepath.Join(cwd, "<eval>")
+	i.builtins = vm.BuiltinRegistry{}
+	i.builtins.New()
+	i.builder = AstBuilder{}
+	i.builder.New()
+	i.builder.SetBuiltins(&i.builtins)
+	i.constructor = ast.AstConstructor{}
+	i.constructor.New()
+	i.constructor.AllowFunctionRedeclaration = true
+	i.compiler = vm.Compiler{}
+	i.compiler.New()
+	i.compiler.SetBuiltins(&i.builtins)
+	// Code is evalulated a bit at a time, and main is only run when called
+	i.compiler.Interactive = true
+
+	stdOut := options.Stdout
+	if stdOut == nil {
+		stdOut = os.Stdout
+	}
+	i.evalulator = vm.Evalulator{}
+	i.evalulator.New(options.Args, stdOut)
+	if options.Stdin != nil {
+		i.evalulator.SetStdin(options.Stdin)
+	}
+	if options.Stderr != nil {
+		i.evalulator.SetStderr(options.Stderr)
+	}
+	i.evalulator.SetTrace(options.Trace)
+	if options.MaxCallDepth > 0 {
+		i.evalulator.SetMaxCallDepth(options.MaxCallDepth)
+	}
+}
+
+// Eval runs code, returning the value of the last expression
+func (i *Interpreter) Eval(code string) (val vm.Value, err error) {
+	defer recoverInternalError(&err)
+	asts, err := i.builder.BuildInput(i.path, code, &i.constructor)
+	if err != nil {
+		return vm.Value{}, err
+	}
+	return i.run(i.path, asts)
+}
+
+// EvalFile runs the file at path, along with any files it imports that have not been run yet.
+// The file's main function is not called, but can be with Call
+func (i *Interpreter) EvalFile(path string) (val vm.Value, err error) {
+	defer recoverInternalError(&err)
+	fullPath, err := filepath.Abs(path)
+	if err != nil {
+		return vm.Value{}, err
+	}
+	asts, err := i.builder.LoadFile(fullPath)
+	if err != nil {
+		return vm.Value{}, err
+	}
+	return i.run(fullPath, asts)
+}
+
+func (i *Interpreter) run(path string, asts []ast.Ast) (vm.Value, error) {
+	compileRes, err := i.compiler.CompileProgram(path, asts)
+	if err != nil {
+		return vm.Value{}, err
+	}
+	return i.evalulator.Eval(compileRes)
+}
+
+// Call calls the function declared with defun as name
+func (i *Interpreter) Call(name string, args ...vm.Value) (val vm.Value, err error) {
+	defer recoverInternalError(&err)
+	idx, ok := i.compiler.FunctionMap[name]
+	if !ok {
+		return vm.Value{}, fmt.Errorf("Unknown function %s", name)
+	}
+	return i.evalulator.Call(idx, args)
+}
+
+// RegisterBuiltin adds a function implemented in Go that can be called by code run by this interpreter.
+// Fails if the name is already used by a builtin or a function
+func (i *Interpreter) RegisterBuiltin(builtin vm.Builtin) error {
+	if _, ok := i.compiler.FunctionMap[builtin.Identifier]; ok {
+		return fmt.Errorf("Function %s is already declared", builtin.Identifier)
+	}
+	return i.builtins.Register(builtin)
+}
+
+// SetGlobal sets the global variable name, declaring it if it does not exist
+func (i *Interpreter) SetGlobal(name string, val vm.Value) {
+	i.evalulator.SetGlobal(i.compiler.DeclareGlobal(name), val)
+}
+
+// GetGlobal returns the value of the global variable name, and false if it has not been declared
+func (i *Interpreter) GetGlobal(name string) (vm.Value, bool) {
+	idx, ok := i.compiler.GlobalVariableMap[name]
+	if !ok {
+		return vm.Value{}, false
+	}
+	globals := i.evalulator.Globals()
+	if idx >= len(globals) {
+		// Declared by code that failed to compile
+		return vm.Value{}, false
+	}
+	return globals[idx], true
+}
+
+// recoverInternalError turns a panic caused by a bug in the VM into an error, so it does not take down the host
+func recoverInternalError(err *error) {
+	if rec := recover(); rec != nil {
+		*err = fmt.Errorf("internal error: %v", rec)
+	}
+}
@@ -0,0 +1,164 @@
+package calc
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/benbanerjeerichards/lisp-calculator/ast"
+	"github.com/benbanerjeerichards/lisp-calculator/format"
+	"github.com/benbanerjeerichards/lisp-calculator/parser"
+	"github.com/benbanerjeerichards/lisp-calculator/types"
+	"github.com/benbanerjeerichards/lisp-calculator/vm"
+)
+
+// macroExpander runs the macros declared in a file, which are compiled into a program of their own
+type macroExpander struct {
+	path       string
+	macros     []ast.Ast
+	functions  map[string]int
+	evalulator vm.Evalulator
+}
+
+// NewMacroExpander creates an expander for the macros declared in the file at path
+func NewMacroExpander(path string) ast.MacroExpander {
+	return &macroExpander{path: path, macros: []ast.Ast{}, functions: make(map[string]int)}
+}
+
+func (m *macroExpander) Define(macro ast.FuncDefStmt) error {
+	macro.FilePath = m.path
+	macros := append(append([]ast.Ast{}, m.macros...), ast.Ast{Kind: ast.StmtType, Statement: macro, FilePath: m.path})
+	compiler := vm.Compiler{}
+	compiler.New()
+	// Macros are only called when they are expanded, so there is no main to run
+	compiler.Interactive = true
+	compileRes, err := compiler.CompileProgram(m.path, macros)
+	if err != nil {
+		return err
+	}
+	evalulator := vm.Evalulator{}
+	evalulator.New([]string{}, os.Stdout)
+	_, err = evalulator.Eval(compileRes)
+	if err != nil {
+		return err
+	}
+	m.macros = macros
+	m.functions = compiler.FunctionMap
+	m.evalulator = evalulator
+	return nil
+}
+
+func (m *macroExpander) Copy() ast.MacroExpander {
+	// Define replaces the macros and the evalulator rather than changing them, so they can be shared
+	copied := *m
+	return &copied
+}
+
+func (m *macroExpander) Expand(macro string, args []ast.Datum, callRange types.FileRange) (parser.Node, error) {
+	argValues := make([]vm.Value, len(args))
+	for i, arg := range args {
+		argValues[i] = vm.DatumValue(arg)
+	}
+	result, err := m.evalulator.Call(m.functions[macro], argValues)
+	if err != nil {
+		detail := err.Error()
+		if runtimeErr, ok := err.(vm.RuntimeError); ok {
+			detail = fmt.Sprintf("%s: %s", runtimeErr.KindName(), runtimeErr.Simple)
+		}
+		return parser.Node{}, types.Error{Range: callRange, Simple: fmt.Sprintf("Failed to expand macro %s", macro),
+			Detail: detail}
+	}
+	return macroCode(result, macro, callRange)
+}
+
+// macroCode is the code that a value returned by a macro represents. Code that was passed to the macro keeps its
+// range, and the rest of the code has the range of the macro call
+func macroCode(val vm.Value, macro string, callRange types.FileRange) (parser.Node, error) {
+	nodeRange := callRange
+	if val.Range != nil {
+		nodeRange = *val.Range
+	}
+	atom := func(kind string, data string) parser.Node {
+		return parser.Node{Kind: parser.ExpressionNode, Range: nodeRange,
+			Children: []parser.Node{{Kind: kind, Data: data, Range: nodeRange}}}
+	}
+	switch val.Kind {
+	case vm.NumType:
+		return atom(parser.NumberNode, strconv.FormatFloat(val.Num, 'f', -1, 64)), nil
+	case vm.StringType:
+		return atom(parser.StringNode, val.String), nil
+	case vm.BoolType:
+		return atom(parser.BoolNode, val.ToString()), nil
+	case vm.NullType:
+		return atom(parser.NullNode, ""), nil
+	case vm.SymbolType:
+		return symbolCode(val.String, macro, nodeRange, callRange)
+	case vm.ListType:
+		children := make([]parser.Node, len(val.List))
+		for i, item := range val.List {
+			child, err := macroCode(item, macro, callRange)
+			if err != nil {
+				return parser.Node{}, err
+			}
+			children[i] = child
+		}
+		// A list of a keyword and a struct is a struct accessor (:name person)
+		if len(children) == 2 && len(children[0].Children) == 1 && children[0].Children[0].Kind == parser.KeywordNode {
+			field := children[0].Children[0]
+			return parser.Node{Kind: parser.AccessorOperationNode, Range: nodeRange,
+				Children: []parser.Node{{Kind: parser.LiteralNode, Data: field.Data, Range: field.Range}, children[1]}}, nil
+		}
+		return parser.Node{Kind: parser.ExpressionNode, Children: children, Range: nodeRange}, nil
+	}
+	return parser.Node{}, types.Error{Range: callRange,
+		Simple: fmt.Sprintf("Macro %s expanded to a %s, which is not code", macro, val.Kind)}
+}
+
+// symbolCode is the code of a symbol, which is parsed so that names such as person:name or q.name are the same as
+// if they were written in the code
+func symbolCode(name string, macro string, nodeRange types.FileRange, callRange types.FileRange) (parser.Node, error) {
+	invalidErr := types.Error{Range: callRange,
+		Simple: fmt.Sprintf("Macro %s expanded to the symbol `%s`, which is not a valid name", macro, name)}
+	tokens, err := parser.Tokenise(name)
+	if err != nil {
+		return parser.Node{}, invalidErr
+	}
+	for _, token := range tokens {
+		if token.Kind != parser.TokIdent && token.Kind != parser.TokKeyword && token.Kind != parser.TokDot &&
+			token.Kind != parser.TokColon {
+			return parser.Node{}, invalidErr
+		}
+	}
+	symbolParser := parser.Parser{}
+	symbolParser.New(tokens)
+	program, err := symbolParser.ParseProgram()
+	if err != nil || len(program.Children) != 1 {
+		return parser.Node{}, invalidErr
+	}
+	return withRange(program.Children[0], nodeRange), nil
+}
+
+// withRange sets the range of node, and every node within it, to nodeRange
+func withRange(node parser.Node, nodeRange types.FileRange) parser.Node {
+	node.Range = nodeRange
+	children := make([]parser.Node, len(node.Children))
+	for i, child := range node.Children {
+		children[i] = withRange(child, nodeRange)
+	}
+	node.Children = children
+	return node
+}
+
+// Expand returns the code of the program at path once its macros have been expanded
+func Expand(path string, code string) (string, error) {
+	astResult, err := createAstForFile(path, code, false, false)
+	if err != nil {
+		return "", err
+	}
+	forms := make([]string, len(astResult.Expanded))
+	for i, form := range astResult.Expanded {
+		forms[i] = form.Code()
+	}
+	return format.Source(strings.Join(forms, "\n\n"))
+}
@@ -14,38 +14,27 @@
 
 
 (defun map (items f)
-    (def i 0)
     (def resultList (list))
-    (while (< i (length items))
-        (def resultList (append 
-            (funcall f (nth i items))
-            resultList
-        ))
-        (def i (+ i 1))
+    (foreach (item items)
+        (def resultList (append (funcall f item) resultList))
     )
     (resultList)
 )
 
 (defun filter (items f)
-    (def i 0)
     (def resultList (list))
-    (while (< i (length items))
-        (def val (nth i items))
+    (foreach (val items)
         (if (funcall f val)
             (def resultList (append val resultList))
         )
-        (def i (+ i 1))
     )
     (resultList)
 )
 
 (defun reduce (items initial f)
-    (def i 0)
     (def result (if (= null initial) (nth 0 items) (initial)))
-    (while (< i (length items))
-        (def val (nth i items))
+    (foreach (val items)
         (def result (funcall f result val))
-        (def i (+ i 1))
     )
     (result)
 )
@@ -0,0 +1,323 @@
+package format
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/benbanerjeerichards/lisp-calculator/parser"
+)
+
+const (
+	indentWidth = 4
+	// Lists that would go past this column are split over multiple lines
+	maxLineWidth = 80
+)
+
+const (
+	atomNode = iota
+	listNode
+	commentNode
+)
+
+// node is a simplified syntax tree that, unlike parser.Node, keeps comments and line breaks
+type node struct {
+	kind     int
+	text     string
+	children []node
+	// Number of line breaks between the previous node and this one
+	newlinesBefore int
+	// prefix is the quote prefixes (e.g. ' or ,@) written before a list
+	prefix string
+}
+
+// quotePrefixes are the text of each quote token
+var quotePrefixes = map[string]string{parser.TokQuote: "'", parser.TokQuasiquote: "`", parser.TokUnquote: ",",
+	parser.TokUnquoteSplicing: ",@"}
+
+// headerItems is the number of items after the head of a form that stay on the first line when the form is split
+// Everything else is indented on its own line as the body of the form.
+var headerItems = map[string]int{
+	"defun":     2,
+	"deftest":   1,
+	"def":       2,
+	"set!":      2,
+	"global":    2,
+	"lambda":    1,
+	"let":       1,
+	"let*":      1,
+	"while":     1,
+	"for":       1,
+	"foreach":   1,
+	"catch":     2,
+	"match":     1,
+	"if":        1,
+	"struct":    1,
+	"funcall":   1,
+	"return":    1,
+	"import":    2,
+	"defstruct": -1,
+}
+
+// alwaysSplit are forms where the body is always on separate lines, no matter how short
+var alwaysSplit = map[string]struct{}{
+	"defun":   {},
+	"deftest": {},
+	"while":   {},
+	"for":     {},
+	"foreach": {},
+}
+
+// Source formats code into the canonical layout
+func Source(code string) (string, error) {
+	// Formatting is only done for code that parses, so never have to deal with broken syntax
+	originalTokens, err := parser.Tokenise(code)
+	if err != nil {
+		return "", err
+	}
+	p := parser.Parser{}
+	p.New(originalTokens)
+	_, err = p.ParseProgram()
+	if err != nil {
+		return "", err
+	}
+
+	tokens, err := parser.TokeniseWithTrivia(code)
+	if err != nil {
+		return "", err
+	}
+	index := 0
+	program, err := buildNodes(code, tokens, &index)
+	if err != nil {
+		return "", err
+	}
+
+	printer := printer{}
+	for i, item := range program {
+		if i > 0 {
+			if item.kind == commentNode && item.newlinesBefore == 0 {
+				printer.write(" ")
+			} else {
+				printer.newline(0)
+				if item.newlinesBefore > 1 {
+					printer.newline(0)
+				}
+			}
+		}
+		printer.print(item)
+	}
+	formatted := printer.sb.String()
+	if len(formatted) > 0 {
+		formatted += "\n"
+	}
+
+	formattedTokens, err := parser.Tokenise(formatted)
+	if err != nil || !sameTokens(originalTokens, formattedTokens) {
+		return "", errors.New("formatting would change the meaning of the program")
+	}
+	return formatted, nil
+}
+
+// buildNodes builds the nodes up to the end of the current list (or end of input)
+func buildNodes(code string, tokens []parser.Token, index *int) ([]node, error) {
+	nodes := make([]node, 0)
+	newlines := 0
+	// True if the next atom should be joined onto the previous one (e.g. after a . or :)
+	joinNext := false
+	// Quote prefixes for the next node
+	prefix := ""
+	for *index < len(tokens) {
+		token := tokens[*index]
+		*index += 1
+		switch token.Kind {
+		case parser.TokNewline:
+			newlines += 1
+			continue
+		case parser.TokRBracket:
+			return nodes, nil
+		case parser.TokLBracket:
+			children, err := buildNodes(code, tokens, index)
+			if err != nil {
+				return nodes, err
+			}
+			nodes = append(nodes, node{kind: listNode, children: children, newlinesBefore: newlines, prefix: prefix})
+		case parser.TokQuote, parser.TokQuasiquote, parser.TokUnquote, parser.TokUnquoteSplicing:
+			prefix += quotePrefixes[token.Kind]
+			continue
+		case parser.TokComment:
+			nodes = append(nodes, node{kind: commentNode, text: strings.TrimRight(token.Data, " \t\r"), newlinesBefore: newlines})
+		case parser.TokColon, parser.TokDot:
+			separator := ":"
+			if token.Kind == parser.TokDot {
+				separator = "."
+			}
+			if len(nodes) > 0 && nodes[len(nodes)-1].kind == atomNode {
+				nodes[len(nodes)-1].text += separator
+			} else {
+				nodes = append(nodes, node{kind: atomNode, text: separator, newlinesBefore: newlines})
+			}
+			joinNext = true
+			newlines = 0
+			continue
+		default:
+			text := token.Data
+			if token.Kind == parser.TokString {
+				// Keep the literal exactly as written so escapes are not changed
+				text = code[token.Range.Start.Position:token.Range.End.Position]
+			} else if token.Kind == parser.TokKeyword {
+				text = ":" + token.Data
+			}
+			if joinNext {
+				nodes[len(nodes)-1].text += text
+			} else {
+				nodes = append(nodes, node{kind: atomNode, text: prefix + text, newlinesBefore: newlines})
+			}
+		}
+		joinNext = false
+		newlines = 0
+		prefix = ""
+	}
+	return nodes, nil
+}
+
+func sameTokens(a []parser.Token, b []parser.Token) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Kind != b[i].Kind || a[i].Data != b[i].Data {
+			return false
+		}
+	}
+	return true
+}
+
+func (n node) head() string {
+	if n.kind == listNode && len(n.children) > 0 && n.children[0].kind == atomNode {
+		return n.children[0].text
+	}
+	return ""
+}
+
+// isBlock is true for a list of expressions, such as the multi-expression branch of an if ((def x 1) (x))
+func (n node) isBlock() bool {
+	return n.kind == listNode && len(n.children) > 0 && n.children[0].kind == listNode
+}
+
+func (n node) mustSplit() bool {
+	if n.kind == commentNode {
+		return true
+	}
+	if n.kind != listNode {
+		return false
+	}
+	if _, ok := alwaysSplit[n.head()]; ok {
+		return true
+	}
+	if n.isBlock() && len(n.children) > 1 {
+		return true
+	}
+	for _, child := range n.children {
+		if child.mustSplit() {
+			return true
+		}
+	}
+	return false
+}
+
+// flat is the node printed on a single line
+func (n node) flat() string {
+	if n.kind != listNode {
+		return n.text
+	}
+	parts := make([]string, len(n.children))
+	for i, child := range n.children {
+		parts[i] = child.flat()
+	}
+	return n.prefix + "(" + strings.Join(parts, " ") + ")"
+}
+
+type printer struct {
+	sb  strings.Builder
+	col int
+	// Indentation of the line currently being written
+	lineIndent int
+}
+
+func (p *printer) write(s string) {
+	p.sb.WriteString(s)
+	p.col += len(s)
+}
+
+func (p *printer) newline(indent int) {
+	p.sb.WriteString("\n")
+	p.sb.WriteString(strings.Repeat(" ", indent))
+	p.col = indent
+	p.lineIndent = indent
+}
+
+func (p *printer) print(n node) {
+	if n.kind != listNode {
+		p.write(n.text)
+		return
+	}
+	if !n.mustSplit() {
+		if flat := n.flat(); p.col+len(flat) <= maxLineWidth {
+			p.write(flat)
+			return
+		}
+	}
+	if len(n.children) == 0 {
+		p.write(n.prefix + "()")
+		return
+	}
+
+	p.write(n.prefix)
+	startCol := p.col
+	startIndent := p.lineIndent
+	bodyIndent := startIndent + indentWidth
+	p.write("(")
+	if n.isBlock() {
+		// Expressions in a block are aligned with each other
+		p.printItems(n.children, 0, startCol+1)
+	} else {
+		numHeader := 0
+		if n.children[0].kind == atomNode {
+			numHeader = 1
+			if count, ok := headerItems[n.head()]; ok {
+				numHeader += count
+				if count == -1 {
+					numHeader = len(n.children)
+				}
+			}
+		}
+		p.printItems(n.children, numHeader, bodyIndent)
+	}
+	if n.children[len(n.children)-1].kind == commentNode {
+		p.newline(startIndent)
+	}
+	p.write(")")
+}
+
+// printItems prints the first numHeader items on the current line, and then each remaining item on its own line
+func (p *printer) printItems(items []node, numHeader int, indent int) {
+	for i, item := range items {
+		switch {
+		case i == 0:
+		case item.kind == commentNode && item.newlinesBefore == 0:
+			// Comment at the end of a line stays there
+			p.write(" ")
+		case i < numHeader && items[i-1].kind != commentNode:
+			p.write(" ")
+		default:
+			if item.newlinesBefore > 1 && i >= numHeader {
+				p.sb.WriteString("\n")
+			}
+			p.newline(indent)
+		}
+		if item.kind == commentNode && i < numHeader {
+			// Anything after a comment has to go on the next line
+			numHeader = i
+		}
+		p.print(item)
+	}
+}
@@ -2,12 +2,14 @@ module github.com/benbanerjeerichards/lisp-calculator
 
 go 1.17
 
-require github.com/google/go-cmp v0.5.6
+require (
+	github.com/c-bata/go-prompt v0.2.6
+	github.com/davecgh/go-spew v1.1.1
+	github.com/google/go-cmp v0.5.6
+	github.com/jessevdk/go-flags v1.5.0
+)
 
 require (
-	github.com/c-bata/go-prompt v0.2.6 // indirect
-	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/jessevdk/go-flags v1.5.0 // indirect
 	github.com/mattn/go-colorable v0.1.7 // indirect
 	github.com/mattn/go-isatty v0.0.12 // indirect
 	github.com/mattn/go-runewidth v0.0.9 // indirect
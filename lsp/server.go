@@ -0,0 +1,385 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/benbanerjeerichards/lisp-calculator/calc"
+	"github.com/benbanerjeerichards/lisp-calculator/parser"
+	"github.com/benbanerjeerichards/lisp-calculator/types"
+	"github.com/benbanerjeerichards/lisp-calculator/util"
+	"github.com/benbanerjeerichards/lisp-calculator/vm"
+)
+
+// Server is a language server that communicates using JSON-RPC messages, each preceded by a Content-Length header
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+	// Contents of each open document, keyed by URI
+	documents map[string]string
+	analyses  map[string]calc.Analysis
+	// True once a shutdown request has been recieved
+	isShutdown bool
+}
+
+func (s *Server) New(in io.Reader, out io.Writer) {
+	s.in = bufio.NewReader(in)
+	s.out = out
+	s.documents = make(map[string]string)
+	s.analyses = make(map[string]calc.Analysis)
+	s.isShutdown = false
+}
+
+// Run serves the language server over stdin and stdout until the client exits, returning the exit status
+func Run() int {
+	// Stdout is used for messages, so make sure nothing else can write to it
+	stdout := os.Stdout
+	os.Stdout = os.Stderr
+
+	server := Server{}
+	server.New(os.Stdin, stdout)
+	err := server.Serve()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !server.isShutdown {
+		return 1
+	}
+	return 0
+}
+
+// Serve handles messages until an exit notification is recieved or the input ends
+func (s *Server) Serve() error {
+	for {
+		body, err := s.readMessage()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		req := request{}
+		if err := json.Unmarshal(body, &req); err != nil {
+			return err
+		}
+		if req.Method == "exit" {
+			return nil
+		}
+		result, respErr := s.handle(req)
+		// Notifications have no id and never get a response
+		if req.Id != nil {
+			err := s.write(response{JsonRpc: "2.0", Id: req.Id, Result: result, Error: respErr})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Server) readMessage() ([]byte, error) {
+	contentLength := -1
+	for {
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(line), "content-length:") {
+			contentLength, err = strconv.Atoi(strings.TrimSpace(line[len("content-length:"):]))
+			if err != nil {
+				return nil, fmt.Errorf("invalid Content-Length header: %s", line)
+			}
+		}
+	}
+	if contentLength < 0 {
+		return nil, fmt.Errorf("message has no Content-Length header")
+	}
+	body := make([]byte, contentLength)
+	_, err := io.ReadFull(s.in, body)
+	return body, err
+}
+
+func (s *Server) write(message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	return err
+}
+
+func (s *Server) handle(req request) (interface{}, *responseError) {
+	switch req.Method {
+	case "initialize":
+		return initializeResult{
+			Capabilities: serverCapabilities{
+				TextDocumentSync:   syncFull,
+				DefinitionProvider: true,
+				HoverProvider:      true,
+				CompletionProvider: completionOptions{TriggerCharacters: []string{"(", "."}},
+			},
+			ServerInfo: serverInfo{Name: "lisp-calculator"},
+		}, nil
+	case "shutdown":
+		s.isShutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		params := didOpenParams{}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		s.update(params.TextDocument.Uri, params.TextDocument.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		params := didChangeParams{}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		// Only full document sync is supported, so the last change is the whole document
+		if len(params.ContentChanges) > 0 {
+			s.update(params.TextDocument.Uri, params.ContentChanges[len(params.ContentChanges)-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		params := didCloseParams{}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		delete(s.documents, params.TextDocument.Uri)
+		delete(s.analyses, params.TextDocument.Uri)
+		s.publishDiagnostics(params.TextDocument.Uri, []diagnostic{})
+		return nil, nil
+	case "textDocument/definition":
+		params := textDocumentPositionParams{}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return s.definition(params), nil
+	case "textDocument/hover":
+		params := textDocumentPositionParams{}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return s.hover(params), nil
+	case "textDocument/completion":
+		params := textDocumentPositionParams{}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return nil, invalidParams(err)
+		}
+		return s.completion(params), nil
+	}
+	if req.Id == nil {
+		// Unknown notifications (e.g. initialized, $/cancelRequest) can safely be ignored
+		return nil, nil
+	}
+	return nil, &responseError{Code: errorMethodNotFound, Message: fmt.Sprintf("Method %s not supported", req.Method)}
+}
+
+func invalidParams(err error) *responseError {
+	return &responseError{Code: errorInvalidParams, Message: err.Error()}
+}
+
+// update stores the new contents of a document, analyses it and reports any errors
+func (s *Server) update(uri string, text string) {
+	s.documents[uri] = text
+	path := uriToPath(uri)
+	analysis := calc.Analyse(path, text)
+	s.analyses[uri] = analysis
+
+	diagnostics := []diagnostic{}
+	if analysis.Err != nil {
+		diagnostics = append(diagnostics, errorToDiagnostic(path, analysis.Err))
+	}
+	s.publishDiagnostics(uri, diagnostics)
+}
+
+func (s *Server) publishDiagnostics(uri string, diagnostics []diagnostic) {
+	s.write(notification{JsonRpc: "2.0", Method: "textDocument/publishDiagnostics",
+		Params: publishDiagnosticsParams{Uri: uri, Diagnostics: diagnostics}})
+}
+
+func errorToDiagnostic(path string, err error) diagnostic {
+	diag := diagnostic{Severity: severityError, Source: "lisp-calculator", Message: err.Error()}
+	if astError, ok := err.(types.Error); ok {
+		diag.Message = astError.Simple
+		if len(astError.Detail) > 0 {
+			diag.Message += " (" + astError.Detail + ")"
+		}
+		if len(astError.File) == 0 || astError.File == path {
+			diag.Range = toLspRange(astError.Range)
+		} else {
+			// Error is in an imported file, so can only show it at the top of this one
+			diag.Message = fmt.Sprintf("%s: %s", util.SubHomeDir(astError.File), diag.Message)
+		}
+	}
+	if diag.Range.Start == diag.Range.End {
+		diag.Range.End.Character += 1
+	}
+	return diag
+}
+
+// symbolAt finds the (possibly qualified) identifier at pos in a document
+func (s *Server) symbolAt(uri string, pos position) (string, string, parser.Token, bool) {
+	// Use whatever tokens we can get, even if the rest of the document is broken
+	tokens, _ := parser.Tokenise(s.documents[uri])
+	for i, token := range tokens {
+		if token.Kind != parser.TokIdent || !containsPosition(token.Range, pos) {
+			continue
+		}
+		// Either the name of a qualified function (a.name) or its qualifier
+		if i >= 2 && tokens[i-1].Kind == parser.TokDot && tokens[i-2].Kind == parser.TokIdent {
+			return tokens[i-2].Data, token.Data, token, true
+		}
+		if i+2 < len(tokens) && tokens[i+1].Kind == parser.TokDot && tokens[i+2].Kind == parser.TokIdent {
+			return token.Data, tokens[i+2].Data, tokens[i+2], true
+		}
+		return "", token.Data, token, true
+	}
+	return "", "", parser.Token{}, false
+}
+
+func (s *Server) definition(params textDocumentPositionParams) interface{} {
+	qualifier, identifier, _, ok := s.symbolAt(params.TextDocument.Uri, params.Position)
+	if !ok {
+		return nil
+	}
+	definition, ok := s.analyses[params.TextDocument.Uri].FindFunction(qualifier, identifier)
+	if !ok {
+		return nil
+	}
+	return location{Uri: pathToUri(definition.FilePath), Range: toLspRange(definition.Function.Range)}
+}
+
+func (s *Server) hover(params textDocumentPositionParams) interface{} {
+	qualifier, identifier, token, ok := s.symbolAt(params.TextDocument.Uri, params.Position)
+	if !ok {
+		return nil
+	}
+	if len(qualifier) == 0 {
+		for _, builtin := range vm.Builtins {
+			if builtin.Identifier == identifier {
+				return hover{Range: toLspRange(token.Range), Contents: markupContent{Kind: "markdown",
+					Value: fmt.Sprintf("```lisp\n%s\n```\n\nBuiltin function taking %s arguments", builtinSignature(builtin),
+						builtin.ArityString())}}
+			}
+		}
+	}
+	definition, ok := s.analyses[params.TextDocument.Uri].FindFunction(qualifier, identifier)
+	if !ok {
+		return nil
+	}
+	value := fmt.Sprintf("```lisp\n%s\n```", functionSignature(definition))
+	if doc := s.docComment(params.TextDocument.Uri, definition); len(doc) > 0 {
+		value += "\n\n" + doc
+	}
+	value += fmt.Sprintf("\n\nDefined in `%s`", util.SubHomeDir(definition.FilePath))
+	return hover{Range: toLspRange(token.Range), Contents: markupContent{Kind: "markdown", Value: value}}
+}
+
+// docComment is the block of comments directly above a function declaration
+func (s *Server) docComment(uri string, definition calc.FunctionDefinition) string {
+	code, ok := s.documents[pathToUri(definition.FilePath)]
+	if !ok {
+		var err error
+		code, err = util.ReadFile(definition.FilePath)
+		if err != nil {
+			return ""
+		}
+	}
+	lines := strings.Split(code, "\n")
+	docLines := []string{}
+	for i := definition.Function.Range.Start.Line - 2; i >= 0 && i < len(lines); i-- {
+		line := strings.TrimSpace(lines[i])
+		if !strings.HasPrefix(line, ";") {
+			break
+		}
+		docLines = append([]string{strings.TrimSpace(strings.TrimLeft(line, ";"))}, docLines...)
+	}
+	return strings.Join(docLines, "\n")
+}
+
+func (s *Server) completion(params textDocumentPositionParams) interface{} {
+	items := []completionItem{}
+	for _, builtin := range vm.Builtins {
+		items = append(items, completionItem{Label: builtin.Identifier, Kind: completionKindFunction,
+			Detail: builtinSignature(builtin)})
+	}
+	analysis := s.analyses[params.TextDocument.Uri]
+	for _, definition := range analysis.Functions() {
+		label := definition.Function.Identifier
+		if len(definition.Qualifier) > 0 {
+			label = definition.Qualifier + "." + label
+		}
+		items = append(items, completionItem{Label: label, Kind: completionKindFunction, Detail: functionSignature(definition)})
+	}
+	for _, structDef := range analysis.Structs() {
+		items = append(items, completionItem{Label: structDef.Identifier, Kind: completionKindStruct,
+			Detail: fmt.Sprintf("(defstruct %s %s)", structDef.Identifier, strings.Join(structDef.FieldNames, " "))})
+	}
+	return items
+}
+
+func functionSignature(definition calc.FunctionDefinition) string {
+	return fmt.Sprintf("(defun %s (%s))", definition.Function.Identifier, definition.Function.Params)
+}
+
+// builtinSignature is a call to the builtin with each argument it takes, where optional arguments are in brackets and
+// ... is any number of further arguments
+func builtinSignature(builtin vm.Builtin) string {
+	args := []string{builtin.Identifier}
+	for i := 0; i < builtin.NumArgs; i++ {
+		args = append(args, fmt.Sprintf("arg%d", i+1))
+	}
+	if builtin.MaxArgs == vm.AnyNumberOfArgs {
+		args = append(args, "...")
+	}
+	for i := builtin.NumArgs; i < builtin.MaxArgs; i++ {
+		args = append(args, fmt.Sprintf("[arg%d]", i+1))
+	}
+	return "(" + strings.Join(args, " ") + ")"
+}
+
+// Positions are 1-indexed in FileRange, but 0-indexed in LSP
+func toLspRange(fileRange types.FileRange) lspRange {
+	return lspRange{Start: toLspPosition(fileRange.Start), End: toLspPosition(fileRange.End)}
+}
+
+func toLspPosition(pos types.FilePos) position {
+	lspPos := position{Line: pos.Line - 1, Character: pos.Col - 1}
+	if lspPos.Line < 0 {
+		lspPos.Line = 0
+	}
+	if lspPos.Character < 0 {
+		lspPos.Character = 0
+	}
+	return lspPos
+}
+
+func containsPosition(fileRange types.FileRange, pos position) bool {
+	start := toLspPosition(fileRange.Start)
+	end := toLspPosition(fileRange.End)
+	return start.Line == pos.Line && start.Character <= pos.Character && pos.Character <= end.Character
+}
+
+func uriToPath(uri string) string {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Scheme != "file" {
+		return uri
+	}
+	return filepath.FromSlash(parsed.Path)
+}
+
+func pathToUri(path string) string {
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+}
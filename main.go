@@ -2,22 +2,40 @@ package main
 
 import (
 	"fmt"
+	"io/fs"
+	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/benbanerjeerichards/lisp-calculator/calc"
+	"github.com/benbanerjeerichards/lisp-calculator/format"
+	"github.com/benbanerjeerichards/lisp-calculator/lsp"
+	"github.com/benbanerjeerichards/lisp-calculator/repl"
 	"github.com/benbanerjeerichards/lisp-calculator/test"
+	"github.com/benbanerjeerichards/lisp-calculator/testrunner"
 	"github.com/benbanerjeerichards/lisp-calculator/types"
 	"github.com/benbanerjeerichards/lisp-calculator/util"
+	"github.com/benbanerjeerichards/lisp-calculator/vm"
 	"github.com/jessevdk/go-flags"
 )
 
 var opts struct {
-	Test           bool `short:"t" long:"test" description:"Run tests"`
-	Debug          bool `short:"D" long:"debug" description:"Print out a debug trace of instructions executed by the VM"`
-	PrintTokens    bool `short:"T" long:"tokens" description:"Print out the tokens"`
-	PrintParseTree bool `short:"P" long:"parse-tree" description:"Print out the parse"`
-	PrintAst       bool `short:"A" long:"ast" description:"Print out the AST"`
-	PrintFunctions bool `short:"F" long:"functions" description:"Print out all defined functions"`
+	Test           bool     `short:"t" long:"test" description:"Run tests"`
+	Debug          bool     `short:"D" long:"debug" description:"Print out a debug trace of instructions executed by the VM"`
+	PrintTokens    bool     `short:"T" long:"tokens" description:"Print out the tokens"`
+	PrintParseTree bool     `short:"P" long:"parse-tree" description:"Print out the parse"`
+	PrintAst       bool     `short:"A" long:"ast" description:"Print out the AST"`
+	PrintFunctions bool     `short:"F" long:"functions" description:"Print out all defined functions"`
+	Expand         bool     `long:"expand" description:"Print out the program after macros are expanded, without running it"`
+	Check          bool     `long:"check" description:"fmt: list files that are not formatted and exit with a non-zero status"`
+	Write          bool     `short:"w" long:"write" description:"fmt: write the formatted code back to the file"`
+	Output         string   `short:"o" long:"output" description:"compile: path of the bytecode file to write"`
+	Break          []string `short:"b" long:"break" description:"debug: add a breakpoint at file:line"`
+	Profile        string   `long:"profile" description:"Write a pprof profile of the calls to each function to this file"`
+	Run            string   `long:"run" description:"test: only run tests with names matching this regular expression"`
+	Junit          string   `long:"junit" description:"test: write the results as JUnit XML to this file"`
+	MaxCallDepth   int      `long:"max-call-depth" description:"Maximum number of calls that can be running at once"`
 }
 
 func main() {
@@ -27,8 +45,33 @@ func main() {
 		test.Run()
 		return
 	}
+	if len(args) == 1 && args[0] == "repl" {
+		repl.Run()
+		return
+	}
+	if len(args) == 1 && args[0] == "lsp" {
+		os.Exit(lsp.Run())
+	}
+	if len(args) == 2 && args[0] == "disasm" {
+		os.Exit(disassembleFile(args[1]))
+	}
+	if len(args) == 2 && args[0] == "debug" {
+		os.Exit(debugFile(args[1], opts.Break))
+	}
+	if len(args) == 2 && args[0] == "compile" {
+		os.Exit(compileFile(args[1], opts.Output))
+	}
+	if len(args) >= 2 && args[0] == "run" {
+		os.Exit(runBytecode(args[1], args[1:]))
+	}
+	if len(args) > 0 && args[0] == "test" {
+		os.Exit(runTests(args[1:], opts.Run, opts.Junit))
+	}
+	if len(args) > 0 && args[0] == "fmt" {
+		os.Exit(formatFiles(args[1:]))
+	}
 	if len(args) != 1 {
-		fmt.Println("Provide file path to execute")
+		fmt.Println("Provide file path to execute, repl to start an interactive session, fmt <paths> to format code, disasm <file> to print bytecode, debug <file> [-b file:line] to debug, compile <file> [-o out.lbc] to compile, run <file.lbc> to run compiled bytecode, test <paths> [--run regexp] [--junit out.xml] to run tests or lsp to start the language server")
 		return
 	}
 	file := args[0]
@@ -39,16 +82,254 @@ func main() {
 		fmt.Printf("Failed to open file %s\n", file)
 		return
 	}
-	opts := calc.RunOptions{Debug: opts.Debug, PrintParseTree: opts.PrintParseTree,
-		PrintTokens: opts.PrintTokens, PrintAst: opts.PrintAst, PrintFunctions: opts.PrintFunctions}
-	evalResult, err := calc.ParseAndEval(filePath, fileContents, args, opts)
+	if opts.Expand {
+		expanded, err := calc.Expand(filePath, fileContents)
+		if err != nil {
+			printError(fileContents, err)
+			return
+		}
+		fmt.Print(expanded)
+		return
+	}
+	runOpts := calc.RunOptions{Debug: opts.Debug, PrintParseTree: opts.PrintParseTree,
+		PrintTokens: opts.PrintTokens, PrintAst: opts.PrintAst, PrintFunctions: opts.PrintFunctions,
+		MaxCallDepth: opts.MaxCallDepth}
+	if len(opts.Profile) > 0 {
+		runOpts.Profiler = &vm.Profiler{}
+		runOpts.Profiler.New()
+	}
+	evalResult, err := calc.ParseAndEval(filePath, fileContents, args, runOpts)
+	if runOpts.Profiler != nil {
+		writeProfile(runOpts.Profiler, opts.Profile)
+	}
 	if err != nil {
-		if astError, ok := err.(types.Error); ok {
-			fmt.Println(calc.AnnotateError(fileContents, astError))
-		} else {
+		printError(fileContents, err)
+		return
+	}
+	fmt.Println(evalResult.ToString())
+}
+
+func printError(code string, err error) {
+	if astError, ok := err.(types.Error); ok {
+		fmt.Println(calc.AnnotateError(code, astError))
+	} else {
+		fmt.Println(err)
+	}
+}
+
+// disassembleFile prints the bytecode compiled for a program, returning the exit status
+func disassembleFile(file string) int {
+	filePath, _ := filepath.Abs(file)
+	fileContents, err := util.ReadFile(filePath)
+	if err != nil {
+		fmt.Printf("Failed to open file %s\n", file)
+		return 2
+	}
+	disassembly, err := calc.Disassemble(filePath, fileContents)
+	if err != nil {
+		printError(fileContents, err)
+		return 1
+	}
+	fmt.Print(disassembly)
+	return 0
+}
+
+func writeProfile(profiler *vm.Profiler, path string) {
+	profileFile, err := os.Create(path)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer profileFile.Close()
+	err = profiler.WritePprof(profileFile)
+	if err != nil {
+		fmt.Println(err)
+	}
+}
+
+// debugFile runs a program with the debugger attached, returning the exit status
+func debugFile(file string, breakpointLocations []string) int {
+	breakpoints := []vm.Breakpoint{}
+	for _, location := range breakpointLocations {
+		breakpoint, err := vm.ParseBreakpoint(location)
+		if err != nil {
 			fmt.Println(err)
+			return 2
 		}
-		return
+		breakpoints = append(breakpoints, breakpoint)
+	}
+	filePath, _ := filepath.Abs(file)
+	fileContents, err := util.ReadFile(filePath)
+	if err != nil {
+		fmt.Printf("Failed to open file %s\n", file)
+		return 2
+	}
+	debugger := vm.Debugger{}
+	debugger.New(os.Stdin, os.Stdout, breakpoints)
+	evalResult, err := calc.ParseAndEval(filePath, fileContents, []string{file}, calc.RunOptions{Debugger: &debugger})
+	if err != nil {
+		printError(fileContents, err)
+		return 1
 	}
 	fmt.Println(evalResult.ToString())
+	return 0
+}
+
+// compileFile compiles a program and writes its bytecode to output (by default the file with a .lbc extension)
+func compileFile(file string, output string) int {
+	filePath, _ := filepath.Abs(file)
+	fileContents, err := util.ReadFile(filePath)
+	if err != nil {
+		fmt.Printf("Failed to open file %s\n", file)
+		return 2
+	}
+	compileRes, err := calc.Compile(filePath, fileContents)
+	if err != nil {
+		printError(fileContents, err)
+		return 1
+	}
+	if len(output) == 0 {
+		output = strings.TrimSuffix(file, filepath.Ext(file)) + ".lbc"
+	}
+	outFile, err := os.Create(output)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	defer outFile.Close()
+	err = vm.WriteBytecode(outFile, compileRes)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	return 0
+}
+
+// runBytecode runs a bytecode file written by compile, returning the exit status
+func runBytecode(file string, programArgs []string) int {
+	inFile, err := os.Open(file)
+	if err != nil {
+		fmt.Printf("Failed to open file %s\n", file)
+		return 2
+	}
+	defer inFile.Close()
+	compileRes, err := vm.ReadBytecode(inFile, nil)
+	if err != nil {
+		fmt.Printf("Failed to load %s: %s\n", file, err)
+		return 2
+	}
+	evalResult, err := vm.EvalBytecode(compileRes, programArgs, opts.Debug, os.Stdout)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println(evalResult.ToString())
+	return 0
+}
+
+// runTests runs the tests declared in paths (searching directories), returning the exit status
+func runTests(paths []string, run string, junit string) int {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	var filter *regexp.Regexp
+	if len(run) > 0 {
+		var err error
+		filter, err = regexp.Compile(run)
+		if err != nil {
+			fmt.Printf("Invalid --run expression: %s\n", err)
+			return 2
+		}
+	}
+	files, err := testrunner.FindFiles(paths)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	results := []testrunner.Result{}
+	for _, file := range files {
+		results = append(results, testrunner.RunFile(file, filter, nil)...)
+	}
+	passed := testrunner.PrintResults(os.Stdout, results)
+	if len(junit) > 0 {
+		junitFile, err := os.Create(junit)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		defer junitFile.Close()
+		err = testrunner.WriteJUnit(junitFile, results)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+	if !passed {
+		return 1
+	}
+	return 0
+}
+
+// formatFiles formats every .lisp file in paths (searching directories), returning the exit status
+func formatFiles(paths []string) int {
+	if len(paths) == 0 {
+		fmt.Println("Provide files or directories to format")
+		return 2
+	}
+	files := []string{}
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			// Files given explicitly are always formatted, whatever their extension
+			if !entry.IsDir() && (filePath == path || strings.HasSuffix(filePath, ".lisp")) {
+				files = append(files, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+	}
+
+	status := 0
+	for _, file := range files {
+		code, err := util.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Failed to open file %s\n", file)
+			status = 2
+			continue
+		}
+		formatted, err := format.Source(code)
+		if err != nil {
+			if astError, ok := err.(types.Error); ok {
+				astError.File = file
+				err = astError
+			}
+			printError(code, err)
+			status = 2
+			continue
+		}
+		if opts.Check {
+			if formatted != code {
+				fmt.Println(file)
+				if status == 0 {
+					status = 1
+				}
+			}
+		} else if opts.Write {
+			if formatted != code {
+				err := os.WriteFile(file, []byte(formatted), 0644)
+				if err != nil {
+					fmt.Println(err)
+					status = 2
+				}
+			}
+		} else {
+			fmt.Print(formatted)
+		}
+	}
+	return status
 }
@@ -3,6 +3,7 @@ package parser
 import (
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/benbanerjeerichards/lisp-calculator/types"
 )
@@ -18,6 +19,7 @@ const (
 	ProgramNode           = "ProgramNode"
 	AccessorNode          = "AccessorNode"
 	AccessorOperationNode = "AccessorOperationNode"
+	KeywordNode           = "KeywordNode"
 )
 
 type Parser struct {
@@ -54,6 +56,8 @@ func (node Node) Label() string {
 		return "Accessor"
 	case AccessorOperationNode:
 		return "AccessorExpression"
+	case KeywordNode:
+		return ":" + node.Data
 	default:
 		return node.Kind
 	}
@@ -63,6 +67,46 @@ func (node Node) ChildNodes() []Node {
 	return node.Children
 }
 
+var stringEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\r", "\\r", "\t", "\\t", "\f", "\\f",
+	"\b", "\\b")
+
+// Code is the source code that parses to the node
+func (node Node) Code() string {
+	switch node.Kind {
+	case StringNode:
+		return "\"" + stringEscaper.Replace(node.Data) + "\""
+	case NullNode:
+		return "null"
+	case KeywordNode:
+		return ":" + node.Data
+	case QualifiedLiteralNode:
+		return node.Children[0].Code() + "." + node.Children[1].Code()
+	case AccessorNode:
+		return node.Children[0].Code() + ":" + node.Children[1].Code()
+	case AccessorOperationNode:
+		return "(:" + node.Children[0].Data + " " + node.Children[1].Code() + ")"
+	case ExpressionNode, ProgramNode:
+		if node.Kind == ExpressionNode && len(node.Children) == 1 && node.Children[0].Kind != ExpressionNode &&
+			node.Children[0].Kind != AccessorOperationNode {
+			return node.Children[0].Code()
+		}
+		children := make([]string, len(node.Children))
+		for i, child := range node.Children {
+			children[i] = child.Code()
+		}
+		if node.Kind == ProgramNode {
+			return strings.Join(children, "\n")
+		}
+		// Quotes are written with their prefix
+		if prefix, ok := quoteFormPrefixes[children[0]]; ok && len(children) == 2 {
+			return prefix + children[1]
+		}
+		return "(" + strings.Join(children, " ") + ")"
+	default:
+		return node.Data
+	}
+}
+
 func (p *Parser) New(tokens []Token) {
 	p.currIndex = 0
 	p.tokens = tokens
@@ -136,6 +180,18 @@ func (p *Parser) parseLiteral() (Node, error) {
 	return Node{}, errors.New("not a string")
 }
 
+func (p *Parser) parseKeyword() (Node, error) {
+	token, err := p.currentToken()
+	if err != nil {
+		return Node{}, err
+	}
+	if token.Kind == TokKeyword {
+		p.nextToken()
+		return Node{Kind: KeywordNode, Data: token.Data, Range: token.Range}, nil
+	}
+	return Node{}, errors.New("not a keyword")
+}
+
 func (p *Parser) parseQualifiedLiteral() (Node, error) {
 	startIdx := p.currIndex
 	qualifierNode, err := p.parseLiteral()
@@ -156,7 +212,39 @@ func (p *Parser) parseQualifiedLiteral() (Node, error) {
 	return Node{}, errors.New("not a qualified literal")
 }
 
+// quoteForms are the forms that the quote prefixes are short for
+var quoteForms = map[string]string{TokQuote: "quote", TokQuasiquote: "quasiquote", TokUnquote: "unquote",
+	TokUnquoteSplicing: "unquote-splicing"}
+
+var quoteFormPrefixes = map[string]string{"quote": "'", "quasiquote": "`", "unquote": ",", "unquote-splicing": ",@"}
+
+// parseQuote parses an expression after a quote prefix, as if it was written as (quote <expression>)
+func (p *Parser) parseQuote() (Node, error) {
+	token, err := p.currentToken()
+	form, ok := quoteForms[token.Kind]
+	if err != nil || !ok {
+		return Node{}, errors.New("not a quote")
+	}
+	p.nextToken()
+	if p.isEndOfInput() {
+		return Node{}, types.Error{Range: token.Range, Simple: fmt.Sprintf("Syntax error - %s must be followed by an expression", form)}
+	}
+	quoted, err := p.ParseExpression()
+	if err != nil {
+		return Node{}, err
+	}
+	formNode := Node{Kind: ExpressionNode, Range: token.Range, Children: []Node{{Kind: LiteralNode, Data: form, Range: token.Range}}}
+	quoteRange := types.FileRange{Start: token.Range.Start, End: p.tokens[p.currIndex-1].Range.End}
+	return Node{Kind: ExpressionNode, Children: []Node{formNode, quoted}, Range: quoteRange}, nil
+}
+
 func (p *Parser) ParseExpression() (Node, error) {
+	quoteNode, err := p.parseQuote()
+	if err == nil {
+		return quoteNode, nil
+	} else if _, ok := err.(types.Error); ok {
+		return Node{}, err
+	}
 	numNode, err := p.parserNumber()
 	if err == nil {
 		return Node{Kind: ExpressionNode, Children: []Node{numNode}, Range: numNode.Range}, nil
@@ -165,6 +253,10 @@ func (p *Parser) ParseExpression() (Node, error) {
 	if err == nil {
 		return Node{Kind: ExpressionNode, Children: []Node{strNode}, Range: strNode.Range}, nil
 	}
+	keywordNode, err := p.parseKeyword()
+	if err == nil {
+		return Node{Kind: ExpressionNode, Children: []Node{keywordNode}, Range: keywordNode.Range}, nil
+	}
 
 	// TODO what about struct access on qualified literal? (e.g. qual.st:field)
 	qual, err := p.parseQualifiedLiteral()
@@ -16,11 +16,22 @@ const (
 	TokRBracket = "TokRBracket"
 	TokColon    = "TokColon"
 	TokDot      = "TokDot"
+	// TokKeyword names a keyword argument (:name). Data is the name without the colon
+	TokKeyword = "TokKeyword"
+	// Quote prefixes, which the parser reads as the form they are short for ('x is (quote x))
+	TokQuote           = "TokQuote"
+	TokQuasiquote      = "TokQuasiquote"
+	TokUnquote         = "TokUnquote"
+	TokUnquoteSplicing = "TokUnquoteSplicing"
+	// Trivia tokens are only produced by TokeniseWithTrivia
+	TokComment = "TokComment"
+	TokNewline = "TokNewline"
 )
 
 // Taken from standard library (strings)
 var asciiSpace = [256]uint8{'\t': 1, '\n': 1, '\v': 1, '\f': 1, '\r': 1, ' ': 1}
 var eof uint8 = 0xFF
+var quotePrefixes = map[uint8]string{'\'': TokQuote, '`': TokQuasiquote, ',': TokUnquote}
 var identifierRegex, _ = regexp.Compile(`^[^0-9\s()\:\.][^()\s\:\.]*$`)
 
 type Token struct {
@@ -45,6 +56,8 @@ type Tokeniser struct {
 	index int
 	line  int
 	col   int
+	// keepTrivia is true if comments and newlines should be returned as tokens rather than skipped
+	keepTrivia bool
 }
 
 func (t *Tokeniser) New(input string) {
@@ -60,8 +73,13 @@ func (t Tokeniser) isEOF() bool {
 }
 
 func (t *Tokeniser) nextChar() uint8 {
+	if t.Current() == '\n' {
+		t.line += 1
+		t.col = 1
+	} else {
+		t.col += 1
+	}
 	t.index += 1
-	t.col += 1
 	return t.Current()
 }
 
@@ -69,10 +87,6 @@ func (t *Tokeniser) consumeSpaces() bool {
 	consumed := false
 	for !t.isEOF() && isSpace(t.Current()) {
 		consumed = true
-		if t.Current() == '\n' {
-			t.line += 1
-			t.col = 1
-		}
 		t.nextChar()
 	}
 	return consumed
@@ -99,10 +113,9 @@ func (t Tokeniser) Peek(n int) uint8 {
 }
 
 func (t *Tokeniser) SeekAhead(amount int) {
-	if t.index+amount > len(t.input) {
-		amount = len(t.input) - 1
+	for i := 0; i < amount && !t.isEOF(); i++ {
+		t.nextChar()
 	}
-	t.index += amount
 }
 
 func (t *Tokeniser) consumeWhile(condition func(uint8) bool) (string, types.FileRange) {
@@ -115,46 +128,94 @@ func (t *Tokeniser) consumeWhile(condition func(uint8) bool) (string, types.File
 	return acc, types.FileRange{Start: start, End: t.currentPos()}
 }
 
-func (t *Tokeniser) consumeComment() bool {
+// consumeComment consumes a comment up to (but not including) the end of the line, returning its text
+func (t *Tokeniser) consumeComment() (string, bool) {
 	if t.Current() != ';' {
-		return false
+		return "", false
 	}
+	start := t.index
 	for !t.isEOF() && t.Current() != '\n' {
 		t.nextChar()
 	}
-	return true
+	return t.input[start:t.index], true
 }
 
 func (t *Tokeniser) consumeSpacesAndCommments() {
 	somethingConsumed := true
 	for somethingConsumed {
-		somethingConsumed = false
-		somethingConsumed = somethingConsumed || t.consumeComment()
-		somethingConsumed = somethingConsumed || t.consumeSpaces()
-		somethingConsumed = somethingConsumed || t.consumeComment()
-		somethingConsumed = somethingConsumed || t.consumeSpaces()
+		_, commentConsumed := t.consumeComment()
+		somethingConsumed = commentConsumed || t.consumeSpaces()
 	}
 }
 
-func (t *Tokeniser) nextToken() (Token, bool) {
-	t.consumeSpacesAndCommments()
+// nextTrivia consumes whitespace up to the next newline or comment and returns it as a token
+func (t *Tokeniser) nextTrivia() (Token, bool) {
+	for !t.isEOF() && isSpace(t.Current()) && t.Current() != '\n' {
+		t.nextChar()
+	}
+	start := t.currentPos()
+	if t.Current() == '\n' {
+		t.nextChar()
+		return Token{Kind: TokNewline, Range: types.FileRange{Start: start, End: t.currentPos()}}, true
+	}
+	if comment, ok := t.consumeComment(); ok {
+		return Token{Kind: TokComment, Data: comment, Range: types.FileRange{Start: start, End: t.currentPos()}}, true
+	}
+	return Token{}, false
+}
+
+// peekIdentifier returns the identifier starting offset characters ahead, or false if there is not one there
+func (t Tokeniser) peekIdentifier(offset int) (string, bool) {
+	// Scan all non-whitespace characters and then test using regex
+	var identBuilder strings.Builder
+	for c := t.Peek(offset); !isSpace(c) && c != eof && c != '(' && c != ')' && c != ':' && c != '.'; c = t.Peek(offset) {
+		identBuilder.WriteByte(c)
+		offset += 1
+	}
+	return identBuilder.String(), identifierRegex.MatchString(identBuilder.String())
+}
+
+// nextToken returns the next token, or false if the end of input has been reached
+func (t *Tokeniser) nextToken() (Token, bool, error) {
+	if t.keepTrivia {
+		if trivia, ok := t.nextTrivia(); ok {
+			return trivia, true, nil
+		}
+	} else {
+		t.consumeSpacesAndCommments()
+	}
 	nextChar := t.Current()
 	start := t.currentPos()
 	if nextChar == '(' {
 		t.nextChar()
-		return Token{Kind: TokLBracket, Range: types.FileRange{Start: start, End: t.currentPos()}}, true
+		return Token{Kind: TokLBracket, Range: types.FileRange{Start: start, End: t.currentPos()}}, true, nil
 	}
 	if nextChar == ')' {
 		t.nextChar()
-		return Token{Kind: TokRBracket, Range: types.FileRange{Start: start, End: t.currentPos()}}, true
+		return Token{Kind: TokRBracket, Range: types.FileRange{Start: start, End: t.currentPos()}}, true, nil
 	}
 	if nextChar == ':' {
+		// A colon after whitespace starts a keyword, otherwise it is part of a struct accessor (person:name or (:name person))
+		if t.index == 0 || isSpace(t.input[t.index-1]) {
+			if name, ok := t.peekIdentifier(1); ok {
+				t.SeekAhead(len(name) + 1)
+				return Token{Kind: TokKeyword, Data: name, Range: types.FileRange{Start: start, End: t.currentPos()}}, true, nil
+			}
+		}
 		t.nextChar()
-		return Token{Kind: TokColon, Range: types.FileRange{Start: start, End: t.currentPos()}}, true
+		return Token{Kind: TokColon, Range: types.FileRange{Start: start, End: t.currentPos()}}, true, nil
+	}
+	if kind, ok := quotePrefixes[nextChar]; ok {
+		t.nextChar()
+		if kind == TokUnquote && t.Current() == '@' {
+			kind = TokUnquoteSplicing
+			t.nextChar()
+		}
+		return Token{Kind: kind, Range: types.FileRange{Start: start, End: t.currentPos()}}, true, nil
 	}
 	if nextChar == '.' {
 		t.nextChar()
-		return Token{Kind: TokDot, Range: types.FileRange{Start: start, End: t.currentPos()}}, true
+		return Token{Kind: TokDot, Range: types.FileRange{Start: start, End: t.currentPos()}}, true, nil
 	}
 	// TODO should improve this, probably just use regexp
 	if isDigit(nextChar) || (nextChar == '-' && isDigit(t.Peek(1))) {
@@ -167,14 +228,14 @@ func (t *Tokeniser) nextToken() (Token, bool) {
 		if isNeg {
 			number = "-" + number
 		}
-		return Token{Kind: TokNumber, Data: number, Range: fRange}, true
+		return Token{Kind: TokNumber, Data: number, Range: fRange}, true, nil
 	}
 	if nextChar == '"' {
 		var stringLit strings.Builder
 		nextChar = t.nextChar()
 		for nextChar != '"' {
 			if nextChar == eof {
-				panic("TODO proper error handling") //FIXME
+				return Token{}, false, types.Error{Range: types.FileRange{Start: start, End: t.currentPos()}, Simple: "Unterminated string literal"}
 			}
 			if nextChar == '\\' {
 				switch t.Peek(1) {
@@ -209,48 +270,58 @@ func (t *Tokeniser) nextToken() (Token, bool) {
 			nextChar = t.nextChar()
 		}
 		t.nextChar()
-		return Token{Kind: TokString, Data: stringLit.String(), Range: types.FileRange{Start: start, End: t.currentPos()}}, true
+		return Token{Kind: TokString, Data: stringLit.String(), Range: types.FileRange{Start: start, End: t.currentPos()}}, true, nil
 	}
 
 	// Now attempt to match an identifier
-	// Scan all non-whitespace characters and then test using regex
-	var identBuilder strings.Builder
-	i := 0
-	for !isSpace(nextChar) && nextChar != eof && nextChar != '(' && nextChar != ')' && nextChar != ':' && nextChar != '.' {
-		identBuilder.WriteByte(nextChar)
-		i += 1
-		nextChar = t.Peek(i)
-	}
-	if identifierRegex.MatchString(identBuilder.String()) {
-		t.SeekAhead(i)
-		return Token{Kind: TokIdent, Data: identBuilder.String(),
-			Range: types.FileRange{Start: start, End: t.currentPos()}}, true
+	ident, ok := t.peekIdentifier(0)
+	if ok {
+		t.SeekAhead(len(ident))
+		return Token{Kind: TokIdent, Data: ident, Range: types.FileRange{Start: start, End: t.currentPos()}}, true, nil
 	}
 
 	if t.isEOF() {
-		return Token{}, false
+		return Token{}, false, nil
 	}
 
-	return Token{}, false
+	t.SeekAhead(len(ident))
+	return Token{}, false, types.Error{Range: types.FileRange{Start: start, End: t.currentPos()},
+		Simple: fmt.Sprintf("Invalid token `%s`", ident)}
 }
 
-func (t *Tokeniser) doTokenise() []Token {
+func (t *Tokeniser) doTokenise() ([]Token, error) {
 	tokens := make([]Token, 0)
 	for {
-		token, ok := t.nextToken()
+		token, ok, err := t.nextToken()
+		if err != nil {
+			return tokens, err
+		}
 		if !ok {
-			return tokens
+			return tokens, nil
 		}
 		tokens = append(tokens, token)
 	}
 }
 
-func Tokenise(input string) []Token {
+// Tokenise splits input into tokens. If an error is returned, the tokens up to the error are still returned
+func Tokenise(input string) ([]Token, error) {
+	if len(input) == 0 {
+		return []Token{}, nil
+	}
+	tok := Tokeniser{}
+	tok.New(input)
+	return tok.doTokenise()
+}
+
+// TokeniseWithTrivia tokenises input in the same way as Tokenise, but also includes a TokComment for every comment
+// and a TokNewline for every line break outside of a string. These are needed to reproduce the source (e.g. when formatting)
+func TokeniseWithTrivia(input string) ([]Token, error) {
 	if len(input) == 0 {
-		return []Token{}
+		return []Token{}, nil
 	}
 	tok := Tokeniser{}
 	tok.New(input)
+	tok.keepTrivia = true
 	return tok.doTokenise()
 }
 
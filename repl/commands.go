@@ -0,0 +1,254 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/benbanerjeerichards/lisp-calculator/ast"
+	"github.com/benbanerjeerichards/lisp-calculator/calc"
+	"github.com/benbanerjeerichards/lisp-calculator/parser"
+	"github.com/benbanerjeerichards/lisp-calculator/util"
+	"github.com/benbanerjeerichards/lisp-calculator/vm"
+	"github.com/davecgh/go-spew/spew"
+)
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(r *Repl, arg string) error
+}
+
+// Commands start with a colon so that they can never be confused with code
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: ":help", usage: ":help", description: "Show this help", run: (*Repl).help},
+		{name: ":tokens", usage: ":tokens <code>", description: "Print the tokens of code", run: (*Repl).tokens},
+		{name: ":parse", usage: ":parse <code>", description: "Print the parse tree of code", run: (*Repl).parseTree},
+		{name: ":ast", usage: ":ast <code>", description: "Print the AST of code", run: (*Repl).ast},
+		{name: ":bytecode", usage: ":bytecode <code>", description: "Print the compiled bytecode of code without running it", run: (*Repl).bytecode},
+		{name: ":time", usage: ":time <code>", description: "Run code and print how long it took", run: (*Repl).time},
+		{name: ":load", usage: ":load <path>", description: "Load a file and everything it imports", run: (*Repl).load},
+		{name: ":reload", usage: ":reload", description: "Load every file loaded with :load again", run: (*Repl).reload},
+		{name: ":env", usage: ":env", description: "List all globals, functions and structs", run: (*Repl).env},
+	}
+}
+
+func (r *Repl) runCommand(input string) error {
+	name := input
+	arg := ""
+	if idx := strings.IndexAny(input, " \t\n"); idx != -1 {
+		name = input[:idx]
+		arg = strings.TrimSpace(input[idx:])
+	}
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(r, arg)
+		}
+	}
+	return fmt.Errorf("Unknown command %s - enter :help to see all commands", name)
+}
+
+func (r *Repl) help(string) error {
+	for _, cmd := range commands {
+		fmt.Fprintf(r.out, "%-18s %s\n", cmd.usage, cmd.description)
+	}
+	return nil
+}
+
+func (r *Repl) tokens(code string) error {
+	tokens, err := parser.Tokenise(code)
+	for _, token := range tokens {
+		fmt.Fprintln(r.out, token)
+	}
+	return err
+}
+
+func parse(code string) (parser.Node, error) {
+	tokens, err := parser.Tokenise(code)
+	if err != nil {
+		return parser.Node{}, err
+	}
+	p := parser.Parser{}
+	p.New(tokens)
+	return p.ParseProgram()
+}
+
+func (r *Repl) parseTree(code string) error {
+	tree, err := parse(code)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(r.out, util.ParseTreeToString(tree))
+	return nil
+}
+
+// createAst creates the AST of code without declaring anything in the session, expanding the macros that the session
+// has declared
+func (r *Repl) createAst(code string) ([]ast.Ast, error) {
+	tree, err := parse(code)
+	if err != nil {
+		return []ast.Ast{}, err
+	}
+	constructor := ast.AstConstructor{}
+	constructor.New()
+	for name, macro := range r.constructor.Macros {
+		constructor.Macros[name] = macro
+	}
+	if r.constructor.Expander != nil {
+		constructor.Expander = r.constructor.Expander.Copy()
+	} else {
+		constructor.Expander = calc.NewMacroExpander(r.path)
+	}
+	astResult, err := constructor.CreateAst(tree)
+	if err != nil {
+		return []ast.Ast{}, err
+	}
+	for i := range astResult.Asts {
+		astResult.Asts[i].FilePath = r.path
+	}
+	return astResult.Asts, nil
+}
+
+func (r *Repl) ast(code string) error {
+	asts, err := r.createAst(code)
+	if err != nil {
+		return err
+	}
+	spew.Fdump(r.out, asts)
+	return nil
+}
+
+func (r *Repl) bytecode(code string) error {
+	asts, err := r.createAst(code)
+	if err != nil {
+		return err
+	}
+	// Compile with a copy so that any declarations are thrown away
+	compiler := r.compiler.Copy()
+	compileRes, err := compiler.CompileProgram(r.path, asts)
+	if err != nil {
+		return err
+	}
+	r.printFrame("<input>", &compileRes.Frame, compileRes)
+	for _, anAst := range asts {
+		if funDef, ok := anAst.Statement.(ast.FuncDefStmt); ok && anAst.Kind == ast.StmtType {
+			r.printFrame(funDef.Identifier, compileRes.Functions[compiler.FunctionMap[funDef.Identifier]], compileRes)
+		}
+	}
+	return nil
+}
+
+func (r *Repl) printFrame(name string, frame *vm.Frame, compileRes vm.CompileResult) {
+	fmt.Fprintf(r.out, "%s:\n", name)
+	builtinNames := compileRes.Builtins.Names()
+	for i, instr := range frame.Code {
+		fmt.Fprintf(r.out, "%4d %4d  %s\n", i, frame.LineMap[i], instr.DetailedString(frame, compileRes.FunctionNames, builtinNames))
+	}
+}
+
+func (r *Repl) time(code string) error {
+	start := time.Now()
+	val, err := r.eval(code)
+	elapsed := time.Since(start)
+	if err != nil {
+		return err
+	}
+	r.printValue(val)
+	fmt.Fprintf(r.out, "Took %s\n", elapsed)
+	return nil
+}
+
+func (r *Repl) load(path string) error {
+	if len(path) == 0 {
+		return errors.New("Usage: :load <path>")
+	}
+	fullPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if !util.FileExists(fullPath) {
+		return fmt.Errorf("File %s does not exist", path)
+	}
+	err = r.loadFile(fullPath)
+	if err != nil {
+		return err
+	}
+	for _, loaded := range r.loaded {
+		if loaded == fullPath {
+			return nil
+		}
+	}
+	r.loaded = append(r.loaded, fullPath)
+	return nil
+}
+
+func (r *Repl) reload(string) error {
+	if len(r.loaded) == 0 {
+		return errors.New("No files have been loaded")
+	}
+	for _, path := range r.loaded {
+		err := r.loadFile(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(r.out, "Reloaded %s\n", util.SubHomeDir(path))
+	}
+	return nil
+}
+
+func (r *Repl) loadFile(path string) (err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("internal error: %v", rec)
+		}
+	}()
+	asts, err := r.builder.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	compileRes, err := r.compiler.CompileProgram(path, asts)
+	if err != nil {
+		return err
+	}
+	_, err = r.evalulator.Eval(compileRes)
+	return err
+}
+
+func (r *Repl) env(string) error {
+	globals := r.evalulator.Globals()
+	fmt.Fprintln(r.out, "Globals:")
+	for _, name := range sortedKeys(r.compiler.GlobalVariableMap) {
+		idx := r.compiler.GlobalVariableMap[name]
+		value := vm.Value{}
+		if idx < len(globals) {
+			value = globals[idx]
+		}
+		fmt.Fprintf(r.out, "  %s = %s\n", name, value.ToString())
+	}
+	fmt.Fprintln(r.out, "Functions:")
+	for _, name := range sortedKeys(r.compiler.FunctionMap) {
+		function := r.compiler.Functions[r.compiler.FunctionMap[name]]
+		fmt.Fprintf(r.out, "  %s (%s)\n", name, function.ArgumentString())
+	}
+	fmt.Fprintln(r.out, "Structs:")
+	for _, name := range sortedKeys(r.compiler.StructMap) {
+		fmt.Fprintf(r.out, "  %s (%s)\n", name, strings.Join(r.compiler.Structs[r.compiler.StructMap[name]], " "))
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
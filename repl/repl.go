@@ -0,0 +1,183 @@
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/benbanerjeerichards/lisp-calculator/ast"
+	"github.com/benbanerjeerichards/lisp-calculator/calc"
+	"github.com/benbanerjeerichards/lisp-calculator/types"
+	"github.com/benbanerjeerichards/lisp-calculator/util"
+	"github.com/benbanerjeerichards/lisp-calculator/vm"
+	"github.com/c-bata/go-prompt"
+)
+
+const (
+	prefix             = "> "
+	continuationPrefix = ". "
+)
+
+// Repl holds everything that needs to live between inputs - all declared functions, structs and globals
+// are kept by the ast constructor, compiler and evalulator
+type Repl struct {
+	path        string
+	builder     calc.AstBuilder
+	constructor ast.AstConstructor
+	compiler    vm.Compiler
+	evalulator  vm.Evalulator
+	// Lines entered so far for an expression that has unbalanced brackets
+	pending []string
+	// Files loaded with :load, which are loaded again by :reload
+	loaded []string
+	out    io.Writer
+}
+
+func (r *Repl) New(out io.Writer) {
+	cwd, _ := os.Getwd()
+	// Imports are resolved relative to the directory the REPL is started in
+	r.path = filepath.Join(cwd, "<repl>")
+	r.builder = calc.AstBuilder{}
+	r.builder.New()
+	r.constructor = ast.AstConstructor{}
+	r.constructor.New()
+	r.constructor.AllowFunctionRedeclaration = true
+	r.compiler = vm.Compiler{}
+	r.compiler.New()
+	r.compiler.Interactive = true
+	r.evalulator = vm.Evalulator{}
+	r.evalulator.New([]string{}, out)
+	r.pending = make([]string, 0)
+	r.loaded = make([]string, 0)
+	r.out = out
+}
+
+// Execute handles a single line of input. Nothing is run until all brackets entered so far are balanced
+func (r *Repl) Execute(line string) {
+	r.pending = append(r.pending, line)
+	code := strings.Join(r.pending, "\n")
+	if bracketDepth(code) > 0 {
+		return
+	}
+	r.pending = r.pending[:0]
+	if len(strings.TrimSpace(code)) == 0 {
+		return
+	}
+
+	var err error
+	if strings.HasPrefix(strings.TrimSpace(code), ":") {
+		err = r.runCommand(strings.TrimSpace(code))
+	} else {
+		var val vm.Value
+		val, err = r.eval(code)
+		if err == nil {
+			r.printValue(val)
+		}
+	}
+	if err != nil {
+		r.printError(code, err)
+	}
+}
+
+func (r *Repl) printValue(val vm.Value) {
+	if val.Kind != vm.NullType {
+		fmt.Fprintln(r.out, val.ToString())
+	}
+}
+
+func (r *Repl) printError(code string, err error) {
+	if astError, ok := err.(types.Error); ok {
+		// Errors from loaded files need to be annotated with the file contents
+		if len(astError.File) > 0 && astError.File != r.path {
+			if fileContents, readErr := util.ReadFile(astError.File); readErr == nil {
+				code = fileContents
+			}
+		}
+		fmt.Fprintln(r.out, calc.AnnotateError(code, astError))
+	} else {
+		fmt.Fprintln(r.out, err)
+	}
+}
+
+// Prefix is the prompt to show for the next line of input
+func (r *Repl) Prefix() (string, bool) {
+	if len(r.pending) > 0 {
+		return continuationPrefix, true
+	}
+	return prefix, false
+}
+
+func (r *Repl) eval(code string) (val vm.Value, err error) {
+	// A bug in the VM should not take down the whole session
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("internal error: %v", rec)
+		}
+	}()
+
+	asts, err := r.builder.BuildInput(r.path, code, &r.constructor)
+	if err != nil {
+		return vm.Value{}, err
+	}
+	compileRes, err := r.compiler.CompileProgram(r.path, asts)
+	if err != nil {
+		return vm.Value{}, err
+	}
+	return r.evalulator.Eval(compileRes)
+}
+
+// bracketDepth counts the number of open brackets that have not been closed, ignoring
+// those that are inside strings and comments
+func bracketDepth(code string) int {
+	depth := 0
+	inString := false
+	inComment := false
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		switch {
+		case inComment:
+			if c == '\n' {
+				inComment = false
+			}
+		case inString:
+			if c == '\\' {
+				i += 1
+			} else if c == '"' {
+				inString = false
+			}
+		case c == ';':
+			inComment = true
+		case c == '"':
+			inString = true
+		case c == '(':
+			depth += 1
+		case c == ')':
+			depth -= 1
+		}
+	}
+	return depth
+}
+
+// Run starts an interactive session on stdin/stdout.
+// If stdin is not a terminal (e.g. code piped in) then lines are read without a prompt
+func Run() {
+	r := Repl{}
+	r.New(os.Stdout)
+
+	if stat, err := os.Stdin.Stat(); err == nil && stat.Mode()&os.ModeCharDevice == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			r.Execute(scanner.Text())
+		}
+		return
+	}
+
+	p := prompt.New(r.Execute, func(prompt.Document) []prompt.Suggest { return []prompt.Suggest{} },
+		prompt.OptionPrefix(prefix),
+		prompt.OptionLivePrefix(r.Prefix),
+		prompt.OptionTitle("lisp-calculator"))
+	p.Run()
+}
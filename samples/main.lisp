@@ -18,15 +18,13 @@
 
         (def seenInstructions (append i seenInstructions))
 
-        (if (= instr "nop")
-            (def i (+ i 1)))
-        
-        (if (= instr "jmp")
-            (def i (+ i arg)))
-
-        (if (= instr "acc")
-            ((def acc (+ acc arg))
-            (def i (+ i 1))))
+        (match instr
+            ("nop" (def i (+ i 1)))
+            ("jmp" (def i (+ i arg)))
+            ("acc"
+                (def acc (+ acc arg))
+                (def i (+ i 1)))
+            (_ null))
     )
 
     (finalAcc)
@@ -1,8 +1,7 @@
 (def n 100)
 
 (defun setN (newValue)
-    (def n newValue)
+    (set! n newValue)
 )
 
 (defun getN () n)
-
@@ -0,0 +1,36 @@
+(defstruct tree value left right)
+
+(defun leaf (value) (struct tree (value value) (left null) (right null)))
+
+(defun node (value left right) (struct tree (value value) (left left) (right right)))
+
+; Walks every node, so locals must survive the recursive calls
+(defun treeSum (t)
+    (if (= t null)
+        0
+        (+ (:value t) (+ (treeSum (:left t)) (treeSum (:right t))))))
+
+(defun depth (t)
+    (if (= t null) (return 0))
+    (def leftDepth (depth (:left t)))
+    (def rightDepth (depth (:right t)))
+    (if (> leftDepth rightDepth) (+ leftDepth 1) (+ rightDepth 1)))
+
+(defun fib (n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))
+
+; Divide and conquer sum of l[from:to]
+(defun sumRange (l from to)
+    (if (= (+ from 1) to) (return (nth from l)))
+    (def mid (floor (/ (+ from to) 2)))
+    (def left (sumRange l from mid))
+    (def right (sumRange l mid to))
+    (+ left right))
+
+(def t (node 1 (node 2 (leaf 3) (node 4 (leaf 5) null)) (leaf 6)))
+(print (treeSum t))
+(print ",")
+(print (depth t))
+(print ",")
+(print (fib 15))
+(print ",")
+(print (sumRange (list 1 2 3 4 5 6 7 8 9 10) 0 10))
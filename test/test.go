@@ -1,14 +1,25 @@
 package test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/benbanerjeerichards/lisp-calculator/calc"
+	"github.com/benbanerjeerichards/lisp-calculator/format"
+	"github.com/benbanerjeerichards/lisp-calculator/lsp"
 	"github.com/benbanerjeerichards/lisp-calculator/parser"
+	"github.com/benbanerjeerichards/lisp-calculator/repl"
+	"github.com/benbanerjeerichards/lisp-calculator/testrunner"
+	"github.com/benbanerjeerichards/lisp-calculator/types"
 	"github.com/benbanerjeerichards/lisp-calculator/util"
 	"github.com/benbanerjeerichards/lisp-calculator/vm"
 	"github.com/google/go-cmp/cmp"
@@ -181,11 +192,87 @@ func (r *Runner) ExpectError(code string) bool {
 	return false
 }
 
+// ExpectRuntimeError checks that code fails when run with a RuntimeError containing message, whose stack trace is
+// the lines of each call that was running (innermost first)
+func (r *Runner) ExpectRuntimeError(code string, message string, traceLines []int) bool {
+	compileRes, err := calc.Compile("", code)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	_, err = vm.Eval(compileRes, []string{}, false, io.Discard)
+	runtimeErr, ok := err.(vm.RuntimeError)
+	if !ok {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected a runtime error but got %v\n", code, err)
+		return false
+	}
+	lines := []int{}
+	for _, trace := range runtimeErr.StackTrace {
+		lines = append(lines, trace.LineNumber)
+	}
+	if !strings.Contains(runtimeErr.Simple, message) || fmt.Sprint(lines) != fmt.Sprint(traceLines) {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected runtime error %q with trace %v but got %q with trace %v\n", code,
+			message, traceLines, runtimeErr.Simple, lines)
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectRuntimeErrorKind checks that code fails when run with a RuntimeError of kind, about the argument info
+func (r *Runner) ExpectRuntimeErrorKind(code string, kind string, info vm.ErrorInfo) bool {
+	compileRes, err := calc.Compile("", code)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	_, err = vm.Eval(compileRes, []string{}, false, io.Discard)
+	runtimeErr, ok := err.(vm.RuntimeError)
+	if !ok {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected a runtime error but got %v\n", code, err)
+		return false
+	}
+	if runtimeErr.Kind != kind || runtimeErr.Info != info {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected %s error about %+v but got %s error about %+v\n", code, kind, info,
+			runtimeErr.Kind, runtimeErr.Info)
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectCompileError checks that code fails to build or compile with an error containing message, at line
+func (r *Runner) ExpectCompileError(code string, message string, line int) bool {
+	_, err := calc.Compile("", code)
+	compileErr, ok := err.(types.Error)
+	if !ok {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected a compile error but got %v\n", code, err)
+		return false
+	}
+	if !strings.Contains(compileErr.Simple, message) || compileErr.Range.Start.Line != line {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected compile error %q at line %d but got %q at line %d\n", code, message,
+			line, compileErr.Simple, compileErr.Range.Start.Line)
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
 func (r *Runner) ExpectParseError(code string) bool {
-	tokens := parser.Tokenise(code)
-	p := parser.Parser{}
-	p.New(tokens)
-	_, err := p.ParseProgram()
+	tokens, err := parser.Tokenise(code)
+	if err == nil {
+		p := parser.Parser{}
+		p.New(tokens)
+		_, err = p.ParseProgram()
+	}
 	if err == nil {
 		fmt.Printf("Failed: %s\nReason: Expected Parse error but code parsed successfully\n", code)
 		r.numFailed += 1
@@ -196,7 +283,12 @@ func (r *Runner) ExpectParseError(code string) bool {
 }
 
 func (r *Runner) ExpectTokens(code string, expected []parser.Token) bool {
-	actual := parser.Tokenise(code)
+	actual, err := parser.Tokenise(code)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
 	if len(actual) != len(expected) {
 		r.numFailed += 1
 		printTokensFailed(code, fmt.Sprintf("Expected %d tokens but got %d\n", len(expected), len(actual)), expected, actual)
@@ -215,6 +307,370 @@ func (r *Runner) ExpectTokens(code string, expected []parser.Token) bool {
 	return true
 }
 
+// ExpectReplOutput enters each line into a fresh REPL session, and checks everything written by the session
+func (r *Runner) ExpectReplOutput(lines []string, expected string) bool {
+	var out strings.Builder
+	session := repl.Repl{}
+	session.New(&out)
+	for _, line := range lines {
+		session.Execute(line)
+	}
+	if out.String() != expected {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected REPL output %q but got %q\n", strings.Join(lines, "\n"), expected, out.String())
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectInterpreter runs a host program against a fresh interpreter with input as its stdin, and checks the value
+// it returns along with everything written to stdout
+func (r *Runner) ExpectInterpreter(description string, input string, run func(*calc.Interpreter) (vm.Value, error),
+	expected string, expectedOutput string) bool {
+	var out strings.Builder
+	interpreter := calc.Interpreter{}
+	interpreter.New(calc.InterpreterOptions{Stdout: &out, Stdin: strings.NewReader(input)})
+	val, err := run(&interpreter)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(description, err)
+		return false
+	}
+	if val.ToString() != expected || out.String() != expectedOutput {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected %s with output %q but got %s with output %q\n", description, expected,
+			expectedOutput, val.ToString(), out.String())
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectFormat checks that code is formatted to expected, and that formatting is stable
+func (r *Runner) ExpectFormat(code string, expected string) bool {
+	formatted, err := format.Source(code)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	if formatted != expected {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected formatted code\n%s\nbut got\n%s\n", code, expected, formatted)
+		return false
+	}
+	reformatted, err := format.Source(formatted)
+	if err != nil || reformatted != formatted {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Formatting is not stable, second format gave\n%s\n", code, reformatted)
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectDisassembly checks the disassembly of every frame in a program
+func (r *Runner) ExpectDisassembly(code string, expected string) bool {
+	disassembly, err := calc.Disassemble("", code)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	if disassembly != expected {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected disassembly\n%s\nbut got\n%s\n", code, expected, disassembly)
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectExpansion checks the code of a program once its macros have been expanded
+func (r *Runner) ExpectExpansion(code string, expected string) bool {
+	expanded, err := calc.Expand("", code)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	if expanded != expected {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected expansion\n%s\nbut got\n%s\n", code, expected, expanded)
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectBytecodeOutput compiles code, writes it as bytecode and then runs the loaded bytecode, checking stdout
+func (r *Runner) ExpectBytecodeOutput(code string, expected string) bool {
+	compileRes, err := calc.Compile("", code)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	var buf bytes.Buffer
+	err = vm.WriteBytecode(&buf, compileRes)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	loaded, err := vm.ReadBytecode(&buf, nil)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	var stdOut strings.Builder
+	_, err = vm.EvalBytecode(loaded, []string{}, false, &stdOut)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	if stdOut.String() != expected {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected output %q from bytecode but got %q\n", code, expected, stdOut.String())
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectInvalidBytecode compiles code, changes the result with corrupt and writes it as bytecode, checking that
+// loading the bytecode (or running it, if it loads) fails with an error containing message
+func (r *Runner) ExpectInvalidBytecode(code string, corrupt func(*vm.CompileResult), message string) bool {
+	compileRes, err := calc.Compile("", code)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	corrupt(&compileRes)
+	var buf bytes.Buffer
+	err = vm.WriteBytecode(&buf, compileRes)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	loaded, err := vm.ReadBytecode(&buf, nil)
+	if err == nil {
+		_, err = vm.EvalBytecode(loaded, []string{}, false, io.Discard)
+	}
+	if err == nil || !strings.Contains(err.Error(), message) {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected loading corrupt bytecode to fail with %q but got %v\n", code, message, err)
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectDebugSession runs code with a debugger that is sent commands, checking what the debugger writes.
+// The code is written to a temporary file so that the debugger can show source lines, and $FILE in expected is
+// replaced with its path
+func (r *Runner) ExpectDebugSession(code string, breakpoints []string, commands []string, expected string) bool {
+	dir, err := os.MkdirTemp("", "debug")
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "main.lisp")
+	util.WriteToFile(path, code)
+	expected = strings.ReplaceAll(expected, "$FILE", path)
+
+	parsedBreakpoints := []vm.Breakpoint{}
+	for _, location := range breakpoints {
+		breakpoint, err := vm.ParseBreakpoint(strings.ReplaceAll(location, "$FILE", path))
+		if err != nil {
+			r.numFailed += 1
+			printTestFailedErr(code, err)
+			return false
+		}
+		parsedBreakpoints = append(parsedBreakpoints, breakpoint)
+	}
+	var out strings.Builder
+	debugger := vm.Debugger{}
+	debugger.New(strings.NewReader(strings.Join(commands, "\n")), &out, parsedBreakpoints)
+	asts, err := calc.Ast(path, code)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	compiler := vm.Compiler{}
+	compiler.New()
+	compileRes, err := compiler.CompileProgram(path, asts)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	evalulator := vm.Evalulator{}
+	evalulator.New([]string{}, io.Discard)
+	evalulator.SetDebugger(&debugger)
+	evalulator.Eval(compileRes)
+	if out.String() != expected {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected debugger output\n%s\nbut got\n%s\n", code, expected, out.String())
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectProfile profiles code, checking the calls, exclusive instructions and inclusive instructions of each
+// function (formatted as "name calls instructions inclusive" and sorted by name)
+func (r *Runner) ExpectProfile(code string, expected []string) bool {
+	compileRes, err := calc.Compile("", code)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	profiler := vm.Profiler{}
+	profiler.New()
+	evalulator := vm.Evalulator{}
+	evalulator.New([]string{}, io.Discard)
+	evalulator.SetProfiler(&profiler)
+	_, err = evalulator.Eval(compileRes)
+	if err != nil {
+		r.numFailed += 1
+		printTestFailedErr(code, err)
+		return false
+	}
+	actual := []string{}
+	for _, function := range profiler.Functions() {
+		actual = append(actual, fmt.Sprintf("%s %d %d %d", function.Name, function.Calls, function.Instructions, function.InclusiveInstructions))
+	}
+	sort.Strings(actual)
+	if !cmp.Equal(actual, expected) {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Expected profile %v but got %v\n", code, expected, actual)
+		return false
+	}
+	var buf bytes.Buffer
+	if err := profiler.WritePprof(&buf); err != nil || !bytes.HasPrefix(buf.Bytes(), []byte{0x1f, 0x8b}) {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Failed to write pprof profile %v\n", code, err)
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectTestResults writes files to a temporary directory and runs the tests declared in them with builtins (or the
+// standard builtins if nil). Each result is "name ok", "name FAIL <line>: <message>" with the line that the error
+// occured on, or "name ERROR <message>" if the test was stopped by an internal error
+func (r *Runner) ExpectTestResults(files map[string]string, filter string, builtins *vm.BuiltinRegistry, expected []string) bool {
+	dir, err := os.MkdirTemp("", "lisp-tests")
+	if err != nil {
+		r.numFailed += 1
+		fmt.Printf("Failed: could not create temporary directory: %s\n", err)
+		return false
+	}
+	defer os.RemoveAll(dir)
+	for name, code := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(code), 0644)
+	}
+	var filterRegexp *regexp.Regexp
+	if len(filter) > 0 {
+		filterRegexp = regexp.MustCompile(filter)
+	}
+	testFiles, err := testrunner.FindFiles([]string{dir})
+	if err != nil {
+		r.numFailed += 1
+		fmt.Printf("Failed: %v\nReason: %s\n", files, err)
+		return false
+	}
+	results := []testrunner.Result{}
+	for _, file := range testFiles {
+		results = append(results, testrunner.RunFile(file, filterRegexp, builtins)...)
+	}
+	actual := []string{}
+	numFailed := 0
+	numErrored := 0
+	for _, result := range results {
+		if result.Passed() {
+			actual = append(actual, result.Name+" ok")
+		} else if result.Errored {
+			numErrored += 1
+			actual = append(actual, fmt.Sprintf("%s ERROR %s", result.Name, result.Err))
+		} else if runtimeErr, ok := result.Err.(vm.RuntimeError); ok {
+			numFailed += 1
+			actual = append(actual, fmt.Sprintf("%s FAIL %d: %s", result.Name, runtimeErr.Line, runtimeErr.Simple))
+		} else {
+			numFailed += 1
+			actual = append(actual, fmt.Sprintf("%s FAIL %s", result.Name, result.Err))
+		}
+	}
+	sort.Strings(actual)
+	if !cmp.Equal(actual, expected) {
+		r.numFailed += 1
+		fmt.Printf("Failed: %v\nReason: Expected test results %v but got %v\n", files, expected, actual)
+		return false
+	}
+	var junit bytes.Buffer
+	testrunner.WriteJUnit(&junit, results)
+	if testrunner.PrintResults(io.Discard, results) != (numFailed+numErrored == 0) ||
+		!strings.Contains(junit.String(), fmt.Sprintf(`<testsuites tests="%d" failures="%d" errors="%d"`, len(results), numFailed, numErrored)) {
+		r.numFailed += 1
+		fmt.Printf("Failed: %v\nReason: Incorrect summary or JUnit output %s\n", files, junit.String())
+		return false
+	}
+	r.numPassed += 1
+	return true
+}
+
+// ExpectLspOutput sends each message to a language server, and checks that the server sends each of the expected
+// message bodies in order (other messages may be sent between them)
+func (r *Runner) ExpectLspOutput(messages []string, expected []string) bool {
+	var in strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(message), message)
+	}
+	var out strings.Builder
+	server := lsp.Server{}
+	server.New(strings.NewReader(in.String()), &out)
+	err := server.Serve()
+	if err != nil {
+		r.numFailed += 1
+		fmt.Printf("Failed: %s\nReason: Server failed with %s\n", strings.Join(messages, "\n"), err)
+		return false
+	}
+	output := out.String()
+	for _, body := range expected {
+		i := strings.Index(output, body)
+		if i == -1 {
+			r.numFailed += 1
+			fmt.Printf("Failed: %s\nReason: Expected server to send %s\nOutput was %s\n", strings.Join(messages, "\n"), body, output)
+			return false
+		}
+		output = output[i+len(body):]
+	}
+	r.numPassed += 1
+	return true
+}
+
+func lspOpen(uri string, text string) string {
+	params, _ := json.Marshal(map[string]interface{}{"textDocument": map[string]string{"uri": uri, "text": text}})
+	return fmt.Sprintf(`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":%s}`, params)
+}
+
+func lspRequest(id int, method string, uri string, line int, character int) string {
+	return fmt.Sprintf(`{"jsonrpc":"2.0","id":%d,"method":"%s","params":{"textDocument":{"uri":"%s"},"position":{"line":%d,"character":%d}}}`,
+		id, method, uri, line, character)
+}
+
 func mkToken(kind string, data string) parser.Token {
 	return parser.Token{Kind: kind, Data: data}
 }
@@ -249,6 +705,9 @@ func Run() {
 	r.ExpectTokens(".ab", []parser.Token{mkToken(parser.TokDot, ""), mkToken(parser.TokIdent, "ab")})
 	r.ExpectTokens("ab.", []parser.Token{mkToken(parser.TokIdent, "ab"), mkToken(parser.TokDot, "")})
 
+	r.ExpectTokens("(a) ; comment\n(b)", []parser.Token{mkToken(parser.TokLBracket, ""), mkToken(parser.TokIdent, "a"),
+		mkToken(parser.TokRBracket, ""), mkToken(parser.TokLBracket, ""), mkToken(parser.TokIdent, "b"), mkToken(parser.TokRBracket, "")})
+
 	r.ExpectTokens("(5)", []parser.Token{mkToken(parser.TokLBracket, ""), mkToken(parser.TokNumber, "5"),
 		mkToken(parser.TokRBracket, "")})
 	r.ExpectTokens("(hello", []parser.Token{mkToken(parser.TokLBracket, ""), mkToken(parser.TokIdent, "hello")})
@@ -269,6 +728,8 @@ func Run() {
 	r.ExpectNumber("(+ (+ 10 20) 100)", 130)
 
 	r.ExpectParseError("(34")
+	r.ExpectParseError(`(print "unterminated)`)
+	r.ExpectError(`(print "unterminated)`)
 
 	r.ExpectString(`("Hello World")`, "Hello World")
 
@@ -471,6 +932,7 @@ func Run() {
 	)
 	(f)
 	`, 40)
+	// Variables are captured by reference, so the closure sees the new value
 	r.ExpectNumber(`
 	(defun f () 
 		(def x 10)
@@ -479,13 +941,774 @@ func Run() {
 		(funcall l 30)
 	)
 	(f)
-	`, 40)
+	`, 130)
+	r.ExpectNumber(`
+	(defun makeCounter ()
+		(def n 0)
+		(lambda () (def n (+ n 1)) (return n)))
+	(defun f ()
+		(def a (makeCounter))
+		(def b (makeCounter))
+		(funcall a)
+		(funcall a)
+		(funcall b)
+		(+ (* 10 (funcall a)) (funcall b)))
+	(f)
+	`, 32)
+	r.ExpectNumber(`
+	(defun makeAdder (n) (lambda (x) (+ x n)))
+	(defun f ()
+		(def add1 (makeAdder 1))
+		(def add5 (makeAdder 5))
+		(+ (* 100 (funcall add1 1)) (funcall add5 1)))
+	(f)
+	`, 206)
+	// A mutation by the closure is seen by its creator, and by other closures sharing the variable
+	r.ExpectNumber(`
+	(defun f ()
+		(def total 0)
+		(def add (lambda (x) (def total (+ total x))))
+		(def get (lambda () total))
+		(funcall add 5)
+		(funcall add 7)
+		(+ (* 100 total) (funcall get)))
+	(f)
+	`, 1212)
+	r.ExpectNumber(`
+	(defun f ()
+		(def x 1)
+		(def outer (lambda ()
+			(def inner (lambda () (def x (* x 10))))
+			(funcall inner)))
+		(funcall outer)
+		(funcall outer)
+		(return x))
+	(f)
+	`, 100)
+	// Closures read the current value of globals
 	r.ExpectNumber(`
 	(def x 200)
 	(def f (lambda (l) (+ x l)))
 	(def x 1000)
 	(funcall f 5)
-	`, 205)
+	`, 1005)
+	r.ExpectNumber(`
+	(def count 0)
+	(def increment (lambda () (set! count (+ count 1))))
+	(funcall increment)
+	(funcall increment)
+	(count)
+	`, 2)
+	r.ExpectNumber(`
+	(def count 0)
+	(defun increment (by) (set! count (+ count by)))
+	(defun f () (funcall (lambda () (increment 5))))
+	(f)
+	(f)
+	(count)
+	`, 10)
+	// def always declares a local inside a function
+	r.ExpectNumber(`
+	(def count 0)
+	(defun f () (def count 5))
+	(f)
+	(count)
+	`, 0)
+	// set! assigns to the closest variable, global skips any local with the same name
+	r.ExpectNumber(`
+	(def x 1)
+	(defun f ()
+		(def x 10)
+		(set! x 20)
+		(global x (+ x 100)))
+	(f)
+	(x)
+	`, 120)
+	r.ExpectNumber(`
+	(defun f ()
+		(def x 1)
+		(def g (lambda () (set! x (* x 3))))
+		(funcall g)
+		(funcall g)
+		(return x))
+	(f)
+	`, 9)
+	r.ExpectError("(defun f () (set! y 1))")
+	r.ExpectError("(defun f () (def y 2) (global y 1))")
+	r.ExpectError("(set! 1 2)")
+	r.ExpectError("(global x)")
+
+	// let and let*
+	r.ExpectNumber("(let ((x 1) (y 2)) (+ x y))", 3)
+	r.ExpectNumber("(defun f (a) (let ((x 1) (y (+ a 1))) (def z (+ x y)) (+ z (+ x y))))\n(f 2)", 8)
+	r.ExpectList("(let ((x 1)) (let ((x 2) (y x)) (list x y)))", []vm.Value{{Kind: vm.NumType, Num: 2}, {Kind: vm.NumType, Num: 1}})
+	r.ExpectList("(let ((x 1)) (let* ((x 2) (y x)) (list x y)))", []vm.Value{{Kind: vm.NumType, Num: 2}, {Kind: vm.NumType, Num: 2}})
+	// A shadowed variable is back in scope once the let has ended
+	r.ExpectNumber("(defun f (x) (let ((x 2)) (+ x 1)) (return x))\n(f 1)", 1)
+	r.ExpectCompileError(`(defun f ()
+	(let ((x 1)) (+ x 1))
+	(return x))`, "Variable x is used outside of its scope", 3)
+	r.ExpectCompileError("(defun f () (let* ((x 1)) (+ x 1)) (set! x 2))", "Variable x is used outside of its scope", 1)
+	r.ExpectCompileError("(let ((x 1) (y x)) y)", "Unknown variable x", 1)
+	r.ExpectCompileError("(let ((x 1) (x 2)) x)", "Variable x is bound more than once", 1)
+	r.ExpectCompileError("(let (x 1) x)", "Syntax error - let should take form", 1)
+	// Each time a let is run its variables are new, so closures created in a loop capture different variables
+	r.ExpectList(`
+	(defun f ()
+		(def fs (list))
+		(def i 0)
+		(while (< i 3)
+			(let ((j i)) (def fs (insert (length fs) (lambda () j) fs)))
+			(def i (+ i 1)))
+		(list (funcall (nth 0 fs)) (funcall (nth 2 fs))))
+	(f)`, []vm.Value{{Kind: vm.NumType, Num: 0}, {Kind: vm.NumType, Num: 2}})
+	// Reusing the slot of a variable that a closure captured does not change the closure's variable
+	r.ExpectNumber(`
+	(defun f ()
+		(def g (let ((x 1)) (lambda () x)))
+		(let ((y 2)) (set! y 3))
+		(funcall g))
+	(f)`, 1)
+	r.ExpectNumber("(defun count (n) (let ((m (- n 1))) (if (< m 0) n (count m))))\n(count 1000000)", 0)
+	r.ExpectDisassembly("(defun f () (let ((x 1)) (print x)) (let ((y 2)) (print y)))", `== <root> ==
+code:
+
+== f ==
+constants:
+     0  1
+     1  2
+variables:
+     0  x, y
+code:
+  ; 1: (defun f () (let ((x 1)) (print x)) (let ((y 2)) (print y)))
+       0  LOAD_CONST 0 (1)
+       1  BIND_VAR 0 (x, y)
+       2  LOAD_VAR 0 (x, y)
+       3  CALL_BUILTIN 21 1 (print)
+       4  LOAD_CONST 1 (2)
+       5  BIND_VAR 0 (x, y)
+       6  LOAD_VAR 0 (x, y)
+       7  CALL_BUILTIN 21 1 (print)
+`)
+
+	// &rest arguments, apply and variadic builtins
+	r.ExpectNumber("(+ 1 2 3 4)", 10)
+	r.ExpectNumber("(+)", 0)
+	r.ExpectNumber("(* 2 3 4)", 24)
+	r.ExpectNumber("(*)", 1)
+	r.ExpectBool("(and true true false)", false)
+	r.ExpectBool("(or false false true)", true)
+	r.ExpectBool("(and)", true)
+	r.ExpectString(`(concat "a" 1 "b" true)`, "a1btrue")
+	r.ExpectNumber("(min 3 1 2)", 1)
+	r.ExpectNumber("(max 3 1 2)", 3)
+	r.ExpectNumber("(max 5)", 5)
+	r.ExpectCompileError("(min)", "Expected at least 1 arguments, got 0", 1)
+	r.ExpectCompileError("(- 1 2 3)", "Expected 2 arguments, got 3", 1)
+	r.ExpectRuntimeError("(+ 1 2 \"3\")", "Type error for argument 3 - expected num but got string", []int{})
+	r.ExpectList("(defun f (a &rest xs) (list a xs))\n(f 1 2 3)", []vm.Value{{Kind: vm.NumType, Num: 1},
+		{Kind: vm.ListType, List: []vm.Value{{Kind: vm.NumType, Num: 2}, {Kind: vm.NumType, Num: 3}}}})
+	r.ExpectList("(defun f (a &rest xs) xs)\n(f 1)", []vm.Value{})
+	r.ExpectNumber("(defun count (&rest xs) (length xs))\n(count 1 2 3)", 3)
+	r.ExpectNumber("(funcall (lambda (a &rest xs) (+ a (length xs))) 10 20 30)", 12)
+	r.ExpectNumber("(apply (lambda (a b) (- a b)) (list 5 2))", 3)
+	r.ExpectList("(apply (lambda (&rest xs) xs) (list))", []vm.Value{})
+	r.ExpectRuntimeError("(apply 1 (list))", "Type error for argument 1 of apply - expected closure but got num", []int{})
+	// A variadic function in tail position reuses the activation
+	r.ExpectNumber(`
+	(defun count (n &rest xs) (if (= n 0) (length xs) (count (- n 1) 1 2)))
+	(count 1000000)`, 2)
+	r.ExpectReplOutput([]string{"(lambda (a &rest xs) a)"}, "lambda(a &rest xs)\n")
+	r.ExpectError("(defun f (&rest) 1)")
+	r.ExpectError("(defun f (&rest a b) 1)")
+	r.ExpectError("(lambda (&rest a &rest b) 1)")
+	r.ExpectDisassembly("(defun f (a &rest xs) (concat a xs))\n(defun main () (f 1 2 3))", `== <root> ==
+code:
+       0  CALL_FUNCTION 1 0 (main)
+
+== f ==
+arguments: a &rest xs
+variables:
+     0  a
+     1  xs
+code:
+  ; 1: (defun f (a &rest xs) (concat a xs))
+       0  STORE_VAR 1 (xs)
+       1  STORE_VAR 0 (a)
+       2  LOAD_VAR 0 (a)
+       3  LOAD_VAR 1 (xs)
+       4  CALL_BUILTIN 19 2 (concat)
+
+== main ==
+constants:
+     0  1
+     1  2
+     2  3
+code:
+  ; 2: (defun main () (f 1 2 3))
+       0  LOAD_CONST 0 (1)
+       1  LOAD_CONST 1 (2)
+       2  LOAD_CONST 2 (3)
+       3  CREATE_LIST 2
+       4  TAIL_CALL_FUNCTION 0 2 (f)
+`)
+
+	// &optional and &key arguments
+	rangeFunc := `(defun range (start end &optional (step 1))
+		(def out (list))
+		(while (< start end)
+			(def out (insert (length out) start out))
+			(def start (+ start step)))
+		(return out))
+	`
+	r.ExpectList(rangeFunc+"(range 1 4)", []vm.Value{{Kind: vm.NumType, Num: 1}, {Kind: vm.NumType, Num: 2},
+		{Kind: vm.NumType, Num: 3}})
+	r.ExpectList(rangeFunc+"(range 1 10 4)", []vm.Value{{Kind: vm.NumType, Num: 1}, {Kind: vm.NumType, Num: 5},
+		{Kind: vm.NumType, Num: 9}})
+	r.ExpectNull("(defun f (&optional x) x)\n(f)")
+	// Defaults are evalulated on each call, and can use the arguments before them
+	r.ExpectNumber("(defun f (a &optional (b (* a 2))) (+ a b))\n(f 3)", 9)
+	r.ExpectNumber("(defun f (&optional (xs (list))) (length (insert 0 1 xs)))\n(f)\n(f)", 1)
+	r.ExpectString(`(defun greet (name &key (greeting "Hello") punct) (concat greeting ", " name (if (= punct null) "" punct)))
+	(greet "a" :punct "!" :greeting "Hi")`, "Hi, a!")
+	r.ExpectString(`(defun greet (name &key (greeting "Hello") punct) (concat greeting ", " name (if (= punct null) "" punct)))
+	(greet "a")`, "Hello, a")
+	r.ExpectList("(defun f (a &optional b &key c) (list a b c))\n(f 1 :c 3)", []vm.Value{{Kind: vm.NumType, Num: 1},
+		{Kind: vm.NullType}, {Kind: vm.NumType, Num: 3}})
+	// Keyword arguments are evalulated in the order that they are written
+	r.ExpectReplOutput([]string{`(defun f (&key a b) (list a b))`, `(f :b (print "b") :a (print "a"))`}, "ba(null null)\n")
+	r.ExpectList("(funcall (lambda (a &optional (b 2) &key (c 3)) (list a b c)) 1 :c 4)", []vm.Value{
+		{Kind: vm.NumType, Num: 1}, {Kind: vm.NumType, Num: 2}, {Kind: vm.NumType, Num: 4}})
+	r.ExpectNumber("(apply (lambda (a &optional (b 10)) (+ a b)) (list 1))", 11)
+	r.ExpectNumber("(defun count (n &key (acc 0)) (if (= n 0) acc (count (- n 1) :acc (+ acc 1))))\n(count 1000000)", 1000000)
+	r.ExpectReplOutput([]string{"(lambda (a &optional b &key c) a)"}, "lambda(a &optional b &key c)\n")
+	r.ExpectCompileError(rangeFunc+"(range 1)", "Function range expected 2 to 3 arguments (start end &optional step), got 1", 7)
+	r.ExpectCompileError(rangeFunc+"(range 1 2 3 4)", "Function range expected 2 to 3 arguments (start end &optional step), got 4", 7)
+	r.ExpectCompileError("(defun f (&key a) a)\n(f :b 1)", "Function f has no keyword argument :b", 2)
+	r.ExpectCompileError("(+ 1 :a 2)", "Builtin + does not take keyword arguments", 1)
+	r.ExpectCompileError("(defun f (&key a) a)\n(f :a)", "Keyword argument :a must be followed by a value", 2)
+	r.ExpectCompileError("(defun f (&key a) a)\n(f :a 1 :a 2)", "Keyword argument :a is passed more than once", 2)
+	r.ExpectCompileError("(defun f (a &key b) a)\n(f :b 1 2)", "arguments must come before keyword arguments", 2)
+	r.ExpectCompileError("(print 1)\n:a", "Keyword :a can only be used to pass an argument to a function", 2)
+	r.ExpectCompileError("(defun f (&key a &optional b) a)", "&optional can not follow &key", 1)
+	r.ExpectCompileError("(defun f (&rest a &key b) a)", "&rest and &key can not be used together", 1)
+	r.ExpectCompileError("(defun f (a &optional a) a)", "Argument a is declared more than once", 1)
+	r.ExpectCompileError("(defun f ((a 1)) a)", "Bad function argument - expected identifier", 1)
+	r.ExpectRuntimeError("(funcall (lambda (&key a) a) :b 1)", "Function <lambda> has no keyword argument :b", []int{})
+	r.ExpectRuntimeError("(funcall (lambda (a &optional b) a))", "Function <lambda> expected 1 to 2 arguments (a &optional b), got 0", []int{})
+
+	// Calls with the wrong number of arguments
+	r.ExpectCompileError("(defun add (a b) (+ a b))\n(add 1)", "Function add expected 2 arguments (a b), got 1", 2)
+	r.ExpectCompileError("(defun add (a b) (+ a b))\n(defun main () (print (add 1 2 3)))", "Function add expected 2 arguments (a b), got 3", 2)
+	r.ExpectCompileError("(defun f () 1)\n(f 1)", "Function f expected 0 arguments, got 1", 2)
+	r.ExpectCompileError("(defun f (a &rest xs) a)\n(f)", "Function f expected at least 1 arguments (a &rest xs), got 0", 2)
+	r.ExpectCompileError("(defun main () (later 1))\n(defun later (a b) a)", "Function later expected 2 arguments (a b), got 1", 1)
+	r.ExpectCompileError("(defun max (a b) (if (> a b) a b))\n(max 1 2)", "Function max has the same name as a builtin", 1)
+	r.ExpectCompileError("(print 1)\n(defun throw (x) x)", "Function throw has the same name as a builtin", 2)
+	r.ExpectCompileError("(def add (lambda (a b) (+ a b)))\n(add 1)", "Variable add can not be called - use funcall to call a closure", 2)
+	r.ExpectRuntimeError("(defun g (f) (funcall f 1))\n(g (lambda () 1))", "Function <lambda> expected 0 arguments, got 1", []int{2})
+	r.ExpectRuntimeError("(defun g (f)\n(def x (funcall f 1 2))\n(return x))\n(g (lambda (x) x))", "Function <lambda> expected 1 arguments (x), got 2", []int{4})
+	r.ExpectRuntimeError("(apply (lambda (a b) a) (list 1 2 3))", "Function <lambda> expected 2 arguments (a b), got 3", []int{})
+	// A call compiled before its function was redeclared is checked against the new declaration
+	replPath, _ := filepath.Abs("<repl>")
+	r.ExpectReplOutput([]string{"(defun f (a b) (+ a b))", "(defun g () (f 1 2))", "(defun h () (def x (f 3 4)) (return x))",
+		"(defun f (a) a)", "(g)", "(h)", "(defun f (a b &optional c) (list a b c))", "(g)", "(defun f (&rest xs) xs)", "(h)"},
+		fmt.Sprintf("%[1]s:1: ArityError[E3]: Function f expected 1 arguments (a), got 2 ()\n\tat %[1]s:1\n"+
+			"%[1]s:1: ArityError[E3]: Function f expected 1 arguments (a), got 2 ()\n\tat %[1]s:1\n(1 2 null)\n(3 4)\n", replPath))
+	// A redeclaration that fails to compile leaves the function as it was, and a new function is not declared
+	r.ExpectReplOutput([]string{"(defun f (a) a)", "(defun f (a b) (+ a unknown))", "(f 1 2)", "(f 5)",
+		"(defun g (x) (nope))", "(g 1)", ":env"},
+		fmt.Sprintf("%[1]s:1:21-1:28: Unknown variable unknown ()\n\n%[1]s:1:2-1:8: Function f expected 1 arguments (a), got 2 ()\n\n5\n"+
+			"%[1]s:1:15-1:20: Unknown identifier nope ()\n\n%[1]s:1:2-1:6: Unknown identifier g ()\n\nGlobals:\nFunctions:\n  f (a)\nStructs:\n", replPath))
+	r.ExpectInterpreter("a redeclaration that fails to compile", "", func(i *calc.Interpreter) (vm.Value, error) {
+		if _, err := i.Eval("(defun f (a) (* a 2))"); err != nil {
+			return vm.Value{}, err
+		}
+		if _, err := i.Eval("(defun f (a b) (+ a unknown))"); err == nil {
+			return vm.Value{}, errors.New("expected a compile error")
+		}
+		return i.Eval("(f 5)")
+	}, "10", "")
+	r.ExpectReplOutput([]string{"(defun apply (f xs) xs)", "(apply (lambda (a b) (+ a b)) (list 1 2))", ":env"},
+		fmt.Sprintf("%s:1:2-1:24: Function apply has the same name as a builtin ()\n\n3\nGlobals:\nFunctions:\nStructs:\n",
+			replPath))
+
+	// try, catch, throw and finally
+	r.ExpectString(`(try (+ 1 "a") (catch RuntimeError e e:message))`, "Type error for argument 2 - expected num but got string")
+	r.ExpectNumber("(try 1 (catch error e 2))", 1)
+	r.ExpectString(`(try (throw "bad") (catch string e e:value))`, "bad")
+	r.ExpectString(`(try (throw 1) (catch string e "string") (catch num e "num"))`, "num")
+	r.ExpectString(`(try (throw (list 1)) (catch error e e:kind))`, "list")
+	r.ExpectString(`(try (try (throw 1) (catch string e "inner")) (catch num e "outer"))`, "outer")
+	r.ExpectNumber(`(defstruct my-error code)
+	(defun check (n) (if (> n 2) (throw (struct my-error (code n))) n))
+	(defun safe (n) (try (check n) (catch my-error e (* 100 (:code e:value)))))
+	(+ (safe 1) (safe 5))`, 501)
+	r.ExpectList(`(try (readFile "/does/not/exist") (catch error e (list e:kind e:message e:trace)))`, []vm.Value{
+		{Kind: vm.StringType, String: "IOError"}, {Kind: vm.StringType, String: "Failed to read from file /does/not/exist"},
+		{Kind: vm.ListType, List: []vm.Value{{Kind: vm.StringType, String: ":1"}}}})
+	r.ExpectList("(defun f (n)\n(if (= n 0) (throw \"bottom\") (+ 1 (f (- n 1)))))\n(try (f 2) (catch error e e:trace))", []vm.Value{
+		{Kind: vm.StringType, String: ":2"}, {Kind: vm.StringType, String: ":2"}, {Kind: vm.StringType, String: ":2"},
+		{Kind: vm.StringType, String: ":3"}})
+	// A caught error keeps its kind and trace when it is thrown again
+	r.ExpectList("(defun f () (throw 1))\n(try (try (f) (catch error e (throw e))) (catch num e (list e:value e:trace)))", []vm.Value{
+		{Kind: vm.NumType, Num: 1}, {Kind: vm.ListType, List: []vm.Value{{Kind: vm.StringType, String: ":1"}, {Kind: vm.StringType, String: ":2"}}}})
+	r.ExpectString(`(try (funcall (lambda () (throw "from closure"))) (catch error e e:message))`, "from closure")
+	r.ExpectString(`(try (apply (lambda (x) (throw x)) (list "from apply")) (catch error e e:message))`, "from apply")
+	r.ExpectString(`(try (assert-error (lambda () 1)) (catch error e e:message))`, "Assertion failed")
+	r.ExpectString(`(assert-error (lambda () (try (throw 1) (catch string e 2))))`, "1")
+	r.ExpectString("(defun f (n) (+ 1 (f n)))\n(try (f 1) (catch error e e:message))", "Maximum call depth of 100000 exceeded")
+	r.ExpectReplOutput([]string{`(try (print "body ") (finally (print "finally ")))`}, "body finally ")
+	r.ExpectReplOutput([]string{`(try (throw 1) (catch num e (print "catch ")) (finally (print "finally ")))`}, "catch finally ")
+	r.ExpectReplOutput([]string{`(try (try (throw 1) (finally (print "finally "))) (catch num e (print "catch ")))`}, "finally catch ")
+	r.ExpectReplOutput([]string{`(try (try (throw 1) (catch num e (throw 2)) (finally (print "finally "))) (catch num e e:value))`},
+		"finally 2\n")
+	// Returning from inside a try runs its finally
+	r.ExpectReplOutput([]string{`(defun f () (try (return 1) (finally (print "finally "))) (return 2))`, "(f)"}, "finally 1\n")
+	r.ExpectReplOutput([]string{`(defun f () (try (try (return 1) (finally (print "inner "))) (finally (print "outer "))) (return 2))`, "(f)"},
+		"inner outer 1\n")
+	r.ExpectReplOutput([]string{`(defun f () (try (throw 1) (catch num e (return e:value)) (finally (print "finally "))) (return 2))`, "(f)"},
+		"finally 1\n")
+	// A try that returns does not leave its handler behind
+	r.ExpectString("(defun f () (try (return 1) (catch error e 2)))\n(f)\n(try (throw \"after\") (catch error e e:message))", "after")
+	// Calls in a try are not tail calls, so that the try can catch their errors
+	r.ExpectString("(defun g () (throw \"g\"))\n(defun f () (try (return (g)) (catch error e e:message)))\n(f)", "g")
+	r.ExpectNumber("(defun loop (n) (if (= n 0) (throw n) (loop (- n 1))))\n(try (loop 100000) (catch num e 7))", 7)
+	r.ExpectRuntimeError("(defun f () (throw \"uncaught\"))\n(f)", "uncaught", []int{2})
+	r.ExpectRuntimeError(`(try (throw "other") (catch num e 1))`, "other", []int{})
+	r.ExpectRuntimeError(`(try (throw 1) (finally (print "")))`, "1", []int{})
+	r.ExpectCompileError("(try (throw 1) (catch error e 1))\n(print e)", "Variable e is used outside of its scope", 2)
+	r.ExpectCompileError("(try 1)", "try must have a catch or a finally", 1)
+	r.ExpectCompileError("(try (catch error e 1))", "try must have a body", 1)
+	r.ExpectCompileError("(try 1 (catch e 1))", "catch should take form (catch <kind> <name> <body>)", 1)
+	r.ExpectCompileError("(try 1 (finally 1) (catch error e 1))", "finally must be the last part of try", 1)
+	r.ExpectCompileError("(catch error e 1)", "catch can only be used in try", 1)
+	r.ExpectFormat("(try (read-config path)\n(catch RuntimeError err (print err:message) (default-config)) (finally (close-file path)))",
+		"(try\n    (read-config path)\n    (catch RuntimeError err (print err:message) (default-config))\n    (finally (close-file path)))\n")
+	r.ExpectDisassembly(`(defun f () (try (g) (catch num e e) (finally (print "done"))))
+(defun g () 1)`, `== <root> ==
+code:
+
+== f ==
+constants:
+     0  "done"
+     1  "done"
+names:
+     0  num
+variables:
+     0  e
+code:
+  ; 1: (defun f () (try (g) (catch num e e) (finally (print "done"))))
+       0  PUSH_HANDLER 15 (-> L3)
+       1  PUSH_HANDLER 3 (-> L0)
+       2  CALL_FUNCTION 1 0 (g)
+       3  POP_HANDLER 1
+       4  JUMP 5 (-> L2)
+  L0:
+       5  MATCH_ERROR 3 0 (num -> L1)
+       6  BIND_VAR 0 (e)
+       7  LOAD_VAR 0 (e)
+       8  JUMP 1 (-> L2)
+  L1:
+       9  CALL_BUILTIN 35 1 (throw)
+  L2:
+      10  POP_HANDLER 1
+      11  BIND_VAR 0 (e)
+      12  LOAD_CONST 0 ("done")
+      13  CALL_BUILTIN 21 1 (print)
+      14  LOAD_VAR 0 (e)
+      15  JUMP 5 (-> L4)
+  L3:
+      16  BIND_VAR 0 (e)
+      17  LOAD_CONST 1 ("done")
+      18  CALL_BUILTIN 21 1 (print)
+      19  LOAD_VAR 0 (e)
+      20  CALL_BUILTIN 35 1 (throw)
+  L4:
+
+== g ==
+constants:
+     0  1
+code:
+  ; 2: (defun g () 1)
+       0  LOAD_CONST 0 (1)
+`)
+	// Typed errors
+	r.ExpectRuntimeErrorKind(`(+ 1 "a")`, vm.TypeError, vm.ErrorInfo{Arg: 2, Expected: "num", Actual: "string"})
+	r.ExpectRuntimeErrorKind(`(length 1)`, vm.TypeError, vm.ErrorInfo{Arg: 1, Expected: "list or string", Actual: "num"})
+	r.ExpectRuntimeErrorKind(`(if 1 2 3)`, vm.TypeError, vm.ErrorInfo{Expected: "bool", Actual: "num"})
+	r.ExpectRuntimeErrorKind(`(funcall 1)`, vm.TypeError, vm.ErrorInfo{Expected: "closure", Actual: "num"})
+	r.ExpectRuntimeErrorKind("(def x 1)\n(print x:a)", vm.TypeError, vm.ErrorInfo{Expected: "struct", Actual: "num"})
+	r.ExpectRuntimeErrorKind(`(funcall (lambda (a b) a) 1)`, vm.ArityError, vm.ErrorInfo{Expected: "2", Actual: "1"})
+	r.ExpectRuntimeErrorKind(`(funcall (lambda (a &optional b) a))`, vm.ArityError, vm.ErrorInfo{Expected: "1 to 2", Actual: "0"})
+	r.ExpectRuntimeErrorKind(`(funcall (lambda (&key a) a) :b 1)`, vm.ArityError, vm.ErrorInfo{Actual: ":b"})
+	r.ExpectRuntimeErrorKind(`(nth 1.5 (list 1 2))`, vm.IndexError, vm.ErrorInfo{Arg: 1, Expected: "whole number", Actual: "1.500000"})
+	r.ExpectRuntimeErrorKind(`(readFile "/does/not/exist")`, vm.IOError, vm.ErrorInfo{Arg: 1})
+	r.ExpectRuntimeErrorKind(`(ord "ab")`, vm.ValueError, vm.ErrorInfo{Arg: 1, Expected: "string of length 1", Actual: "string of length 2"})
+	r.ExpectRuntimeErrorKind(`(chr -1)`, vm.ValueError, vm.ErrorInfo{Arg: 1, Expected: "character code", Actual: "-1"})
+	r.ExpectRuntimeErrorKind(`(panic "stop")`, vm.PanicError, vm.ErrorInfo{})
+	r.ExpectRuntimeErrorKind(`(assert (= 1 2))`, vm.AssertionError, vm.ErrorInfo{})
+	r.ExpectRuntimeErrorKind(`(assert-equal 1 2)`, vm.AssertionError, vm.ErrorInfo{Expected: "1", Actual: "2"})
+	r.ExpectRuntimeErrorKind(`(assert-error (lambda () 1))`, vm.AssertionError, vm.ErrorInfo{})
+	r.ExpectRuntimeError(`(chr 1.5)`, "chr expected a character code, got 1.5", []int{})
+	r.ExpectList(`(try (+ 1 "a") (catch TypeError e (list e:kind e:code e:arg e:expected e:actual)))`, []vm.Value{
+		{Kind: vm.StringType, String: "TypeError"}, {Kind: vm.NumType, Num: 2}, {Kind: vm.NumType, Num: 2},
+		{Kind: vm.StringType, String: "num"}, {Kind: vm.StringType, String: "string"}})
+	r.ExpectList(`(try (panic "stop") (catch error e (list e:kind e:code e:arg e:expected)))`, []vm.Value{
+		{Kind: vm.StringType, String: "PanicError"}, {Kind: vm.NumType, Num: 8}, {Kind: vm.NullType}, {Kind: vm.NullType}})
+	r.ExpectString(`(try (panic "stop") (catch AssertionError e "assertion") (catch PanicError e e:message))`, "panic - stop")
+	r.ExpectNumber(`(try (assert false) (catch PanicError e 0) (catch AssertionError e e:code))`, 7)
+	r.ExpectList(`(try (assert-equal (list 1) (list 2)) (catch AssertionError e (list e:message e:expected e:actual)))`, []vm.Value{
+		{Kind: vm.StringType, String: "Assertion failed"}, {Kind: vm.StringType, String: "(1)"}, {Kind: vm.StringType, String: "(2)"}})
+	r.ExpectString(`(try (assert-error (lambda () 1)) (catch AssertionError e e:kind))`, "AssertionError")
+	r.ExpectNull(`(try (throw 1) (catch error e e:code))`)
+	r.ExpectString(`(try (nth 1 5) (catch TypeError e "type") (catch IndexError e "index"))`, "type")
+	r.ExpectString(`(try (nth 1.5 (list 1)) (catch TypeError e "type") (catch IndexError e "index"))`, "index")
+	// A catch of RuntimeError handles errors of every kind raised by the evalulator or a builtin, but not thrown values
+	r.ExpectString(`(try (ord "ab") (catch RuntimeError e e:kind))`, "ValueError")
+	r.ExpectRuntimeError(`(try (throw "thrown") (catch RuntimeError e e:kind))`, "thrown", []int{})
+	r.ExpectRuntimeError(`(try (+ 1 "a") (catch IOError e 1))`, "expected num but got string", []int{})
+	r.ExpectString(`(try (try (length 1) (catch error e (throw e))) (catch TypeError e e:actual))`, "num")
+	r.ExpectString(`(assert-error (lambda () (ord "")))`, "ord expected string of length 1")
+
+	// cond and match
+	r.ExpectString(`(defun sign (n) (cond ((< n 0) "negative") ((= n 0) "zero") (else "positive")))
+	(concat (sign -2) (sign 0) (sign 5))`, "negativezeropositive")
+	r.ExpectNull(`(cond ((= 1 2) 1) (false 2))`)
+	r.ExpectNumber(`(cond (else 2))`, 2)
+	r.ExpectNumber(`(def x 0)
+	(cond (true (def x (+ x 1)) (def x (+ x 1))) (true (def x 100)))
+	(x)`, 2)
+	r.ExpectNumber("(defun count (n acc) (cond ((= n 0) acc) (else (count (- n 1) (+ acc 1)))))\n(count 100000 0)", 100000)
+	r.ExpectRuntimeError(`(cond (1 2))`, "expected type Bool for condition, got num", []int{})
+	r.ExpectCompileError(`(cond)`, "cond must have a clause", 1)
+	r.ExpectCompileError(`(cond (true))`, "cond clause should take form (<test> <body>)", 1)
+	r.ExpectCompileError("(cond\n(else 1)\n(true 2))", "else must be the last clause of cond", 3)
+	r.ExpectString(`(defstruct point x y)
+	(defun describe (v)
+		(match v
+			(0 "zero")
+			("hi" "greeting")
+			(true "yes")
+			(null "nothing")
+			((list) "empty")
+			((list x) (concat "one " x))
+			((list 1 _ z) (concat "three ending " z))
+			((list (list a b) c) (concat "nested " a b c))
+			((struct point (x 0) (y y)) (concat "on the y axis at " y))
+			((struct point) "a point")
+			(n (concat "other " n))))
+	(concat (describe 0) "," (describe "hi") "," (describe true) "," (describe null) "," (describe (list)) ","
+		(describe (list 5)) "," (describe (list 1 2 3)) "," (describe (list (list 1 2) 3)) ","
+		(describe (struct point (x 0) (y 4))) "," (describe (struct point (x 1) (y 4))) "," (describe 7) ","
+		(describe (list 2 2 3)) "," (describe "0") ",")`,
+		"zero,greeting,yes,nothing,empty,one 5,three ending 3,nested 123,on the y axis at 4,a point,other 7,other (2 2 3),other 0,")
+	r.ExpectNumber(`(match (list 1 2) ((list a b) (+ a b)) (else 0))`, 3)
+	r.ExpectNumber(`(match 5 (1 1) (else 2))`, 2)
+	r.ExpectNumber(`(match 5 (_ 2))`, 2)
+	// Variables bound by a pattern are only in scope for its clause, and shadow variables outside of the match
+	r.ExpectNumber(`(def x 1)
+	(def y (match (list 10) ((list x) x)))
+	(+ x y)`, 11)
+	r.ExpectCompileError("(match 1 (x x))\n(print x)", "Variable x is used outside of its scope", 2)
+	r.ExpectCompileError("(defun f (v) (match v ((list a) 1) (_ a)))", "Variable a is used outside of its scope", 1)
+	r.ExpectNumber(`(defun adder (n) (match n (x (lambda (y) (+ x y)))))
+	(funcall (adder 2) 3)`, 5)
+	r.ExpectNumber("(defun count (n acc) (match n (0 acc) (_ (count (- n 1) (+ acc 1)))))\n(count 100000 0)", 100000)
+	r.ExpectRuntimeError("(defun f (v) (match v (1 \"one\")))\n(f 2)", "No clause of match at 1:15-1:33 matched 2", []int{2})
+	r.ExpectRuntimeErrorKind(`(match (list 1) ((list) 0))`, vm.ValueError, vm.ErrorInfo{Actual: "(1)"})
+	r.ExpectString(`(try (match 1 ("1" 1)) (catch ValueError e e:message))`, "No clause of match at 1:7-1:23 matched 1")
+	r.ExpectCompileError(`(match 1 ((list a a) a))`, "Variable a is bound more than once by pattern", 1)
+	r.ExpectCompileError(`(match 1 ((struct point) 1))`, "Use of undeclared struct point", 1)
+	r.ExpectCompileError("(defstruct point x y)\n(match 1 ((struct point (z 1)) 1))", "Struct has no field z", 2)
+	r.ExpectCompileError(`(match 1 ((+ 1 2) 1))`, "a pattern must be a number, string, bool, null, variable, _", 1)
+	r.ExpectCompileError(`(match 1 (else 1) (2 2))`, "else must be the last clause of match", 1)
+	r.ExpectCompileError(`(match 1)`, "match should take form (match <value> (<pattern> <body>)...)", 1)
+	r.ExpectNumber("(defstruct point x y)\n(match (lambda () 1) ((struct point) 1) ((list) 2) (_ 3))", 3)
+	// Testing the type of a value does not need a builtin, so no name is taken from the program
+	r.ExpectString("(defun type-of (x) \"mine\")\n(match (list 1) ((list a) (type-of a)))", "mine")
+	r.ExpectCompileError("(type-of 1)", "Unknown identifier type-of", 1)
+	r.ExpectDisassembly(`(defun f (v) (match v (1 "one") ((list a) a)))`, `== <root> ==
+code:
+
+== f ==
+arguments: v
+constants:
+     0  1
+     1  "one"
+     2  1
+     3  0
+     4  "1:15-1:46"
+names:
+     0  list
+variables:
+     0  v
+     1  
+     2  a
+code:
+  ; 1: (defun f (v) (match v (1 "one") ((list a) a)))
+       0  STORE_VAR 0 (v)
+       1  LOAD_VAR 0 (v)
+       2  BIND_VAR 1
+       3  LOAD_VAR 1
+       4  LOAD_CONST 0 (1)
+       5  CALL_BUILTIN 15 2 (=)
+       6  COND_JUMP_FALSE 2 (-> L0)
+       7  LOAD_CONST 1 ("one")
+       8  JUMP 16 (-> L2)
+  L0:
+       9  LOAD_VAR 1
+      10  IS_TYPE 0 (list)
+      11  COND_JUMP_FALSE 11 (-> L1)
+      12  LOAD_VAR 1
+      13  CALL_BUILTIN 22 1 (length)
+      14  LOAD_CONST 2 (1)
+      15  CALL_BUILTIN 15 2 (=)
+      16  COND_JUMP_FALSE 6 (-> L1)
+      17  LOAD_CONST 3 (0)
+      18  LOAD_VAR 1
+      19  CALL_BUILTIN 28 2 (nth)
+      20  BIND_VAR 2 (a)
+      21  LOAD_VAR 2 (a)
+      22  JUMP 2 (-> L2)
+  L1:
+      23  LOAD_VAR 1
+      24  NO_MATCH 4 ("1:15-1:46")
+  L2:
+`)
+	r.ExpectFormat(`(match (parse line) ((list "jmp" offset) (jump offset)) ((list "acc" n) (add n)) (else (next)))`,
+		"(match (parse line)\n    ((list \"jmp\" offset)\n     (jump offset))\n    ((list \"acc\" n)\n     (add n))\n    (else (next)))\n")
+
+	// for, foreach, break and continue
+	r.ExpectNumber("(def total 0)\n(for (i 0 5) (set! total (+ total i)))\n(total)", 10)
+	r.ExpectList("(def xs (list))\n(for (i 10 0 -3) (set! xs (insert (length xs) i xs)))\n(xs)", []vm.Value{
+		{Kind: vm.NumType, Num: 10}, {Kind: vm.NumType, Num: 7}, {Kind: vm.NumType, Num: 4}, {Kind: vm.NumType, Num: 1}})
+	r.ExpectNumber("(def total 0)\n(for (i 0 1 0.25) (set! total (+ total i)))\n(total)", 1.5)
+	r.ExpectNumber("(def n 0)\n(for (i 0 5 0) (set! n (+ n 1)))\n(for (i 5 0) (set! n (+ n 1)))\n(n)", 0)
+	// The end and step are evaluated once
+	r.ExpectNumber("(def n 0)\n(defun end () (set! n (+ n 1)) (return 3))\n(for (i 0 (end)) (print \"\"))\n(n)", 1)
+	r.ExpectString(`(def s "")
+	(foreach (c "abc") (set! s (concat c s)))
+	(s)`, "cba")
+	r.ExpectNumber("(def total 0)\n(foreach (x (list 1 2 3)) (set! total (+ total x)))\n(total)", 6)
+	r.ExpectNull("(foreach (x (list)) (print x))")
+	r.ExpectNull("(for (i 0 3) (print \"\"))")
+	r.ExpectNumber(`(def total 0)
+	(foreach (x (list 1 2 3 4 5 6))
+		(if (= 0 (mod x 2)) (continue))
+		(if (> x 4) (break))
+		(set! total (+ total x)))
+	(total)`, 4)
+	r.ExpectNumber("(foreach (x (list 3 8 11 14)) (if (> x 10) (break x)))", 11)
+	r.ExpectNumber("(def x (for (i 0 10) (if (= (* i i) 49) (break i))))\n(x)", 7)
+	r.ExpectNumber("(defun first-divisor (n) (for (d 2 n) (if (= 0 (mod n d)) (return d))) (return n))\n(first-divisor 91)", 7)
+	r.ExpectNumber("(def i 0)\n(while true (set! i (+ i 1)) (if (> i 5) (break)))\n(i)", 6)
+	r.ExpectNumber("(def i 0)\n(def odd 0)\n(while (< i 10) (set! i (+ i 1)) (if (= 0 (mod i 2)) (continue)) (set! odd (+ odd 1)))\n(odd)", 5)
+	// break and continue end the innermost loop
+	r.ExpectNumber(`(def n 0)
+	(for (i 0 3) (for (j 0 3) (if (= j 1) (break)) (set! n (+ n 1))))
+	(n)`, 3)
+	// Each iteration has its own variable, so closures capture the value of their iteration
+	r.ExpectList(`(def fs (list))
+	(for (i 0 3) (set! fs (insert (length fs) (lambda () i) fs)))
+	(def vals (list))
+	(foreach (f fs) (set! vals (insert (length vals) (funcall f) vals)))
+	(vals)`, []vm.Value{{Kind: vm.NumType, Num: 0}, {Kind: vm.NumType, Num: 1}, {Kind: vm.NumType, Num: 2}})
+	// Leaving a try with break or continue runs its finally
+	r.ExpectString(`(def s "")
+	(foreach (x (list 1 2 3)) (try (if (= x 2) (continue)) (set! s (concat s "b" x)) (finally (set! s (concat s "f" x)))))
+	(s)`, "b1f1f2b3f3")
+	r.ExpectList(`(def s "")
+	(def v (for (i 0 10) (try (if (= i 2) (break (* i 100))) (finally (set! s (concat s i))))))
+	(list v s)`, []vm.Value{{Kind: vm.NumType, Num: 200}, {Kind: vm.StringType, String: "012"}})
+	r.ExpectString("(try (foreach (x (list 1 2)) (if (= x 2) (throw \"two\"))) (catch error e e:message))", "two")
+	r.ExpectNumber("(try (foreach (x (list 1 2)) (try (break x) (catch error e 0))) (catch error e 5))", 1)
+	// The values of the body are removed, so a loop within a call gives the call only its own value
+	r.ExpectNumber("(+ 1 (for (i 0 5) (+ i 1) (if (= i 2) (continue)) (+ i 2) (if (= i 4) (break i))))", 5)
+	r.ExpectNumber("(+ 1 (foreach (x (list 1 2 3)) (if (= x 2) (break 10))))", 11)
+	r.ExpectList("(list 1 (for (i 0 3) (list 2 (if (= i 1) (continue)) 3)))", []vm.Value{{Kind: vm.NumType, Num: 1}, {Kind: vm.NullType}})
+	r.ExpectNumber("(def i 0)\n(+ 1 (if true (while (< i 10) (set! i (+ i 1)) (+ 100 (if (= i 3) (break 5) 1)))))", 6)
+	r.ExpectNumber("(* 2 (for (i 0 3) (try (+ 1 (if (= i 1) (break 7) 1)) (finally (+ 1 1)))))", 14)
+	// A lambda in the body captures the variables in scope, but not the loop's own slots
+	r.ExpectNumber("(defun g () (+ 100 (foreach (x (list 1 2 3)) (def h (lambda () x)) (if (= x 3) (break 8) (continue)))))\n(g)", 108)
+	r.ExpectList("(defun f () (for (i 0 3) (def h (lambda () i)) (break 5)))\n(list 100 (f))",
+		[]vm.Value{{Kind: vm.NumType, Num: 100}, {Kind: vm.NumType, Num: 5}})
+	r.ExpectNumber("(def fs (list))\n(for (i 0 3) (def fs (insert 0 (lambda () i) fs)) (continue))\n(+ (funcall (nth 0 fs)) (length fs))", 5)
+	r.ExpectCompileError("(for (i 0 3) (print i))\n(print i)", "Variable i is used outside of its scope", 2)
+	r.ExpectCompileError("(print 1)\n(break)", "break can only be used in a loop", 2)
+	r.ExpectCompileError("(continue)", "continue can only be used in a loop", 1)
+	r.ExpectCompileError("(foreach (x (list 1)) (funcall (lambda () (break))))", "break can only be used in a loop", 1)
+	r.ExpectCompileError("(break 1 2)", "bad break: expected either (break) or (break <value>)", 1)
+	r.ExpectCompileError("(for (i 0) (print i))", "for should take form (for (<name> <from> <to> <step>) <body>)", 1)
+	r.ExpectCompileError("(foreach (x) (print x))", "foreach should take form (foreach (<name> <items>) <body>)", 1)
+	r.ExpectRuntimeErrorKind("(foreach (x 5) (print x))", vm.TypeError, vm.ErrorInfo{Arg: 1, Expected: "list or string", Actual: "num"})
+	r.ExpectRuntimeErrorKind(`(for (i 0 "a") (print i))`, vm.TypeError, vm.ErrorInfo{Arg: 2, Expected: "num", Actual: "string"})
+	r.ExpectDisassembly(`(defun f (xs) (foreach (x xs) (if x (continue) (break 1))))`, `== <root> ==
+code:
+
+== f ==
+arguments: xs
+constants:
+     0  0
+     1  1
+     2  1
+variables:
+     0  xs
+     1  
+     2  
+     3  
+     4  x
+code:
+  ; 1: (defun f (xs) (foreach (x xs) (if x (continue) (break 1))))
+       0  STORE_VAR 0 (xs)
+       1  LOAD_VAR 0 (xs)
+       2  BIND_VAR 1
+       3  LOAD_CONST 0 (0)
+       4  BIND_VAR 2
+       5  SAVE_STACK_HEIGHT 3
+  L0:
+       6  LOAD_VAR 2
+       7  LOAD_VAR 1
+       8  CALL_BUILTIN 22 1 (length)
+       9  CALL_BUILTIN 13 2 (<)
+      10  COND_JUMP_FALSE 18 (-> L4)
+      11  LOAD_VAR 2
+      12  LOAD_VAR 1
+      13  CALL_BUILTIN 28 2 (nth)
+      14  BIND_VAR 4 (x)
+      15  LOAD_VAR 4 (x)
+      16  COND_JUMP_FALSE 3 (-> L1)
+      17  RESTORE_STACK_HEIGHT 3 0
+      18  JUMP 5 (-> L3)
+      19  JUMP 3 (-> L2)
+  L1:
+      20  LOAD_CONST 1 (1)
+      21  RESTORE_STACK_HEIGHT 3 1
+      22  JUMP 7 (-> L5)
+  L2:
+      23  POP
+  L3:
+      24  LOAD_VAR 2
+      25  LOAD_CONST 2 (1)
+      26  CALL_BUILTIN 0 2 (+)
+      27  STORE_VAR 2
+      28  JUMP -23 (-> L0)
+  L4:
+      29  STORE_NULL
+  L5:
+`)
+	r.ExpectFormat("(foreach (x xs) (if (= x 1) (break x)) (continue))", "(foreach (x xs)\n    (if (= x 1) (break x))\n    (continue))\n")
+
+	// Quotes and macros
+	r.ExpectTokens("'(a ,b ,@c `d)", []parser.Token{mkToken(parser.TokQuote, ""), mkToken(parser.TokLBracket, ""),
+		mkToken(parser.TokIdent, "a"), mkToken(parser.TokUnquote, ""), mkToken(parser.TokIdent, "b"),
+		mkToken(parser.TokUnquoteSplicing, ""), mkToken(parser.TokIdent, "c"), mkToken(parser.TokQuasiquote, ""),
+		mkToken(parser.TokIdent, "d"), mkToken(parser.TokRBracket, "")})
+	r.ExpectTokens("don't", []parser.Token{mkToken(parser.TokIdent, "don't")})
+	r.ExpectParseError("(list ')")
+	r.ExpectNumber(`(match 'x ((list) 1) ("x" 2) (_ 3))`, 3)
+	r.ExpectBool("(= 'x (quote x))", true)
+	r.ExpectBool("(= 'x 'y)", false)
+	r.ExpectBool(`(= 'x "x")`, false)
+	r.ExpectList(`'(1 "a" true null)`, []vm.Value{{Kind: vm.NumType, Num: 1}, {Kind: vm.StringType, String: "a"},
+		{Kind: vm.BoolType, Bool: true}, {Kind: vm.NullType}})
+	r.ExpectNumber("(length '(+ (* 2 3) x))", 3)
+	r.ExpectBytecodeOutput(`(print '(f :k p:name q.g (:name p) "s" 1.5 ()))`, `(f :k p:name q.g (:name p) "s" 1.500000 ())`)
+	r.ExpectBytecodeOutput("(def x 2)\n(def xs (list 3 4))\n(print `(a ,x ,@xs (b ,(+ x 1)) ,@xs))", "(a 2 3 4 (b 3) 3 4)")
+	r.ExpectBytecodeOutput("(def x 2)\n(print `(a `(b ,(c ,x))))", "(a (quasiquote (b (unquote (c 2)))))")
+	r.ExpectBytecodeOutput("(print '(a ,b))", "(a (unquote b))")
+	r.ExpectList("(def xs (list))\n`(,@xs)", []vm.Value{})
+	r.ExpectList("(defun concat-lists (xs) xs)\n`(0 ,@(concat-lists (list 1 2)) ,@(list) 3)", []vm.Value{{Kind: vm.NumType, Num: 0},
+		{Kind: vm.NumType, Num: 1}, {Kind: vm.NumType, Num: 2}, {Kind: vm.NumType, Num: 3}})
+	r.ExpectRuntimeErrorKind("(def x 1)\n`(a ,@x)", vm.TypeError, vm.ErrorInfo{Arg: 2, Expected: "list", Actual: "num"})
+	r.ExpectCompileError("(print 1)\n(print ,x)", "unquote can only be used in a quasiquote", 2)
+	r.ExpectCompileError("`,@x", "unquote-splicing can only be used in a list", 1)
+	r.ExpectCompileError("(quote a b)", "quote should take form (quote <code>)", 1)
+	r.ExpectNumber(`(defmacro unless (test &rest body)
+		`+"`"+`(if (not ,test) (,@body)))
+	(def n 0)
+	(unless (> n 5) (set! n (+ n 1)) (set! n (* n 10)))
+	(n)`, 10)
+	r.ExpectList(`(defmacro swap! (a b)
+		`+"`"+`(let ((tmp ,a)) (set! ,a ,b) (set! ,b tmp)))
+	(def x 1)
+	(def y 2)
+	(swap! x y)
+	(list x y)`, []vm.Value{{Kind: vm.NumType, Num: 2}, {Kind: vm.NumType, Num: 1}})
+	// Macros can build code with any builtin, use macros declared before them and expand to statements
+	r.ExpectNumber(`(defmacro infix (expr) (list (nth 1 expr) (nth 0 expr) (nth 2 expr)))
+	(defmacro square (x) `+"`"+`(infix (,x * ,x)))
+	(defmacro defconst (name value) `+"`"+`(def ,name ,value))
+	(defconst nine (square 3))
+	(defun f () (return (infix (nine - 2))))
+	(f)`, 7)
+	r.ExpectNumber("(defmacro five () 5)\n(five)", 5)
+	r.ExpectNumber("(defstruct point x y)\n(defmacro get-x (p) `(:x ,p))\n(get-x (struct point (x 3)))", 3)
+	// Errors in expanded code point at the code passed to the macro, or otherwise at the macro call
+	r.ExpectCompileError(`(defmacro swap! (a b)
+		`+"`"+`(let ((tmp ,a)) (set! ,a ,b) (set! ,b tmp)))
+	(def x 1)
+
+	(swap! x
+		y)`, "Unknown variable y", 6)
+	r.ExpectCompileError("(defmacro call-f () `(f 1))\n(print 1)\n(call-f)", "Unknown identifier f", 3)
+	r.ExpectRuntimeError("(defun g (x) (+ x 1))\n(defmacro call-g (a) `(g ,a))\n(defun f (x)\n\t(call-g x)\n\t(return 1))\n(f \"a\")",
+		"Type error", []int{4, 6})
+	r.ExpectCompileError("(defmacro m (x) (+ x 1))\n(m a)", "Failed to expand macro m", 2)
+	r.ExpectCompileError("(defmacro m (x) x)\n(print 1)\n(m 1 2)", "Failed to expand macro m", 3)
+	r.ExpectCompileError("(defmacro m () (lambda () 1))\n(m)", "Macro m expanded to a closure, which is not code", 2)
+	r.ExpectCompileError("(defmacro m (x) `(+ ,x (m ,x)))\n(m 1)", "Expansion of macro m is nested too deeply", 2)
+	r.ExpectCompileError("(defmacro m (x) x)\n(defmacro m (x) x)", "Duplicate declaration of macro m", 2)
+	r.ExpectCompileError("(defun f () (defmacro m (x) x))", "macros can only be declared at top level", 1)
+	r.ExpectCompileError("(defmacro m)", "macro declaration should take form (defmacro <name> <args> <body>)", 1)
+	r.ExpectExpansion(`(defmacro unless (test &rest body)
+    `+"`"+`(if (not ,test) (,@body)))
+(defun f (x) (unless (> x 1) (print "small") (print 'x)))
+(f 0)`, `(defun f (x)
+    (if (not (> x 1))
+        ((print "small")
+         (print 'x))))
+
+(f 0)
+`)
+	r.ExpectFormat("(print   '(a  ,b ,@ (c)))\n`x", "(print '(a ,b ,@(c)))\n`x\n")
+	r.ExpectReplOutput([]string{"(defmacro twice (x) `(list ,x ,x))", "(twice (+ 1 2))", "(twice 'a)"}, "(3 3)\n(a a)\n")
+	// Commands expand the macros declared in the session, but do not declare any
+	r.ExpectReplOutput([]string{"(defmacro twice (x) `(list ,x ,x))", ":bytecode (twice 1)", ":bytecode (defmacro one () 1)", "(one)"},
+		"<input>:\n   0    1  LOAD_CONST 0 (1)\n   1    1  LOAD_CONST 1 (1)\n   2    1  CREATE_LIST 2\n<input>:\n"+
+			fmt.Sprintf("%s:1:2-1:6: Unknown identifier one ()\n\n", replPath))
+
+	// A colon after whitespace is a keyword, otherwise it is a struct accessor
+	r.ExpectReplOutput([]string{":tokens (f :a b:c)"}, "1:1-1:2 TokLBracket\n1:2-1:3 TokIdent(f)\n1:4-1:6 TokKeyword(a)\n"+
+		"1:7-1:8 TokIdent(b)\n1:8-1:9 TokColon\n1:9-1:10 TokIdent(c)\n1:10-1:11 TokRBracket\n")
+	r.ExpectNumber("(defstruct point x y)\n(defun f (p &key (scale 1)) (* scale p:x))\n(f (struct point (x 2)) :scale 3)", 6)
+	r.ExpectFormat("(defun f (a &optional (b 2) &key c) (list a b c))\n(f   1 :c   3)",
+		"(defun f (a &optional (b 2) &key c)\n    (list a b c))\n(f 1 :c 3)\n")
+	r.ExpectDisassembly("(defun f (&optional (x 1)) x)\n(defun main () (f))", `== <root> ==
+code:
+       0  CALL_FUNCTION 1 0 (main)
+
+== f ==
+arguments: &optional x
+constants:
+     0  1
+variables:
+     0  x
+code:
+  ; 1: (defun f (&optional (x 1)) x)
+       0  STORE_VAR 0 (x)
+       1  JUMP_IF_PASSED 2 0 (x -> L0)
+       2  LOAD_CONST 0 (1)
+       3  STORE_VAR 0 (x)
+  L0:
+       4  LOAD_VAR 0 (x)
+
+== main ==
+code:
+  ; 2: (defun main () (f))
+       0  PUSH_MISSING
+       1  TAIL_CALL_FUNCTION 0 1 (f)
+`)
 
 	r.ExpectNumber(`
 		((lambda (x y) (+ x y)) 10 20)
@@ -691,6 +1914,590 @@ func Run() {
 	(f 20)
 	`)
 
+	// REPL
+	r.ExpectReplOutput([]string{"(+ 1 2)"}, "3\n")
+	r.ExpectReplOutput([]string{"(def x 10)", "(defun f (y) (+ x y))", "(f 5)"}, "15\n")
+	r.ExpectReplOutput([]string{"(defstruct person age)", "(def p (struct person (age 30)))", "(p:age)"}, "30\n")
+	r.ExpectReplOutput([]string{"(defun f () 1)", "(defun f () 2)", "(f)"}, "2\n")
+	r.ExpectReplOutput([]string{"(def x 1)", "(defun f () x)", "(def x 2)", "(f)"}, "2\n")
+	r.ExpectReplOutput([]string{`(concat "a"`, "  ; comment )", `  ")")`}, "\"a)\"\n")
+	r.ExpectReplOutput([]string{"(+", "1", "2)"}, "3\n")
+	r.ExpectReplOutput([]string{"(defun main () 10)", "(+ 1 1)"}, "2\n")
+	cwd, _ := os.Getwd()
+	r.ExpectReplOutput([]string{"(def x 5)", `(nth "a" 1)`, "(x)"},
+		fmt.Sprintf("%s:1: TypeError[E2]: Type error for argument 1 - expected num but got string ()\n5\n", filepath.Join(cwd, "<repl>")))
+
+	r.ExpectReplOutput([]string{":tokens (a)"}, "1:1-1:2 TokLBracket\n1:2-1:3 TokIdent(a)\n1:3-1:4 TokRBracket\n")
+	r.ExpectReplOutput([]string{":parse (+ 1", "2)"}, "ExpressionNode\n\tExpressionNode\n\t\tLiteralNode(+)\n\tExpressionNode\n\t\tNumberNode(1)\n\tExpressionNode\n\t\tNumberNode(2)\n")
+	r.ExpectReplOutput([]string{":bytecode (+ 1 2)"},
+		"<input>:\n   0    1  LOAD_CONST 0 (1)\n   1    1  LOAD_CONST 1 (2)\n   2    1  CALL_BUILTIN 0 2 (+)\n")
+	r.ExpectReplOutput([]string{":bytecode (defun f () 1)", "(f)"}, "<input>:\nf:\n   0    1  LOAD_CONST 0 (1)\n"+
+		fmt.Sprintf("%s:1:2-1:4: Unknown identifier f ()\n\n", filepath.Join(cwd, "<repl>")))
+	r.ExpectReplOutput([]string{"(def x 10)", "(defun f (a b) a)", "(defstruct person name age)", ":env"},
+		"Globals:\n  x = 10\nFunctions:\n  f (a b)\nStructs:\n  person (name age)\n")
+	r.ExpectReplOutput([]string{":load test/output/import-unqualified-simple/a.lisp", "(aFunction)"}, "A")
+	r.ExpectReplOutput([]string{":reload"}, "No files have been loaded\n")
+	r.ExpectReplOutput([]string{":unknown"}, "Unknown command :unknown - enter :help to see all commands\n")
+
+	// Formatting
+	r.ExpectFormat("(+   1  2)", "(+ 1 2)\n")
+	r.ExpectFormat("(defun f (x) (+ x 1))", "(defun f (x)\n    (+ x 1))\n")
+	r.ExpectFormat("(defun f (x)\n  (def y 1)\n\n\n  (+ x y)\n)\n", "(defun f (x)\n    (def y 1)\n\n    (+ x y))\n")
+	r.ExpectFormat("(while (< i 10) (def i (+ i 1)))", "(while (< i 10)\n    (def i (+ i 1)))\n")
+	r.ExpectFormat("(if true 1 2)", "(if true 1 2)\n")
+	r.ExpectFormat("(if (> x 0) ((def y 1) (y)) (0))", "(if (> x 0)\n    ((def y 1)\n     (y))\n    (0))\n")
+	r.ExpectFormat("(def p (struct person (age 2)))\n(print p : age)\n(print ( : age p))\n(a . f 1)",
+		"(def p (struct person (age 2)))\n(print p:age)\n(print (:age p))\n(a.f 1)\n")
+	r.ExpectFormat("; header\n(def x 1)   ; trailing  \n\n\n(defun f () ; f\n  ; body\n  (x)\n  ; end\n  )",
+		"; header\n(def x 1) ; trailing\n\n(defun f () ; f\n    ; body\n    (x)\n    ; end\n)\n")
+	r.ExpectFormat("(defun f (a) (let ((x 1) (y (+ a 1))) (def z (+ x y)) (+ z x y)))",
+		"(defun f (a)\n    (let ((x 1)\n          (y (+ a 1)))\n        (def z (+ x y))\n        (+ z x y)))\n")
+	r.ExpectFormat(`(print "a\"b\n")`, `(print "a\"b\n")`+"\n")
+	r.ExpectFormat("(def result (concat \"a long string that goes on\" (concat \"and on and on\" \"until it is too long\")))",
+		"(def result (concat\n    \"a long string that goes on\"\n    (concat \"and on and on\" \"until it is too long\")))\n")
+
+	// Disassembler
+	r.ExpectDisassembly("(def x 1)\n(print x)", `== <root> ==
+constants:
+     0  1
+globals:
+     0  x
+code:
+  ; 1: (def x 1)
+       0  LOAD_CONST 0 (1)
+       1  STORE_GLOBAL 0 (x)
+       2  STORE_NULL
+  ; 2: (print x)
+       3  LOAD_GLOBAL 0 (x)
+       4  CALL_BUILTIN 21 1 (print)
+`)
+	r.ExpectDisassembly("(defun f (n)\n    (while (> n 0)\n        (def n (- n 1))))\n(defun main () (f 2))", `== <root> ==
+code:
+       0  CALL_FUNCTION 1 0 (main)
+
+== f ==
+arguments: n
+constants:
+     0  0
+     1  1
+variables:
+     0  n
+     1  
+code:
+  ; 1: (defun f (n)
+       0  STORE_VAR 0 (n)
+  ; 2: (while (> n 0)
+       1  SAVE_STACK_HEIGHT 1
+  L0:
+       2  LOAD_VAR 0 (n)
+       3  LOAD_CONST 0 (0)
+       4  CALL_BUILTIN 11 2 (>)
+       5  COND_JUMP_FALSE 7 (-> L1)
+  ; 3: (def n (- n 1))))
+       6  LOAD_VAR 0 (n)
+       7  LOAD_CONST 1 (1)
+       8  CALL_BUILTIN 1 2 (-)
+       9  STORE_VAR 0 (n)
+      10  STORE_NULL
+      11  POP
+  ; 2: (while (> n 0)
+      12  JUMP -11 (-> L0)
+  L1:
+      13  STORE_NULL
+
+== main ==
+constants:
+     0  2
+code:
+  ; 4: (defun main () (f 2))
+       0  LOAD_CONST 0 (2)
+       1  TAIL_CALL_FUNCTION 0 1 (f)
+`)
+	r.ExpectDisassembly("(defun f (x) (lambda (y) (+ x y)))", `== <root> ==
+code:
+
+== f ==
+arguments: x
+constants:
+     0  lambda(y) -> f/lambda#1
+variables:
+     0  x
+code:
+  ; 1: (defun f (x) (lambda (y) (+ x y)))
+       0  STORE_VAR 0 (x)
+       1  LOAD_CONST 0 (f/lambda#1)
+       2  PUSH_CLOSURE_VAR 0 0 (x)
+
+== f/lambda#1 ==
+arguments: y
+variables:
+     0  x
+     1  y
+code:
+       0  STORE_VAR 1 (y)
+  ; 1: (defun f (x) (lambda (y) (+ x y)))
+       1  LOAD_VAR 0 (x)
+       2  LOAD_VAR 1 (y)
+       3  CALL_BUILTIN 0 2 (+)
+`)
+
+	// Bytecode files
+	r.ExpectBytecodeOutput(`(print (+ 1.5 2))`, "3.500000")
+	r.ExpectBytecodeOutput(`
+	(defstruct person name age)
+	(defun greet (p) (concat "Hello " p:name))
+	(def people (list (struct person (name "a") (age 1)) (struct person (name "b"))))
+	(print (greet (nth 1 people)))`, "Hello b")
+	r.ExpectBytecodeOutput(`
+	(defun make-adder (x) (lambda (y) (+ x y)))
+	(defun main ()
+		(def i 0)
+		(while (< i 3)
+			(def i (+ i 1)))
+		(print (funcall (make-adder i) 10)))`, "13")
+	if _, err := vm.ReadBytecode(strings.NewReader("LBC\x00\x63"), nil); err == nil {
+		r.numFailed += 1
+		fmt.Println("Failed: expected bytecode with an unknown version to be rejected")
+	} else {
+		r.numPassed += 1
+	}
+	setInstr := func(functionIdx int, pc int, instr vm.Instruction) func(*vm.CompileResult) {
+		return func(compileRes *vm.CompileResult) {
+			frame := &compileRes.Frame
+			if functionIdx >= 0 {
+				frame = compileRes.Functions[functionIdx]
+			}
+			frame.Code[pc] = instr
+		}
+	}
+	bytecodeProgram := "(defstruct point x y)\n(def g 1)\n(defun f (x) (+ x g))\n(print (f 2))"
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(-1, 0, vm.Instruction{Opcode: 1000}), "unknown opcode")
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(0, 0, vm.Instruction{Opcode: vm.JUMP, Arg1: 100}), "jumps outside")
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(0, 0, vm.Instruction{Opcode: vm.COND_JUMP, Arg1: -3}), "jumps outside")
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(-1, 0, vm.Instruction{Opcode: vm.LOAD_CONST, Arg1: 50}), "constant")
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(0, 0, vm.Instruction{Opcode: vm.LOAD_VAR, Arg1: 7}), "variable")
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(0, 0, vm.Instruction{Opcode: vm.LOAD_VAR, Arg1: -1}), "variable")
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(-1, 0, vm.Instruction{Opcode: vm.CALL_FUNCTION, Arg1: 3, Arg2: 1}), "function")
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(-1, 0, vm.Instruction{Opcode: vm.CALL_BUILTIN, Arg1: 100000, Arg2: 1}), "builtin")
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(0, 0, vm.Instruction{Opcode: vm.STRUCT_FIELD_INDEX, Arg1: 4}), "name")
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(0, 0, vm.Instruction{Opcode: vm.LOAD_GLOBAL, Arg1: 9}), "global")
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(0, 0, vm.Instruction{Opcode: vm.CREATE_STRUCT, Arg1: 1}), "struct")
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(0, 0, vm.Instruction{Opcode: vm.CREATE_LIST, Arg1: -2}), "negative")
+	// Loading does not check the stack, so popping from an empty stack is reported when the file is run
+	r.ExpectInvalidBytecode(bytecodeProgram, setInstr(-1, 0, vm.Instruction{Opcode: vm.POP}), "invalid bytecode file")
+	closureProgram := "(defun f (x) (lambda () x))\n(print (funcall (f 1)))"
+	r.ExpectInvalidBytecode(closureProgram, func(compileRes *vm.CompileResult) {
+		for i, instr := range compileRes.Functions[0].Code {
+			if instr.Opcode == vm.PUSH_CLOSURE_VAR {
+				compileRes.Functions[0].Code[i].Arg2 = 40
+			}
+		}
+	}, "refers to a variable of the closure that does not exist")
+	r.ExpectInvalidBytecode(closureProgram, func(compileRes *vm.CompileResult) {
+		for i, instr := range compileRes.Functions[0].Code {
+			if instr.Opcode == vm.LOAD_CONST {
+				compileRes.Functions[0].Code[i] = vm.Instruction{Opcode: vm.STORE_NULL}
+			}
+		}
+	}, "does not follow the closure")
+	// Closures are constants of the frame that creates them, and their code is checked in the same way
+	r.ExpectInvalidBytecode("(def f (lambda (x) (+ x 1)))\n(print (funcall f 1))", func(compileRes *vm.CompileResult) {
+		for _, constant := range compileRes.Frame.Constants {
+			if constant.Kind == vm.ClosureType {
+				constant.Closure.Body.Code[0] = vm.Instruction{Opcode: vm.LOAD_VAR, Arg1: 5}
+			}
+		}
+	}, "variable")
+
+	// Debugger
+	debugProgram := "(def g 5)\n(defun sq (x)\n    (* x x))\n(defun f (x)\n    (def y (sq x))\n    (+ y 1))\n(print (f g))\n(print g)"
+	r.ExpectDebugSession(debugProgram, []string{"$FILE:5"}, []string{"n", "q"}, `Paused at $FILE:5 in f
+     5  (def y (sq x))
+Locals:
+  x = 5
+  y = <undef>
+Globals:
+  g = 5
+Stack: null
+Call chain:
+  #0 f at $FILE:5
+  #1 <root> at $FILE:7
+(debug) Paused at $FILE:6 in f
+     6  (+ y 1))
+Locals:
+  x = 5
+  y = 25
+Globals:
+  g = 5
+Stack: null null
+Call chain:
+  #0 f at $FILE:6
+  #1 <root> at $FILE:7
+(debug) `)
+	// Loops leave only their value on the stack, however many times they run
+	r.ExpectDebugSession(`(defun f ()
+    (def n 0)
+    (while (< n 10000) (def n (+ n 1)) (if (= n 5000) (continue)))
+    (for (i 0 10000) (+ i 1) (if (= i 5) (continue)))
+    (print n))
+(f)`, []string{"$FILE:5"}, []string{"st", "c"}, `Paused at $FILE:5 in f
+     5  (print n))
+Locals:
+  n = 10000
+  i = 10000
+Globals:
+Stack: null null null
+Call chain:
+  #0 f at $FILE:5
+  #1 <root> at $FILE:6
+(debug) Stack: null null null
+(debug) `)
+	r.ExpectDebugSession(debugProgram, []string{"main.lisp:5"}, []string{"s", "bt", "o", "bt", "o", "bt", "c"}, `Paused at $FILE:5 in f
+     5  (def y (sq x))
+Locals:
+  x = 5
+  y = <undef>
+Globals:
+  g = 5
+Stack: null
+Call chain:
+  #0 f at $FILE:5
+  #1 <root> at $FILE:7
+(debug) Paused at $FILE:2 in sq
+     2  (defun sq (x)
+Locals:
+  x = <undef>
+Globals:
+  g = 5
+Stack: null 5
+Call chain:
+  #0 sq at $FILE:2
+  #1 f at $FILE:5
+  #2 <root> at $FILE:7
+(debug) Call chain:
+  #0 sq at $FILE:2
+  #1 f at $FILE:5
+  #2 <root> at $FILE:7
+(debug) Paused at $FILE:5 in f
+     5  (def y (sq x))
+Locals:
+  x = 5
+  y = <undef>
+Globals:
+  g = 5
+Stack: null 25
+Call chain:
+  #0 f at $FILE:5
+  #1 <root> at $FILE:7
+(debug) Call chain:
+  #0 f at $FILE:5
+  #1 <root> at $FILE:7
+(debug) Paused at $FILE:7 in <root>
+     7  (print (f g))
+Locals:
+Globals:
+  g = 5
+Stack: null 26
+Call chain:
+  #0 <root> at $FILE:7
+(debug) Call chain:
+  #0 <root> at $FILE:7
+(debug) `)
+	r.ExpectDebugSession("(def x 1)\n(def x 2)", []string{}, []string{"b 2", "b", "c"}, `Paused at $FILE:1 in <root>
+     1  (def x 1)
+Locals:
+Globals:
+  x = <undef>
+Stack: 
+Call chain:
+  #0 <root> at $FILE:1
+(debug) (debug) 2
+(debug) Paused at $FILE:2 in <root>
+     2  (def x 2)
+Locals:
+Globals:
+  x = 1
+Stack: null
+Call chain:
+  #0 <root> at $FILE:2
+(debug) 
+`)
+
+	// Profiler
+	r.ExpectInterpreter("state is kept between evals", "", func(i *calc.Interpreter) (vm.Value, error) {
+		if _, err := i.Eval("(def x 5)\n(defun addX (n) (+ n x))"); err != nil {
+			return vm.Value{}, err
+		}
+		return i.Eval("(addX 2)")
+	}, "7", "")
+	r.ExpectInterpreter("calling a function from go", "", func(i *calc.Interpreter) (vm.Value, error) {
+		if _, err := i.Eval("(defun greet (name times) (print name) (* times 2))"); err != nil {
+			return vm.Value{}, err
+		}
+		name := vm.Value{}
+		name.NewString("hello")
+		times := vm.Value{}
+		times.NewNum(21)
+		i.Call("greet", name, times)
+		return i.Call("greet", name, times)
+	}, "42", "hellohello")
+	r.ExpectInterpreter("setting and getting globals", "", func(i *calc.Interpreter) (vm.Value, error) {
+		limit := vm.Value{}
+		limit.NewNum(10)
+		i.SetGlobal("limit", limit)
+		if _, err := i.Eval("(def doubled (* limit 2))"); err != nil {
+			return vm.Value{}, err
+		}
+		val, _ := i.GetGlobal("doubled")
+		return val, nil
+	}, "20", "")
+	r.ExpectInterpreter("reading from stdin", "first\nsecond\n", func(i *calc.Interpreter) (vm.Value, error) {
+		i.Eval("(input)")
+		return i.Eval("(input)")
+	}, "\"second\n\"", "")
+	r.ExpectInterpreter("loading a file", "", func(i *calc.Interpreter) (vm.Value, error) {
+		if _, err := i.EvalFile("test/output/import-qualified-simple/main.lisp"); err != nil {
+			return vm.Value{}, err
+		}
+		// Functions in imported files can be called too
+		return i.Call("aFunction")
+	}, "null", "AA")
+	r.ExpectInterpreter("errors", "", func(i *calc.Interpreter) (vm.Value, error) {
+		_, unknownErr := i.Call("missing")
+		i.Eval("(defun f (x) x)")
+		_, arityErr := i.Call("f")
+		_, compileErr := i.Eval("(+ y 1)")
+		_, found := i.GetGlobal("y")
+		if unknownErr == nil || arityErr == nil || compileErr == nil || found {
+			return vm.Value{}, errors.New("expected errors")
+		}
+		return i.Eval("(+ 1 2)")
+	}, "3", "")
+	double := vm.Builtin{Identifier: "double", NumArgs: 1, ArgTypes: []string{vm.NumType},
+		Function: func(v []vm.Value) (vm.Value, error) {
+			res := vm.Value{}
+			res.NewNum(v[0].Num * 2)
+			return res, nil
+		}}
+	r.ExpectInterpreter("registering a builtin", "", func(i *calc.Interpreter) (vm.Value, error) {
+		if err := i.RegisterBuiltin(double); err != nil {
+			return vm.Value{}, err
+		}
+		return i.Eval("(double (double 3))")
+	}, "12", "")
+	r.ExpectInterpreter("builtins are checked against their type signature", "", func(i *calc.Interpreter) (vm.Value, error) {
+		i.RegisterBuiltin(double)
+		_, err := i.Eval("(double \"3\")")
+		if runtimeErr, ok := err.(vm.RuntimeError); !ok || !strings.Contains(runtimeErr.Simple, "argument 1 of double") {
+			return vm.Value{}, fmt.Errorf("expected type error, got %v", err)
+		}
+		_, err = i.Eval("(double 1 2)")
+		if err == nil {
+			return vm.Value{}, errors.New("expected error for wrong number of arguments")
+		}
+		return i.Eval("(double 1)")
+	}, "2", "")
+	r.ExpectInterpreter("builtin names can not collide", "", func(i *calc.Interpreter) (vm.Value, error) {
+		i.Eval("(defun triple (x) (* x 3))")
+		plus := double
+		plus.Identifier = "+"
+		triple := double
+		triple.Identifier = "triple"
+		noFunction := double
+		noFunction.Function = nil
+		if i.RegisterBuiltin(double) != nil || i.RegisterBuiltin(double) == nil || i.RegisterBuiltin(plus) == nil ||
+			i.RegisterBuiltin(triple) == nil || i.RegisterBuiltin(noFunction) == nil {
+			return vm.Value{}, errors.New("expected collisions to be detected")
+		}
+		return i.Eval("(triple (+ 1 1))")
+	}, "6", "")
+	r.ExpectInterpreter("builtins are only registered in one interpreter", "", func(i *calc.Interpreter) (vm.Value, error) {
+		other := calc.Interpreter{}
+		other.New(calc.InterpreterOptions{})
+		other.RegisterBuiltin(double)
+		if _, err := i.Eval("(double 1)"); err == nil {
+			return vm.Value{}, errors.New("expected double to be unknown")
+		}
+		return other.Eval("(double 1)")
+	}, "2", "")
+	r.ExpectInterpreter("variadic builtins", "", func(i *calc.Interpreter) (vm.Value, error) {
+		sum := vm.Builtin{Identifier: "sum", NumArgs: 1, MaxArgs: vm.AnyNumberOfArgs, ArgTypes: []string{vm.NumType},
+			Function: func(v []vm.Value) (vm.Value, error) {
+				res := vm.Value{}
+				for _, val := range v {
+					res.NewNum(res.Num + val.Num)
+				}
+				return res, nil
+			}}
+		if err := i.RegisterBuiltin(sum); err != nil {
+			return vm.Value{}, err
+		}
+		if _, err := i.Eval("(sum)"); err == nil {
+			return vm.Value{}, errors.New("expected error for too few arguments")
+		}
+		if _, err := i.Eval("(sum 1 \"2\")"); err == nil {
+			return vm.Value{}, errors.New("expected type error for the second argument")
+		}
+		return i.Eval("(sum 1 2 3)")
+	}, "6", "")
+	r.ExpectInterpreter("calling a function with optional arguments from go", "", func(i *calc.Interpreter) (vm.Value, error) {
+		i.Eval("(defun f (a &optional (b 2) &key (c 3)) (+ a (* b c)))")
+		one := vm.Value{}
+		one.NewNum(1)
+		if _, err := i.Call("f", one, one, one); err == nil {
+			return vm.Value{}, errors.New("expected error for too many arguments")
+		}
+		return i.Call("f", one)
+	}, "7", "")
+	r.ExpectInterpreter("catching an error in a function called from go", "", func(i *calc.Interpreter) (vm.Value, error) {
+		i.Eval("(defun f (x) (try (+ x 1) (catch error e e:kind)))")
+		str := vm.Value{}
+		str.NewString("a")
+		_, err := i.Call("f", str)
+		if err != nil {
+			return vm.Value{}, err
+		}
+		if _, err := i.Eval("(throw 1)"); err == nil {
+			return vm.Value{}, errors.New("expected error for uncaught throw")
+		}
+		return i.Call("f", str)
+	}, "\"TypeError\"", "")
+	r.ExpectInterpreter("calling a variadic function from go", "", func(i *calc.Interpreter) (vm.Value, error) {
+		i.Eval("(defun f (a &rest xs) (+ a (length xs)))")
+		if _, err := i.Call("f"); err == nil {
+			return vm.Value{}, errors.New("expected error for too few arguments")
+		}
+		one := vm.Value{}
+		one.NewNum(1)
+		return i.Call("f", one, one, one)
+	}, "3", "")
+	// Each call has its own locals
+	r.ExpectNumber("(defun fib (n) (if (< n 2) n (+ (fib (- n 1)) (fib (- n 2)))))\n(fib 15)", 610)
+	r.ExpectNumber(`
+	(defun f (n)
+		(def before n)
+		(if (> n 0) (f (- n 1)))
+		(return before))
+	(f 5)`, 5)
+	r.ExpectError("(defun f (n) (if (= n 0) (assert false) (f (- n 1))))\n(f 3)\n(f 3)")
+	// Calls in tail position reuse the activation, so do not run out of stack
+	r.ExpectNumber("(defun count (n acc) (if (= n 0) acc (count (- n 1) (+ acc 1))))\n(count 1000000 0)", 1000000)
+	r.ExpectBool(`
+	(defun even? (n) (if (= n 0) true (odd? (- n 1))))
+	(defun odd? (n) (if (= n 0) false (even? (- n 1))))
+	(even? 100001)`, false)
+	r.ExpectNumber(`
+	(defun f (n)
+		(while true
+			(if (= n 0) (return 7))
+			(return (f (- n 1)))))
+	(f 1000000)`, 7)
+	r.ExpectNumber(`
+	(defun loop (n)
+		(def step null)
+		(set! step (lambda (i) (if (< i n) (funcall step (+ i 1)) i)))
+		(funcall step 0))
+	(loop 1000000)`, 1000000)
+	// Values left on the stack by the caller are dropped by a tail call
+	r.ExpectNumber(`
+	(defun f (n acc)
+		(+ 1 2)
+		(list 3)
+		(if (= n 0) acc (f (- n 1) (+ acc n))))
+	(+ 100 (f 4 0))`, 110)
+	r.ExpectString(`
+	(defun greet (name) (concat "hi " name))
+	(defun f (g) (funcall g "bob"))
+	(f (lambda (name) (greet name)))`, "hi bob")
+	// Calls are not limited by the Go stack, but by the maximum call depth
+	r.ExpectNumber("(defun sum (n) (if (= n 0) 0 (+ n (sum (- n 1)))))\n(sum 50000)", 1250025000)
+	r.ExpectRuntimeError("(defun f (n) (+ 1 (f n)))\n(f 1)", "Maximum call depth of 100000 exceeded",
+		append(repeatLine(1, 99998), 2))
+	r.ExpectInterpreter("Maximum call depth can be set", "", func(i *calc.Interpreter) (vm.Value, error) {
+		limited := calc.Interpreter{}
+		limited.New(calc.InterpreterOptions{MaxCallDepth: 10})
+		_, err := limited.Eval("(defun f (n) (if (= n 0) 0 (+ 1 (f (- n 1)))))\n(f 20)")
+		if err == nil || !strings.Contains(err.Error(), "Maximum call depth of 10 exceeded") {
+			return vm.Value{}, fmt.Errorf("expected call depth to be exceeded, got %v", err)
+		}
+		// The failed calls are cleaned up, so the interpreter can still be used
+		return limited.Eval("(f 5)")
+	}, "5", "")
+	// Stack traces are the lines of every running call, including calls to closures
+	r.ExpectRuntimeError(`(defun f (g)
+	(+ 1 (funcall g 2)))
+(defun main ()
+	(+ 1 (f (lambda (x) (+ 1 (assert false))))))`, "Assertion failed", []int{2, 4, -1})
+	r.ExpectRuntimeError("(defun f () (assert-error (lambda () 1)))\n(f)", "Assertion failed", []int{2})
+	r.ExpectNumber("(defun f () (assert-error (lambda () (assert false))) (return 5))\n(+ 1 (f))", 6)
+	r.ExpectNull("(assert (= 1 1))")
+	r.ExpectError("(assert (= 1 2))")
+	r.ExpectError("(assert 1)")
+	r.ExpectNull("(assert-equal (list 1 \"a\") (list 1 \"a\"))")
+	r.ExpectError("(assert-equal 1 \"1\")")
+	r.ExpectString("(assert-error (lambda () (assert false)))", "Assertion failed")
+	r.ExpectError("(assert-error (lambda () 1))")
+	r.ExpectError("(assert-error 1)")
+	r.ExpectError("(defun f () (deftest \"t\" (assert true)))")
+	r.ExpectTestResults(map[string]string{
+		"math.lisp": "(defun sq (x) (* x x))\n(def base 10)\n(deftest \"squares\"\n  (assert-equal 9 (sq 3)))\n" +
+			"(deftest \"uses globals\"\n  (assert (= base 10)))\n(deftest \"fails\"\n  (print \"x\")\n  (assert-equal 10 (sq 3)))",
+		"sub/other.lisp": "(deftest errors\n  (assert-error (lambda () (assert false))))",
+		"broken.lisp":    "(undefined-function)",
+	}, "", nil, []string{"errors ok", "fails FAIL 9: Assertion failed", "squares ok", "uses globals ok"})
+	r.ExpectTestResults(map[string]string{
+		"a.lisp": "(deftest \"one\" (assert true))\n(deftest \"two\" (assert false))",
+	}, "^o", nil, []string{"one ok"})
+	// Each test is run in isolation, so globals changed by one test are not seen by another
+	r.ExpectTestResults(map[string]string{
+		"a.lisp": "(def x 1)\n(deftest \"a\"\n  (def x 2)\n  (assert (= x 2)))\n(deftest \"b\" (assert (= x 1)))",
+	}, "", nil, []string{"a ok", "b ok"})
+	// A test that panics the evalulator is reported, and the tests after it still run
+	explodingBuiltins := vm.BuiltinRegistry{}
+	explodingBuiltins.New()
+	explodingBuiltins.Register(vm.Builtin{Identifier: "explode", NumArgs: 0,
+		Function: func(v []vm.Value) (vm.Value, error) {
+			panic("boom")
+		}})
+	r.ExpectTestResults(map[string]string{
+		"a.lisp": "(deftest \"a\" (explode))\n(deftest \"b\" (assert true))",
+	}, "", &explodingBuiltins, []string{"a ERROR internal error: boom", "b ok"})
+	r.ExpectProfile("(defun f (x) (+ x 1))\n(f 1)\n(f 2)", []string{"+ 2 0 0", "f 2 8 8", "top-level 1 4 12"})
+	// f tail calls the lambda, so is no longer running while the lambda is
+	r.ExpectProfile("(defun f (g) (funcall g 1))\n(f (lambda (x) (* x 2)))",
+		[]string{"* 1 0 0", "f 1 4 4", "lambda:2 1 4 4", "top-level 1 2 10"})
+	r.ExpectProfile("(defun f (g) (+ (funcall g 1) 1))\n(f (lambda (x) (* x 2)))",
+		[]string{"* 1 0 0", "+ 1 0 0", "f 1 6 10", "lambda:2 1 4 4", "top-level 1 2 12"})
+
+	// Language server
+	mainUri := "file://" + filepath.ToSlash(filepath.Join(cwd, "test/output/import-qualified-simple/main.lisp"))
+	aUri := "file://" + filepath.ToSlash(filepath.Join(cwd, "test/output/import-qualified-simple/a.lisp"))
+	mainCode, _ := util.ReadFile("test/output/import-qualified-simple/main.lisp")
+	r.ExpectLspOutput([]string{`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`, `{"jsonrpc":"2.0","method":"exit"}`},
+		[]string{`{"jsonrpc":"2.0","id":1,"result":{"capabilities":{"textDocumentSync":1,"definitionProvider":true,"hoverProvider":true,`})
+	r.ExpectLspOutput([]string{lspOpen("file:///tmp/a.lisp", "(def x 1)\n(+ x y)")},
+		[]string{`{"uri":"file:///tmp/a.lisp","diagnostics":[{"range":{"start":{"line":1,"character":5},"end":{"line":1,"character":6}},"severity":1,"source":"lisp-calculator","message":"Unknown variable y"}]}`})
+	r.ExpectLspOutput([]string{lspOpen("file:///tmp/a.lisp", "(print \"a)")},
+		[]string{`"message":"Unterminated string literal"`})
+	r.ExpectLspOutput([]string{lspOpen("file:///tmp/a.lisp", "(def x 1)")}, []string{`{"uri":"file:///tmp/a.lisp","diagnostics":[]}`})
+	r.ExpectLspOutput([]string{lspOpen(mainUri, mainCode), lspRequest(2, "textDocument/definition", mainUri, 2, 4)},
+		[]string{`{"jsonrpc":"2.0","id":2,"result":{"uri":"` + aUri + `","range":{"start":{"line":0,"character":1},"end":{"line":2,"character":1}}}}`})
+	r.ExpectLspOutput([]string{lspOpen("file:///tmp/a.lisp", "(print 1)"), lspRequest(2, "textDocument/definition", "file:///tmp/a.lisp", 0, 2)},
+		[]string{`{"jsonrpc":"2.0","id":2,"result":null}`})
+	r.ExpectLspOutput([]string{lspOpen("file:///tmp/a.lisp", "; Adds one\n; to x\n(defun f (x) (+ x 1))\n(f 2)"),
+		lspRequest(2, "textDocument/hover", "file:///tmp/a.lisp", 3, 1)},
+		[]string{`"value":"` + "```lisp\\n(defun f (x))\\n```\\n\\nAdds one\\nto x\\n\\nDefined in `/tmp/a.lisp`" + `"`})
+	r.ExpectLspOutput([]string{lspOpen("file:///tmp/a.lisp", "(print 1)"), lspRequest(2, "textDocument/hover", "file:///tmp/a.lisp", 0, 3)},
+		[]string{`"value":"` + "```lisp\\n(print arg1)\\n```\\n\\nBuiltin function taking 1 arguments" + `"`})
+	r.ExpectLspOutput([]string{lspOpen("file:///tmp/a.lisp", "(max 1 2)"), lspRequest(2, "textDocument/hover", "file:///tmp/a.lisp", 0, 2)},
+		[]string{`"value":"` + "```lisp\\n(max arg1 ...)\\n```\\n\\nBuiltin function taking at least 1 arguments" + `"`})
+	r.ExpectLspOutput([]string{lspOpen(mainUri, mainCode), lspRequest(2, "textDocument/completion", mainUri, 2, 1)},
+		[]string{`{"label":"+","kind":3,"detail":"(+ ...)"}`, `{"label":"print","kind":3,"detail":"(print arg1)"}`})
+	r.ExpectLspOutput([]string{lspOpen(mainUri, mainCode), lspRequest(2, "textDocument/completion", mainUri, 2, 1)},
+		[]string{`{"label":"a.aFunction","kind":3,"detail":"(defun aFunction ())"}`})
+	r.ExpectLspOutput([]string{lspRequest(2, "textDocument/unknown", mainUri, 0, 0)},
+		[]string{`"error":{"code":-32601,"message":"Method textDocument/unknown not supported"}`})
+
 	r.RunOutputTest()
 
 	fmt.Print("\033[1m")
@@ -754,3 +2561,11 @@ func (r *Runner) RunOutputTest() {
 		}
 	}
 }
+
+func repeatLine(line int, n int) []int {
+	lines := make([]int, n)
+	for i := range lines {
+		lines[i] = line
+	}
+	return lines
+}
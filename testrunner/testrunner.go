@@ -0,0 +1,264 @@
+package testrunner
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/benbanerjeerichards/lisp-calculator/calc"
+	"github.com/benbanerjeerichards/lisp-calculator/parser"
+	"github.com/benbanerjeerichards/lisp-calculator/util"
+	"github.com/benbanerjeerichards/lisp-calculator/vm"
+)
+
+// Result is the outcome of running a single test
+type Result struct {
+	Name string
+	// File the test is declared in, as it was found
+	File string
+	Line int
+	// Err is why the test failed, or nil if it passed
+	Err error
+	// Errored is true if the test was stopped by an internal error, rather than by an error raised by the program
+	Errored bool
+	// Anything printed by the test
+	Output   string
+	Duration time.Duration
+}
+
+func (r Result) Passed() bool {
+	return r.Err == nil
+}
+
+// FindFiles returns every file that declares tests in paths, searching directories recursively
+func FindFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, path := range paths {
+		err := filepath.WalkDir(path, func(filePath string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if entry.IsDir() || (filePath != path && !strings.HasSuffix(filePath, ".lisp")) {
+				return nil
+			}
+			code, err := util.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			if declaresTests(code) {
+				files = append(files, filePath)
+			}
+			return nil
+		})
+		if err != nil {
+			return []string{}, err
+		}
+	}
+	return files, nil
+}
+
+// declaresTests checks for a deftest without having to build the file, so broken files without tests are ignored
+func declaresTests(code string) bool {
+	tokens, _ := parser.Tokenise(code)
+	for i, token := range tokens {
+		if token.Kind == parser.TokIdent && token.Data == "deftest" && i > 0 && tokens[i-1].Kind == parser.TokLBracket {
+			return true
+		}
+	}
+	return false
+}
+
+// RunFile runs each test declared in a file whose name matches filter (or every test if filter is nil), with builtins
+// (or the standard builtins if nil). Every test is run with a freshly compiled program, after the top level of the
+// file has been evalulated
+func RunFile(file string, filter *regexp.Regexp, builtins *vm.BuiltinRegistry) []Result {
+	path, _ := filepath.Abs(file)
+	compileRes, err := compileTests(path, builtins)
+	if err != nil {
+		return []Result{{Name: filepath.Base(file), File: file, Err: err}}
+	}
+
+	results := []Result{}
+	for i, test := range compileRes.Tests {
+		// Tests from imported files are run when that file is tested
+		if test.FilePath != path || (filter != nil && !filter.MatchString(test.Name)) {
+			continue
+		}
+		results = append(results, runTest(file, path, builtins, i))
+	}
+	return results
+}
+
+func compileTests(path string, builtins *vm.BuiltinRegistry) (vm.CompileResult, error) {
+	builder := calc.AstBuilder{}
+	builder.New()
+	compiler := vm.Compiler{}
+	compiler.New()
+	if builtins != nil {
+		builder.SetBuiltins(builtins)
+		compiler.SetBuiltins(builtins)
+	}
+	asts, err := builder.LoadFile(path)
+	if err != nil {
+		return vm.CompileResult{}, err
+	}
+	// Tests have to be able to use the file's globals, but its main function must not be called
+	compiler.Interactive = true
+	return compiler.CompileProgram(path, asts)
+}
+
+func runTest(file string, path string, builtins *vm.BuiltinRegistry, testIndex int) (result Result) {
+	start := time.Now()
+	// Compiled code keeps some state (e.g. variables of closures), so compile again to isolate tests
+	compileRes, err := compileTests(path, builtins)
+	if err != nil {
+		return Result{Name: fmt.Sprintf("<test %d>", testIndex), File: file, Err: err}
+	}
+	test := compileRes.Tests[testIndex]
+	result = Result{Name: test.Name, File: file, Line: test.Line}
+
+	var out strings.Builder
+	// A bug in the evalulator must only stop the test that found it
+	defer func() {
+		if rec := recover(); rec != nil {
+			result.Err = fmt.Errorf("internal error: %v", rec)
+			result.Errored = true
+			result.Output = out.String()
+			result.Duration = time.Since(start)
+		}
+	}()
+	evalulator := vm.Evalulator{}
+	evalulator.New([]string{path}, &out)
+	_, err = evalulator.Eval(compileRes)
+	if err == nil {
+		_, err = evalulator.EvalFrame(test.Frame)
+	}
+	result.Err = err
+	result.Output = out.String()
+	result.Duration = time.Since(start)
+	return result
+}
+
+// PrintResults writes the failed tests and a summary, returning true if every test passed
+func PrintResults(w io.Writer, results []Result) bool {
+	numFailed := 0
+	for _, result := range results {
+		if result.Passed() {
+			continue
+		}
+		numFailed += 1
+		status := "FAIL"
+		if result.Errored {
+			status = "ERROR"
+		}
+		fmt.Fprintf(w, "--- %s: %s (%s:%d)\n", status, result.Name, result.File, result.Line)
+		fmt.Fprintf(w, "    %s\n", strings.ReplaceAll(result.Err.Error(), "\n", "\n    "))
+		if len(result.Output) > 0 {
+			fmt.Fprintf(w, "    output:\n        %s\n", strings.ReplaceAll(strings.TrimRight(result.Output, "\n"), "\n", "\n        "))
+		}
+	}
+	if numFailed > 0 {
+		fmt.Fprintf(w, "FAIL: %d of %d tests failed\n", numFailed, len(results))
+		return false
+	}
+	fmt.Fprintf(w, "ok: %d tests passed\n", len(results))
+	return true
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// WriteJUnit writes results as JUnit XML, with a test suite for each file
+func WriteJUnit(w io.Writer, results []Result) error {
+	suites := junitTestSuites{}
+	suiteIndexes := map[string]int{}
+	var total time.Duration
+	for _, result := range results {
+		idx, ok := suiteIndexes[result.File]
+		if !ok {
+			suites.Suites = append(suites.Suites, junitTestSuite{Name: result.File})
+			idx = len(suites.Suites) - 1
+			suiteIndexes[result.File] = idx
+		}
+		suite := &suites.Suites[idx]
+		testCase := junitTestCase{Name: result.Name, ClassName: result.File, Time: seconds(result.Duration),
+			SystemOut: result.Output}
+		if result.Errored {
+			testCase.Error = &junitFailure{Message: result.Err.Error(), Text: result.Err.Error()}
+			suite.Errors += 1
+			suites.Errors += 1
+		} else if !result.Passed() {
+			testCase.Failure = &junitFailure{Message: result.Err.Error(), Text: result.Err.Error()}
+			if runtimeErr, ok := result.Err.(vm.RuntimeError); ok {
+				testCase.Failure.Message = runtimeErr.Simple
+				testCase.Failure.Type = runtimeErr.KindName()
+			}
+			suite.Failures += 1
+			suites.Failures += 1
+		}
+		suite.Cases = append(suite.Cases, testCase)
+		suite.Tests += 1
+		suites.Tests += 1
+		total += result.Duration
+	}
+	suites.Time = seconds(total)
+	for i := range suites.Suites {
+		var suiteTime time.Duration
+		for _, result := range results {
+			if result.File == suites.Suites[i].Name {
+				suiteTime += result.Duration
+			}
+		}
+		suites.Suites[i].Time = seconds(suiteTime)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
@@ -1,42 +1,101 @@
 package vm
 
 import (
-	"bufio"
 	"fmt"
 	"math"
 	"math/rand"
-	"os"
+	"strings"
+	"unicode"
 
-	"github.com/benbanerjeerichards/lisp-calculator/types"
 	"github.com/benbanerjeerichards/lisp-calculator/util"
 )
 
 type Builtin struct {
-	Function   func([]Value) (Value, error)
-	NumArgs    int
+	Function func([]Value) (Value, error)
+	// NumArgs is the number of arguments, or the least number of arguments if MaxArgs is set
+	NumArgs int
+	// MaxArgs is the most arguments that can be passed, or AnyNumberOfArgs. If zero, exactly NumArgs must be passed
+	MaxArgs    int
 	Identifier string
+	// ArgTypes is the type signature, checked before Function is called. Functions without one check their own types.
+	// If more arguments can be passed than there are types, the last type is used for the rest of the arguments
+	ArgTypes []string
+}
+
+// AnyNumberOfArgs is the MaxArgs of a builtin that can take any number of arguments
+const AnyNumberOfArgs = -1
+
+// acceptsArgs is true if the builtin can be called with numArgs arguments
+func (b Builtin) acceptsArgs(numArgs int) bool {
+	if b.MaxArgs == 0 {
+		return numArgs == b.NumArgs
+	}
+	return numArgs >= b.NumArgs && (b.MaxArgs == AnyNumberOfArgs || numArgs <= b.MaxArgs)
+}
+
+// ArityString describes the number of arguments that the builtin takes, such as "2" or "at least 1"
+func (b Builtin) ArityString() string {
+	if b.MaxArgs == 0 {
+		return fmt.Sprint(b.NumArgs)
+	} else if b.MaxArgs == AnyNumberOfArgs {
+		return fmt.Sprintf("at least %d", b.NumArgs)
+	}
+	return fmt.Sprintf("%d to %d", b.NumArgs, b.MaxArgs)
 }
 
 func checKTypes(values []Value, expected []string) error {
 	for i, val := range values {
 		if val.Kind != expected[i] {
-			return types.Error{Simple: fmt.Sprintf("Type error for argument %d - expected %s but got %s", i+1, expected[i], val.Kind)}
+			return typeError(i+1, expected[i], val.Kind, fmt.Sprintf("Type error for argument %d - expected %s but got %s", i+1, expected[i], val.Kind))
+		}
+	}
+	return nil
+}
+
+// checkAllTypes checks that every argument of a builtin that takes any number of arguments has the same type
+func checkAllTypes(values []Value, expected string) error {
+	for i, val := range values {
+		if val.Kind != expected {
+			return typeError(i+1, expected, val.Kind, fmt.Sprintf("Type error for argument %d - expected %s but got %s", i+1, expected, val.Kind))
 		}
 	}
 	return nil
 }
 
+// checkIndex checks that the index passed as the first argument of a builtin is a whole number
+func checkIndex(index Value, builtin string) error {
+	if index.Num != math.Floor(index.Num) {
+		return BuiltinError{Kind: IndexError, Message: fmt.Sprintf("Index %s of %s is not a whole number", index.ToString(), builtin),
+			Info: ErrorInfo{Arg: 1, Expected: "whole number", Actual: index.ToString()}}
+	}
+	return nil
+}
+
+// stringOf is the text of a value when joined into a string, which is the value itself for a string
+func stringOf(val Value) string {
+	if val.Kind == StringType {
+		return val.String
+	}
+	return val.ToString()
+}
+
+// Builtins are the standard builtins, which every BuiltinRegistry starts with
 var Builtins []Builtin = []Builtin{
 	{
 		Identifier: "+",
-		NumArgs:    2,
+		NumArgs:    0,
+		MaxArgs:    AnyNumberOfArgs,
 		Function: func(v []Value) (Value, error) {
-			err := checKTypes(v, []string{NumType, NumType})
+			err := checkAllTypes(v, NumType)
 			if err != nil {
 				return Value{}, err
 			}
+			sum := 0.0
+			for _, val := range v {
+				sum += val.Num
+			}
 			res := Value{}
-			res.NewNum(v[0].Num + v[1].Num)
+			res.NewNum(sum)
 			return res, nil
 		},
 	},
@@ -68,14 +127,19 @@ var Builtins []Builtin = []Builtin{
 	},
 	{
 		Identifier: "*",
-		NumArgs:    2,
+		NumArgs:    0,
+		MaxArgs:    AnyNumberOfArgs,
 		Function: func(v []Value) (Value, error) {
-			err := checKTypes(v, []string{NumType, NumType})
+			err := checkAllTypes(v, NumType)
 			if err != nil {
 				return Value{}, err
 			}
+			product := 1.0
+			for _, val := range v {
+				product *= val.Num
+			}
 			res := Value{}
-			res.NewNum(v[0].Num * v[1].Num)
+			res.NewNum(product)
 			return res, nil
 		},
 	},
@@ -243,44 +307,51 @@ var Builtins []Builtin = []Builtin{
 	},
 	{
 		Identifier: "and",
-		NumArgs:    2,
+		NumArgs:    0,
+		MaxArgs:    AnyNumberOfArgs,
 		Function: func(v []Value) (Value, error) {
-			err := checKTypes(v, []string{BoolType, BoolType})
+			err := checkAllTypes(v, BoolType)
 			if err != nil {
 				return Value{}, err
 			}
+			all := true
+			for _, val := range v {
+				all = all && val.Bool
+			}
 			res := Value{}
-			res.NewBool(v[0].Bool && v[1].Bool)
+			res.NewBool(all)
 			return res, nil
 		},
 	},
 	{
 		Identifier: "or",
-		NumArgs:    2,
+		NumArgs:    0,
+		MaxArgs:    AnyNumberOfArgs,
 		Function: func(v []Value) (Value, error) {
-			err := checKTypes(v, []string{BoolType, BoolType})
+			err := checkAllTypes(v, BoolType)
 			if err != nil {
 				return Value{}, err
 			}
+			some := false
+			for _, val := range v {
+				some = some || val.Bool
+			}
 			res := Value{}
-			res.NewBool(v[0].Bool || v[1].Bool)
+			res.NewBool(some)
 			return res, nil
 		},
 	},
 	{
 		Identifier: "concat",
-		NumArgs:    2,
+		NumArgs:    0,
+		MaxArgs:    AnyNumberOfArgs,
 		Function: func(v []Value) (Value, error) {
-			lString := v[0].ToString()
-			if v[0].Kind == StringType {
-				lString = v[0].String
-			}
-			rString := v[1].ToString()
-			if v[1].Kind == StringType {
-				rString = v[1].String
+			var str strings.Builder
+			for _, val := range v {
+				str.WriteString(stringOf(val))
 			}
 			val := Value{}
-			val.NewString(fmt.Sprintf("%s%s", lString, rString))
+			val.NewString(str.String())
 			return val, nil
 		},
 	},
@@ -292,7 +363,7 @@ var Builtins []Builtin = []Builtin{
 			if err != nil {
 				return Value{}, err
 			}
-			return Value{}, types.Error{Simple: fmt.Sprintf("panic - %s", v[0].String)}
+			return Value{}, BuiltinError{Kind: PanicError, Message: fmt.Sprintf("panic - %s", v[0].String)}
 		},
 	},
 	{
@@ -315,8 +386,8 @@ var Builtins []Builtin = []Builtin{
 		Function: func(v []Value) (Value, error) {
 			val := v[0]
 			if val.Kind != ListType && val.Kind != StringType {
-				return Value{}, types.Error{
-					Simple: fmt.Sprintf("Function length requires argument of type list or string(got %s)", val.Kind)}
+				return Value{}, typeError(1, ListType+" or "+StringType, val.Kind,
+					fmt.Sprintf("Function length requires argument of type list or string(got %s)", val.Kind))
 			}
 			lengthVal := Value{}
 			if val.Kind == ListType {
@@ -335,8 +406,12 @@ var Builtins []Builtin = []Builtin{
 			if err != nil {
 				return Value{}, err
 			}
+			if v[0].Num < 0 || v[0].Num > unicode.MaxRune || v[0].Num != math.Floor(v[0].Num) {
+				return Value{}, BuiltinError{Kind: ValueError, Message: fmt.Sprintf("chr expected a character code, got %s", v[0].ToString()),
+					Info: ErrorInfo{Arg: 1, Expected: "character code", Actual: v[0].ToString()}}
+			}
 			val := Value{}
-			val.NewString(string(int(v[0].Num)))
+			val.NewString(string(rune(int(v[0].Num))))
 			return val, nil
 		},
 	},
@@ -349,7 +424,8 @@ var Builtins []Builtin = []Builtin{
 				return Value{}, err
 			}
 			if len(v[0].String) != 1 {
-				return Value{}, types.Error{Simple: "ord expected string of length 1"}
+				return Value{}, BuiltinError{Kind: ValueError, Message: "ord expected string of length 1",
+					Info: ErrorInfo{Arg: 1, Expected: "string of length 1", Actual: fmt.Sprintf("string of length %d", len(v[0].String))}}
 			}
 			val := Value{}
 			val.NewNum(float64(int(v[0].String[0])))
@@ -366,7 +442,8 @@ var Builtins []Builtin = []Builtin{
 			}
 			contents, err := util.ReadFile(v[0].String)
 			if err != nil {
-				return Value{}, types.Error{Simple: fmt.Sprintf("Failed to read from file %s", v[0].String)}
+				return Value{}, BuiltinError{Kind: IOError, Message: fmt.Sprintf("Failed to read from file %s", v[0].String),
+					Info: ErrorInfo{Arg: 1}}
 			}
 			val := Value{}
 			val.NewString(contents)
@@ -374,26 +451,23 @@ var Builtins []Builtin = []Builtin{
 		},
 	},
 	{
+		// Implemented by the evalulator, as it reads from the evalulator's stdin
+		// TODO make this work with go-prompt for REPL
 		Identifier: "input",
 		NumArgs:    0,
-		Function: func(v []Value) (Value, error) {
-			// TODO make this work with go-prompt for REPL
-			reader := bufio.NewReader(os.Stdin)
-			text, _ := reader.ReadString('\n')
-			val := Value{}
-			val.NewString(text)
-			return val, nil
-		},
 	},
 	{
 		Identifier: "insert",
 		NumArgs:    3,
 		Function: func(v []Value) (Value, error) {
 			if v[0].Kind != NumType {
-				return Value{}, types.Error{Simple: fmt.Sprintf("Type error - argument 1 of insert expected Num, got %s", v[0].Kind)}
+				return Value{}, typeError(1, NumType, v[0].Kind, fmt.Sprintf("Type error - argument 1 of insert expected Num, got %s", v[0].Kind))
 			}
 			if v[2].Kind != ListType {
-				return Value{}, types.Error{Simple: fmt.Sprintf("Type error - argument 3 of insert expected type List , got %s", v[0].Kind)}
+				return Value{}, typeError(3, ListType, v[2].Kind, fmt.Sprintf("Type error - argument 3 of insert expected type List , got %s", v[2].Kind))
+			}
+			if err := checkIndex(v[0], "insert"); err != nil {
+				return Value{}, err
 			}
 			idx := int(v[0].Num)
 			if idx < 0 {
@@ -421,7 +495,11 @@ var Builtins []Builtin = []Builtin{
 				return Value{}, err
 			}
 			if v[1].Kind != StringType && v[1].Kind != ListType {
-				return Value{}, types.Error{Simple: fmt.Sprintf("Type error - argument 1 of nth: expected type String or List , got %s", v[0].Kind)}
+				return Value{}, typeError(2, StringType+" or "+ListType, v[1].Kind,
+					fmt.Sprintf("Type error - argument 2 of nth: expected type String or List , got %s", v[1].Kind))
+			}
+			if err := checkIndex(v[0], "nth"); err != nil {
+				return Value{}, err
 			}
 			idx := int(v[0].Num)
 			if idx < 0 || (v[1].Kind == ListType && idx >= len(v[1].List)) || (v[1].Kind == StringType && idx >= len(v[1].String)) {
@@ -438,6 +516,88 @@ var Builtins []Builtin = []Builtin{
 			return v[1].List[idx], nil
 		},
 	},
+	{
+		Identifier: "assert",
+		NumArgs:    1,
+		Function: func(v []Value) (Value, error) {
+			err := checKTypes(v, []string{BoolType})
+			if err != nil {
+				return Value{}, err
+			}
+			if !v[0].Bool {
+				return Value{}, BuiltinError{Kind: AssertionError, Message: "Assertion failed"}
+			}
+			val := Value{}
+			val.NewNull()
+			return val, nil
+		},
+	},
+	{
+		Identifier: "assert-equal",
+		NumArgs:    2,
+		Function: func(v []Value) (Value, error) {
+			if !v[0].equals(v[1]) {
+				return Value{}, BuiltinError{Kind: AssertionError, Message: "Assertion failed",
+					Detail: fmt.Sprintf("expected %s but got %s", v[0].ToString(), v[1].ToString()),
+					Info:   ErrorInfo{Expected: v[0].ToString(), Actual: v[1].ToString()}}
+			}
+			val := Value{}
+			val.NewNull()
+			return val, nil
+		},
+	},
+	{
+		// Implemented by the evalulator, as it has to call the closure
+		Identifier: "assert-error",
+		NumArgs:    1,
+	},
+	{
+		Identifier: "min",
+		NumArgs:    1,
+		MaxArgs:    AnyNumberOfArgs,
+		Function: func(v []Value) (Value, error) {
+			err := checkAllTypes(v, NumType)
+			if err != nil {
+				return Value{}, err
+			}
+			res := v[0]
+			for _, val := range v[1:] {
+				if val.Num < res.Num {
+					res = val
+				}
+			}
+			return res, nil
+		},
+	},
+	{
+		Identifier: "max",
+		NumArgs:    1,
+		MaxArgs:    AnyNumberOfArgs,
+		Function: func(v []Value) (Value, error) {
+			err := checkAllTypes(v, NumType)
+			if err != nil {
+				return Value{}, err
+			}
+			res := v[0]
+			for _, val := range v[1:] {
+				if val.Num > res.Num {
+					res = val
+				}
+			}
+			return res, nil
+		},
+	},
+	{
+		// Implemented by the evalulator, as it has to call the closure with the items of the list as its arguments
+		Identifier: "apply",
+		NumArgs:    2,
+		ArgTypes:   []string{ClosureType, ListType},
+	},
+	{
+		// Implemented by the evalulator, as it raises an error that the program can catch
+		Identifier: "throw",
+		NumArgs:    1,
+	},
 }
 
 func (a Value) equals(b Value) bool {
@@ -447,7 +607,7 @@ func (a Value) equals(b Value) bool {
 	switch a.Kind {
 	case NumType:
 		return a.Num == b.Num
-	case StringType:
+	case StringType, SymbolType:
 		return a.String == b.String
 	case BoolType:
 		return a.Bool == b.Bool
@@ -0,0 +1,546 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Bytecode files start with bytecodeMagic followed by the format version. The version must be incremented whenever
+// the format, the instruction set or the order of the standard Builtins changes
+const (
+	bytecodeMagic   = "LBC\x00"
+	BytecodeVersion = 9
+)
+
+// WriteBytecode serializes a compile result so that it can later be run without the source code
+func WriteBytecode(w io.Writer, compileRes CompileResult) error {
+	enc := encoder{w: bufio.NewWriter(w)}
+	enc.w.WriteString(bytecodeMagic)
+	enc.uint(BytecodeVersion)
+
+	// Builtins are called by index, so record them to check the file is run with the same builtins
+	builtins := compileRes.Builtins
+	if builtins == nil {
+		builtins = &BuiltinRegistry{}
+		builtins.New()
+	}
+	enc.strings(builtins.Names())
+
+	enc.frame(&compileRes.Frame)
+	enc.uint(uint64(len(compileRes.Functions)))
+	for _, function := range compileRes.Functions {
+		enc.frame(function)
+	}
+	enc.values(compileRes.GlobalVariables)
+	enc.int(int64(compileRes.MainIndex))
+	enc.strings(compileRes.FunctionNames)
+	enc.uint(uint64(len(compileRes.Structs)))
+	for _, decl := range compileRes.Structs {
+		enc.string(decl.Name)
+		enc.strings(decl.FieldNames)
+	}
+	enc.strings(compileRes.GlobalNames)
+
+	if enc.err != nil {
+		return enc.err
+	}
+	return enc.w.Flush()
+}
+
+// ReadBytecode loads a compile result written by WriteBytecode, to be run with builtins. These must contain every
+// builtin that the file was compiled with, in the same order. If builtins is nil the standard builtins are used
+func ReadBytecode(r io.Reader, builtins *BuiltinRegistry) (CompileResult, error) {
+	if builtins == nil {
+		builtins = &BuiltinRegistry{}
+		builtins.New()
+	}
+	dec := decoder{r: bufio.NewReader(r)}
+	magic := make([]byte, len(bytecodeMagic))
+	if _, err := io.ReadFull(dec.r, magic); err != nil || string(magic) != bytecodeMagic {
+		return CompileResult{}, errors.New("not a bytecode file")
+	}
+	if version := dec.uint(); dec.err == nil && version != BytecodeVersion {
+		return CompileResult{}, fmt.Errorf("unsupported bytecode version %d (expected %d)", version, BytecodeVersion)
+	}
+	builtinNames := dec.strings()
+	if dec.err == nil {
+		if len(builtinNames) > builtins.Len() {
+			return CompileResult{}, errors.New("bytecode was compiled with a different set of builtins")
+		}
+		for i, name := range builtinNames {
+			if builtins.At(i).Identifier != name {
+				return CompileResult{}, errors.New("bytecode was compiled with a different set of builtins")
+			}
+		}
+	}
+
+	compileRes := CompileResult{Builtins: builtins}
+	compileRes.Frame = *dec.frame()
+	numFunctions := dec.uint()
+	for i := uint64(0); i < numFunctions && dec.err == nil; i++ {
+		compileRes.Functions = append(compileRes.Functions, dec.frame())
+	}
+	compileRes.GlobalVariables = dec.values()
+	compileRes.MainIndex = int(dec.int())
+	compileRes.FunctionNames = dec.strings()
+	numStructs := dec.uint()
+	for i := uint64(0); i < numStructs && dec.err == nil; i++ {
+		compileRes.Structs = append(compileRes.Structs, StructDecl{Name: dec.string(), FieldNames: dec.strings()})
+	}
+	compileRes.GlobalNames = dec.strings()
+
+	if dec.err != nil {
+		return CompileResult{}, fmt.Errorf("invalid bytecode file: %w", dec.err)
+	}
+	if err := validateProgram(&compileRes, len(builtinNames)); err != nil {
+		return CompileResult{}, fmt.Errorf("invalid bytecode file: %w", err)
+	}
+	return compileRes, nil
+}
+
+// EvalBytecode runs a compile result loaded by ReadBytecode in the same way as Eval. Loading checks each instruction
+// on its own but not what they do to the stack, so a corrupt file that makes the evalulator fail (such as by popping
+// from an empty stack) is reported as an error
+func EvalBytecode(compileRes CompileResult, programArgs []string, debug bool, stdOut io.Writer) (val Value, err error) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			err = fmt.Errorf("invalid bytecode file: %v", rec)
+		}
+	}()
+	return Eval(compileRes, programArgs, debug, stdOut)
+}
+
+// validateProgram checks that every instruction of a decoded program only refers to code, constants, variables,
+// functions, builtins, names, globals and structs that exist, so that a corrupt file is rejected before it is run.
+// Only the first numBuiltins builtins were recorded in the file
+func validateProgram(compileRes *CompileResult, numBuiltins int) error {
+	if len(compileRes.FunctionNames) != len(compileRes.Functions) {
+		return errors.New("function names do not match functions")
+	}
+	if compileRes.MainIndex < -1 || compileRes.MainIndex >= len(compileRes.Functions) {
+		return fmt.Errorf("main function %d does not exist", compileRes.MainIndex)
+	}
+	if err := validateFrame(&compileRes.Frame, compileRes, numBuiltins); err != nil {
+		return err
+	}
+	for _, function := range compileRes.Functions {
+		if err := validateFrame(function, compileRes, numBuiltins); err != nil {
+			return err
+		}
+	}
+	return validateValues(compileRes.GlobalVariables, compileRes, numBuiltins)
+}
+
+func validateFrame(frame *Frame, compileRes *CompileResult, numBuiltins int) error {
+	for pc, instr := range frame.Code {
+		if err := validateInstruction(frame, pc, compileRes, numBuiltins); err != nil {
+			return fmt.Errorf("instruction %d (%s) of %s %s", pc, instr, callName(frame), err)
+		}
+	}
+	if err := validateValues(frame.Constants, compileRes, numBuiltins); err != nil {
+		return err
+	}
+	// Closures that have been created are stored in variables, and their bodies are run in the same way as constants
+	return validateValues(frame.Variables, compileRes, numBuiltins)
+}
+
+// validateInstruction returns why the instruction at pc is invalid, or nil if it is valid
+func validateInstruction(frame *Frame, pc int, compileRes *CompileResult, numBuiltins int) error {
+	instr := frame.Code[pc]
+	inRange := func(idx int, length int) bool {
+		return idx >= 0 && idx < length
+	}
+	switch instr.Opcode {
+	case POP, STORE_NULL, RETURN, PUSH_ARGS, SET_STRUCT_FIELD, GET_STRUCT_FIELD, PUSH_MISSING:
+	case JUMP, COND_JUMP, COND_JUMP_FALSE, PUSH_HANDLER:
+		// The target may be the end of the code, which returns from the frame
+		if target := pc + instr.Arg1 + 1; target < 0 || target > len(frame.Code) {
+			return errors.New("jumps outside of its code")
+		}
+	case JUMP_IF_PASSED:
+		if target := pc + instr.Arg1 + 1; target < 0 || target > len(frame.Code) {
+			return errors.New("jumps outside of its code")
+		}
+		if !inRange(instr.Arg2, len(frame.Variables)) {
+			return errors.New("refers to a variable that does not exist")
+		}
+	case MATCH_ERROR:
+		if target := pc + instr.Arg1 + 1; target < 0 || target > len(frame.Code) {
+			return errors.New("jumps outside of its code")
+		}
+		if !inRange(instr.Arg2, len(frame.Names)) {
+			return errors.New("refers to a name that does not exist")
+		}
+	case LOAD_CONST, NO_MATCH:
+		if !inRange(instr.Arg1, len(frame.Constants)) {
+			return errors.New("refers to a constant that does not exist")
+		}
+	case LOAD_VAR, STORE_VAR, BIND_VAR, SAVE_STACK_HEIGHT:
+		if !inRange(instr.Arg1, len(frame.Variables)) {
+			return errors.New("refers to a variable that does not exist")
+		}
+	case PUSH_CLOSURE_VAR:
+		if !inRange(instr.Arg1, len(frame.Variables)) {
+			return errors.New("refers to a variable that does not exist")
+		}
+		closure, ok := capturingClosure(frame, pc)
+		if !ok {
+			return errors.New("does not follow the closure that it captures into")
+		}
+		if !inRange(instr.Arg2, len(closure.Body.Variables)) {
+			return errors.New("refers to a variable of the closure that does not exist")
+		}
+	case RESTORE_STACK_HEIGHT:
+		if !inRange(instr.Arg1, len(frame.Variables)) {
+			return errors.New("refers to a variable that does not exist")
+		}
+		if instr.Arg2 < 0 {
+			return errors.New("keeps a negative number of values")
+		}
+	case CALL_FUNCTION, TAIL_CALL_FUNCTION:
+		if !inRange(instr.Arg1, len(compileRes.Functions)) {
+			return errors.New("calls a function that does not exist")
+		}
+		if instr.Arg2 < 0 {
+			return errors.New("passes a negative number of arguments")
+		}
+	case CALL_BUILTIN:
+		if !inRange(instr.Arg1, numBuiltins) {
+			return errors.New("calls a builtin that does not exist")
+		}
+		if !compileRes.Builtins.At(instr.Arg1).acceptsArgs(instr.Arg2) {
+			return errors.New("passes the wrong number of arguments")
+		}
+	case CALL_CLOSURE, TAIL_CALL_CLOSURE:
+		if instr.Arg1 < 0 || instr.Arg2 < 0 {
+			return errors.New("passes a negative number of arguments")
+		}
+	case CREATE_LIST, CONCAT_LISTS, POP_HANDLER:
+		if instr.Arg1 < 0 {
+			return errors.New("has a negative count")
+		}
+	case LOAD_GLOBAL, STORE_GLOBAL:
+		if !inRange(instr.Arg1, len(compileRes.GlobalVariables)) {
+			return errors.New("refers to a global that does not exist")
+		}
+	case CREATE_STRUCT:
+		if !inRange(instr.Arg1, len(compileRes.Structs)) {
+			return errors.New("refers to a struct that does not exist")
+		}
+	case STRUCT_FIELD_INDEX, IS_TYPE:
+		if !inRange(instr.Arg1, len(frame.Names)) {
+			return errors.New("refers to a name that does not exist")
+		}
+	default:
+		return errors.New("has an unknown opcode")
+	}
+	return nil
+}
+
+// capturingClosure returns the closure that the PUSH_CLOSURE_VAR at pc captures into. The compiler only emits these
+// straight after loading the closure constant, so that is the only place it can be
+func capturingClosure(frame *Frame, pc int) (ClosureValue, bool) {
+	for pc >= 0 && frame.Code[pc].Opcode == PUSH_CLOSURE_VAR {
+		pc -= 1
+	}
+	if pc < 0 || frame.Code[pc].Opcode != LOAD_CONST {
+		return ClosureValue{}, false
+	}
+	constIdx := frame.Code[pc].Arg1
+	if constIdx < 0 || constIdx >= len(frame.Constants) || frame.Constants[constIdx].Kind != ClosureType {
+		return ClosureValue{}, false
+	}
+	return frame.Constants[constIdx].Closure, true
+}
+
+// validateValues validates the bodies of any closures in values
+func validateValues(values []Value, compileRes *CompileResult, numBuiltins int) error {
+	for _, value := range values {
+		var err error
+		switch value.Kind {
+		case ClosureType:
+			err = validateFrame(value.Closure.Body, compileRes, numBuiltins)
+		case ListType:
+			err = validateValues(value.List, compileRes, numBuiltins)
+		case StructType:
+			err = validateValues(value.Struct.FieldValues, compileRes, numBuiltins)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encoder writes primitives as varints and length prefixed strings. The first error is kept, and everything
+// after it is ignored
+type encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *encoder) uint(n uint64) {
+	if e.err != nil {
+		return
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	_, e.err = e.w.Write(buf[:binary.PutUvarint(buf, n)])
+}
+
+func (e *encoder) int(n int64) {
+	if e.err != nil {
+		return
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	_, e.err = e.w.Write(buf[:binary.PutVarint(buf, n)])
+}
+
+func (e *encoder) bool(b bool) {
+	if b {
+		e.uint(1)
+	} else {
+		e.uint(0)
+	}
+}
+
+func (e *encoder) float(f float64) {
+	if e.err != nil {
+		return
+	}
+	e.err = binary.Write(e.w, binary.LittleEndian, math.Float64bits(f))
+}
+
+func (e *encoder) string(s string) {
+	e.uint(uint64(len(s)))
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.WriteString(s)
+}
+
+func (e *encoder) strings(strs []string) {
+	e.uint(uint64(len(strs)))
+	for _, s := range strs {
+		e.string(s)
+	}
+}
+
+func (e *encoder) frame(f *Frame) {
+	e.uint(uint64(len(f.Code)))
+	for _, instr := range f.Code {
+		e.uint(uint64(instr.Opcode))
+		e.int(int64(instr.Arg1))
+		e.int(int64(instr.Arg2))
+	}
+	e.values(f.Constants)
+	e.values(f.Variables)
+
+	names := make([]string, 0, len(f.VariableMap))
+	for name := range f.VariableMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	e.uint(uint64(len(names)))
+	for _, name := range names {
+		e.string(name)
+		e.int(int64(f.VariableMap[name]))
+	}
+
+	e.strings(f.FunctionArguments)
+	e.bool(f.Variadic)
+	e.int(int64(f.NumOptional))
+	e.int(int64(f.NumKeys))
+	e.strings(f.Names)
+	e.bool(f.IsRootFrame)
+	e.uint(uint64(len(f.LineMap)))
+	for _, line := range f.LineMap {
+		e.int(int64(line))
+	}
+	e.string(f.FilePath)
+	e.string(f.FunctionName)
+}
+
+func (e *encoder) values(values []Value) {
+	e.uint(uint64(len(values)))
+	for _, value := range values {
+		e.value(value)
+	}
+}
+
+func (e *encoder) value(v Value) {
+	e.string(v.Kind)
+	switch v.Kind {
+	case NumType:
+		e.float(v.Num)
+	case BoolType:
+		e.bool(v.Bool)
+	case StringType, SymbolType:
+		e.string(v.String)
+	case ListType:
+		e.values(v.List)
+	case ClosureType:
+		e.strings(v.Closure.Args)
+		e.frame(v.Closure.Body)
+	case StructType:
+		e.string(v.Struct.TypeName)
+		e.strings(v.Struct.FieldNames)
+		e.values(v.Struct.FieldValues)
+	case NullType, "":
+	default:
+		if e.err == nil {
+			e.err = fmt.Errorf("can not serialize value of type %s", v.Kind)
+		}
+	}
+}
+
+// decoder is the inverse of encoder
+type decoder struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (d *decoder) uint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadUvarint(d.r)
+	d.err = unexpectedEOF(err)
+	return n
+}
+
+func (d *decoder) int() int64 {
+	if d.err != nil {
+		return 0
+	}
+	n, err := binary.ReadVarint(d.r)
+	d.err = unexpectedEOF(err)
+	return n
+}
+
+func (d *decoder) bool() bool {
+	return d.uint() == 1
+}
+
+func (d *decoder) float() float64 {
+	if d.err != nil {
+		return 0
+	}
+	var bits uint64
+	d.err = unexpectedEOF(binary.Read(d.r, binary.LittleEndian, &bits))
+	return math.Float64frombits(bits)
+}
+
+func (d *decoder) string() string {
+	length := d.uint()
+	if d.err != nil {
+		return ""
+	}
+	// Read in chunks so a corrupt length can not allocate a huge buffer up front
+	var buf []byte
+	chunk := make([]byte, 4096)
+	for uint64(len(buf)) < length {
+		n := length - uint64(len(buf))
+		if n > uint64(len(chunk)) {
+			n = uint64(len(chunk))
+		}
+		if _, err := io.ReadFull(d.r, chunk[:n]); err != nil {
+			d.err = unexpectedEOF(err)
+			return ""
+		}
+		buf = append(buf, chunk[:n]...)
+	}
+	return string(buf)
+}
+
+func (d *decoder) strings() []string {
+	count := d.uint()
+	strs := []string{}
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		strs = append(strs, d.string())
+	}
+	return strs
+}
+
+func (d *decoder) frame() *Frame {
+	f := Frame{}
+	f.New("")
+	numInstructions := d.uint()
+	for i := uint64(0); i < numInstructions && d.err == nil; i++ {
+		opcode := int(d.uint())
+		arg1 := int(d.int())
+		arg2 := int(d.int())
+		f.Code = append(f.Code, Instruction{Opcode: opcode, Arg1: arg1, Arg2: arg2})
+	}
+	f.Constants = d.values()
+	f.Variables = d.values()
+	numNames := d.uint()
+	for i := uint64(0); i < numNames && d.err == nil; i++ {
+		name := d.string()
+		f.VariableMap[name] = int(d.int())
+	}
+	f.FunctionArguments = d.strings()
+	f.Variadic = d.bool()
+	f.NumOptional = int(d.int())
+	f.NumKeys = int(d.int())
+	f.Names = d.strings()
+	f.IsRootFrame = d.bool()
+	numLines := d.uint()
+	for i := uint64(0); i < numLines && d.err == nil; i++ {
+		f.LineMap = append(f.LineMap, int(d.int()))
+	}
+	f.FilePath = d.string()
+	f.FunctionName = d.string()
+	if d.err == nil && len(f.LineMap) != len(f.Code) {
+		d.err = errors.New("line map does not match code")
+	}
+	return &f
+}
+
+func (d *decoder) values() []Value {
+	count := d.uint()
+	values := []Value{}
+	for i := uint64(0); i < count && d.err == nil; i++ {
+		values = append(values, d.value())
+	}
+	return values
+}
+
+func (d *decoder) value() Value {
+	v := Value{Kind: d.string()}
+	switch v.Kind {
+	case NumType:
+		v.Num = d.float()
+	case BoolType:
+		v.Bool = d.bool()
+	case StringType, SymbolType:
+		v.String = d.string()
+	case ListType:
+		v.List = d.values()
+	case ClosureType:
+		v.Closure.Args = d.strings()
+		v.Closure.Body = d.frame()
+	case StructType:
+		v.Struct.TypeName = d.string()
+		v.Struct.FieldNames = d.strings()
+		v.Struct.FieldValues = d.values()
+	case NullType, "":
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("unknown value type %s", v.Kind)
+		}
+	}
+	return v
+}
+
+// unexpectedEOF turns an EOF in the middle of the file into an error that says so
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -3,6 +3,7 @@ package vm
 import (
 	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/benbanerjeerichards/lisp-calculator/ast"
 	"github.com/benbanerjeerichards/lisp-calculator/types"
@@ -17,6 +18,12 @@ type Compiler struct {
 	FunctionNames     []string
 	Structs           [][]string
 	StructMap         map[string]int
+	// Interactive compiles every top level form in order and never calls main, so that the
+	// same compiler can be used to compile many inputs (e.g. the REPL)
+	Interactive bool
+	// Tests declared in the program currently being compiled
+	tests    []TestDecl
+	builtins *BuiltinRegistry
 }
 
 func (c *Compiler) New() {
@@ -26,6 +33,44 @@ func (c *Compiler) New() {
 	c.GlobalVariables = make([]Value, 0)
 	c.Structs = make([][]string, 0)
 	c.StructMap = make(map[string]int)
+	c.builtins = &BuiltinRegistry{}
+	c.builtins.New()
+}
+
+// SetBuiltins sets the builtins that can be called, which are then used by the evalulator to run the program
+func (c *Compiler) SetBuiltins(builtins *BuiltinRegistry) {
+	c.builtins = builtins
+}
+
+// Copy returns a compiler with the same declarations that can be used without affecting this one
+func (c *Compiler) Copy() Compiler {
+	copied := Compiler{Interactive: c.Interactive}
+	copied.New()
+	copied.builtins = c.builtins
+	copied.GlobalVariables = append(copied.GlobalVariables, c.GlobalVariables...)
+	copied.Functions = append(copied.Functions, c.Functions...)
+	copied.FunctionNames = append(copied.FunctionNames, c.FunctionNames...)
+	copied.Structs = append(copied.Structs, c.Structs...)
+	for name, idx := range c.GlobalVariableMap {
+		copied.GlobalVariableMap[name] = idx
+	}
+	for name, idx := range c.FunctionMap {
+		copied.FunctionMap[name] = idx
+	}
+	for name, idx := range c.StructMap {
+		copied.StructMap[name] = idx
+	}
+	return copied
+}
+
+// DeclareGlobal returns the index of a global variable, declaring it if it does not exist
+func (c *Compiler) DeclareGlobal(name string) int {
+	if idx, ok := c.GlobalVariableMap[name]; ok {
+		return idx
+	}
+	c.GlobalVariables = append(c.GlobalVariables, Value{})
+	c.GlobalVariableMap[name] = len(c.GlobalVariables) - 1
+	return len(c.GlobalVariables) - 1
 }
 
 type CompileResult struct {
@@ -35,6 +80,19 @@ type CompileResult struct {
 	MainIndex       int
 	FunctionNames   []string
 	Structs         []StructDecl
+	// GlobalNames is the name of each global, indexed in the same way as GlobalVariables
+	GlobalNames []string
+	Tests       []TestDecl
+	// Builtins called by the program, which must be used to run it
+	Builtins *BuiltinRegistry
+}
+
+// TestDecl is a test declared with deftest. Its frame is only run by the test runner
+type TestDecl struct {
+	Name     string
+	FilePath string
+	Line     int
+	Frame    *Frame
 }
 
 type StructDecl struct {
@@ -43,15 +101,24 @@ type StructDecl struct {
 }
 
 // CompileProgram compiles the given AST into bytecode
-func (c *Compiler) CompileProgram(startPath string, asts []ast.Ast) (CompileResult, error) {
+func (c *Compiler) CompileProgram(startPath string, asts []ast.Ast) (_ CompileResult, err error) {
 	frame := Frame{}
 	frame.New(startPath)
 	frame.IsRootFrame = true
 	mainIndex := -1
+	c.tests = []TestDecl{}
 
+	// Functions are declared before any of them are compiled, so if the program fails to compile the functions are
+	// put back to how they were, rather than being left with a signature (or body) that was never compiled
+	previousFunctions := append([]*Frame{}, c.Functions...)
+	defer func() {
+		if err != nil {
+			c.restoreFunctions(previousFunctions)
+		}
+	}()
 	c.processDeclarations(asts)
 
-	// Compile all function declarations first
+	// Compile all function (and test) declarations first
 	for i := range asts {
 		if asts[i].Kind == ast.StmtType {
 			if funDefStmt, ok := asts[i].Statement.(ast.FuncDefStmt); ok {
@@ -62,10 +129,18 @@ func (c *Compiler) CompileProgram(startPath string, asts []ast.Ast) (CompileResu
 					return CompileResult{}, err
 				}
 			}
+			if testDefStmt, ok := asts[i].Statement.(ast.TestDefStmt); ok {
+				testDefStmt.FilePath = asts[i].FilePath
+				asts[i].Statement = testDefStmt
+				err := c.compileAst(asts[i], &frame)
+				if err != nil {
+					return CompileResult{}, err
+				}
+			}
 		}
 	}
 
-	if mainIdx, ok := c.FunctionMap["main"]; ok {
+	if mainIdx, ok := c.FunctionMap["main"]; ok && !c.Interactive {
 		// If we are calling main, we need to first evalulate all global variables
 		for _, exprOrStmt := range asts {
 			if exprOrStmt.Kind == ast.StmtType {
@@ -84,7 +159,7 @@ func (c *Compiler) CompileProgram(startPath string, asts []ast.Ast) (CompileResu
 		} else if len(c.Functions[mainIdx].FunctionArguments) > 1 {
 			return CompileResult{}, types.Error{Simple: "Main function must take zero or one argument"}
 		}
-		frame.EmitUnary(CALL_FUNCTION, mainIdx, -1)
+		frame.EmitBinary(CALL_FUNCTION, mainIdx, len(c.Functions[mainIdx].FunctionArguments), -1)
 	} else {
 		for _, exprOrStmt := range asts {
 			if exprOrStmt.Kind == ast.ExprType {
@@ -95,7 +170,8 @@ func (c *Compiler) CompileProgram(startPath string, asts []ast.Ast) (CompileResu
 			} else {
 				_, isFunction := exprOrStmt.Statement.(ast.FuncDefStmt)
 				_, isStructDef := exprOrStmt.Statement.(ast.StructDefStmt)
-				if !isFunction && !isStructDef {
+				_, isTest := exprOrStmt.Statement.(ast.TestDefStmt)
+				if !isFunction && !isStructDef && !isTest {
 					err := c.compileAst(exprOrStmt, &frame)
 					if err != nil {
 						return CompileResult{}, err
@@ -110,32 +186,65 @@ func (c *Compiler) CompileProgram(startPath string, asts []ast.Ast) (CompileResu
 		structs[fieldIdx] = StructDecl{Name: name, FieldNames: c.Structs[fieldIdx]}
 	}
 
+	globalNames := make([]string, len(c.GlobalVariables))
+	for name, globalIdx := range c.GlobalVariableMap {
+		globalNames[globalIdx] = name
+	}
+
 	return CompileResult{Frame: frame, Functions: c.Functions, GlobalVariables: c.GlobalVariables,
-		MainIndex: mainIndex, FunctionNames: c.FunctionNames, Structs: structs}, nil
+		MainIndex: mainIndex, FunctionNames: c.FunctionNames, Structs: structs, GlobalNames: globalNames,
+		Tests: c.tests, Builtins: c.builtins}, nil
 }
 
 // processDeclarations ensures that all declared symbols (functions, globals & structs) are known about
 // Must be done in initial pass location of declarations in code does not matter - e.g. functions can be used
 // before declaration
+// Symbols that are already known keep their index, so redeclaring them replaces the existing definition
 func (c *Compiler) processDeclarations(asts []ast.Ast) {
 	for _, exprOrStmt := range asts {
 		if exprOrStmt.Kind == ast.StmtType {
 			switch stmt := exprOrStmt.Statement.(type) {
 			case ast.FuncDefStmt:
-				c.Functions = append(c.Functions, &Frame{})
-				c.FunctionMap[stmt.Identifier] = len(c.Functions) - 1
-				c.FunctionNames = append(c.FunctionNames, stmt.Identifier)
+				// Calls are compiled against the function's signature, which is known before its body is compiled
+				if idx, ok := c.FunctionMap[stmt.Identifier]; ok {
+					declared := *c.Functions[idx]
+					setSignature(&declared, stmt.Params)
+					c.Functions[idx] = &declared
+				} else {
+					declared := Frame{}
+					setSignature(&declared, stmt.Params)
+					c.Functions = append(c.Functions, &declared)
+					c.FunctionMap[stmt.Identifier] = len(c.Functions) - 1
+					c.FunctionNames = append(c.FunctionNames, stmt.Identifier)
+				}
 			case ast.StructDefStmt:
-				c.Structs = append(c.Structs, stmt.FieldNames)
-				c.StructMap[stmt.Identifier] = len(c.Structs) - 1
+				if idx, ok := c.StructMap[stmt.Identifier]; ok {
+					c.Structs[idx] = stmt.FieldNames
+				} else {
+					c.Structs = append(c.Structs, stmt.FieldNames)
+					c.StructMap[stmt.Identifier] = len(c.Structs) - 1
+				}
 			case ast.VarDefStmt:
-				c.GlobalVariables = append(c.GlobalVariables, Value{})
-				c.GlobalVariableMap[stmt.Identifier] = len(c.GlobalVariables) - 1
+				if _, ok := c.GlobalVariableMap[stmt.Identifier]; !ok {
+					c.GlobalVariables = append(c.GlobalVariables, Value{})
+					c.GlobalVariableMap[stmt.Identifier] = len(c.GlobalVariables) - 1
+				}
 			}
 		}
 	}
 }
 
+// restoreFunctions puts back the functions that were declared when previous was taken, removing any declared since
+func (c *Compiler) restoreFunctions(previous []*Frame) {
+	for _, name := range c.FunctionNames[len(previous):] {
+		delete(c.FunctionMap, name)
+	}
+	// Copied back rather than replaced, as the evalulator may share the slice from the last program compiled
+	copy(c.Functions, previous)
+	c.Functions = c.Functions[:len(previous)]
+	c.FunctionNames = c.FunctionNames[:len(previous)]
+}
+
 func (c *Compiler) compileAst(theAst ast.Ast, frame *Frame) error {
 	var err error
 	if theAst.Kind == ast.ExprType {
@@ -202,46 +311,31 @@ func (c *Compiler) compileExpression(exprNode ast.Expr, frame *Frame) error {
 			}
 		}
 		frame.EmitUnary(CREATE_LIST, len(expr.Value), expr.Range.Start.Line)
+	case ast.QuoteExpr:
+		return c.compileDatum(expr.Datum, frame)
 	case ast.IfElseExpr:
-		err := c.compileExpression(expr.Condition, frame)
-		if err != nil {
-			return err
-		}
-		frame.EmitUnary(COND_JUMP_FALSE, 0, expr.Range.Start.Line)
-		condJumpInstrIdx := len(frame.Code) - 1
-		err = c.compileBlock(expr.IfBranch, frame)
-		if err != nil {
-			return err
-		}
-		frame.Code[condJumpInstrIdx].Arg1 = len(frame.Code) - condJumpInstrIdx
-		frame.EmitUnary(JUMP, 0, expr.Range.Start.Line)
-		ifJumpIndx := len(frame.Code) - 1
-		err = c.compileBlock(expr.ElseBranch, frame)
-		if err != nil {
-			return err
-		}
-		frame.Code[ifJumpIndx].Arg1 = len(frame.Code) - (ifJumpIndx + 1)
+		return c.compileIfElse(expr, frame, false)
 	case ast.IfOnlyExpr:
-		err := c.compileExpression(expr.Condition, frame)
-		if err != nil {
-			return err
-		}
-		frame.EmitUnary(COND_JUMP_FALSE, 0, expr.Range.Start.Line)
-		condJumpInstrIdx := len(frame.Code) - 1
-		err = c.compileBlock(expr.IfBranch, frame)
-		if err != nil {
-			return err
-		}
-		frame.Code[condJumpInstrIdx].Arg1 = len(frame.Code) - condJumpInstrIdx
-		frame.EmitUnary(JUMP, 1, expr.Range.Start.Line)
-		frame.Emit(STORE_NULL, expr.Range.Start.Line)
+		return c.compileIfOnly(expr, frame, false)
+	case ast.LetExpr:
+		return c.compileLet(expr, frame, false)
+	case ast.ForExpr:
+		return c.compileFor(expr, frame)
+	case ast.ForeachExpr:
+		return c.compileForeach(expr, frame)
+	case ast.CondExpr:
+		return c.compileCond(expr, frame, false)
+	case ast.MatchExpr:
+		return c.compileMatch(expr, frame, false)
+	case ast.TryExpr:
+		return c.compileTry(expr, frame)
 	case ast.VarUseExpr:
 		if idx, ok := frame.VariableMap[expr.Identifier]; ok {
 			frame.EmitUnary(LOAD_VAR, idx, expr.Range.Start.Line)
 		} else if idx, ok := c.GlobalVariableMap[expr.Identifier]; ok {
 			frame.EmitUnary(LOAD_GLOBAL, idx, expr.Range.Start.Line)
 		} else {
-			return types.Error{Range: expr.GetRange(), Simple: fmt.Sprintf("Unknown variable %s", expr.Identifier)}
+			return unknownVariable(frame, expr.Identifier, expr.GetRange(), fmt.Sprintf("Unknown variable %s", expr.Identifier))
 		}
 	case ast.StructExpr:
 		if structIdx, ok := c.StructMap[expr.StructIdentifier]; ok {
@@ -285,90 +379,1046 @@ func (c *Compiler) compileExpression(exprNode ast.Expr, frame *Frame) error {
 	case ast.ClosureDefExpr:
 		closureFrame := Frame{}
 		closureFrame.New(frame.FilePath)
-		// Capture all variables in current scope
+		// Capture all variables in current scope. Globals are not captured, they are accessed directly
 		closureFrame.VariableMap = make(map[string]int)
 		closureFrame.Variables = make([]Value, 0)
 
 		for name, index := range frame.VariableMap {
 			closureFrame.VariableMap[name] = index
-			closureFrame.Variables = append(closureFrame.Variables, frame.Variables[index])
 		}
-		// Capture globals as vars
-		for range c.GlobalVariables {
-			closureFrame.Variables = append(closureFrame.Variables, Value{})
+		for name, slots := range frame.scopeEnded {
+			closureFrame.scopeEnded[name] = append([]int{}, slots...)
 		}
-		for globalName, globalIdx := range c.GlobalVariableMap {
-			closureFrame.VariableMap[globalName] = globalIdx + len(frame.Variables)
+		for range frame.Variables {
+			closureFrame.Variables = append(closureFrame.Variables, Value{})
 		}
 
-		// Push arguments onto stack
-		for i := range expr.Args {
-			argName := expr.Args[len(expr.Args)-(i+1)]
-			closureFrame.Variables = append(closureFrame.Variables, Value{})
-			closureFrame.VariableMap[argName] = len(closureFrame.Variables) - 1
-			closureFrame.EmitUnary(STORE_VAR, len(closureFrame.Variables)-1, expr.Range.Start.Line)
+		err := c.compileParams(expr.Params, &closureFrame, expr.Range.Start.Line)
+		if err != nil {
+			return err
 		}
-		err := c.compileBlock(expr.Body, &closureFrame)
+		err = c.compileTailBlock(expr.Body, &closureFrame)
 		if err != nil {
 			return err
 		}
 
 		// Closure is a value that needs to be pushed to top of stack
 		closureValue := Value{}
-		closureValue.NewClosure(expr.Args, &closureFrame)
+		closureValue.NewClosure(closureFrame.FunctionArguments, &closureFrame)
 		frame.Constants = append(frame.Constants, closureValue)
 		frame.EmitUnary(LOAD_CONST, len(frame.Constants)-1, expr.Range.Start.Line)
 
-		// Now capture the values of the variables
-		for sourceIndex := range frame.Variables {
+		// Now capture the variables, which are in this order: <captured vars><lambda arguments><closure variables>.
+		// Only variables that are in scope can be used by the closure, so the slots that the compiler uses itself
+		// (such as the stack height of a loop) are never captured
+		for _, sourceIndex := range frame.scopeSlots() {
 			frame.EmitBinary(PUSH_CLOSURE_VAR, sourceIndex, sourceIndex, expr.Range.Start.Line)
 		}
-		// Now capture globals - closures can not access or modify globals, only capture them into variables
-		// From langauge user POV, this means that globals can only be read from closure and and changes exist only within
-		// the closure
-		for globalIndex := range c.GlobalVariables {
-			// Target index set  - see above capturing logic.
-			// Variables are in this order: <captured vars><captured globals><lambda arguments><closure variables>
-			frame.EmitBinary(PUSH_GLOBAL_CLOSURE_VAR, globalIndex, len(frame.Variables)+globalIndex, expr.Range.Start.Line)
-		}
 	case ast.ClosureApplicationExpr:
-		for _, arg := range expr.Args {
-			err := c.compileExpression(arg, frame)
+		return c.compileClosureApplication(expr, frame, false)
+	case ast.FunctionApplicationExpr:
+		return c.compileFunctionApplication(expr, frame, false)
+	default:
+		return errors.New(fmt.Sprintf("unsupported ast type %s", exprNode))
+	}
+
+	return nil
+}
+
+// compileTailBlock compiles a body whose last form is in tail position, so that a call there reuses the activation
+// of the call that is running it
+func (c *Compiler) compileTailBlock(asts []ast.Ast, frame *Frame) error {
+	if len(asts) == 0 {
+		return nil
+	}
+	err := c.compileBlock(asts[:len(asts)-1], frame)
+	if err != nil {
+		return err
+	}
+	last := asts[len(asts)-1]
+	if last.Kind == ast.ExprType {
+		return c.compileTailExpression(last.Expression, frame)
+	}
+	return c.compileBlock(asts[len(asts)-1:], frame)
+}
+
+// compileTailExpression compiles an expression in tail position - its value is returned by the frame
+func (c *Compiler) compileTailExpression(exprNode ast.Expr, frame *Frame) error {
+	if len(frame.handlers) > 0 {
+		// The try has to end after the call returns, so the call can not replace the frame
+		return c.compileExpression(exprNode, frame)
+	}
+	switch expr := exprNode.(type) {
+	case ast.IfElseExpr:
+		return c.compileIfElse(expr, frame, true)
+	case ast.IfOnlyExpr:
+		return c.compileIfOnly(expr, frame, true)
+	case ast.LetExpr:
+		return c.compileLet(expr, frame, true)
+	case ast.CondExpr:
+		return c.compileCond(expr, frame, true)
+	case ast.MatchExpr:
+		return c.compileMatch(expr, frame, true)
+	case ast.ClosureApplicationExpr:
+		return c.compileClosureApplication(expr, frame, true)
+	case ast.FunctionApplicationExpr:
+		return c.compileFunctionApplication(expr, frame, true)
+	}
+	return c.compileExpression(exprNode, frame)
+}
+
+func (c *Compiler) compileBranch(asts []ast.Ast, frame *Frame, tail bool) error {
+	if tail {
+		return c.compileTailBlock(asts, frame)
+	}
+	return c.compileBlock(asts, frame)
+}
+
+func (c *Compiler) compileIfElse(expr ast.IfElseExpr, frame *Frame, tail bool) error {
+	err := c.compileExpression(expr.Condition, frame)
+	if err != nil {
+		return err
+	}
+	frame.EmitUnary(COND_JUMP_FALSE, 0, expr.Range.Start.Line)
+	condJumpInstrIdx := len(frame.Code) - 1
+	err = c.compileBranch(expr.IfBranch, frame, tail)
+	if err != nil {
+		return err
+	}
+	frame.Code[condJumpInstrIdx].Arg1 = len(frame.Code) - condJumpInstrIdx
+	frame.EmitUnary(JUMP, 0, expr.Range.Start.Line)
+	ifJumpIndx := len(frame.Code) - 1
+	err = c.compileBranch(expr.ElseBranch, frame, tail)
+	if err != nil {
+		return err
+	}
+	frame.Code[ifJumpIndx].Arg1 = len(frame.Code) - (ifJumpIndx + 1)
+	return nil
+}
+
+func (c *Compiler) compileIfOnly(expr ast.IfOnlyExpr, frame *Frame, tail bool) error {
+	err := c.compileExpression(expr.Condition, frame)
+	if err != nil {
+		return err
+	}
+	frame.EmitUnary(COND_JUMP_FALSE, 0, expr.Range.Start.Line)
+	condJumpInstrIdx := len(frame.Code) - 1
+	err = c.compileBranch(expr.IfBranch, frame, tail)
+	if err != nil {
+		return err
+	}
+	frame.Code[condJumpInstrIdx].Arg1 = len(frame.Code) - condJumpInstrIdx
+	frame.EmitUnary(JUMP, 1, expr.Range.Start.Line)
+	frame.Emit(STORE_NULL, expr.Range.Start.Line)
+	return nil
+}
+
+// compileLet gives each variable of a let a slot, which is only in scope for its body. Once the body is compiled the
+// slots can be reused by a later let
+func (c *Compiler) compileLet(expr ast.LetExpr, frame *Frame, tail bool) error {
+	slots := make([]int, len(expr.Bindings))
+	shadowed := make(map[string]int)
+	bind := func(i int) {
+		binding := expr.Bindings[i]
+		if idx, ok := frame.VariableMap[binding.Identifier]; ok {
+			shadowed[binding.Identifier] = idx
+		}
+		frame.VariableMap[binding.Identifier] = slots[i]
+	}
+
+	if expr.Sequential {
+		for i, binding := range expr.Bindings {
+			err := c.compileExpression(binding.Value, frame)
 			if err != nil {
 				return err
 			}
+			slots[i] = frame.allocateSlot()
+			frame.EmitUnary(BIND_VAR, slots[i], binding.Range.Start.Line)
+			bind(i)
+		}
+	} else {
+		// Every value is evaluated before any of the variables are in scope
+		for _, binding := range expr.Bindings {
+			err := c.compileExpression(binding.Value, frame)
+			if err != nil {
+				return err
+			}
+		}
+		for i := range expr.Bindings {
+			slots[i] = frame.allocateSlot()
+		}
+		for i := len(expr.Bindings) - 1; i >= 0; i-- {
+			frame.EmitUnary(BIND_VAR, slots[i], expr.Bindings[i].Range.Start.Line)
+		}
+		for i := range expr.Bindings {
+			bind(i)
+		}
+	}
+
+	err := c.compileBranch(expr.Body, frame, tail)
+	if err != nil {
+		return err
+	}
+
+	for i, binding := range expr.Bindings {
+		if idx, ok := shadowed[binding.Identifier]; ok {
+			frame.VariableMap[binding.Identifier] = idx
+		} else {
+			delete(frame.VariableMap, binding.Identifier)
+		}
+		frame.scopeEnded[binding.Identifier] = append(frame.scopeEnded[binding.Identifier], slots[i])
+		frame.freeSlots = append(frame.freeSlots, slots[i])
+	}
+	return nil
+}
+
+// compileCond compiles a cond to a chain of tests, where each test that is false jumps to the next. A cond without an
+// else is null if no test is true
+func (c *Compiler) compileCond(expr ast.CondExpr, frame *Frame, tail bool) error {
+	endJumps := []int{}
+	for _, clause := range expr.Clauses {
+		err := c.compileExpression(clause.Condition, frame)
+		if err != nil {
+			return err
+		}
+		frame.EmitUnary(COND_JUMP_FALSE, 0, clause.Range.Start.Line)
+		condJumpIdx := len(frame.Code) - 1
+		err = c.compileBranch(clause.Body, frame, tail)
+		if err != nil {
+			return err
+		}
+		frame.EmitUnary(JUMP, 0, clause.Range.Start.Line)
+		endJumps = append(endJumps, len(frame.Code)-1)
+		frame.Code[condJumpIdx].Arg1 = len(frame.Code) - 1 - condJumpIdx
+	}
+	if expr.Else != nil {
+		err := c.compileBranch(expr.Else, frame, tail)
+		if err != nil {
+			return err
+		}
+	} else {
+		frame.Emit(STORE_NULL, expr.Range.Start.Line)
+	}
+	for _, jumpIdx := range endJumps {
+		frame.Code[jumpIdx].Arg1 = len(frame.Code) - 1 - jumpIdx
+	}
+	return nil
+}
+
+// matchScope is what the pattern of a match clause needs whilst it is compiled - the variables it binds, the slots
+// holding the parts of the value that it looks at and the jumps to the next clause for when the pattern fails
+type matchScope struct {
+	names     []string
+	bindings  []int
+	slots     []int
+	failJumps []int
+}
+
+// compileMatch compiles a match to a chain of patterns. The value is kept in a slot, and each pattern tests it (and
+// its parts) in turn, jumping to the next clause as soon as a test fails
+func (c *Compiler) compileMatch(expr ast.MatchExpr, frame *Frame, tail bool) error {
+	line := expr.Range.Start.Line
+	err := c.compileExpression(expr.Value, frame)
+	if err != nil {
+		return err
+	}
+	valueSlot := frame.allocateSlot()
+	frame.EmitUnary(BIND_VAR, valueSlot, line)
+
+	endJumps := []int{}
+	for i, clause := range expr.Clauses {
+		scope := matchScope{}
+		err := c.compilePattern(clause.Pattern, valueSlot, frame, &scope)
+		if err != nil {
+			return err
+		}
+		shadowed := make(map[string]int)
+		for i, name := range scope.names {
+			if idx, ok := frame.VariableMap[name]; ok {
+				shadowed[name] = idx
+			}
+			frame.VariableMap[name] = scope.bindings[i]
 		}
-		err := c.compileExpression(expr.Closure, frame)
+		err = c.compileBranch(clause.Body, frame, tail)
 		if err != nil {
 			return err
 		}
-		frame.Emit(CALL_CLOSURE, expr.Range.Start.Line)
-	case ast.FunctionApplicationExpr:
-		for _, arg := range expr.Args {
-			err := c.compileExpression(arg, frame)
+		for i, name := range scope.names {
+			if idx, ok := shadowed[name]; ok {
+				frame.VariableMap[name] = idx
+			} else {
+				delete(frame.VariableMap, name)
+			}
+			frame.scopeEnded[name] = append(frame.scopeEnded[name], scope.bindings[i])
+		}
+		frame.freeSlots = append(frame.freeSlots, scope.slots...)
+		if len(scope.failJumps) == 0 && i == len(expr.Clauses)-1 {
+			// The last pattern matches every value, so there is no need to handle nothing matching
+			frame.freeSlots = append(frame.freeSlots, valueSlot)
+			break
+		}
+		frame.EmitUnary(JUMP, 0, clause.Range.Start.Line)
+		endJumps = append(endJumps, len(frame.Code)-1)
+		for _, jumpIdx := range scope.failJumps {
+			frame.Code[jumpIdx].Arg1 = len(frame.Code) - 1 - jumpIdx
+		}
+		if i < len(expr.Clauses)-1 {
+			continue
+		}
+		rangeValue := Value{}
+		rangeValue.NewString(expr.Range.String())
+		frame.Constants = append(frame.Constants, rangeValue)
+		frame.EmitUnary(LOAD_VAR, valueSlot, line)
+		frame.EmitUnary(NO_MATCH, len(frame.Constants)-1, line)
+		frame.freeSlots = append(frame.freeSlots, valueSlot)
+	}
+	for _, jumpIdx := range endJumps {
+		frame.Code[jumpIdx].Arg1 = len(frame.Code) - 1 - jumpIdx
+	}
+	return nil
+}
+
+// compilePattern compiles the tests of a pattern against the value in slot
+func (c *Compiler) compilePattern(pattern ast.Pattern, slot int, frame *Frame, scope *matchScope) error {
+	line := pattern.GetRange().Start.Line
+	switch p := pattern.(type) {
+	case ast.WildcardPattern:
+	case ast.BindPattern:
+		scope.names = append(scope.names, p.Identifier)
+		scope.bindings = append(scope.bindings, slot)
+	case ast.LiteralPattern:
+		frame.EmitUnary(LOAD_VAR, slot, line)
+		err := c.compileExpression(p.Value, frame)
+		if err != nil {
+			return err
+		}
+		c.compileBuiltinCall(frame, "=", 2, line)
+		c.compilePatternTest(frame, scope, line)
+	case ast.ListPattern:
+		c.compileTypeTest(ListType, slot, frame, scope, line)
+		frame.EmitUnary(LOAD_VAR, slot, line)
+		c.compileBuiltinCall(frame, "length", 1, line)
+		length := Value{}
+		length.NewNum(float64(len(p.Items)))
+		frame.emitConst(length, line)
+		c.compileBuiltinCall(frame, "=", 2, line)
+		c.compilePatternTest(frame, scope, line)
+		for i, item := range p.Items {
+			if _, ok := item.(ast.WildcardPattern); ok {
+				continue
+			}
+			index := Value{}
+			index.NewNum(float64(i))
+			frame.emitConst(index, item.GetRange().Start.Line)
+			frame.EmitUnary(LOAD_VAR, slot, item.GetRange().Start.Line)
+			c.compileBuiltinCall(frame, "nth", 2, item.GetRange().Start.Line)
+			err := c.compileSubPattern(item, frame, scope)
 			if err != nil {
 				return err
 			}
 		}
-		if idx, builtinFunc, ok := lookupBuiltin(expr.Identifier); ok {
-			if len(expr.Args) != builtinFunc.NumArgs {
-				return types.Error{Range: expr.GetRange(), Simple: fmt.Sprintf("Expected %d arguments, got %d", builtinFunc.NumArgs, len(expr.Args))}
+	case ast.StructPattern:
+		structIdx, ok := c.StructMap[p.StructIdentifier]
+		if !ok {
+			return types.Error{Range: p.Range, Simple: fmt.Sprintf("Use of undeclared struct %s", p.StructIdentifier)}
+		}
+		for _, field := range p.Fields {
+			if !hasField(c.Structs[structIdx], field.FieldIdentifier) {
+				return types.Error{Range: field.Range, Simple: fmt.Sprintf("Struct has no field %s", field.FieldIdentifier)}
 			}
-			frame.EmitUnary(CALL_BUILTIN, idx, expr.Range.Start.Line)
-		} else if idx, ok := frame.VariableMap[expr.Identifier]; ok {
-			frame.EmitUnary(LOAD_VAR, idx, expr.Range.Start.Line)
-		} else if idx, ok := c.GlobalVariableMap[expr.Identifier]; ok {
-			frame.EmitUnary(LOAD_GLOBAL, idx, expr.Range.Start.Line)
-		} else if idx, ok := c.FunctionMap[expr.Identifier]; ok {
-			frame.EmitUnary(CALL_FUNCTION, idx, expr.Range.Start.Line)
-		} else {
-			spew.Dump(c.FunctionMap)
-			return types.Error{Range: expr.Range, Simple: fmt.Sprintf("Unknown identifier %s", expr.Identifier)}
+		}
+		c.compileTypeTest(p.StructIdentifier, slot, frame, scope, line)
+		for _, field := range p.Fields {
+			if _, ok := field.Pattern.(ast.WildcardPattern); ok {
+				continue
+			}
+			frame.EmitUnary(LOAD_VAR, slot, field.Range.Start.Line)
+			frame.EmitUnary(STRUCT_FIELD_INDEX, getNameIndex(field.FieldIdentifier, frame), field.Range.Start.Line)
+			frame.Emit(GET_STRUCT_FIELD, field.Range.Start.Line)
+			err := c.compileSubPattern(field.Pattern, frame, scope)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compileSubPattern compiles a pattern against the part of a value at the top of stack, which is kept in a new slot
+func (c *Compiler) compileSubPattern(pattern ast.Pattern, frame *Frame, scope *matchScope) error {
+	slot := frame.allocateSlot()
+	scope.slots = append(scope.slots, slot)
+	frame.EmitUnary(BIND_VAR, slot, pattern.GetRange().Start.Line)
+	return c.compilePattern(pattern, slot, frame, scope)
+}
+
+// compileTypeTest tests that the value in slot has the type kind, which is the name of the struct for a struct
+func (c *Compiler) compileTypeTest(kind string, slot int, frame *Frame, scope *matchScope, line int) {
+	frame.EmitUnary(LOAD_VAR, slot, line)
+	frame.EmitUnary(IS_TYPE, getNameIndex(kind, frame), line)
+	c.compilePatternTest(frame, scope, line)
+}
+
+// compilePatternTest jumps to the next clause if the bool at the top of stack is false
+func (c *Compiler) compilePatternTest(frame *Frame, scope *matchScope, line int) {
+	frame.EmitUnary(COND_JUMP_FALSE, 0, line)
+	scope.failJumps = append(scope.failJumps, len(frame.Code)-1)
+}
+
+func (c *Compiler) compileBuiltinCall(frame *Frame, identifier string, numArgs int, line int) {
+	idx, _, _ := c.builtins.Lookup(identifier)
+	frame.EmitBinary(CALL_BUILTIN, idx, numArgs, line)
+}
+
+// compileDatum pushes the value of code that is quoted, evalulating the code that is unquoted
+func (c *Compiler) compileDatum(datum ast.Datum, frame *Frame) error {
+	line := datum.Range.Start.Line
+	switch datum.Kind {
+	case ast.UnquoteDatum:
+		return c.compileExpression(datum.Expr, frame)
+	case ast.ListDatum:
+		// The items between each splice are made into a list, and then every list is appended together
+		numLists := 0
+		numItems := 0
+		spliced := false
+		for _, item := range datum.Items {
+			if item.Kind != ast.SpliceDatum {
+				err := c.compileDatum(item, frame)
+				if err != nil {
+					return err
+				}
+				numItems++
+				continue
+			}
+			if numItems > 0 {
+				frame.EmitUnary(CREATE_LIST, numItems, line)
+				numLists++
+				numItems = 0
+			}
+			err := c.compileExpression(item.Expr, frame)
+			if err != nil {
+				return err
+			}
+			numLists++
+			spliced = true
+		}
+		if numItems > 0 || numLists == 0 {
+			frame.EmitUnary(CREATE_LIST, numItems, line)
+			numLists++
+		}
+		if spliced {
+			frame.EmitUnary(CONCAT_LISTS, numLists, line)
 		}
 	default:
-		return errors.New(fmt.Sprintf("unsupported ast type %s", exprNode))
+		val := DatumValue(datum)
+		// The range is only needed for code passed to a macro
+		val.Range = nil
+		frame.emitConst(val, line)
+	}
+	return nil
+}
+
+// emitConst pushes a constant onto the stack
+func (f *Frame) emitConst(val Value, line int) {
+	f.Constants = append(f.Constants, val)
+	f.EmitUnary(LOAD_CONST, len(f.Constants)-1, line)
+}
+
+func hasField(fieldNames []string, name string) bool {
+	for _, fieldName := range fieldNames {
+		if fieldName == name {
+			return true
+		}
 	}
+	return false
+}
 
+// loopScope is a loop whilst it is being compiled. Its breaks and continues jump to the end of the loop and to the
+// start of its next iteration, which are set once they are known
+type loopScope struct {
+	// Number of trys that the loop is in, which a break or continue does not leave
+	handlers int
+	// Slot of the height of the stack when the loop started, which a break or continue returns the stack to
+	heightSlot    int
+	breakJumps    []int
+	continueJumps []int
+}
+
+// pushLoop starts a loop, saving the height of the stack so that a break or continue in the middle of an expression
+// can remove what the expression left on the stack
+func (f *Frame) pushLoop(line int) {
+	heightSlot := f.allocateSlot()
+	f.EmitUnary(SAVE_STACK_HEIGHT, heightSlot, line)
+	f.loops = append(f.loops, loopScope{handlers: len(f.handlers), heightSlot: heightSlot})
+}
+
+// endLoopIteration sets the continues of the innermost loop to jump to target, which starts its next iteration
+func (f *Frame) endLoopIteration(target int) {
+	for _, jumpIdx := range f.loops[len(f.loops)-1].continueJumps {
+		f.Code[jumpIdx].Arg1 = target - jumpIdx - 1
+	}
+}
+
+// popLoop ends the innermost loop, whose breaks jump to the next instruction
+func (f *Frame) popLoop() {
+	for _, jumpIdx := range f.loops[len(f.loops)-1].breakJumps {
+		f.Code[jumpIdx].Arg1 = len(f.Code) - 1 - jumpIdx
+	}
+	f.freeSlots = append(f.freeSlots, f.loops[len(f.loops)-1].heightSlot)
+	f.loops = f.loops[:len(f.loops)-1]
+}
+
+// compileFor compiles a for, whose end and step are evaluated once before the first iteration. With a step, the loop
+// runs whilst (i - to) * step is negative, so it counts down for a negative step and never runs for a step of 0
+func (c *Compiler) compileFor(expr ast.ForExpr, frame *Frame) error {
+	line := expr.Range.Start.Line
+	for _, valExpr := range []ast.Expr{expr.From, expr.To, expr.Step} {
+		if valExpr == nil {
+			continue
+		}
+		err := c.compileExpression(valExpr, frame)
+		if err != nil {
+			return err
+		}
+	}
+	stepSlot := -1
+	if expr.Step != nil {
+		stepSlot = frame.allocateSlot()
+		frame.EmitUnary(BIND_VAR, stepSlot, line)
+	}
+	toSlot := frame.allocateSlot()
+	frame.EmitUnary(BIND_VAR, toSlot, line)
+	slot := frame.allocateSlot()
+	frame.EmitUnary(BIND_VAR, slot, line)
+
+	frame.pushLoop(line)
+	condStart := len(frame.Code)
+	frame.EmitUnary(LOAD_VAR, slot, line)
+	frame.EmitUnary(LOAD_VAR, toSlot, line)
+	if expr.Step == nil {
+		c.compileBuiltinCall(frame, "<", 2, line)
+	} else {
+		c.compileBuiltinCall(frame, "-", 2, line)
+		frame.EmitUnary(LOAD_VAR, stepSlot, line)
+		c.compileBuiltinCall(frame, "*", 2, line)
+		zero := Value{}
+		zero.NewNum(0)
+		frame.emitConst(zero, line)
+		c.compileBuiltinCall(frame, "<", 2, line)
+	}
+	frame.EmitUnary(COND_JUMP_FALSE, 0, line)
+	condJumpIdx := len(frame.Code) - 1
+
+	err := c.compileLoopBody(expr.Identifier, slot, expr.Body, frame)
+	if err != nil {
+		return err
+	}
+	frame.endLoopIteration(len(frame.Code))
+	frame.EmitUnary(LOAD_VAR, slot, line)
+	if expr.Step == nil {
+		one := Value{}
+		one.NewNum(1)
+		frame.emitConst(one, line)
+	} else {
+		frame.EmitUnary(LOAD_VAR, stepSlot, line)
+	}
+	c.compileBuiltinCall(frame, "+", 2, line)
+	// A new variable for each iteration, so that a closure captures the value of its own iteration
+	frame.EmitUnary(BIND_VAR, slot, line)
+	frame.EmitUnary(JUMP, condStart-len(frame.Code)-1, line)
+	frame.Code[condJumpIdx].Arg1 = len(frame.Code) - 1 - condJumpIdx
+	frame.Emit(STORE_NULL, line)
+	frame.popLoop()
+
+	frame.freeSlots = append(frame.freeSlots, slot, toSlot)
+	if stepSlot != -1 {
+		frame.freeSlots = append(frame.freeSlots, stepSlot)
+	}
+	return nil
+}
+
+// compileForeach compiles a foreach, which keeps the list or string and the index of the current item in slots
+func (c *Compiler) compileForeach(expr ast.ForeachExpr, frame *Frame) error {
+	line := expr.Range.Start.Line
+	err := c.compileExpression(expr.Items, frame)
+	if err != nil {
+		return err
+	}
+	itemsSlot := frame.allocateSlot()
+	frame.EmitUnary(BIND_VAR, itemsSlot, line)
+	zero := Value{}
+	zero.NewNum(0)
+	frame.emitConst(zero, line)
+	indexSlot := frame.allocateSlot()
+	frame.EmitUnary(BIND_VAR, indexSlot, line)
+
+	frame.pushLoop(line)
+	condStart := len(frame.Code)
+	frame.EmitUnary(LOAD_VAR, indexSlot, line)
+	frame.EmitUnary(LOAD_VAR, itemsSlot, line)
+	c.compileBuiltinCall(frame, "length", 1, line)
+	c.compileBuiltinCall(frame, "<", 2, line)
+	frame.EmitUnary(COND_JUMP_FALSE, 0, line)
+	condJumpIdx := len(frame.Code) - 1
+	frame.EmitUnary(LOAD_VAR, indexSlot, line)
+	frame.EmitUnary(LOAD_VAR, itemsSlot, line)
+	c.compileBuiltinCall(frame, "nth", 2, line)
+	slot := frame.allocateSlot()
+	frame.EmitUnary(BIND_VAR, slot, line)
+
+	err = c.compileLoopBody(expr.Identifier, slot, expr.Body, frame)
+	if err != nil {
+		return err
+	}
+	frame.endLoopIteration(len(frame.Code))
+	frame.EmitUnary(LOAD_VAR, indexSlot, line)
+	one := Value{}
+	one.NewNum(1)
+	frame.emitConst(one, line)
+	c.compileBuiltinCall(frame, "+", 2, line)
+	frame.EmitUnary(STORE_VAR, indexSlot, line)
+	frame.EmitUnary(JUMP, condStart-len(frame.Code)-1, line)
+	frame.Code[condJumpIdx].Arg1 = len(frame.Code) - 1 - condJumpIdx
+	frame.Emit(STORE_NULL, line)
+	frame.popLoop()
+
+	frame.freeSlots = append(frame.freeSlots, slot, indexSlot, itemsSlot)
+	return nil
+}
+
+// compileLoopBody compiles the body of a for or foreach, whose variable in slot is only in scope for the body
+func (c *Compiler) compileLoopBody(identifier string, slot int, body []ast.Ast, frame *Frame) error {
+	shadowed, isShadowing := frame.VariableMap[identifier]
+	frame.VariableMap[identifier] = slot
+	err := c.compileLoopBlock(body, frame)
+	if err != nil {
+		return err
+	}
+	if isShadowing {
+		frame.VariableMap[identifier] = shadowed
+	} else {
+		delete(frame.VariableMap, identifier)
+	}
+	frame.scopeEnded[identifier] = append(frame.scopeEnded[identifier], slot)
+	return nil
+}
+
+// compileLoopBlock compiles the forms of the body of a loop, removing the value of each so that the stack is the same
+// height at the end of every iteration
+func (c *Compiler) compileLoopBlock(body []ast.Ast, frame *Frame) error {
+	for _, exprOrStmt := range body {
+		err := c.compileBlock([]ast.Ast{exprOrStmt}, frame)
+		if err != nil {
+			return err
+		}
+		switch exprOrStmt.Statement.(type) {
+		case ast.ImportStmt, ast.MacroDefStmt, ast.StructDefStmt:
+			// These have no value
+			continue
+		}
+		// On the line of the form, which is the line of the last instruction it compiled to
+		frame.Emit(POP, frame.LineMap[len(frame.LineMap)-1])
+	}
+	return nil
+}
+
+// compileBreak jumps to the end of the innermost loop with the value of the loop at the top of stack, leaving the trys
+// that are in the loop
+func (c *Compiler) compileBreak(stmt ast.BreakStmt, frame *Frame) error {
+	if len(frame.loops) == 0 {
+		return types.Error{Range: stmt.Range, Simple: "break can only be used in a loop"}
+	}
+	loopIdx := len(frame.loops) - 1
+	if stmt.Value != nil {
+		err := c.compileExpression(stmt.Value, frame)
+		if err != nil {
+			return err
+		}
+	} else {
+		frame.Emit(STORE_NULL, stmt.Range.Start.Line)
+	}
+	err := c.compileLeaveTrys(frame, frame.loops[loopIdx].handlers, stmt.Range.Start.Line)
+	if err != nil {
+		return err
+	}
+	frame.EmitBinary(RESTORE_STACK_HEIGHT, frame.loops[loopIdx].heightSlot, 1, stmt.Range.Start.Line)
+	frame.EmitUnary(JUMP, 0, stmt.Range.Start.Line)
+	frame.loops[loopIdx].breakJumps = append(frame.loops[loopIdx].breakJumps, len(frame.Code)-1)
+	return nil
+}
+
+// compileContinue jumps to the start of the next iteration of the innermost loop, leaving the trys that are in the
+// loop
+func (c *Compiler) compileContinue(stmt ast.ContinueStmt, frame *Frame) error {
+	if len(frame.loops) == 0 {
+		return types.Error{Range: stmt.Range, Simple: "continue can only be used in a loop"}
+	}
+	loopIdx := len(frame.loops) - 1
+	if len(frame.handlers) > frame.loops[loopIdx].handlers {
+		// Leaving a try keeps the value at the top of stack, so there has to be one
+		frame.Emit(STORE_NULL, stmt.Range.Start.Line)
+		err := c.compileLeaveTrys(frame, frame.loops[loopIdx].handlers, stmt.Range.Start.Line)
+		if err != nil {
+			return err
+		}
+	}
+	frame.EmitBinary(RESTORE_STACK_HEIGHT, frame.loops[loopIdx].heightSlot, 0, stmt.Range.Start.Line)
+	frame.EmitUnary(JUMP, 0, stmt.Range.Start.Line)
+	frame.loops[loopIdx].continueJumps = append(frame.loops[loopIdx].continueJumps, len(frame.Code)-1)
+	return nil
+}
+
+// handlerScope is a handler pushed by a try whilst it is being compiled. The handler of a try's finally keeps the
+// finally's body, which has to be run when jumping out of the try
+type handlerScope struct {
+	finally []ast.Ast
+}
+
+// pushHandler starts a handler, returning the index of its PUSH_HANDLER so that where it jumps to can be set later
+func (f *Frame) pushHandler(finally []ast.Ast, line int) int {
+	f.handlers = append(f.handlers, handlerScope{finally: finally})
+	f.EmitUnary(PUSH_HANDLER, 0, line)
+	return len(f.Code) - 1
+}
+
+func (f *Frame) popHandler(line int) {
+	f.handlers = f.handlers[:len(f.handlers)-1]
+	f.EmitUnary(POP_HANDLER, 1, line)
+}
+
+// compileTry compiles a try, whose catches are run by a handler around its body. If it has a finally, a second
+// handler around both runs the finally and then throws the error again. The finally is also compiled after the
+// try, for when it finishes without an error
+func (c *Compiler) compileTry(expr ast.TryExpr, frame *Frame) error {
+	line := expr.Range.Start.Line
+	finallyHandler := -1
+	if expr.Finally != nil {
+		finallyHandler = frame.pushHandler(expr.Finally, line)
+	}
+	catchHandler := -1
+	if len(expr.Catches) > 0 {
+		catchHandler = frame.pushHandler(nil, line)
+	}
+	err := c.compileBlock(expr.Body, frame)
+	if err != nil {
+		return err
+	}
+
+	if catchHandler != -1 {
+		frame.popHandler(line)
+		frame.EmitUnary(JUMP, 0, line)
+		endJumps := []int{len(frame.Code) - 1}
+		frame.Code[catchHandler].Arg1 = len(frame.Code) - 1 - catchHandler
+		for _, catch := range expr.Catches {
+			frame.EmitBinary(MATCH_ERROR, 0, getNameIndex(catch.Kind, frame), catch.Range.Start.Line)
+			matchIdx := len(frame.Code) - 1
+			err := c.compileCatch(catch, frame)
+			if err != nil {
+				return err
+			}
+			frame.EmitUnary(JUMP, 0, catch.Range.Start.Line)
+			endJumps = append(endJumps, len(frame.Code)-1)
+			frame.Code[matchIdx].Arg1 = len(frame.Code) - 1 - matchIdx
+		}
+		// No catch matched, so the error is passed on
+		c.compileThrow(frame, line)
+		for _, jumpIdx := range endJumps {
+			frame.Code[jumpIdx].Arg1 = len(frame.Code) - 1 - jumpIdx
+		}
+	}
+	if finallyHandler == -1 {
+		return nil
+	}
+
+	frame.popHandler(line)
+	// The value of the try is kept whilst the finally is run
+	slot := frame.allocateSlot()
+	frame.EmitUnary(BIND_VAR, slot, line)
+	err = c.compileBlock(expr.Finally, frame)
+	if err != nil {
+		return err
+	}
+	frame.EmitUnary(LOAD_VAR, slot, line)
+	frame.EmitUnary(JUMP, 0, line)
+	endJump := len(frame.Code) - 1
+
+	frame.Code[finallyHandler].Arg1 = len(frame.Code) - 1 - finallyHandler
+	frame.EmitUnary(BIND_VAR, slot, line)
+	err = c.compileBlock(expr.Finally, frame)
+	if err != nil {
+		return err
+	}
+	frame.EmitUnary(LOAD_VAR, slot, line)
+	c.compileThrow(frame, line)
+	frame.Code[endJump].Arg1 = len(frame.Code) - 1 - endJump
+	frame.freeSlots = append(frame.freeSlots, slot)
+	return nil
+}
+
+// compileCatch binds the error at the top of stack to the catch's variable, which is only in scope for its body
+func (c *Compiler) compileCatch(catch ast.CatchClause, frame *Frame) error {
+	slot := frame.allocateSlot()
+	frame.EmitUnary(BIND_VAR, slot, catch.Range.Start.Line)
+	shadowed, isShadowing := frame.VariableMap[catch.Identifier]
+	frame.VariableMap[catch.Identifier] = slot
+	err := c.compileBlock(catch.Body, frame)
+	if err != nil {
+		return err
+	}
+	if isShadowing {
+		frame.VariableMap[catch.Identifier] = shadowed
+	} else {
+		delete(frame.VariableMap, catch.Identifier)
+	}
+	frame.scopeEnded[catch.Identifier] = append(frame.scopeEnded[catch.Identifier], slot)
+	frame.freeSlots = append(frame.freeSlots, slot)
+	return nil
+}
+
+// compileThrow throws the value at the top of stack
+func (c *Compiler) compileThrow(frame *Frame, line int) {
+	c.compileBuiltinCall(frame, "throw", 1, line)
+}
+
+// compileLeaveTrys ends the trys that are jumped out of, leaving only the first depth trys of the frame. Their
+// finallys are run, innermost first, keeping the value at the top of stack
+func (c *Compiler) compileLeaveTrys(frame *Frame, depth int, line int) error {
+	handlers := frame.handlers
+	slot := -1
+	for i := len(handlers) - 1; i >= depth; i-- {
+		if handlers[i].finally == nil {
+			continue
+		}
+		if slot == -1 {
+			slot = frame.allocateSlot()
+			frame.EmitUnary(BIND_VAR, slot, line)
+		}
+		frame.EmitUnary(POP_HANDLER, len(frame.handlers)-i, line)
+		// A finally is not inside its own try
+		frame.handlers = handlers[:i:i]
+		err := c.compileBlock(handlers[i].finally, frame)
+		if err != nil {
+			return err
+		}
+	}
+	if len(frame.handlers) > depth {
+		frame.EmitUnary(POP_HANDLER, len(frame.handlers)-depth, line)
+	}
+	if slot != -1 {
+		frame.EmitUnary(LOAD_VAR, slot, line)
+		frame.freeSlots = append(frame.freeSlots, slot)
+	}
+	frame.handlers = handlers
+	return nil
+}
+
+// setSignature sets how a frame is called from the arguments that it declares. Its arguments are passed in the order
+// <args><optional args><rest arg><key args>
+func setSignature(frame *Frame, params ast.Params) {
+	names := append([]string{}, params.Args...)
+	for _, arg := range params.Optional {
+		names = append(names, arg.Identifier)
+	}
+	if len(params.Rest) > 0 {
+		names = append(names, params.Rest)
+	}
+	for _, arg := range params.Keys {
+		names = append(names, arg.Identifier)
+	}
+	frame.FunctionArguments = names
+	frame.Variadic = len(params.Rest) > 0
+	frame.NumOptional = len(params.Optional)
+	frame.NumKeys = len(params.Keys)
+}
+
+// compileParams declares the arguments of a function or closure after the variables that frame already has. Every
+// argument is passed, so they are stored from the stack and then the optional arguments that were not passed are
+// given their default
+func (c *Compiler) compileParams(params ast.Params, frame *Frame, line int) error {
+	setSignature(frame, params)
+	first := len(frame.Variables)
+	for i, argName := range frame.FunctionArguments {
+		frame.Variables = append(frame.Variables, Value{})
+		frame.VariableMap[argName] = first + i
+	}
+	for i := len(frame.FunctionArguments) - 1; i >= 0; i-- {
+		frame.EmitUnary(STORE_VAR, first+i, line)
+	}
+
+	for _, arg := range append(append([]ast.OptionalArg{}, params.Optional...), params.Keys...) {
+		slot := frame.VariableMap[arg.Identifier]
+		frame.EmitBinary(JUMP_IF_PASSED, 0, slot, arg.Range.Start.Line)
+		jumpIdx := len(frame.Code) - 1
+		if arg.Default == nil {
+			frame.Emit(STORE_NULL, arg.Range.Start.Line)
+		} else if err := c.compileExpression(arg.Default, frame); err != nil {
+			return err
+		}
+		frame.EmitUnary(STORE_VAR, slot, arg.Range.Start.Line)
+		frame.Code[jumpIdx].Arg1 = len(frame.Code) - 1 - jumpIdx
+	}
+	return nil
+}
+
+func (c *Compiler) compileClosureApplication(expr ast.ClosureApplicationExpr, frame *Frame, tail bool) error {
+	for _, arg := range expr.Args {
+		err := c.compileExpression(arg, frame)
+		if err != nil {
+			return err
+		}
+	}
+	// The closure is only known when it is called, so keyword arguments are passed as name and value pairs
+	for _, keywordArg := range expr.KeywordArgs {
+		name := Value{}
+		name.NewString(keywordArg.Name)
+		frame.Constants = append(frame.Constants, name)
+		frame.EmitUnary(LOAD_CONST, len(frame.Constants)-1, keywordArg.Range.Start.Line)
+		err := c.compileExpression(keywordArg.Value, frame)
+		if err != nil {
+			return err
+		}
+	}
+	err := c.compileExpression(expr.Closure, frame)
+	if err != nil {
+		return err
+	}
+	if tail {
+		frame.EmitBinary(TAIL_CALL_CLOSURE, len(expr.Args), len(expr.KeywordArgs), expr.Range.Start.Line)
+	} else {
+		frame.EmitBinary(CALL_CLOSURE, len(expr.Args), len(expr.KeywordArgs), expr.Range.Start.Line)
+	}
+	return nil
+}
+
+// compileCallArgs compiles the arguments of a call to a function declared with defun. Optional arguments that are not
+// passed are filled in, so that every argument of the function is passed in the order that it declares them
+func (c *Compiler) compileCallArgs(expr ast.FunctionApplicationExpr, callee *Frame, frame *Frame) error {
+	numPositional := callee.numRequired() + callee.NumOptional
+	if len(expr.Args) < callee.numRequired() || (!callee.Variadic && len(expr.Args) > numPositional) {
+		return types.Error{Range: expr.Range, Simple: callee.arityMessage(expr.Identifier, len(expr.Args))}
+	}
+	keys := callee.FunctionArguments[len(callee.FunctionArguments)-callee.NumKeys:]
+	// Index of each keyword argument in keys
+	keyIndexes := make([]int, len(expr.KeywordArgs))
+	inOrder := true
+	for i, keywordArg := range expr.KeywordArgs {
+		keyIndexes[i] = -1
+		for j, key := range keys {
+			if key == keywordArg.Name {
+				keyIndexes[i] = j
+			}
+		}
+		if keyIndexes[i] == -1 {
+			return types.Error{Range: keywordArg.Range,
+				Simple: fmt.Sprintf("Function %s has no keyword argument :%s", expr.Identifier, keywordArg.Name)}
+		}
+		inOrder = inOrder && (i == 0 || keyIndexes[i] > keyIndexes[i-1])
+	}
+
+	for i, arg := range expr.Args {
+		if callee.Variadic && i == numPositional {
+			break
+		}
+		err := c.compileExpression(arg, frame)
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(expr.Args); i < numPositional; i++ {
+		frame.Emit(PUSH_MISSING, expr.Range.Start.Line)
+	}
+	if callee.Variadic {
+		numRest := 0
+		for i := numPositional; i < len(expr.Args); i++ {
+			err := c.compileExpression(expr.Args[i], frame)
+			if err != nil {
+				return err
+			}
+			numRest += 1
+		}
+		frame.EmitUnary(CREATE_LIST, numRest, expr.Range.Start.Line)
+	}
+
+	// Keyword arguments are evaluated in the order that they are written. If that is not the order that the function
+	// declares them in, they are evaluated into temporary variables first
+	slots := make([]int, len(expr.KeywordArgs))
+	if !inOrder {
+		for i, keywordArg := range expr.KeywordArgs {
+			err := c.compileExpression(keywordArg.Value, frame)
+			if err != nil {
+				return err
+			}
+			slots[i] = frame.allocateSlot()
+			frame.EmitUnary(BIND_VAR, slots[i], keywordArg.Range.Start.Line)
+		}
+	}
+	for keyIdx := range keys {
+		passed := false
+		for i, keywordArg := range expr.KeywordArgs {
+			if keyIndexes[i] != keyIdx {
+				continue
+			}
+			passed = true
+			if inOrder {
+				err := c.compileExpression(keywordArg.Value, frame)
+				if err != nil {
+					return err
+				}
+			} else {
+				frame.EmitUnary(LOAD_VAR, slots[i], keywordArg.Range.Start.Line)
+			}
+		}
+		if !passed {
+			frame.Emit(PUSH_MISSING, expr.Range.Start.Line)
+		}
+	}
+	if !inOrder {
+		frame.freeSlots = append(frame.freeSlots, slots...)
+	}
+	return nil
+}
+
+func (c *Compiler) compileFunctionApplication(expr ast.FunctionApplicationExpr, frame *Frame, tail bool) error {
+	_, _, isBuiltin := c.builtins.Lookup(expr.Identifier)
+	_, isLocal := frame.VariableMap[expr.Identifier]
+	_, isGlobal := c.GlobalVariableMap[expr.Identifier]
+	if idx, ok := c.FunctionMap[expr.Identifier]; ok && !isBuiltin && !isLocal && !isGlobal {
+		err := c.compileCallArgs(expr, c.Functions[idx], frame)
+		if err != nil {
+			return err
+		}
+		numArgs := len(c.Functions[idx].FunctionArguments)
+		if tail {
+			frame.EmitBinary(TAIL_CALL_FUNCTION, idx, numArgs, expr.Range.Start.Line)
+		} else {
+			frame.EmitBinary(CALL_FUNCTION, idx, numArgs, expr.Range.Start.Line)
+		}
+		return nil
+	}
+
+	for _, arg := range expr.Args {
+		err := c.compileExpression(arg, frame)
+		if err != nil {
+			return err
+		}
+	}
+	if idx, builtinFunc, ok := c.builtins.Lookup(expr.Identifier); ok {
+		if len(expr.KeywordArgs) > 0 {
+			return types.Error{Range: expr.KeywordArgs[0].Range, Simple: fmt.Sprintf("Builtin %s does not take keyword arguments", expr.Identifier)}
+		}
+		if !builtinFunc.acceptsArgs(len(expr.Args)) {
+			return types.Error{Range: expr.GetRange(), Simple: fmt.Sprintf("Expected %s arguments, got %d", builtinFunc.ArityString(), len(expr.Args))}
+		}
+		frame.EmitBinary(CALL_BUILTIN, idx, len(expr.Args), expr.Range.Start.Line)
+	} else if (isLocal || isGlobal) && (len(expr.Args) > 0 || len(expr.KeywordArgs) > 0) {
+		return types.Error{Range: expr.Range, Simple: fmt.Sprintf("Variable %s can not be called - use funcall to call a closure", expr.Identifier)}
+	} else if idx, ok := frame.VariableMap[expr.Identifier]; ok {
+		frame.EmitUnary(LOAD_VAR, idx, expr.Range.Start.Line)
+	} else if idx, ok := c.GlobalVariableMap[expr.Identifier]; ok {
+		frame.EmitUnary(LOAD_GLOBAL, idx, expr.Range.Start.Line)
+	} else {
+		return unknownVariable(frame, expr.Identifier, expr.Range, fmt.Sprintf("Unknown identifier %s", expr.Identifier))
+	}
 	return nil
 }
 
@@ -399,9 +1449,25 @@ func (c *Compiler) compileStatement(stmtExpr ast.Stmt, frame *Frame) error {
 		}
 		frame.Emit(STORE_NULL, stmt.Range.Start.Line)
 
-	case ast.ImportStmt:
+	case ast.AssignStmt:
+		err := c.compileExpression(stmt.Value, frame)
+		if err != nil {
+			return err
+		}
+		if idx, ok := frame.VariableMap[stmt.Identifier]; ok && !stmt.Global {
+			frame.EmitUnary(STORE_VAR, idx, stmt.Range.Start.Line)
+		} else if idx, ok := c.GlobalVariableMap[stmt.Identifier]; ok {
+			frame.EmitUnary(STORE_GLOBAL, idx, stmt.Range.Start.Line)
+		} else if stmt.Global {
+			return types.Error{Range: stmt.Range, Simple: fmt.Sprintf("Unknown global %s", stmt.Identifier)}
+		} else {
+			return unknownVariable(frame, stmt.Identifier, stmt.Range, fmt.Sprintf("Unknown variable %s", stmt.Identifier))
+		}
+		frame.Emit(STORE_NULL, stmt.Range.Start.Line)
+	case ast.ImportStmt, ast.MacroDefStmt:
 		// NOP
 	case ast.WhileStmt:
+		frame.pushLoop(stmt.Range.Start.Line)
 		condStartIdx := len(frame.Code) - 1
 		err := c.compileExpression(stmt.Condition, frame)
 		if err != nil {
@@ -409,25 +1475,32 @@ func (c *Compiler) compileStatement(stmtExpr ast.Stmt, frame *Frame) error {
 		}
 		frame.EmitUnary(COND_JUMP_FALSE, 0, stmt.Range.Start.Line)
 		condJumpIdx := len(frame.Code) - 1
-		err = c.compileBlock(stmt.Body, frame)
+		err = c.compileLoopBlock(stmt.Body, frame)
 		if err != nil {
 			return err
 		}
+		frame.endLoopIteration(condStartIdx + 1)
 		frame.Code[condJumpIdx].Arg1 = len(frame.Code) - condJumpIdx
 		frame.EmitUnary(JUMP, condStartIdx-len(frame.Code), stmt.Range.Start.Line)
 		frame.Emit(STORE_NULL, stmt.Range.Start.Line)
+		frame.popLoop()
+	case ast.BreakStmt:
+		return c.compileBreak(stmt, frame)
+	case ast.ContinueStmt:
+		return c.compileContinue(stmt, frame)
 	case ast.FuncDefStmt:
+		// Calls by name are compiled to a builtin before a function, so the function could never be called
+		if _, _, ok := c.builtins.Lookup(stmt.Identifier); ok {
+			return types.Error{Range: stmt.Range, Simple: fmt.Sprintf("Function %s has the same name as a builtin", stmt.Identifier)}
+		}
 		functionFrame := Frame{}
 		functionFrame.New(stmt.FilePath)
-		for i, argName := range stmt.Args {
-			functionFrame.VariableMap[argName] = i
-			functionFrame.Variables = append(functionFrame.Variables, Value{})
-			functionFrame.FunctionArguments = stmt.Args
-			functionFrame.FunctionName = stmt.Identifier
-			// Store each argument from the stack into the variables array
-			functionFrame.EmitUnary(STORE_VAR, len(stmt.Args)-(i+1), stmt.Range.Start.Line)
-		}
-		err := c.compileBlock(stmt.Body, &functionFrame)
+		functionFrame.FunctionName = stmt.Identifier
+		err := c.compileParams(stmt.Params, &functionFrame, stmt.Range.Start.Line)
+		if err != nil {
+			return err
+		}
+		err = c.compileTailBlock(stmt.Body, &functionFrame)
 		if err != nil {
 			return err
 		}
@@ -438,6 +1511,16 @@ func (c *Compiler) compileStatement(stmtExpr ast.Stmt, frame *Frame) error {
 			c.FunctionMap[stmt.Identifier] = len(c.Functions) - 1
 			c.FunctionNames = append(c.FunctionNames, stmt.Identifier)
 		}
+	case ast.TestDefStmt:
+		testFrame := Frame{}
+		testFrame.New(stmt.FilePath)
+		testFrame.FunctionName = stmt.Name
+		err := c.compileBlock(stmt.Body, &testFrame)
+		if err != nil {
+			return err
+		}
+		c.tests = append(c.tests, TestDecl{Name: stmt.Name, FilePath: stmt.FilePath, Line: stmt.Range.Start.Line,
+			Frame: &testFrame})
 	case ast.StructDefStmt:
 		if _, ok := c.StructMap[stmt.Identifier]; ok {
 			return types.Error{Range: stmt.Range, Simple: fmt.Sprintf("Duplicate declaration of struct %s", stmt.Identifier)}
@@ -451,7 +1534,8 @@ func (c *Compiler) compileStatement(stmtExpr ast.Stmt, frame *Frame) error {
 			if globalIdx, ok := c.GlobalVariableMap[stmt.StructIdentifier]; ok {
 				frame.EmitUnary(LOAD_GLOBAL, globalIdx, stmt.Range.Start.Line)
 			} else {
-				return types.Error{Range: stmt.Range, Simple: fmt.Sprintf("Unknown variable %s", stmt.StructIdentifier)}
+				return unknownVariable(frame, stmt.StructIdentifier, stmt.Range,
+					fmt.Sprintf("Unknown variable %s", stmt.StructIdentifier))
 			}
 		}
 		frame.EmitUnary(STRUCT_FIELD_INDEX, getNameIndex(stmt.FieldIdentifier, frame), stmt.Range.Start.Line)
@@ -462,9 +1546,22 @@ func (c *Compiler) compileStatement(stmtExpr ast.Stmt, frame *Frame) error {
 		frame.Emit(SET_STRUCT_FIELD, stmt.Range.Start.Line)
 	case ast.ReturnStmt:
 		frame.Emit(STORE_NULL, stmt.Range.Start.Line)
+		err := c.compileLeaveTrys(frame, 0, stmt.Range.Start.Line)
+		if err != nil {
+			return err
+		}
 		frame.Emit(RETURN, stmt.Range.Start.Line)
 	case ast.ReturnValueStmt:
-		err := c.compileExpression(stmt.Value, frame)
+		var err error
+		if frame.IsRootFrame {
+			err = c.compileExpression(stmt.Value, frame)
+		} else {
+			err = c.compileTailExpression(stmt.Value, frame)
+		}
+		if err != nil {
+			return err
+		}
+		err = c.compileLeaveTrys(frame, 0, stmt.Range.Start.Line)
 		if err != nil {
 			return err
 		}
@@ -476,6 +1573,36 @@ func (c *Compiler) compileStatement(stmtExpr ast.Stmt, frame *Frame) error {
 	return nil
 }
 
+// allocateSlot returns a slot for a variable of a let, reusing the slot of a let that has ended if there is one
+func (f *Frame) allocateSlot() int {
+	if n := len(f.freeSlots); n > 0 {
+		slot := f.freeSlots[n-1]
+		f.freeSlots = f.freeSlots[:n-1]
+		return slot
+	}
+	f.Variables = append(f.Variables, Value{})
+	return len(f.Variables) - 1
+}
+
+// scopeSlots returns the slots of the variables that are in scope, in order
+func (f *Frame) scopeSlots() []int {
+	slots := []int{}
+	for _, slot := range f.VariableMap {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	return slots
+}
+
+// unknownVariable is the error for using identifier when it is not a variable, unless it is a variable whose let has
+// ended
+func unknownVariable(frame *Frame, identifier string, fileRange types.FileRange, message string) error {
+	if _, ok := frame.scopeEnded[identifier]; ok {
+		return types.Error{Range: fileRange, Simple: fmt.Sprintf("Variable %s is used outside of its scope", identifier)}
+	}
+	return types.Error{Range: fileRange, Simple: message}
+}
+
 func getNameIndex(nameToFind string, frame *Frame) int {
 	idx := -1
 	for i, name := range frame.Names {
@@ -490,13 +1617,3 @@ func getNameIndex(nameToFind string, frame *Frame) int {
 	}
 	return idx
 }
-
-func lookupBuiltin(identifier string) (int, Builtin, bool) {
-	for i, item := range Builtins {
-		if item.Identifier == identifier {
-			return i, item, true
-		}
-	}
-
-	return 0, Builtin{}, false
-}
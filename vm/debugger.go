@@ -0,0 +1,280 @@
+package vm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	debugContinue = iota
+	debugStepInto
+	debugStepOver
+	debugStepOut
+)
+
+// Breakpoint pauses the program when it reaches a line. An empty FilePath matches every file
+type Breakpoint struct {
+	FilePath string
+	Line     int
+}
+
+// ParseBreakpoint parses a breakpoint written as file:line (or just line)
+func ParseBreakpoint(location string) (Breakpoint, error) {
+	file := ""
+	lineStr := location
+	if idx := strings.LastIndex(location, ":"); idx != -1 {
+		file = location[:idx]
+		lineStr = location[idx+1:]
+	}
+	line, err := strconv.Atoi(lineStr)
+	if err != nil || line < 1 {
+		return Breakpoint{}, fmt.Errorf("invalid breakpoint %s - expected file:line", location)
+	}
+	return Breakpoint{FilePath: file, Line: line}, nil
+}
+
+func (b Breakpoint) String() string {
+	if len(b.FilePath) == 0 {
+		return fmt.Sprint(b.Line)
+	}
+	return fmt.Sprintf("%s:%d", b.FilePath, b.Line)
+}
+
+func (b Breakpoint) matches(filePath string, line int) bool {
+	if b.Line != line {
+		return false
+	}
+	if len(b.FilePath) == 0 || b.FilePath == filePath {
+		return true
+	}
+	if absPath, err := filepath.Abs(b.FilePath); err == nil && absPath == filePath {
+		return true
+	}
+	return strings.HasSuffix(filePath, string(filepath.Separator)+b.FilePath)
+}
+
+// activeCall is the debugger's state for a call that is running. The call itself is in the evalulator's call stack
+type activeCall struct {
+	// Line of the last instruction executed in this call
+	line int
+}
+
+// ErrDebuggerQuit is returned from evalulation when the program is stopped from the debugger
+var ErrDebuggerQuit = errors.New("program stopped by debugger")
+
+// Debugger pauses evalulation at breakpoints and when stepping, and reads commands to inspect the program
+type Debugger struct {
+	Breakpoints []Breakpoint
+	in          *bufio.Scanner
+	out         io.Writer
+	mode        int
+	// Call depth when the last step command was given
+	stepDepth int
+	calls     []activeCall
+	// True once there is no more input, so the program runs to completion
+	detached bool
+	sources  map[string][]string
+}
+
+// New creates a debugger that reads commands from in and writes to out.
+// The program is paused at the first line unless there are breakpoints
+func (d *Debugger) New(in io.Reader, out io.Writer, breakpoints []Breakpoint) {
+	d.in = bufio.NewScanner(in)
+	d.out = out
+	d.Breakpoints = breakpoints
+	d.mode = debugStepInto
+	if len(breakpoints) > 0 {
+		d.mode = debugContinue
+	}
+	d.calls = []activeCall{}
+	d.detached = false
+	d.sources = make(map[string][]string)
+}
+
+func (d *Debugger) enter() {
+	d.calls = append(d.calls, activeCall{})
+}
+
+func (d *Debugger) leave() {
+	d.calls = d.calls[:len(d.calls)-1]
+}
+
+// beforeInstruction is called before every instruction, and pauses if needed
+func (d *Debugger) beforeInstruction(e *Evalulator) error {
+	running := e.calls[len(e.calls)-1]
+	call := &d.calls[len(d.calls)-1]
+	line := running.frame.LineMap[running.pc]
+	newLine := line != call.line
+	call.line = line
+	if d.detached || line <= 0 {
+		return nil
+	}
+
+	depth := len(d.calls)
+	pause := false
+	switch d.mode {
+	case debugStepInto:
+		pause = newLine || depth < d.stepDepth
+	case debugStepOver:
+		pause = depth < d.stepDepth || (depth == d.stepDepth && newLine)
+	case debugStepOut:
+		pause = depth < d.stepDepth
+	}
+	if !pause && newLine {
+		for _, breakpoint := range d.Breakpoints {
+			if breakpoint.matches(running.frame.FilePath, line) {
+				pause = true
+				break
+			}
+		}
+	}
+	if pause {
+		return d.pause(e)
+	}
+	return nil
+}
+
+// pause prints the state of the program and handles commands until the program is resumed
+func (d *Debugger) pause(e *Evalulator) error {
+	frame := &e.calls[len(e.calls)-1].frame
+	line := d.calls[len(d.calls)-1].line
+	fmt.Fprintf(d.out, "Paused at %s:%d in %s\n", frame.FilePath, line, callName(frame))
+	if source := sourceLine(d.sources, frame.FilePath, line); len(source) > 0 {
+		fmt.Fprintf(d.out, "%6d  %s\n", line, source)
+	}
+	d.printLocals(e)
+	d.printGlobals(e)
+	d.printStack(e)
+	d.printCalls(e)
+
+	for {
+		fmt.Fprint(d.out, "(debug) ")
+		if !d.in.Scan() {
+			fmt.Fprintln(d.out)
+			d.detached = true
+			return nil
+		}
+		fields := strings.Fields(d.in.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "c", "continue":
+			d.mode = debugContinue
+			return nil
+		case "s", "step":
+			d.resume(debugStepInto)
+			return nil
+		case "n", "next":
+			d.resume(debugStepOver)
+			return nil
+		case "o", "out":
+			d.resume(debugStepOut)
+			return nil
+		case "q", "quit":
+			return ErrDebuggerQuit
+		case "b", "break":
+			if len(fields) == 1 {
+				for _, breakpoint := range d.Breakpoints {
+					fmt.Fprintln(d.out, breakpoint)
+				}
+				continue
+			}
+			breakpoint, err := ParseBreakpoint(fields[1])
+			if err != nil {
+				fmt.Fprintln(d.out, err)
+				continue
+			}
+			d.Breakpoints = append(d.Breakpoints, breakpoint)
+		case "d", "delete":
+			if len(fields) == 1 {
+				d.Breakpoints = []Breakpoint{}
+				continue
+			}
+			breakpoints := []Breakpoint{}
+			for _, breakpoint := range d.Breakpoints {
+				if breakpoint.String() != fields[1] {
+					breakpoints = append(breakpoints, breakpoint)
+				}
+			}
+			d.Breakpoints = breakpoints
+		case "l", "locals":
+			d.printLocals(e)
+		case "g", "globals":
+			d.printGlobals(e)
+		case "st", "stack":
+			d.printStack(e)
+		case "bt", "backtrace":
+			d.printCalls(e)
+		case "h", "help":
+			fmt.Fprint(d.out, debuggerHelp)
+		default:
+			fmt.Fprintf(d.out, "Unknown command %s - enter help to see all commands\n", fields[0])
+		}
+	}
+}
+
+const debuggerHelp = `c, continue       run until the next breakpoint
+s, step           step to the next line, entering function calls
+n, next           step to the next line, over function calls
+o, out            run until the current function returns
+b, break [loc]    add a breakpoint at file:line, or list breakpoints
+d, delete [loc]   delete a breakpoint, or all breakpoints
+l, locals         print local variables
+g, globals        print global variables
+st, stack         print the operand stack
+bt, backtrace     print the call chain
+q, quit           stop the program
+`
+
+func (d *Debugger) resume(mode int) {
+	d.mode = mode
+	d.stepDepth = len(d.calls)
+}
+
+func (d *Debugger) printLocals(e *Evalulator) {
+	frame := &e.calls[len(e.calls)-1].frame
+	fmt.Fprintln(d.out, "Locals:")
+	for i, names := range frame.variableNames() {
+		if i < len(frame.Variables) && len(names) > 0 {
+			fmt.Fprintf(d.out, "  %s = %s\n", strings.Join(names, ", "), frame.Variables[i].dereference().ToString())
+		}
+	}
+}
+
+func (d *Debugger) printGlobals(e *Evalulator) {
+	fmt.Fprintln(d.out, "Globals:")
+	for i, name := range e.globalNames {
+		if i < len(*e.globalVariables) {
+			fmt.Fprintf(d.out, "  %s = %s\n", name, (*e.globalVariables)[i].ToString())
+		}
+	}
+}
+
+func (d *Debugger) printStack(e *Evalulator) {
+	fmt.Fprintf(d.out, "Stack: %s\n", strings.TrimSpace(stackToString(e.stack)))
+}
+
+func (d *Debugger) printCalls(e *Evalulator) {
+	fmt.Fprintln(d.out, "Call chain:")
+	for i := len(e.calls) - 1; i >= 0; i-- {
+		call := &e.calls[i]
+		fmt.Fprintf(d.out, "  #%d %s at %s:%d\n", len(e.calls)-1-i, callName(&call.frame), call.frame.FilePath,
+			call.frame.LineMap[call.pc])
+	}
+}
+
+func callName(frame *Frame) string {
+	if frame.FunctionName != "." {
+		return frame.FunctionName
+	}
+	if frame.IsRootFrame {
+		return "<root>"
+	}
+	return "<lambda>"
+}
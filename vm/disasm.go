@@ -0,0 +1,267 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// disassembler prints compiled frames in a human readable form
+type disassembler struct {
+	sb            strings.Builder
+	functionNames []string
+	globalNames   []string
+	builtinNames  []string
+	// Lines of each source file, loaded when first needed
+	sources map[string][]string
+}
+
+// Disassemble prints every frame in a compile result - the root frame, each function and each closure body.
+// sources maps file paths to their code; any other file is read from disk so its lines can be shown
+func Disassemble(compileRes CompileResult, sources map[string]string) string {
+	d := disassembler{functionNames: compileRes.FunctionNames, globalNames: compileRes.GlobalNames,
+		sources: make(map[string][]string)}
+	if compileRes.Builtins != nil {
+		d.builtinNames = compileRes.Builtins.Names()
+	}
+	for path, code := range sources {
+		d.sources[path] = strings.Split(code, "\n")
+	}
+
+	d.frame("<root>", &compileRes.Frame)
+	for i, function := range compileRes.Functions {
+		d.sb.WriteString("\n")
+		name := fmt.Sprintf("<function %d>", i)
+		if i < len(compileRes.FunctionNames) {
+			name = compileRes.FunctionNames[i]
+		}
+		d.frame(name, function)
+	}
+	for _, test := range compileRes.Tests {
+		d.sb.WriteString("\n")
+		d.frame(fmt.Sprintf("<test %q>", test.Name), test.Frame)
+	}
+	return d.sb.String()
+}
+
+// frame prints a frame followed by the bodies of any closures that it creates
+func (d *disassembler) frame(name string, frame *Frame) {
+	closures := map[int]string{}
+	closureIndexes := []int{}
+	for i, constant := range frame.Constants {
+		if constant.Kind == ClosureType {
+			closures[i] = fmt.Sprintf("%s/lambda#%d", name, len(closureIndexes)+1)
+			closureIndexes = append(closureIndexes, i)
+		}
+	}
+
+	d.sb.WriteString(fmt.Sprintf("== %s", name))
+	if len(frame.FilePath) > 0 {
+		d.sb.WriteString(fmt.Sprintf(" (%s)", frame.FilePath))
+	}
+	d.sb.WriteString(" ==\n")
+	if len(frame.FunctionArguments) > 0 {
+		d.sb.WriteString(fmt.Sprintf("arguments: %s\n", frame.ArgumentString()))
+	}
+
+	if len(frame.Constants) > 0 {
+		d.sb.WriteString("constants:\n")
+		for i, constant := range frame.Constants {
+			d.sb.WriteString(fmt.Sprintf("  %4d  %s", i, constant.ToString()))
+			if closureName, ok := closures[i]; ok {
+				d.sb.WriteString(fmt.Sprintf(" -> %s", closureName))
+			}
+			d.sb.WriteString("\n")
+		}
+	}
+	if len(frame.Names) > 0 {
+		d.sb.WriteString("names:\n")
+		for i, name := range frame.Names {
+			d.sb.WriteString(fmt.Sprintf("  %4d  %s\n", i, name))
+		}
+	}
+	variableNames := frame.variableNames()
+	if len(variableNames) > 0 {
+		d.sb.WriteString("variables:\n")
+		for i, names := range variableNames {
+			d.sb.WriteString(fmt.Sprintf("  %4d  %s\n", i, strings.Join(names, ", ")))
+		}
+	}
+	if frame.IsRootFrame && len(d.globalNames) > 0 {
+		d.sb.WriteString("globals:\n")
+		for i, name := range d.globalNames {
+			d.sb.WriteString(fmt.Sprintf("  %4d  %s\n", i, name))
+		}
+	}
+
+	// Jumps are relative, so give each target an absolute label
+	labels := map[int]string{}
+	targets := []int{}
+	for pc, instr := range frame.Code {
+		if isJump(instr.Opcode) {
+			target := jumpTarget(pc, instr)
+			if _, ok := labels[target]; !ok {
+				labels[target] = ""
+				targets = append(targets, target)
+			}
+		}
+	}
+	sort.Ints(targets)
+	for i, target := range targets {
+		labels[target] = fmt.Sprintf("L%d", i)
+	}
+
+	d.sb.WriteString("code:\n")
+	lastLine := 0
+	for pc, instr := range frame.Code {
+		line := -1
+		if pc < len(frame.LineMap) {
+			line = frame.LineMap[pc]
+		}
+		if line != lastLine && line > 0 {
+			d.sb.WriteString(fmt.Sprintf("  ; %d: %s\n", line, sourceLine(d.sources, frame.FilePath, line)))
+		}
+		lastLine = line
+		if label, ok := labels[pc]; ok {
+			d.sb.WriteString(fmt.Sprintf("  %s:\n", label))
+		}
+		d.sb.WriteString(fmt.Sprintf("  %6d  %s%s\n", pc, opcodeToString(instr.Opcode), d.detail(instr, pc, frame, labels, closures, variableNames)))
+	}
+	if label, ok := labels[len(frame.Code)]; ok {
+		d.sb.WriteString(fmt.Sprintf("  %s:\n", label))
+	}
+
+	for _, constIdx := range closureIndexes {
+		d.sb.WriteString("\n")
+		d.frame(closures[constIdx], frame.Constants[constIdx].Closure.Body)
+	}
+}
+
+// detail is the arguments of an instruction, along with what they refer to
+func (d *disassembler) detail(instr Instruction, pc int, frame *Frame, labels map[int]string, closures map[int]string,
+	variableNames [][]string) string {
+	args := ""
+	detail := ""
+	lookup := func(names []string, idx int) string {
+		if idx < 0 || idx >= len(names) {
+			return "<ERROR>"
+		}
+		return names[idx]
+	}
+
+	switch instr.Opcode {
+	case JUMP, COND_JUMP, COND_JUMP_FALSE, PUSH_HANDLER:
+		args = fmt.Sprintf(" %d", instr.Arg1)
+		detail = "-> " + labels[jumpTarget(pc, instr)]
+	case JUMP_IF_PASSED:
+		args = fmt.Sprintf(" %d %d", instr.Arg1, instr.Arg2)
+		detail = "-> " + labels[jumpTarget(pc, instr)]
+		if instr.Arg2 < len(variableNames) {
+			detail = strings.Join(variableNames[instr.Arg2], ", ") + " " + detail
+		}
+	case MATCH_ERROR:
+		args = fmt.Sprintf(" %d %d", instr.Arg1, instr.Arg2)
+		detail = lookup(frame.Names, instr.Arg2) + " -> " + labels[jumpTarget(pc, instr)]
+	case LOAD_CONST:
+		args = fmt.Sprintf(" %d", instr.Arg1)
+		if closureName, ok := closures[instr.Arg1]; ok {
+			detail = closureName
+		} else if instr.Arg1 < len(frame.Constants) {
+			detail = frame.Constants[instr.Arg1].ToString()
+		}
+	case NO_MATCH:
+		args = fmt.Sprintf(" %d", instr.Arg1)
+		if instr.Arg1 < len(frame.Constants) {
+			detail = frame.Constants[instr.Arg1].ToString()
+		}
+	case LOAD_VAR, STORE_VAR, BIND_VAR, SAVE_STACK_HEIGHT:
+		args = fmt.Sprintf(" %d", instr.Arg1)
+		if instr.Arg1 < len(variableNames) {
+			detail = strings.Join(variableNames[instr.Arg1], ", ")
+		}
+	case LOAD_GLOBAL, STORE_GLOBAL:
+		args = fmt.Sprintf(" %d", instr.Arg1)
+		detail = lookup(d.globalNames, instr.Arg1)
+	case CALL_FUNCTION, TAIL_CALL_FUNCTION:
+		args = fmt.Sprintf(" %d %d", instr.Arg1, instr.Arg2)
+		detail = lookup(d.functionNames, instr.Arg1)
+	case CALL_BUILTIN:
+		args = fmt.Sprintf(" %d %d", instr.Arg1, instr.Arg2)
+		detail = lookup(d.builtinNames, instr.Arg1)
+	case CALL_CLOSURE, TAIL_CALL_CLOSURE:
+		args = fmt.Sprintf(" %d %d", instr.Arg1, instr.Arg2)
+	case STRUCT_FIELD_INDEX, IS_TYPE:
+		args = fmt.Sprintf(" %d", instr.Arg1)
+		detail = lookup(frame.Names, instr.Arg1)
+	case PUSH_CLOSURE_VAR:
+		args = fmt.Sprintf(" %d %d", instr.Arg1, instr.Arg2)
+		if instr.Arg1 < len(variableNames) {
+			detail = strings.Join(variableNames[instr.Arg1], ", ")
+		}
+	case RESTORE_STACK_HEIGHT:
+		args = fmt.Sprintf(" %d %d", instr.Arg1, instr.Arg2)
+	case CREATE_LIST, CREATE_STRUCT, POP_HANDLER, CONCAT_LISTS:
+		args = fmt.Sprintf(" %d", instr.Arg1)
+	}
+	if len(detail) > 0 {
+		return args + " (" + detail + ")"
+	}
+	return args
+}
+
+// sourceLine is the trimmed text of a line of a file, using sources as a cache of each file's lines
+func sourceLine(sources map[string][]string, path string, line int) string {
+	lines, ok := sources[path]
+	if !ok {
+		contents, err := os.ReadFile(path)
+		if err == nil {
+			lines = strings.Split(string(contents), "\n")
+		}
+		sources[path] = lines
+	}
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	return strings.TrimSpace(lines[line-1])
+}
+
+// variableNames gives the names of each variable slot in the frame, including those of lets that have ended
+func (f *Frame) variableNames() [][]string {
+	names := make([][]string, len(f.Variables))
+	addName := func(name string, idx int) {
+		for idx >= len(names) {
+			names = append(names, []string{})
+		}
+		for _, existing := range names[idx] {
+			if existing == name {
+				return
+			}
+		}
+		names[idx] = append(names[idx], name)
+	}
+	for name, idx := range f.VariableMap {
+		addName(name, idx)
+	}
+	for name, slots := range f.scopeEnded {
+		for _, idx := range slots {
+			if current, ok := f.VariableMap[name]; !ok || current != idx {
+				addName(name, idx)
+			}
+		}
+	}
+	for _, slotNames := range names {
+		sort.Strings(slotNames)
+	}
+	return names
+}
+
+func isJump(opcode int) bool {
+	return opcode == JUMP || opcode == COND_JUMP || opcode == COND_JUMP_FALSE || opcode == JUMP_IF_PASSED ||
+		opcode == PUSH_HANDLER || opcode == MATCH_ERROR
+}
+
+// jumpTarget is the absolute index of the next instruction executed when a jump is taken
+func jumpTarget(pc int, instr Instruction) int {
+	return pc + instr.Arg1 + 1
+}
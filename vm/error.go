@@ -1,6 +1,15 @@
 package vm
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/benbanerjeerichards/lisp-calculator/types"
+)
+
+// Number of calls shown at each end of a long stack trace
+const stackTraceEnds = 10
 
 type TraceFrame struct {
 	FilePath   string
@@ -13,8 +22,71 @@ type RuntimeError struct {
 	Detail     string
 	FilePath   string
 	StackTrace []TraceFrame
+	// Kind is what a catch matches the error by. Empty for an error raised by the evalulator without a more specific
+	// kind, which is caught as a RuntimeError
+	Kind string
+	// Info is the structured detail of an error about an argument
+	Info ErrorInfo
+	// Value is the value passed to throw, if the error was thrown by the program
+	Value *Value
+}
+
+// ErrorStruct is the type of struct that a caught error is bound to
+const ErrorStruct = "error"
+
+// Kinds of error raised by the evalulator and builtins
+const (
+	RuntimeErrorKind = "RuntimeError"
+	TypeError        = "TypeError"
+	ArityError       = "ArityError"
+	IndexError       = "IndexError"
+	IOError          = "IOError"
+	ValueError       = "ValueError"
+	AssertionError   = "AssertionError"
+	PanicError       = "PanicError"
+)
+
+// ErrorCodes is the code of each kind of error raised by the evalulator and builtins, which never changes
+var ErrorCodes = map[string]int{
+	RuntimeErrorKind: 1,
+	TypeError:        2,
+	ArityError:       3,
+	IndexError:       4,
+	IOError:          5,
+	ValueError:       6,
+	AssertionError:   7,
+	PanicError:       8,
+}
+
+// ErrorInfo is the structured detail of an error about an argument
+type ErrorInfo struct {
+	// Arg is the position of the argument, starting from 1. Zero if the error is not about a single argument
+	Arg int
+	// Expected and Actual are what was expected and what was given, such as the types of a TypeError or the number of
+	// arguments of an ArityError
+	Expected string
+	Actual   string
+}
+
+// BuiltinError is an error returned by a builtin (or by the evalulator whilst running an instruction), which is
+// raised as a RuntimeError of the same kind
+type BuiltinError struct {
+	Kind    string
+	Message string
+	Detail  string
+	Info    ErrorInfo
+}
+
+func (b BuiltinError) Error() string {
+	return b.Message
 }
 
+func typeError(arg int, expected string, actual string, message string) BuiltinError {
+	return BuiltinError{Kind: TypeError, Message: message, Info: ErrorInfo{Arg: arg, Expected: expected, Actual: actual}}
+}
+
+var errorFields = []string{"kind", "code", "message", "value", "trace", "arg", "expected", "actual"}
+
 func (r *RuntimeError) AddStackTrace(filePath string, lineNumber int) {
 	if r.StackTrace == nil {
 		r.StackTrace = make([]TraceFrame, 0)
@@ -22,13 +94,153 @@ func (r *RuntimeError) AddStackTrace(filePath string, lineNumber int) {
 	r.StackTrace = append(r.StackTrace, TraceFrame{FilePath: filePath, LineNumber: lineNumber})
 }
 
+// KindName is the kind of the error, along with its code if it has one
+func (a RuntimeError) KindName() string {
+	kind := a.Kind
+	if len(kind) == 0 {
+		kind = RuntimeErrorKind
+	}
+	if code, ok := ErrorCodes[kind]; ok {
+		return fmt.Sprintf("%s[E%d]", kind, code)
+	}
+	return kind
+}
+
 func (a RuntimeError) Error() string {
-	out := fmt.Sprintf("%s:%d: %s (%s)", a.FilePath, a.Line, a.Simple, a.Detail)
+	out := fmt.Sprintf("%s:%d: %s: %s (%s)", a.FilePath, a.Line, a.KindName(), a.Simple, a.Detail)
 	if a.StackTrace == nil {
 		return out
 	}
-	for _, trace := range a.StackTrace {
+	for i, trace := range a.StackTrace {
+		// Deep recursion gives a very long trace, so only show each end of it
+		if len(a.StackTrace) > 2*stackTraceEnds && i == stackTraceEnds {
+			out += fmt.Sprintf("\n\t... %d more", len(a.StackTrace)-2*stackTraceEnds)
+		}
+		if len(a.StackTrace) > 2*stackTraceEnds && i >= stackTraceEnds && i < len(a.StackTrace)-stackTraceEnds {
+			continue
+		}
 		out += fmt.Sprintf("\n\tat %s:%d", trace.FilePath, trace.LineNumber)
 	}
 	return out
 }
+
+// raisedError is the runtime error raised at filePath:line for an error returned by a builtin, or by the evalulator
+// whilst running an instruction
+func raisedError(err error, filePath string, line int) RuntimeError {
+	runtimeErr := RuntimeError{FilePath: filePath, Line: line, Simple: err.Error()}
+	switch builtinErr := err.(type) {
+	case BuiltinError:
+		runtimeErr.Kind = builtinErr.Kind
+		runtimeErr.Simple = builtinErr.Message
+		runtimeErr.Detail = builtinErr.Detail
+		runtimeErr.Info = builtinErr.Info
+	case types.Error:
+		runtimeErr.Simple = builtinErr.Simple
+		runtimeErr.Detail = builtinErr.Detail
+	}
+	return runtimeErr
+}
+
+// errorValue is the value that a catch binds the error to - an error struct holding its kind and code, message, the
+// value that was thrown, the stack trace as a list of file:line strings (starting where the error was raised) and
+// the argument that the error is about. Fields that the error does not have are null
+func (r RuntimeError) errorValue() Value {
+	kind := r.Kind
+	if len(kind) == 0 {
+		kind = RuntimeErrorKind
+	}
+	trace := []Value{}
+	for _, frame := range append([]TraceFrame{{FilePath: r.FilePath, LineNumber: r.Line}}, r.StackTrace...) {
+		val := Value{}
+		val.NewString(fmt.Sprintf("%s:%d", frame.FilePath, frame.LineNumber))
+		trace = append(trace, val)
+	}
+
+	val := Value{}
+	val.NewStruct(ErrorStruct, errorFields)
+	for i := range val.Struct.FieldValues {
+		val.Struct.FieldValues[i].NewNull()
+	}
+	val.Struct.FieldValues[0].NewString(kind)
+	if code, ok := ErrorCodes[kind]; ok {
+		val.Struct.FieldValues[1].NewNum(float64(code))
+	}
+	val.Struct.FieldValues[2].NewString(r.Simple)
+	if r.Value != nil {
+		val.Struct.FieldValues[3] = *r.Value
+	}
+	val.Struct.FieldValues[4].NewList(trace)
+	if r.Info.Arg > 0 {
+		val.Struct.FieldValues[5].NewNum(float64(r.Info.Arg))
+	}
+	if len(r.Info.Expected) > 0 {
+		val.Struct.FieldValues[6].NewString(r.Info.Expected)
+	}
+	if len(r.Info.Actual) > 0 {
+		val.Struct.FieldValues[7].NewString(r.Info.Actual)
+	}
+	return val
+}
+
+// isErrorValue is true if val is an error that was caught, which keeps its kind and stack trace when thrown again
+func isErrorValue(val Value) bool {
+	if val.Kind != StructType || val.Struct.TypeName != ErrorStruct || len(val.Struct.FieldNames) != len(errorFields) {
+		return false
+	}
+	for i, name := range errorFields {
+		if val.Struct.FieldNames[i] != name {
+			return false
+		}
+	}
+	return val.Struct.FieldValues[0].Kind == StringType && val.Struct.FieldValues[2].Kind == StringType &&
+		val.Struct.FieldValues[4].Kind == ListType
+}
+
+// thrownError is the error raised by throwing val at filePath:line. A value that is not a caught error is thrown with
+// its struct type (or its type, if it is not a struct) as its kind
+func thrownError(val Value, filePath string, line int) RuntimeError {
+	if isErrorValue(val) {
+		fields := val.Struct.FieldValues
+		err := RuntimeError{FilePath: filePath, Line: line, Kind: fields[0].String, Simple: fields[2].String,
+			StackTrace: []TraceFrame{}}
+		if fields[3].Kind != NullType {
+			thrown := fields[3]
+			err.Value = &thrown
+		}
+		for i, item := range fields[4].List {
+			frame := TraceFrame{FilePath: filePath, LineNumber: line}
+			if idx := strings.LastIndex(item.String, ":"); idx != -1 {
+				frame.FilePath = item.String[:idx]
+				frame.LineNumber, _ = strconv.Atoi(item.String[idx+1:])
+			}
+			if i == 0 {
+				err.FilePath = frame.FilePath
+				err.Line = frame.LineNumber
+			} else {
+				err.StackTrace = append(err.StackTrace, frame)
+			}
+		}
+		if fields[5].Kind == NumType {
+			err.Info.Arg = int(fields[5].Num)
+		}
+		err.Info.Expected = fields[6].String
+		err.Info.Actual = fields[7].String
+		return err
+	}
+
+	kind := val.Kind
+	if val.Kind == StructType {
+		kind = val.Struct.TypeName
+	}
+	return RuntimeError{FilePath: filePath, Line: line, Kind: kind, Simple: stringOf(val), Value: &val}
+}
+
+// matchesKind is true if a catch of kind handles the error val. Every error is handled by a catch of kind error, and
+// every error raised by the evalulator or a builtin (of any kind) by a catch of kind RuntimeError
+func matchesKind(val Value, kind string) bool {
+	errorKind := val.Struct.FieldValues[0].String
+	if _, ok := ErrorCodes[errorKind]; ok && kind == RuntimeErrorKind {
+		return true
+	}
+	return kind == ErrorStruct || errorKind == kind
+}
@@ -29,13 +29,13 @@ const (
 	// Store value at top of stack into variable at index varIndex
 	STORE_VAR
 
-	// CALL_FUNCTION <functionIndex>
-	// Calls the function <functionIndex>
+	// CALL_FUNCTION <functionIndex> <numArgs>
+	// Calls the function <functionIndex> with numArgs arguments, which is every argument that the function declares
 	// Arguments must be passed into stack first (same as with builtins)
 	CALL_FUNCTION
 
-	// CALL_BUILTIN <builtinIdx>
-	// Call builtin at index in vm.Builtins[builtinIdx]
+	// CALL_BUILTIN <builtinIdx> <numArgs>
+	// Call builtin at index in the BuiltinRegistry that the program was compiled with, with numArgs arguments
 	CALL_BUILTIN
 
 	// CREATE_LIST <N>
@@ -59,14 +59,13 @@ const (
 	STORE_GLOBAL
 
 	// PUSH_CLOSURE_VAR <sourceIdx> <targetIdx>
-	// Store variable at current from index sourceIdx into closure (at TOS) frame index targetIdx
+	// Capture variable at index sourceIdx of the current frame by reference into the closure (at TOS), so that it is
+	// variable targetIdx when the closure is called
 	PUSH_CLOSURE_VAR
 
-	// PUSH_GLOBAL_CLOSURE_VAR <globalIdx> <targetIdx>
-	// Push global at globalIdx into closure (at TOS) variable targetIdx (This means closures capture global)
-	PUSH_GLOBAL_CLOSURE_VAR
-
-	// Call the closure at the top of stack
+	// CALL_CLOSURE <numArgs> <numKeywordArgs>
+	// Call the closure at the top of stack with numArgs arguments, followed by numKeywordArgs keyword arguments as
+	// name and value pairs
 	CALL_CLOSURE
 
 	// PUSH_ARGS pushes command line arguments onto stack as List<String>
@@ -88,6 +87,62 @@ const (
 	// GET_STRUCT_FIELD <fieldIdx>
 	// For struct at top of stack, push field value at fieldIdx onto top of stack
 	GET_STRUCT_FIELD
+
+	// TAIL_CALL_FUNCTION <functionIndex> <numArgs>
+	// Calls the function <functionIndex> with numArgs arguments in tail position, replacing the current frame rather than returning to it
+	TAIL_CALL_FUNCTION
+
+	// TAIL_CALL_CLOSURE <numArgs> <numKeywordArgs>
+	// Calls the closure at the top of stack in the same way as CALL_CLOSURE, but in tail position, replacing the current frame rather than returning to it
+	TAIL_CALL_CLOSURE
+
+	// BIND_VAR <varIndex>
+	// Store value at top of stack into variable at index varIndex as a new variable, replacing (rather than storing
+	// into) any cell that a closure captured the slot's previous variable into
+	BIND_VAR
+
+	// PUSH_MISSING
+	// Push the value of an &optional or &key argument that is not passed to a call
+	PUSH_MISSING
+
+	// JUMP_IF_PASSED <relativeOffset> <varIndex>
+	// Jumps by relativeOffset amount from current PC only if the argument in variable varIndex was passed to the call
+	JUMP_IF_PASSED
+
+	// PUSH_HANDLER <relativeOffset>
+	// Start a try. Until the matching POP_HANDLER, an error raised by the frame or a call it makes is caught by
+	// returning the stack to its current height, pushing the error and jumping by relativeOffset from the current PC
+	PUSH_HANDLER
+
+	// POP_HANDLER <N>
+	// End the N innermost trys started by the frame
+	POP_HANDLER
+
+	// MATCH_ERROR <relativeOffset> <nameIdx>
+	// Jumps by relativeOffset amount from current PC unless the error at TOS is of kind names[nameIdx]. Error NOT
+	// popped from stack
+	MATCH_ERROR
+
+	// NO_MATCH <constantRef>
+	// Raise an error that the value at TOS matches no clause of the match at the source range in constant constantRef
+	NO_MATCH
+
+	// SAVE_STACK_HEIGHT <varIndex>
+	// Store the height of the stack into variable varIndex as a new variable, in the same way as BIND_VAR
+	SAVE_STACK_HEIGHT
+
+	// RESTORE_STACK_HEIGHT <varIndex> <keep>
+	// Remove everything above the height stored in variable varIndex from the stack, other than the keep values at the
+	// top of stack
+	RESTORE_STACK_HEIGHT
+
+	// IS_TYPE <nameIdx>
+	// Replace the value at TOS with whether its type is names[nameIdx], which is the name of its struct for a struct
+	IS_TYPE
+
+	// CONCAT_LISTS <N>
+	// Replace the N lists at the top of stack with a single list of their items, in order
+	CONCAT_LISTS
 )
 
 func opcodeToString(op int) string {
@@ -122,8 +177,6 @@ func opcodeToString(op int) string {
 		return "LOAD_GLOBAL"
 	case PUSH_CLOSURE_VAR:
 		return "PUSH_CLOSURE_VAR"
-	case PUSH_GLOBAL_CLOSURE_VAR:
-		return "PUSH_GLOBAL_CLOSURE_VAR"
 	case CALL_CLOSURE:
 		return "CALL_CLOSURE"
 	case PUSH_ARGS:
@@ -136,6 +189,32 @@ func opcodeToString(op int) string {
 		return "GET_STRUCT_FIELD"
 	case STRUCT_FIELD_INDEX:
 		return "STRUCT_FIELD_INDEX"
+	case TAIL_CALL_FUNCTION:
+		return "TAIL_CALL_FUNCTION"
+	case TAIL_CALL_CLOSURE:
+		return "TAIL_CALL_CLOSURE"
+	case BIND_VAR:
+		return "BIND_VAR"
+	case PUSH_MISSING:
+		return "PUSH_MISSING"
+	case JUMP_IF_PASSED:
+		return "JUMP_IF_PASSED"
+	case PUSH_HANDLER:
+		return "PUSH_HANDLER"
+	case POP_HANDLER:
+		return "POP_HANDLER"
+	case MATCH_ERROR:
+		return "MATCH_ERROR"
+	case NO_MATCH:
+		return "NO_MATCH"
+	case SAVE_STACK_HEIGHT:
+		return "SAVE_STACK_HEIGHT"
+	case RESTORE_STACK_HEIGHT:
+		return "RESTORE_STACK_HEIGHT"
+	case IS_TYPE:
+		return "IS_TYPE"
+	case CONCAT_LISTS:
+		return "CONCAT_LISTS"
 	default:
 		return fmt.Sprintf("<%d>", op)
 	}
@@ -151,29 +230,31 @@ func (i Instruction) String() string {
 	return fmt.Sprintf("%s %d %d", opcodeToString(i.Opcode), i.Arg1, i.Arg2)
 }
 
-func (i Instruction) DetailedString(frame *Frame, functionNames []string) string {
+func (i Instruction) DetailedString(frame *Frame, functionNames []string, builtinNames []string) string {
 	str := opcodeToString(i.Opcode)
-	return str + i.Detail(frame, functionNames)
+	return str + i.Detail(frame, functionNames, builtinNames)
 }
 
-func (i Instruction) Detail(frame *Frame, functionNames []string) string {
+func (i Instruction) Detail(frame *Frame, functionNames []string, builtinNames []string) string {
 	showArg1 := true
-	showArg2 := i.Opcode == PUSH_GLOBAL_CLOSURE_VAR || i.Opcode == PUSH_CLOSURE_VAR
+	showArg2 := i.Opcode == PUSH_CLOSURE_VAR || i.Opcode == CALL_BUILTIN || i.Opcode == CALL_FUNCTION ||
+		i.Opcode == TAIL_CALL_FUNCTION || i.Opcode == CALL_CLOSURE || i.Opcode == TAIL_CALL_CLOSURE ||
+		i.Opcode == JUMP_IF_PASSED || i.Opcode == MATCH_ERROR || i.Opcode == RESTORE_STACK_HEIGHT
 	detail := ""
-	if i.Opcode == LOAD_CONST {
+	if i.Opcode == LOAD_CONST || i.Opcode == NO_MATCH {
 		detail = frame.Constants[i.Arg1].ToString()
 	}
 	if i.Opcode == CALL_BUILTIN {
-		detail = Builtins[i.Arg1].Identifier
+		detail = builtinNames[i.Arg1]
 	}
-	if i.Opcode == CALL_FUNCTION {
+	if i.Opcode == CALL_FUNCTION || i.Opcode == TAIL_CALL_FUNCTION {
 		detail = functionNames[i.Arg1]
 	}
 	if i.Opcode == LOAD_VAR {
 		if len(frame.Variables) <= i.Arg1 {
 			detail = "<ERROR>"
 		} else {
-			v := frame.Variables[i.Arg1]
+			v := frame.Variables[i.Arg1].dereference()
 			if v.Kind != "" {
 				detail = v.ToString()
 			}
@@ -185,7 +266,7 @@ func (i Instruction) Detail(frame *Frame, functionNames []string) string {
 		str += " " + fmt.Sprintf("%d", i.Arg1)
 	}
 	if showArg2 {
-		str += " " + fmt.Sprintf("%d", i.Arg1)
+		str += " " + fmt.Sprintf("%d", i.Arg2)
 	}
 	if len(detail) > 0 {
 		str += " (" + detail + ")"
@@ -0,0 +1,132 @@
+package vm
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// WritePprof writes the profile as a gzipped protocol buffer in the format read by `go tool pprof`
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+func (p *Profiler) WritePprof(w io.Writer) error {
+	strs := stringTable{ids: map[string]int64{}}
+	strs.id("")
+
+	profile := protoMessage{}
+	for _, sampleType := range [][2]string{{"calls", "count"}, {"instructions", "count"}, {"time", "nanoseconds"}} {
+		valueType := protoMessage{}
+		valueType.int(1, strs.id(sampleType[0]))
+		valueType.int(2, strs.id(sampleType[1]))
+		profile.message(1, valueType)
+	}
+	for _, sample := range p.samples {
+		locations := make([]uint64, len(sample.functions))
+		for i, id := range sample.functions {
+			// Each function has a single location, and ids in pprof start at 1
+			locations[i] = uint64(id + 1)
+		}
+		message := protoMessage{}
+		message.packed(1, locations)
+		message.packed(2, []uint64{uint64(sample.calls), uint64(sample.instructions), uint64(sample.nanos)})
+		profile.message(2, message)
+	}
+	// There is no binary, but a mapping is needed to tell pprof that functions are already symbolized
+	mapping := protoMessage{}
+	mapping.uint(1, 1)
+	mapping.uint(7, 1)
+	profile.message(3, mapping)
+	for id, function := range p.functions {
+		line := protoMessage{}
+		line.uint(1, uint64(id+1))
+		line.int(2, int64(function.line))
+		location := protoMessage{}
+		location.uint(1, uint64(id+1))
+		location.uint(2, 1)
+		location.message(4, line)
+		profile.message(4, location)
+	}
+	for id, function := range p.functions {
+		message := protoMessage{}
+		message.uint(1, uint64(id+1))
+		message.int(2, strs.id(function.name))
+		message.int(3, strs.id(function.name))
+		message.int(4, strs.id(function.filePath))
+		message.int(5, int64(function.line))
+		profile.message(5, message)
+	}
+	// String table has to be written after everything else has added its strings
+	timeId := strs.id("time")
+	for _, str := range strs.strings {
+		profile.bytes(6, []byte(str))
+	}
+	profile.int(9, p.start.UnixNano())
+	profile.int(10, time.Since(p.start).Nanoseconds())
+	profile.int(14, timeId)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(profile.buf); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+type stringTable struct {
+	strings []string
+	ids     map[string]int64
+}
+
+func (s *stringTable) id(str string) int64 {
+	if id, ok := s.ids[str]; ok {
+		return id
+	}
+	s.strings = append(s.strings, str)
+	s.ids[str] = int64(len(s.strings) - 1)
+	return s.ids[str]
+}
+
+// protoMessage encodes the fields of a protocol buffer message
+type protoMessage struct {
+	buf []byte
+}
+
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+func (m *protoMessage) varint(n uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	m.buf = append(m.buf, buf[:binary.PutUvarint(buf[:], n)]...)
+}
+
+func (m *protoMessage) tag(field int, wireType int) {
+	m.varint(uint64(field<<3 | wireType))
+}
+
+func (m *protoMessage) uint(field int, n uint64) {
+	m.tag(field, wireVarint)
+	m.varint(n)
+}
+
+func (m *protoMessage) int(field int, n int64) {
+	m.uint(field, uint64(n))
+}
+
+func (m *protoMessage) bytes(field int, b []byte) {
+	m.tag(field, wireBytes)
+	m.varint(uint64(len(b)))
+	m.buf = append(m.buf, b...)
+}
+
+func (m *protoMessage) message(field int, message protoMessage) {
+	m.bytes(field, message.buf)
+}
+
+func (m *protoMessage) packed(field int, values []uint64) {
+	packed := protoMessage{}
+	for _, value := range values {
+		packed.varint(value)
+	}
+	m.bytes(field, packed.buf)
+}
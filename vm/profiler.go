@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Profiler records the calls, instructions executed and wall time of every function, closure and builtin.
+// Each distinct call chain is recorded separately, so both exclusive and inclusive costs can be calculated
+type Profiler struct {
+	functions   []profileFunction
+	functionIds map[profileFunction]int
+	samples     []*profileSample
+	sampleIds   map[string]*profileSample
+	calls       []profileCall
+	start       time.Time
+	// Time that the last cost was charged to the running function
+	last time.Time
+}
+
+type profileFunction struct {
+	name     string
+	filePath string
+	line     int
+}
+
+// profileSample is the exclusive cost of a single call chain
+type profileSample struct {
+	// Function ids in the chain, starting with the innermost call
+	functions    []int
+	calls        int64
+	instructions int64
+	nanos        int64
+}
+
+type profileCall struct {
+	key    string
+	sample *profileSample
+}
+
+// FunctionProfile is the total cost of a function. Exclusive costs do not include the functions that it calls
+type FunctionProfile struct {
+	Name                  string
+	FilePath              string
+	Calls                 int64
+	Instructions          int64
+	InclusiveInstructions int64
+	ExclusiveTime         time.Duration
+	InclusiveTime         time.Duration
+}
+
+func (p *Profiler) New() {
+	p.functions = []profileFunction{}
+	p.functionIds = make(map[profileFunction]int)
+	p.samples = []*profileSample{}
+	p.sampleIds = make(map[string]*profileSample)
+	p.calls = []profileCall{}
+	p.start = time.Now()
+	p.last = p.start
+}
+
+func (p *Profiler) enter(name string, filePath string, line int) {
+	p.charge()
+	function := profileFunction{name: name, filePath: filePath, line: line}
+	id, ok := p.functionIds[function]
+	if !ok {
+		p.functions = append(p.functions, function)
+		id = len(p.functions) - 1
+		p.functionIds[function] = id
+	}
+
+	key := strconv.Itoa(id)
+	var callers []int
+	if len(p.calls) > 0 {
+		parent := p.calls[len(p.calls)-1]
+		key = parent.key + "," + key
+		callers = parent.sample.functions
+	}
+	sample, ok := p.sampleIds[key]
+	if !ok {
+		sample = &profileSample{functions: append([]int{id}, callers...)}
+		p.samples = append(p.samples, sample)
+		p.sampleIds[key] = sample
+	}
+	sample.calls += 1
+	p.calls = append(p.calls, profileCall{key: key, sample: sample})
+}
+
+func (p *Profiler) enterFrame(frame *Frame) {
+	line := 0
+	for _, frameLine := range frame.LineMap {
+		if frameLine > 0 {
+			line = frameLine
+			break
+		}
+	}
+	// pprof removes anything in angle brackets from names, so can't use callName
+	name := frame.FunctionName
+	if name == "." && frame.IsRootFrame {
+		name = "top-level"
+	} else if name == "." {
+		// Lambdas have no name, so tell them apart by where they are declared
+		name = fmt.Sprintf("lambda:%d", line)
+	}
+	p.enter(name, frame.FilePath, line)
+}
+
+func (p *Profiler) leave() {
+	p.charge()
+	p.calls = p.calls[:len(p.calls)-1]
+}
+
+func (p *Profiler) instruction() {
+	p.calls[len(p.calls)-1].sample.instructions += 1
+}
+
+// charge adds the time since the last charge to the function that is running
+func (p *Profiler) charge() {
+	now := time.Now()
+	if len(p.calls) > 0 {
+		p.calls[len(p.calls)-1].sample.nanos += now.Sub(p.last).Nanoseconds()
+	}
+	p.last = now
+}
+
+// Functions returns the cost of each function, most expensive (by exclusive time) first
+func (p *Profiler) Functions() []FunctionProfile {
+	profiles := make([]FunctionProfile, len(p.functions))
+	for i, function := range p.functions {
+		profiles[i] = FunctionProfile{Name: function.name, FilePath: function.filePath}
+	}
+	for _, sample := range p.samples {
+		leaf := &profiles[sample.functions[0]]
+		leaf.Calls += sample.calls
+		leaf.Instructions += sample.instructions
+		leaf.ExclusiveTime += time.Duration(sample.nanos)
+		// Recursive functions appear in a chain many times, but the cost is only included once
+		seen := map[int]struct{}{}
+		for _, id := range sample.functions {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			profiles[id].InclusiveInstructions += sample.instructions
+			profiles[id].InclusiveTime += time.Duration(sample.nanos)
+		}
+	}
+	sort.SliceStable(profiles, func(i, j int) bool {
+		return profiles[i].ExclusiveTime > profiles[j].ExclusiveTime
+	})
+	return profiles
+}
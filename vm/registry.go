@@ -0,0 +1,103 @@
+package vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// AnyType can be used in a builtin's ArgTypes for an argument that can be of any type
+const AnyType = "any"
+
+// BuiltinRegistry holds the builtins that can be called by a program. Builtins are called by their index,
+// so once registered a builtin is never moved or removed
+type BuiltinRegistry struct {
+	builtins []Builtin
+	indexes  map[string]int
+}
+
+// New creates a registry containing the standard builtins
+func (r *BuiltinRegistry) New() {
+	r.builtins = make([]Builtin, 0, len(Builtins))
+	r.indexes = make(map[string]int, len(Builtins))
+	for _, builtin := range Builtins {
+		r.builtins = append(r.builtins, builtin)
+		r.indexes[builtin.Identifier] = len(r.builtins) - 1
+	}
+}
+
+// Register adds a builtin implemented in Go. Fails if a builtin with the same name already exists
+func (r *BuiltinRegistry) Register(builtin Builtin) error {
+	if len(builtin.Identifier) == 0 {
+		return errors.New("Builtin must have a name")
+	}
+	if _, ok := r.indexes[builtin.Identifier]; ok {
+		return fmt.Errorf("Builtin %s is already registered", builtin.Identifier)
+	}
+	if builtin.Function == nil {
+		return fmt.Errorf("Builtin %s has no function", builtin.Identifier)
+	}
+	if builtin.NumArgs < 0 {
+		return fmt.Errorf("Builtin %s can not take %d arguments", builtin.Identifier, builtin.NumArgs)
+	}
+	if builtin.MaxArgs != 0 && builtin.MaxArgs != AnyNumberOfArgs && builtin.MaxArgs < builtin.NumArgs {
+		return fmt.Errorf("Builtin %s can not take at most %d arguments when it takes at least %d", builtin.Identifier,
+			builtin.MaxArgs, builtin.NumArgs)
+	}
+	if builtin.MaxArgs != 0 && len(builtin.ArgTypes) > 0 {
+		if len(builtin.ArgTypes) < builtin.NumArgs || (builtin.MaxArgs != AnyNumberOfArgs && len(builtin.ArgTypes) > builtin.MaxArgs) {
+			return fmt.Errorf("Builtin %s takes %s arguments but has %d argument types", builtin.Identifier,
+				builtin.ArityString(), len(builtin.ArgTypes))
+		}
+	} else if len(builtin.ArgTypes) > 0 && len(builtin.ArgTypes) != builtin.NumArgs {
+		return fmt.Errorf("Builtin %s takes %d arguments but has %d argument types", builtin.Identifier,
+			builtin.NumArgs, len(builtin.ArgTypes))
+	}
+	r.builtins = append(r.builtins, builtin)
+	r.indexes[builtin.Identifier] = len(r.builtins) - 1
+	return nil
+}
+
+// Lookup finds a builtin by name, returning its index
+func (r *BuiltinRegistry) Lookup(identifier string) (int, Builtin, bool) {
+	idx, ok := r.indexes[identifier]
+	if !ok {
+		return 0, Builtin{}, false
+	}
+	return idx, r.builtins[idx], true
+}
+
+// At returns the builtin at idx
+func (r *BuiltinRegistry) At(idx int) Builtin {
+	return r.builtins[idx]
+}
+
+func (r *BuiltinRegistry) Len() int {
+	return len(r.builtins)
+}
+
+// Names returns the name of every builtin, in index order
+func (r *BuiltinRegistry) Names() []string {
+	names := make([]string, len(r.builtins))
+	for i, builtin := range r.builtins {
+		names[i] = builtin.Identifier
+	}
+	return names
+}
+
+// checkArgTypes checks the arguments of a call to a builtin against its type signature, if it has one
+func (b Builtin) checkArgTypes(args []Value) error {
+	if len(b.ArgTypes) == 0 {
+		return nil
+	}
+	for i, arg := range args {
+		argType := b.ArgTypes[len(b.ArgTypes)-1]
+		if i < len(b.ArgTypes) {
+			argType = b.ArgTypes[i]
+		}
+		if argType != AnyType && arg.Kind != argType {
+			return typeError(i+1, argType, arg.Kind, fmt.Sprintf("Type error for argument %d of %s - expected %s but got %s",
+				i+1, b.Identifier, argType, arg.Kind))
+		}
+	}
+	return nil
+}
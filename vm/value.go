@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"math"
 	"strings"
+
+	"github.com/benbanerjeerichards/lisp-calculator/ast"
+	"github.com/benbanerjeerichards/lisp-calculator/types"
 )
 
 const (
@@ -14,6 +17,13 @@ const (
 	ListType    = "list"
 	ClosureType = "closure"
 	StructType  = "struct"
+	// SymbolType is a name in quoted code, such as x in '(+ x 1). String is the name
+	SymbolType = "symbol"
+	// cellType is a local variable that has been captured by a closure. The variable's value is moved into Cell, which
+	// is shared with every closure that captured it. Cells are only ever stored in a frame's variables
+	cellType = "cell"
+	// missingType is an &optional or &key argument that was not passed, until it is given its default
+	missingType = "missing"
 )
 
 // Value is a runtime value
@@ -25,11 +35,17 @@ type Value struct {
 	List    []Value
 	Closure ClosureValue
 	Struct  StructValue
+	Cell    *Value
+	// Range is the code that a quoted value was created from, which is only kept for the code passed to a macro
+	Range *types.FileRange
 }
 
 type ClosureValue struct {
 	Args []string
 	Body *Frame
+	// Env is the environment of this closure instance - the cells of the variables it captured, indexed by the
+	// variable in Body that each is loaded into. Only set once the closure has been created at runtime
+	Env []*Value
 }
 
 type StructValue struct {
@@ -38,6 +54,14 @@ type StructValue struct {
 	FieldValues []Value
 }
 
+// dereference gives the value of a variable, which may have been captured into a cell
+func (v Value) dereference() Value {
+	if v.Kind == cellType {
+		return *v.Cell
+	}
+	return v
+}
+
 func (v *Value) NewNum(value float64) {
 	v.Kind = NumType
 	v.Num = value
@@ -48,6 +72,11 @@ func (v *Value) NewString(value string) {
 	v.String = value
 }
 
+func (v *Value) NewSymbol(name string) {
+	v.Kind = SymbolType
+	v.String = name
+}
+
 func (v *Value) NewBool(value bool) {
 	v.Kind = BoolType
 	v.Bool = value
@@ -70,6 +99,33 @@ func (v *Value) NewStruct(structType string, fieldNames []string) {
 	v.Struct = StructValue{TypeName: structType, FieldNames: fieldNames, FieldValues: make([]Value, len(fieldNames))}
 }
 
+// DatumValue is the value of code that is quoted, where each part of the value has the range of its code
+// Code that is unquoted has no value until it is run, so it is null
+func DatumValue(datum ast.Datum) Value {
+	val := Value{}
+	switch datum.Kind {
+	case ast.SymbolDatum:
+		val.NewSymbol(datum.Text)
+	case ast.NumberDatum:
+		val.NewNum(datum.Num)
+	case ast.StringDatum:
+		val.NewString(datum.Text)
+	case ast.BoolDatum:
+		val.NewBool(datum.Bool)
+	case ast.ListDatum:
+		items := make([]Value, len(datum.Items))
+		for i, item := range datum.Items {
+			items[i] = DatumValue(item)
+		}
+		val.NewList(items)
+	default:
+		val.NewNull()
+	}
+	datumRange := datum.Range
+	val.Range = &datumRange
+	return val
+}
+
 // Cant use Stringer interface due to name conflict
 func (val Value) ToString() string {
 	switch val.Kind {
@@ -80,6 +136,8 @@ func (val Value) ToString() string {
 		return fmt.Sprintf("%f", val.Num)
 	case StringType:
 		return "\"" + val.String + "\""
+	case SymbolType:
+		return val.String
 	case BoolType:
 		if val.Bool {
 			return "true"
@@ -99,14 +157,10 @@ func (val Value) ToString() string {
 		listStrBuilder.WriteString(")")
 		return listStrBuilder.String()
 	case ClosureType:
-		var argString strings.Builder
-		for i, arg := range val.Closure.Args {
-			argString.WriteString(arg)
-			if i != len(val.Closure.Args)-1 {
-				argString.WriteString(" ")
-			}
+		if val.Closure.Body != nil {
+			return fmt.Sprintf("lambda(%s)", val.Closure.Body.ArgumentString())
 		}
-		return fmt.Sprintf("lambda(%s)", argString.String())
+		return fmt.Sprintf("lambda(%s)", strings.Join(val.Closure.Args, " "))
 	case StructType:
 		var str strings.Builder
 		str.WriteString(fmt.Sprintf("%s{", val.Struct.TypeName))
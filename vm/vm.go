@@ -1,13 +1,13 @@
 package vm
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"strings"
 	"text/tabwriter"
-
-	"github.com/benbanerjeerichards/lisp-calculator/types"
 )
 
 type Frame struct {
@@ -16,13 +16,29 @@ type Frame struct {
 	Variables         []Value
 	VariableMap       map[string]int
 	FunctionArguments []string
-	Names             []string
+	// Variadic is true if the &rest argument, which collects any further arguments into a list, is in FunctionArguments
+	Variadic bool
+	// NumOptional is the number of &optional arguments, which follow the required arguments in FunctionArguments
+	NumOptional int
+	// NumKeys is the number of &key arguments, which are the last of the FunctionArguments
+	NumKeys int
+	Names   []string
 	// The root node of the frame hierarchy
 	IsRootFrame bool
 	// LineMap maps from opcode index to line number
 	LineMap      []int
 	FilePath     string
 	FunctionName string
+	// env is set on a copy of a closure's body when it is called, to the cells captured by the closure instance
+	env []*Value
+	// Only used whilst compiling - slots of variables whose let has ended, which a later let can reuse, and the names
+	// of those variables so that using them outside of their let can be reported
+	freeSlots  []int
+	scopeEnded map[string][]int
+	// Only used whilst compiling - trys that the code being compiled is in, with the innermost last
+	handlers []handlerScope
+	// Only used whilst compiling - loops that the code being compiled is in, with the innermost last
+	loops []loopScope
 }
 
 func (f *Frame) New(filePath string) {
@@ -36,6 +52,53 @@ func (f *Frame) New(filePath string) {
 	f.LineMap = []int{}
 	f.FunctionName = "."
 	f.FilePath = filePath
+	f.scopeEnded = make(map[string][]int)
+}
+
+// ArgumentString is the names of the frame's arguments, as they are written when declaring the function
+func (f *Frame) ArgumentString() string {
+	names := append([]string{}, f.FunctionArguments[:f.numRequired()]...)
+	next := f.numRequired()
+	if f.NumOptional > 0 {
+		names = append(append(names, "&optional"), f.FunctionArguments[next:next+f.NumOptional]...)
+		next += f.NumOptional
+	}
+	if f.Variadic {
+		names = append(names, "&rest", f.FunctionArguments[next])
+		next += 1
+	}
+	if f.NumKeys > 0 {
+		names = append(append(names, "&key"), f.FunctionArguments[next:]...)
+	}
+	return strings.Join(names, " ")
+}
+
+// numRequired is the number of arguments that every call to the frame has to pass
+func (f *Frame) numRequired() int {
+	required := len(f.FunctionArguments) - f.NumOptional - f.NumKeys
+	if f.Variadic {
+		required -= 1
+	}
+	return required
+}
+
+// arityString describes the number of arguments (excluding keyword arguments) that a call to the frame can pass,
+// such as "2" or "at least 1"
+func (f *Frame) arityString() string {
+	if f.Variadic {
+		return fmt.Sprintf("at least %d", f.numRequired())
+	} else if f.NumOptional > 0 {
+		return fmt.Sprintf("%d to %d", f.numRequired(), f.numRequired()+f.NumOptional)
+	}
+	return fmt.Sprint(f.numRequired())
+}
+
+// arityMessage describes a call to the frame (named name) with the wrong number of arguments
+func (f *Frame) arityMessage(name string, numArgs int) string {
+	if len(f.FunctionArguments) == 0 {
+		return fmt.Sprintf("Function %s expected 0 arguments, got %d", name, numArgs)
+	}
+	return fmt.Sprintf("Function %s expected %s arguments (%s), got %d", name, f.arityString(), f.ArgumentString(), numArgs)
 }
 
 func (f *Frame) Emit(opcode int, lineNumber int) {
@@ -54,24 +117,92 @@ func (f *Frame) EmitBinary(opcode int, arg1 int, arg2 int, lineNumber int) {
 }
 
 func Eval(compileRes CompileResult, programArgs []string, debug bool, stdOut io.Writer) (Value, error) {
-	evalulator := Evalulator{stack: []Value{},
-		globalVariables: &compileRes.GlobalVariables,
-		functions:       compileRes.Functions,
-		programArgs:     programArgs,
-		functionNames:   compileRes.FunctionNames,
-		structs:         compileRes.Structs,
-		stdOutWriter:    stdOut,
-		printProfile:    debug,
-		profileWriter:   tabwriter.NewWriter(os.Stdout, 1, 1, 1, ' ', 0)}
-
-	val, err := evalulator.evalInstructions(compileRes.Frame)
-	if debug {
-		evalulator.profileWriter.Flush()
-		fmt.Println("Final stack: ", stackToString(evalulator.stack))
+	evalulator := Evalulator{}
+	evalulator.New(programArgs, stdOut)
+	evalulator.globalVariables = &compileRes.GlobalVariables
+	evalulator.printProfile = debug
+	return evalulator.Eval(compileRes)
+}
+
+// New creates an evalulator that can be used to evalulate many compile results, keeping its globals between them
+func (e *Evalulator) New(programArgs []string, stdOut io.Writer) {
+	e.stack = []Value{}
+	e.globalVariables = &[]Value{}
+	e.programArgs = programArgs
+	e.stdOutWriter = stdOut
+	e.stdIn = bufio.NewReader(os.Stdin)
+	e.stdErrWriter = os.Stdout
+	e.builtins = &BuiltinRegistry{}
+	e.builtins.New()
+	e.printProfile = false
+	e.profileWriter = tabwriter.NewWriter(e.stdErrWriter, 1, 1, 1, ' ', 0)
+	e.calls = []callFrame{}
+	e.handlers = []handler{}
+	e.maxCallDepth = DefaultMaxCallDepth
+}
+
+// DefaultMaxCallDepth is how many calls can be running at once, unless changed with SetMaxCallDepth
+const DefaultMaxCallDepth = 100000
+
+// SetMaxCallDepth sets how many calls can be running at once. A call beyond this fails with a RuntimeError
+func (e *Evalulator) SetMaxCallDepth(depth int) {
+	e.maxCallDepth = depth
+}
+
+// SetStdin sets where the input builtin reads from
+func (e *Evalulator) SetStdin(stdIn io.Reader) {
+	e.stdIn = bufio.NewReader(stdIn)
+}
+
+// SetStderr sets where the trace of instructions executed is written
+func (e *Evalulator) SetStderr(stdErr io.Writer) {
+	e.stdErrWriter = stdErr
+	e.profileWriter = tabwriter.NewWriter(stdErr, 1, 1, 1, ' ', 0)
+}
+
+// SetTrace enables printing a trace of every instruction executed, along with the resulting stack
+func (e *Evalulator) SetTrace(trace bool) {
+	e.printProfile = trace
+}
+
+// Eval runs the root frame of compileRes.
+// Functions and structs are replaced by those in compileRes, and any newly declared globals are added
+func (e *Evalulator) Eval(compileRes CompileResult) (Value, error) {
+	e.functions = compileRes.Functions
+	e.functionNames = compileRes.FunctionNames
+	e.structs = compileRes.Structs
+	if compileRes.Builtins != nil {
+		e.builtins = compileRes.Builtins
+	}
+	e.globalNames = compileRes.GlobalNames
+	for len(*e.globalVariables) < len(compileRes.GlobalVariables) {
+		*e.globalVariables = append(*e.globalVariables, Value{})
+	}
+
+	val, err := e.run(compileRes.Frame, 0)
+	if e.printProfile {
+		e.profileWriter.Flush()
+		fmt.Fprintln(e.stdErrWriter, "Final stack: ", stackToString(e.stack))
 	}
 	return val, err
 }
 
+// EvalFrame runs a frame (such as a test) that is not part of the program's code, using the current state
+func (e *Evalulator) EvalFrame(frame *Frame) (Value, error) {
+	return e.run(*frame, 0)
+}
+
+// Call runs a function with args, using the current state
+func (e *Evalulator) Call(functionIdx int, args []Value) (Value, error) {
+	function := e.functions[functionIdx]
+	e.stack = append(e.stack, args...)
+	if err := e.bindArgs(function, len(args), 0); err != nil {
+		e.stack = e.stack[:len(e.stack)-len(args)]
+		return Value{}, raisedError(err, "", 0)
+	}
+	return e.run(*function, len(function.FunctionArguments))
+}
+
 type Evalulator struct {
 	programArgs     []string
 	globalVariables *[]Value
@@ -79,33 +210,135 @@ type Evalulator struct {
 	stack           []Value
 	functionNames   []string
 	structs         []StructDecl
+	globalNames     []string
+	builtins        *BuiltinRegistry
 
 	// Where to write stdout
 	stdOutWriter io.Writer
+	stdIn        *bufio.Reader
+	// Where to write the trace of instructions
+	stdErrWriter io.Writer
 
 	// printProfile is true if we should print a profile of all instructions executed, along with the resulting stack
 	printProfile  bool
 	profileWriter *tabwriter.Writer
+
+	// Calls that are running, with the innermost last
+	calls        []callFrame
+	maxCallDepth int
+	// Activation records that have been released, to be reused by later calls
+	localsPool [][]Value
+
+	// Trys that are running, with the innermost last
+	handlers []handler
+
+	// debugger is called before each instruction if set
+	debugger *Debugger
+	profiler *Profiler
+}
+
+// SetDebugger attaches a debugger that can pause the program being evalulated
+func (e *Evalulator) SetDebugger(debugger *Debugger) {
+	e.debugger = debugger
+}
+
+// SetProfiler records a profile of the program being evalulated
+func (e *Evalulator) SetProfiler(profiler *Profiler) {
+	e.profiler = profiler
+}
+
+// SetGlobal sets the value of the global at idx, adding any globals up to idx that the evalulator does not have yet
+func (e *Evalulator) SetGlobal(idx int, val Value) {
+	for len(*e.globalVariables) <= idx {
+		*e.globalVariables = append(*e.globalVariables, Value{})
+	}
+	(*e.globalVariables)[idx] = val
+}
+
+// Globals returns the current value of every global variable, indexed in the same way as Compiler.GlobalVariableMap
+func (e *Evalulator) Globals() []Value {
+	return *e.globalVariables
 }
 
-func (e *Evalulator) evalInstructions(frame Frame) (Value, error) {
+// callFrame is a call that is running, or that is waiting for a call it made to return
+type callFrame struct {
+	// A copy of the frame being run, whose Variables are the call's own activation record
+	frame Frame
+	// Index of the instruction being run. For a caller, this is the call that it is waiting on
+	pc int
+	// Stack index of the call's first argument. Everything from here up belongs to the call
+	base int
+}
+
+// handler is a try that is running, which catches errors raised by the code it protects
+type handler struct {
+	// Index in e.calls of the call running the try
+	call int
+	// Instruction that the error is passed to
+	pc int
+	// Height of the stack when the try started
+	stackLen int
+}
+
+// errCaught is returned by fail when a try has caught the error, so that evalulation continues at its catch
+var errCaught = errors.New("error caught")
+
+// run evalulates frame, called with numArgs arguments, until it returns. Calls are pushed onto e.calls and run by the same loop rather than by
+// recursing, so the depth of the program's calls is limited by maxCallDepth and not by the Go stack
+func (e *Evalulator) run(frame Frame, numArgs int) (Value, error) {
+	depth := len(e.calls)
 	// Ensure that trace gets printed when debugging after a panic
 	defer func() {
 		if r := recover(); r != nil {
 			if e.printProfile {
 				e.profileWriter.Flush()
 			}
+			e.unwind(depth)
 			panic(r)
 		}
 	}()
+	if err := e.pushCall(frame, numArgs); err != nil {
+		return e.fail(depth, err)
+	}
+	for {
+		// An error caught by a try resumes evalulation at its catch
+		val, err := e.execute(depth)
+		if err != errCaught {
+			return val, err
+		}
+	}
+}
 
-	pc := 0
+// execute runs the calls started since the call stack was depth deep, until the first of them returns
+func (e *Evalulator) execute(depth int) (Value, error) {
+	for {
+		call := &e.calls[len(e.calls)-1]
+		frame := &call.frame
+		pc := call.pc
+		if pc >= len(frame.Code) {
+			if e.printProfile {
+				e.profileNewLine()
+			}
+			val := e.popCall()
+			if len(e.calls) == depth {
+				return val, nil
+			}
+			e.stack = append(e.stack, val)
+			e.calls[len(e.calls)-1].pc += 1
+			continue
+		}
 
-out:
-	for pc < len(frame.Code) {
 		instr := frame.Code[pc]
 		if e.printProfile {
-			e.profileInstruction(pc, instr, &frame)
+			e.profileInstruction(pc, instr, frame)
+		}
+		if e.debugger != nil {
+			if err := e.debugger.beforeInstruction(e); err != nil {
+				return e.fail(depth, err)
+			}
+		}
+		if e.profiler != nil {
+			e.profiler.instruction()
 		}
 		switch instr.Opcode {
 		case LOAD_CONST:
@@ -119,8 +352,8 @@ out:
 		case COND_JUMP:
 			val := e.stack[len(e.stack)-1]
 			if val.Kind != BoolType {
-				return Value{}, RuntimeError{FilePath: frame.FilePath, Line: frame.LineMap[pc],
-					Simple: fmt.Sprintf("Type error -  expected type Bool for condition, got %s", val.Kind)}
+				return e.fail(depth, raisedError(typeError(0, BoolType, val.Kind,
+					fmt.Sprintf("Type error -  expected type Bool for condition, got %s", val.Kind)), frame.FilePath, frame.LineMap[pc]))
 			}
 			e.stack = e.stack[0 : len(e.stack)-1]
 			if val.Bool {
@@ -129,8 +362,8 @@ out:
 		case COND_JUMP_FALSE:
 			val := e.stack[len(e.stack)-1]
 			if val.Kind != BoolType {
-				return Value{}, RuntimeError{FilePath: frame.FilePath, Line: frame.LineMap[pc],
-					Simple: fmt.Sprintf("Type error -  expected type Bool for condition, got %s", val.Kind)}
+				return e.fail(depth, raisedError(typeError(0, BoolType, val.Kind,
+					fmt.Sprintf("Type error -  expected type Bool for condition, got %s", val.Kind)), frame.FilePath, frame.LineMap[pc]))
 			}
 			e.stack = e.stack[0 : len(e.stack)-1]
 			if !val.Bool {
@@ -139,10 +372,65 @@ out:
 		case JUMP:
 			pc += instr.Arg1
 		case LOAD_VAR:
-			e.stack = append(e.stack, frame.Variables[instr.Arg1])
-		case STORE_VAR:
+			e.stack = append(e.stack, frame.Variables[instr.Arg1].dereference())
+		case PUSH_MISSING:
+			e.stack = append(e.stack, Value{Kind: missingType})
+		case JUMP_IF_PASSED:
+			if frame.Variables[instr.Arg2].dereference().Kind != missingType {
+				pc += instr.Arg1
+			}
+		case PUSH_HANDLER:
+			e.handlers = append(e.handlers, handler{call: len(e.calls) - 1, pc: pc + instr.Arg1 + 1, stackLen: len(e.stack)})
+		case POP_HANDLER:
+			e.handlers = e.handlers[:len(e.handlers)-instr.Arg1]
+		case MATCH_ERROR:
+			if !matchesKind(e.stack[len(e.stack)-1], frame.Names[instr.Arg2]) {
+				pc += instr.Arg1
+			}
+		case NO_MATCH:
+			val := e.stack[len(e.stack)-1]
+			return e.fail(depth, RuntimeError{FilePath: frame.FilePath, Line: frame.LineMap[pc], Kind: ValueError,
+				Simple: fmt.Sprintf("No clause of match at %s matched %s", frame.Constants[instr.Arg1].String, val.ToString()),
+				Info:   ErrorInfo{Actual: val.ToString()}})
+		case SAVE_STACK_HEIGHT:
+			height := Value{}
+			height.NewNum(float64(len(e.stack)))
+			frame.Variables[instr.Arg1] = height
+		case RESTORE_STACK_HEIGHT:
+			height := int(frame.Variables[instr.Arg1].dereference().Num)
+			e.stack = append(e.stack[:height], e.stack[len(e.stack)-instr.Arg2:]...)
+		case IS_TYPE:
+			val := e.stack[len(e.stack)-1]
+			kind := val.Kind
+			if val.Kind == StructType {
+				kind = val.Struct.TypeName
+			}
+			res := Value{}
+			res.NewBool(kind == frame.Names[instr.Arg1])
+			e.stack[len(e.stack)-1] = res
+		case CONCAT_LISTS:
+			lists := e.stack[len(e.stack)-instr.Arg1:]
+			if err := checkAllTypes(lists, ListType); err != nil {
+				return e.fail(depth, raisedError(err, frame.FilePath, frame.LineMap[pc]))
+			}
+			items := []Value{}
+			for _, list := range lists {
+				items = append(items, list.List...)
+			}
+			val := Value{}
+			val.NewList(items)
+			e.stack = append(e.stack[:len(e.stack)-instr.Arg1], val)
+		case BIND_VAR:
 			frame.Variables[instr.Arg1] = e.stack[len(e.stack)-1]
 			e.stack = e.stack[0 : len(e.stack)-1]
+		case STORE_VAR:
+			if frame.Variables[instr.Arg1].Kind == cellType {
+				// Captured by a closure, so the closure has to see the new value
+				*frame.Variables[instr.Arg1].Cell = e.stack[len(e.stack)-1]
+			} else {
+				frame.Variables[instr.Arg1] = e.stack[len(e.stack)-1]
+			}
+			e.stack = e.stack[0 : len(e.stack)-1]
 		case LOAD_GLOBAL:
 			e.stack = append(e.stack, (*e.globalVariables)[instr.Arg1])
 		case STORE_GLOBAL:
@@ -167,8 +455,8 @@ out:
 			name := frame.Names[instr.Arg1]
 			stru := e.stack[len(e.stack)-1]
 			if stru.Kind != StructType {
-				return Value{}, RuntimeError{FilePath: frame.FilePath, Line: frame.LineMap[pc],
-					Simple: fmt.Sprintf("Expected type struct, got %s", stru.Kind)}
+				return e.fail(depth, raisedError(typeError(0, StructType, stru.Kind,
+					fmt.Sprintf("Expected type struct, got %s", stru.Kind)), frame.FilePath, frame.LineMap[pc]))
 			}
 			// TODO (optimization) probably want to use a map to store this mapping on Value.Struct
 			idx := -1
@@ -179,14 +467,17 @@ out:
 				}
 			}
 			if idx == -1 {
-				return Value{}, RuntimeError{FilePath: frame.FilePath, Line: frame.LineMap[pc],
-					Simple: fmt.Sprintf("Field %s not found on struct", name)}
+				return e.fail(depth, RuntimeError{FilePath: frame.FilePath, Line: frame.LineMap[pc],
+					Simple: fmt.Sprintf("Field %s not found on struct", name)})
 			}
 			val := Value{}
 			val.NewNum(float64(idx))
 			e.stack = append(e.stack, val)
 		case CALL_BUILTIN:
-			builtin := Builtins[instr.Arg1]
+			builtin := e.builtins.At(instr.Arg1)
+			if e.profiler != nil {
+				e.profiler.enter(builtin.Identifier, "<builtin>", 0)
+			}
 			if builtin.Identifier == "print" {
 				// Special case - allow overriding of stdout writer
 				valToPrint := e.stack[len(e.stack)-1]
@@ -197,19 +488,92 @@ out:
 				}
 				res := Value{}
 				res.NewNull()
-				e.stack = e.stack[0 : len(e.stack)-(builtin.NumArgs)]
+				e.stack = e.stack[0 : len(e.stack)-instr.Arg2]
+				e.stack = append(e.stack, res)
+			} else if builtin.Identifier == "input" {
+				// Special case - allow overriding of stdin reader
+				text, _ := e.stdIn.ReadString('\n')
+				res := Value{}
+				res.NewString(text)
 				e.stack = append(e.stack, res)
+			} else if builtin.Identifier == "assert-error" {
+				// Special case - calls a closure that takes no arguments, which must fail
+				closure := e.stack[len(e.stack)-1]
+				if closure.Kind != ClosureType || len(closure.Closure.Args) != 0 {
+					if e.profiler != nil {
+						e.profiler.leave()
+					}
+					return e.fail(depth, raisedError(typeError(1, ClosureType, closure.Kind,
+						fmt.Sprintf("Type error - assert-error expected a closure with no arguments, got %s", closure.ToString())),
+						frame.FilePath, frame.LineMap[pc]))
+				}
+				e.stack = e.stack[:len(e.stack)-1]
+				body := *closure.Closure.Body
+				body.env = closure.Closure.Env
+				_, err := e.run(body, 0)
+				if err == nil {
+					if e.profiler != nil {
+						e.profiler.leave()
+					}
+					return e.fail(depth, RuntimeError{FilePath: frame.FilePath, Line: frame.LineMap[pc],
+						Kind: AssertionError, Simple: "Assertion failed", Detail: "expected an error"})
+				}
+				res := Value{}
+				res.NewString(err.Error())
+				if runtimeErr, ok := err.(RuntimeError); ok {
+					res.NewString(runtimeErr.Simple)
+				}
+				e.stack = append(e.stack, res)
+			} else if builtin.Identifier == "throw" {
+				// Special case - raises an error with the value, which a try can catch
+				if e.profiler != nil {
+					e.profiler.leave()
+				}
+				return e.fail(depth, thrownError(e.stack[len(e.stack)-1], frame.FilePath, frame.LineMap[pc]))
+			} else if builtin.Identifier == "apply" {
+				// Special case - calls the closure with the items of the list as its arguments. Like CALL_CLOSURE, the
+				// closure's value is pushed when it returns
+				err := builtin.checkArgTypes(e.stack[len(e.stack)-2:])
+				if e.profiler != nil {
+					e.profiler.leave()
+				}
+				if err != nil {
+					return e.fail(depth, raisedError(err, frame.FilePath, frame.LineMap[pc]))
+				}
+				closure := e.stack[len(e.stack)-2]
+				args := e.stack[len(e.stack)-1].List
+				e.stack = append(e.stack[:len(e.stack)-2], args...)
+				if err := e.bindArgs(closure.Closure.Body, len(args), 0); err != nil {
+					return e.fail(depth, raisedError(err, frame.FilePath, frame.LineMap[pc]))
+				}
+				if e.printProfile {
+					e.profileNewLine()
+				}
+				body := *closure.Closure.Body
+				body.env = closure.Closure.Env
+				if err := e.pushCall(body, len(body.FunctionArguments)); err != nil {
+					return e.fail(depth, err)
+				}
+				continue
 			} else {
-				res, err := builtin.Function(e.stack[len(e.stack)-(builtin.NumArgs):])
+				args := e.stack[len(e.stack)-instr.Arg2:]
+				err := builtin.checkArgTypes(args)
+				var res Value
+				if err == nil {
+					res, err = builtin.Function(args)
+				}
 				if err != nil {
-					if stdErr, ok := err.(types.Error); ok {
-						return Value{}, RuntimeError{Simple: stdErr.Simple, Detail: stdErr.Detail, Line: frame.LineMap[pc], FilePath: frame.FilePath}
+					if e.profiler != nil {
+						e.profiler.leave()
 					}
-					return Value{}, nil
+					return e.fail(depth, raisedError(err, frame.FilePath, frame.LineMap[pc]))
 				}
-				e.stack = e.stack[0 : len(e.stack)-(builtin.NumArgs)]
+				e.stack = e.stack[0 : len(e.stack)-instr.Arg2]
 				e.stack = append(e.stack, res)
 			}
+			if e.profiler != nil {
+				e.profiler.leave()
+			}
 		case CREATE_LIST:
 			list := make([]Value, instr.Arg1)
 			for i := 0; i < instr.Arg1; i++ {
@@ -220,7 +584,8 @@ out:
 			val.NewList(list)
 			e.stack = append(e.stack, val)
 		case RETURN:
-			break out
+			call.pc = len(frame.Code)
+			continue
 		case PUSH_ARGS:
 			argVal := Value{}
 			argsAsValues := []Value{}
@@ -236,71 +601,313 @@ out:
 				e.profileNewLine()
 			}
 			function := e.functions[instr.Arg1]
-			stackIndex := len(e.stack) - (len(function.FunctionArguments) + 1)
-			val, err := e.evalInstructions(*function)
-			if err != nil {
-				if runtimeErr, ok := err.(RuntimeError); ok {
-					runtimeErr.AddStackTrace(frame.FilePath, frame.LineMap[pc])
-					return Value{}, runtimeErr
-				}
-				return Value{}, err
+			if err := e.checkArity(function, instr.Arg2); err != nil {
+				return e.fail(depth, raisedError(err, frame.FilePath, frame.LineMap[pc]))
 			}
-			e.stack = e.stack[:stackIndex+1]
-			e.stack = append(e.stack, val)
+			if err := e.pushCall(*function, len(function.FunctionArguments)); err != nil {
+				return e.fail(depth, err)
+			}
+			continue
 		case PUSH_CLOSURE_VAR:
 			closure := e.stack[len(e.stack)-1]
 			if closure.Kind != ClosureType {
-				return Value{}, RuntimeError{Line: frame.LineMap[pc], Simple: fmt.Sprintf("Type error -  expected Closure, got %s", closure.Kind), FilePath: frame.FilePath}
+				return e.fail(depth, raisedError(typeError(0, ClosureType, closure.Kind,
+					fmt.Sprintf("Type error -  expected Closure, got %s", closure.Kind)), frame.FilePath, frame.LineMap[pc]))
 			}
-			closure.Closure.Body.Variables[instr.Arg2] = frame.Variables[instr.Arg1]
-			e.stack[len(e.stack)-1] = closure
-		case PUSH_GLOBAL_CLOSURE_VAR:
-			closure := e.stack[len(e.stack)-1]
-			if closure.Kind != ClosureType {
-				if closure.Kind != ClosureType {
-					return Value{}, RuntimeError{FilePath: frame.FilePath, Line: frame.LineMap[pc],
-						Simple: fmt.Sprintf("Type error -  expected Closure, got %s", closure.Kind)}
-				}
+			// The closure constant has no environment, so every closure created gets its own
+			if closure.Closure.Env == nil {
+				closure.Closure.Env = make([]*Value, len(closure.Closure.Body.Variables))
 			}
-			closure.Closure.Body.Variables[instr.Arg2] = (*e.globalVariables)[instr.Arg2]
+			closure.Closure.Env[instr.Arg2] = captureLocal(frame.Variables, instr.Arg1)
 			e.stack[len(e.stack)-1] = closure
-
 		case CALL_CLOSURE:
 			closure := e.stack[len(e.stack)-1]
+			if closure.Kind != ClosureType {
+				return e.fail(depth, raisedError(typeError(0, ClosureType, closure.Kind,
+					fmt.Sprintf("Type error -  expected Closure, got %s", closure.Kind)), frame.FilePath, frame.LineMap[pc]))
+			}
 			e.stack = e.stack[:len(e.stack)-1]
-			stackIndex := len(e.stack) - (len(closure.Closure.Args) + 1)
+			if err := e.bindArgs(closure.Closure.Body, instr.Arg1, instr.Arg2); err != nil {
+				return e.fail(depth, raisedError(err, frame.FilePath, frame.LineMap[pc]))
+			}
+			if e.printProfile {
+				e.profileNewLine()
+			}
+			body := *closure.Closure.Body
+			body.env = closure.Closure.Env
+			if err := e.pushCall(body, len(body.FunctionArguments)); err != nil {
+				return e.fail(depth, err)
+			}
+			continue
+		case TAIL_CALL_FUNCTION:
+			if e.printProfile {
+				e.profileNewLine()
+			}
+			function := e.functions[instr.Arg1]
+			if err := e.checkArity(function, instr.Arg2); err != nil {
+				return e.fail(depth, raisedError(err, frame.FilePath, frame.LineMap[pc]))
+			}
+			e.tailCall(call, *function, len(function.FunctionArguments))
+			continue
+		case TAIL_CALL_CLOSURE:
+			closure := e.stack[len(e.stack)-1]
 			if closure.Kind != ClosureType {
-				if closure.Kind != ClosureType {
-					return Value{}, RuntimeError{FilePath: frame.FilePath, Line: frame.LineMap[pc],
-						Simple: fmt.Sprintf("Type error -  expected Closure, got %s", closure.Kind)}
-				}
+				return e.fail(depth, raisedError(typeError(0, ClosureType, closure.Kind,
+					fmt.Sprintf("Type error -  expected Closure, got %s", closure.Kind)), frame.FilePath, frame.LineMap[pc]))
 			}
-			val, err := e.evalInstructions(*closure.Closure.Body)
-			if err != nil {
-				return Value{}, err
+			e.stack = e.stack[:len(e.stack)-1]
+			if err := e.bindArgs(closure.Closure.Body, instr.Arg1, instr.Arg2); err != nil {
+				return e.fail(depth, raisedError(err, frame.FilePath, frame.LineMap[pc]))
 			}
-			e.stack = e.stack[:stackIndex+1]
-			e.stack = append(e.stack, val)
+			if e.printProfile {
+				e.profileNewLine()
+			}
+			body := *closure.Closure.Body
+			body.env = closure.Closure.Env
+			e.tailCall(call, body, len(body.FunctionArguments))
+			continue
 		default:
 			fmt.Println("Unknown instruction", instr)
 		}
-		pc += 1
+		// A builtin that calls back into the VM may have moved e.calls, so call can not be used
+		e.calls[len(e.calls)-1].pc = pc + 1
 	}
-	if e.printProfile {
-		e.profileNewLine()
+}
+
+// pushCall starts running frame as a new call, whose numArgs arguments are at the top of the stack
+func (e *Evalulator) pushCall(frame Frame, numArgs int) error {
+	if len(e.calls) >= e.maxCallDepth {
+		err := RuntimeError{Simple: fmt.Sprintf("Maximum call depth of %d exceeded", e.maxCallDepth)}
+		if len(e.calls) > 0 {
+			caller := e.calls[len(e.calls)-1]
+			err.FilePath = caller.frame.FilePath
+			err.Line = caller.frame.LineMap[caller.pc]
+		}
+		return err
+	}
+	base := len(e.stack) - numArgs
+	e.calls = append(e.calls, callFrame{frame: frame, base: base})
+	call := &e.calls[len(e.calls)-1]
+	e.activate(&call.frame)
+	if e.debugger != nil {
+		e.debugger.enter()
+	}
+	if e.profiler != nil {
+		e.profiler.enterFrame(&call.frame)
+	}
+	return nil
+}
+
+// popCall finishes the running call, returning its value and removing everything else it left on the stack
+func (e *Evalulator) popCall() Value {
+	call := &e.calls[len(e.calls)-1]
+	val := Value{}
+	val.NewNull()
+	if len(e.stack) > call.base {
+		val = e.stack[len(e.stack)-1]
+	}
+	if call.base >= 0 && call.base < len(e.stack) {
+		e.stack = e.stack[:call.base]
+	}
+	e.leaveCall()
+	return val
+}
+
+func (e *Evalulator) leaveCall() {
+	call := &e.calls[len(e.calls)-1]
+	e.releaseLocals(call.frame.Variables)
+	*call = callFrame{}
+	e.calls = e.calls[:len(e.calls)-1]
+	// A call that returns from inside a try ends the try
+	for len(e.handlers) > 0 && e.handlers[len(e.handlers)-1].call >= len(e.calls) {
+		e.handlers = e.handlers[:len(e.handlers)-1]
+	}
+	if e.debugger != nil {
+		e.debugger.leave()
+	}
+	if e.profiler != nil {
+		e.profiler.leave()
 	}
-	if len(e.stack) == 0 {
+}
+
+// fail stops every call started since the call stack was depth deep. A runtime error is given a stack trace of the
+// calls that were running when it happened
+func (e *Evalulator) fail(depth int, err error) (Value, error) {
+	if runtimeErr, ok := err.(RuntimeError); ok && runtimeErr.StackTrace == nil {
+		for i := len(e.calls) - 2; i >= 0; i-- {
+			caller := e.calls[i]
+			runtimeErr.AddStackTrace(caller.frame.FilePath, caller.frame.LineMap[caller.pc])
+		}
+		err = runtimeErr
+	}
+	if e.catch(depth, err) {
+		return Value{}, errCaught
+	}
+	e.unwind(depth)
+	return Value{}, err
+}
+
+// catch passes a runtime error to the innermost try started since the call stack was depth deep, if there is one.
+// Calls made by the try are stopped, and the try's call continues from its catch with the error at the top of stack
+func (e *Evalulator) catch(depth int, err error) bool {
+	runtimeErr, ok := err.(RuntimeError)
+	if !ok || len(e.handlers) == 0 || e.handlers[len(e.handlers)-1].call < depth {
+		return false
+	}
+	h := e.handlers[len(e.handlers)-1]
+	e.handlers = e.handlers[:len(e.handlers)-1]
+	for len(e.calls) > h.call+1 {
+		e.leaveCall()
+	}
+	e.stack = append(e.stack[:h.stackLen], runtimeErr.errorValue())
+	e.calls[h.call].pc = h.pc
+	return true
+}
+
+// unwind removes calls until the call stack is depth deep, along with everything they put on the stack
+func (e *Evalulator) unwind(depth int) {
+	if len(e.calls) <= depth {
+		return
+	}
+	if base := e.calls[depth].base; base >= 0 && base < len(e.stack) {
+		e.stack = e.stack[:base]
+	}
+	for len(e.calls) > depth {
+		e.leaveCall()
+	}
+}
+
+// activate gives a frame that is about to run its own activation record, holding the cells of a closure's environment
+func (e *Evalulator) activate(frame *Frame) {
+	frame.Variables = e.allocateLocals(frame.Variables)
+	for slot, cell := range frame.env {
+		if cell != nil {
+			frame.Variables[slot] = Value{Kind: cellType, Cell: cell}
+		}
+	}
+}
+
+// tailCall replaces the running call with callee, so that the call stack does not grow. The callee's arguments are
+// moved down to the base of the call, dropping everything else that the replaced frame left on the stack
+func (e *Evalulator) tailCall(call *callFrame, callee Frame, numArgs int) {
+	copy(e.stack[call.base:], e.stack[len(e.stack)-numArgs:])
+	e.stack = e.stack[:call.base+numArgs]
+	e.releaseLocals(call.frame.Variables)
+	call.frame = callee
+	call.pc = 0
+	e.activate(&call.frame)
+	if e.debugger != nil {
+		e.debugger.leave()
+		e.debugger.enter()
+	}
+	if e.profiler != nil {
+		e.profiler.leave()
+		e.profiler.enterFrame(&call.frame)
+	}
+}
+
+// checkArity checks a call that was compiled to pass numArgs arguments to function. The call passes every argument
+// that function declares, unless function was redeclared with different arguments after the call was compiled (such as
+// in the REPL), in which case the arguments are bound as if they were passed to the new declaration
+func (e *Evalulator) checkArity(function *Frame, numArgs int) error {
+	if numArgs == len(function.FunctionArguments) {
+		return nil
+	}
+	return e.bindArgs(function, numArgs, 0)
+}
+
+// bindArgs arranges the arguments of a call to frame, which are numArgs arguments followed by numKeys keyword name
+// and value pairs at the top of the stack, into every argument that frame declares in the order that it declares them
+func (e *Evalulator) bindArgs(frame *Frame, numArgs int, numKeys int) error {
+	numPositional := frame.numRequired() + frame.NumOptional
+	if numArgs < frame.numRequired() || (!frame.Variadic && numArgs > numPositional) {
+		return BuiltinError{Kind: ArityError, Message: frame.arityMessage(callName(frame), numArgs),
+			Info: ErrorInfo{Expected: frame.arityString(), Actual: fmt.Sprint(numArgs)}}
+	}
+	start := len(e.stack) - numArgs - 2*numKeys
+	args := e.stack[start : start+numArgs]
+	bound := make([]Value, 0, len(frame.FunctionArguments))
+	for i := 0; i < numPositional; i++ {
+		if i < numArgs {
+			bound = append(bound, args[i])
+		} else {
+			bound = append(bound, Value{Kind: missingType})
+		}
+	}
+	if frame.Variadic {
+		rest := []Value{}
+		if numArgs > numPositional {
+			rest = append(rest, args[numPositional:]...)
+		}
 		val := Value{}
-		val.NewNull()
-		return val, nil
+		val.NewList(rest)
+		bound = append(bound, val)
+	}
+
+	keys := frame.FunctionArguments[len(frame.FunctionArguments)-frame.NumKeys:]
+	for range keys {
+		bound = append(bound, Value{Kind: missingType})
+	}
+	for i := 0; i < numKeys; i++ {
+		name := e.stack[start+numArgs+2*i].String
+		found := false
+		for j, key := range keys {
+			if key == name {
+				bound[len(bound)-len(keys)+j] = e.stack[start+numArgs+2*i+1]
+				found = true
+			}
+		}
+		if !found {
+			return BuiltinError{Kind: ArityError, Message: fmt.Sprintf("Function %s has no keyword argument :%s", callName(frame), name),
+				Info: ErrorInfo{Actual: ":" + name}}
+		}
+	}
+	e.stack = append(e.stack[:start], bound...)
+	return nil
+}
+
+// captureLocal moves a local into a cell (if it is not in one already), so that it is shared by reference between
+// the frame and the closures that capture it
+func captureLocal(locals []Value, slot int) *Value {
+	if locals[slot].Kind == cellType {
+		return locals[slot].Cell
+	}
+	cell := &Value{}
+	*cell = locals[slot]
+	locals[slot] = Value{Kind: cellType, Cell: cell}
+	return cell
+}
+
+// allocateLocals returns an activation record holding a copy of template, which has the initial value of each local
+func (e *Evalulator) allocateLocals(template []Value) []Value {
+	if len(template) == 0 {
+		return template
+	}
+	var locals []Value
+	if n := len(e.localsPool); n > 0 && cap(e.localsPool[n-1]) >= len(template) {
+		locals = e.localsPool[n-1][:len(template)]
+		e.localsPool = e.localsPool[:n-1]
+	} else {
+		locals = make([]Value, len(template))
+	}
+	copy(locals, template)
+	return locals
+}
+
+// releaseLocals returns an activation record to the pool once its call has finished
+func (e *Evalulator) releaseLocals(locals []Value) {
+	if len(locals) == 0 {
+		return
+	}
+	// Don't keep values alive just because they are in the pool
+	for i := range locals {
+		locals[i] = Value{}
 	}
-	val := e.stack[len(e.stack)-1]
-	e.stack = e.stack[:len(e.stack)-1]
-	return val, nil
+	e.localsPool = append(e.localsPool, locals)
 }
 
 func (e *Evalulator) profileInstruction(pc int, instr Instruction, frame *Frame) {
-	str := fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t", frame.LineMap[pc], frame.FunctionName, opcodeToString(instr.Opcode), instr.Detail(frame, e.functionNames), stackToString(e.stack))
+	str := fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t", frame.LineMap[pc], frame.FunctionName, opcodeToString(instr.Opcode), instr.Detail(frame, e.functionNames, e.builtins.Names()), stackToString(e.stack))
 	str = strings.ReplaceAll(str, "\n", "\\n")
 	fmt.Fprintf(e.profileWriter, str+"\n")
 }